@@ -0,0 +1,90 @@
+// Package bookstatus is the single source of truth for the circulation
+// status of a book and the transitions allowed between statuses.
+package bookstatus
+
+import "fmt"
+
+// Status is the circulation status stored in bookcopies.status.
+type Status string
+
+const (
+	Available Status = "Available" // on the shelf, can be borrowed
+	Borrowed  Status = "Borrowed"  // out on an open loan
+	OnHold    Status = "OnHold"    // on the hold shelf, reserved for the next patron in the queue
+	Missing   Status = "Missing"   // overdue loan the overdue job gave up on, can still be returned
+	Lost      Status = "Lost"      // declared lost by an admin
+	InRepair  Status = "InRepair"  // taken out of circulation for repair
+	Withdrawn Status = "Withdrawn" // permanently taken out of circulation
+)
+
+// All lists every status in display order.
+var All = []Status{Available, Borrowed, OnHold, Missing, Lost, InRepair, Withdrawn}
+
+// transitions maps a status to the statuses it may move to.
+var transitions = map[Status][]Status{
+	Available: {Borrowed, OnHold, Lost, InRepair, Withdrawn},
+	Borrowed:  {Available, OnHold, Missing, Lost},
+	OnHold:    {Available, Borrowed, Lost, InRepair, Withdrawn},
+	Missing:   {Available, OnHold, Lost},
+	Lost:      {Available, Withdrawn},
+	InRepair:  {Available, OnHold, Lost, Withdrawn},
+	Withdrawn: {Available},
+}
+
+// UnknownStatusError is returned for a status outside the model.
+type UnknownStatusError struct {
+	Status string
+}
+
+func (e *UnknownStatusError) Error() string {
+	return fmt.Sprintf("unknown book status %q", e.Status)
+}
+
+// TransitionError is returned when a status change is not allowed.
+type TransitionError struct {
+	From, To Status
+}
+
+func (e *TransitionError) Error() string {
+	return fmt.Sprintf("illegal book status transition from %s to %s", e.From, e.To)
+}
+
+// Parse converts a stored or user supplied value into a Status.
+func Parse(s string) (Status, error) {
+	status := Status(s)
+	if _, ok := transitions[status]; !ok {
+		return "", &UnknownStatusError{Status: s}
+	}
+	return status, nil
+}
+
+// Valid reports whether s is part of the status model.
+func (s Status) Valid() bool {
+	_, ok := transitions[s]
+	return ok
+}
+
+// CanTransition reports whether a book may move from one status to another.
+func CanTransition(from, to Status) bool {
+	for _, next := range transitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// Transition validates a status change and returns a *TransitionError or
+// *UnknownStatusError when it is not allowed.
+func Transition(from, to Status) error {
+	if !from.Valid() {
+		return &UnknownStatusError{Status: string(from)}
+	}
+	if !to.Valid() {
+		return &UnknownStatusError{Status: string(to)}
+	}
+	if !CanTransition(from, to) {
+		return &TransitionError{From: from, To: to}
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package bookstatus_test
+
+import (
+	"errors"
+	"testing"
+
+	"p3/gc2/bookstatus"
+	"p3/gc2/pb"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// unittest for the allowed circulation transitions
+func TestTransition(t *testing.T) {
+	assert.NoError(t, bookstatus.Transition(bookstatus.Available, bookstatus.Borrowed))
+	assert.NoError(t, bookstatus.Transition(bookstatus.Borrowed, bookstatus.OnHold))
+	assert.NoError(t, bookstatus.Transition(bookstatus.Missing, bookstatus.Available))
+	assert.NoError(t, bookstatus.Transition(bookstatus.Lost, bookstatus.Available))
+
+	err := bookstatus.Transition(bookstatus.Withdrawn, bookstatus.Borrowed)
+	var transitionErr *bookstatus.TransitionError
+	if assert.True(t, errors.As(err, &transitionErr)) {
+		assert.Equal(t, bookstatus.Withdrawn, transitionErr.From)
+		assert.Equal(t, bookstatus.Borrowed, transitionErr.To)
+	}
+
+	assert.Error(t, bookstatus.Transition(bookstatus.Borrowed, bookstatus.Borrowed))
+	assert.Error(t, bookstatus.Transition(bookstatus.Lost, bookstatus.Missing))
+}
+
+// unittest for parsing stored status values
+func TestParse(t *testing.T) {
+	for _, status := range bookstatus.All {
+		parsed, err := bookstatus.Parse(string(status))
+		assert.NoError(t, err)
+		assert.Equal(t, status, parsed)
+	}
+
+	_, err := bookstatus.Parse("OnHoldShelf")
+	var unknownErr *bookstatus.UnknownStatusError
+	assert.True(t, errors.As(err, &unknownErr))
+}
+
+// unittest for the proto enum mapping
+func TestProtoRoundTrip(t *testing.T) {
+	for _, s := range bookstatus.All {
+		got, ok := bookstatus.FromProto(bookstatus.ToProto(s))
+		assert.True(t, ok)
+		assert.Equal(t, s, got)
+	}
+
+	_, ok := bookstatus.FromProto(pb.BookStatus_BOOK_STATUS_UNSPECIFIED)
+	assert.False(t, ok)
+}
@@ -0,0 +1,29 @@
+package bookstatus
+
+import "p3/gc2/pb"
+
+var protoStatuses = map[Status]pb.BookStatus{
+	Available: pb.BookStatus_BOOK_STATUS_AVAILABLE,
+	Borrowed:  pb.BookStatus_BOOK_STATUS_BORROWED,
+	OnHold:    pb.BookStatus_BOOK_STATUS_ON_HOLD,
+	Missing:   pb.BookStatus_BOOK_STATUS_MISSING,
+	Lost:      pb.BookStatus_BOOK_STATUS_LOST,
+	InRepair:  pb.BookStatus_BOOK_STATUS_IN_REPAIR,
+	Withdrawn: pb.BookStatus_BOOK_STATUS_WITHDRAWN,
+}
+
+// ToProto converts a status to its proto enum, BOOK_STATUS_UNSPECIFIED for unknown values.
+func ToProto(s Status) pb.BookStatus {
+	return protoStatuses[s]
+}
+
+// FromProto converts a proto enum to a status. It reports false for
+// BOOK_STATUS_UNSPECIFIED and unknown values.
+func FromProto(p pb.BookStatus) (Status, bool) {
+	for s, enum := range protoStatuses {
+		if enum == p {
+			return s, true
+		}
+	}
+	return "", false
+}
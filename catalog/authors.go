@@ -0,0 +1,131 @@
+package catalog
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Role is how an author is credited on a book.
+type Role string
+
+const (
+	RoleAuthor     Role = "author"
+	RoleEditor     Role = "editor"
+	RoleTranslator Role = "translator"
+)
+
+// ParseRole accepts a role name in any case, empty is the author role.
+func ParseRole(s string) (Role, error) {
+	switch role := Role(strings.ToLower(strings.TrimSpace(s))); role {
+	case "":
+		return RoleAuthor, nil
+	case RoleAuthor, RoleEditor, RoleTranslator:
+		return role, nil
+	}
+	return "", &OptionError{Field: "role", Reason: "must be author, editor or translator"}
+}
+
+// Credit is an author credited on a book.
+type Credit struct {
+	AuthorID string `json:"author_id"`
+	Name     string `json:"name"`
+	Role     Role   `json:"role"`
+}
+
+// CreditsColumn selects the credits of the books row as a JSON array in
+// credit order, it scans into a []Credit.
+const CreditsColumn = `(SELECT COALESCE(json_agg(json_build_object('author_id', a.id, 'name', a.name, 'role', ba.role) ORDER BY ba.position, ba.role), '[]')
+		FROM bookauthors ba JOIN authors a ON a.id = ba.author_id WHERE ba.book_id = books.id)`
+
+// LinkAuthor credits the book to the author with the given name as its only
+// author, adding the author when the name is new. Editors and translators are
+// kept. A name that was merged into another author resolves to that author,
+// whose name becomes the byline of the book and is returned.
+func LinkAuthor(ctx context.Context, db Execer, bookID, name string) (string, error) {
+	var authorID string
+	err := db.QueryRow(ctx, `
+		INSERT INTO authors (name) VALUES ($1)
+		ON CONFLICT ((LOWER(name))) DO UPDATE SET name = authors.name
+		RETURNING COALESCE(merged_into, id)`, strings.TrimSpace(name)).Scan(&authorID)
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := db.Exec(ctx, `DELETE FROM bookauthors WHERE book_id = $1 AND role = 'author' AND author_id <> $2`, bookID, authorID); err != nil {
+		return "", err
+	}
+	if _, err := db.Exec(ctx, `INSERT INTO bookauthors (book_id, author_id, role) VALUES ($1, $2, 'author') ON CONFLICT DO NOTHING`, bookID, authorID); err != nil {
+		return "", err
+	}
+
+	var byline string
+	err = db.QueryRow(ctx, `
+		UPDATE books SET author = a.name FROM authors a
+		WHERE books.id = $1 AND a.id = $2
+		RETURNING books.author`, bookID, authorID).Scan(&byline)
+	return byline, err
+}
+
+// LockByline locks the books row for an update and returns its byline, ""
+// when there is no such book. An update only relinks the author when the
+// byline it was sent differs, so a byline read from the book and sent back
+// leaves its credits as they are.
+func LockByline(ctx context.Context, db Execer, bookID string) (string, error) {
+	var byline string
+	err := db.QueryRow(ctx, `SELECT author FROM books WHERE id = $1 FOR UPDATE`, bookID).Scan(&byline)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", nil
+	}
+	return byline, err
+}
+
+// LinkByline credits a book to the authors of its byline and returns the
+// final byline. A byline that joins the names of known authors with ", ", as
+// bylines built from credits do, credits each of them in order. Any other
+// byline, or one that is itself the name of an author, goes to LinkAuthor.
+func LinkByline(ctx context.Context, db Execer, bookID, byline string) (string, error) {
+	names := strings.Split(byline, ", ")
+	if len(names) < 2 {
+		return LinkAuthor(ctx, db, bookID, byline)
+	}
+
+	var (
+		whole     bool
+		authorIDs []string
+	)
+	err := db.QueryRow(ctx, `
+		SELECT EXISTS (SELECT 1 FROM authors WHERE LOWER(name) = LOWER($1)),
+			COALESCE((SELECT array_agg(COALESCE(a.merged_into, a.id)::TEXT ORDER BY n.position)
+				FROM unnest($2::TEXT[]) WITH ORDINALITY AS n(name, position)
+				JOIN authors a ON LOWER(a.name) = LOWER(TRIM(n.name))), '{}')`,
+		strings.TrimSpace(byline), names).Scan(&whole, &authorIDs)
+	if err != nil {
+		return "", err
+	}
+	if whole || len(authorIDs) != len(names) {
+		return LinkAuthor(ctx, db, bookID, byline)
+	}
+
+	if _, err := db.Exec(ctx, `DELETE FROM bookauthors WHERE book_id = $1 AND role = 'author'`, bookID); err != nil {
+		return "", err
+	}
+	_, err = db.Exec(ctx, `
+		INSERT INTO bookauthors (book_id, author_id, role, position)
+		SELECT $1, c.author_id, 'author', c.position
+		FROM unnest($2::UUID[]) WITH ORDINALITY AS c(author_id, position)
+		ON CONFLICT DO NOTHING`, bookID, authorIDs)
+	if err != nil {
+		return "", err
+	}
+	err = db.QueryRow(ctx, `
+		UPDATE books SET author = (
+			SELECT string_agg(a.name, ', ' ORDER BY ba.position, a.name)
+			FROM bookauthors ba JOIN authors a ON a.id = ba.author_id
+			WHERE ba.book_id = $1 AND ba.role = 'author')
+		WHERE id = $1
+		RETURNING author`, bookID).Scan(&byline)
+	return byline, err
+}
@@ -0,0 +1,19 @@
+package catalog
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// unittest for reading the role of a credit
+func TestParseRole(t *testing.T) {
+	for input, want := range map[string]Role{"": RoleAuthor, "Editor": RoleEditor, " translator ": RoleTranslator} {
+		role, err := ParseRole(input)
+		if assert.NoError(t, err, input) {
+			assert.Equal(t, want, role, input)
+		}
+	}
+	_, err := ParseRole("illustrator")
+	assert.ErrorContains(t, err, "must be author, editor or translator")
+}
@@ -0,0 +1,110 @@
+package catalog
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"p3/gc2/covers"
+	"p3/gc2/isbn"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// BookColumns selects a books row with the number of copies in circulation
+// (not lost or withdrawn), the number of copies on the shelf, the tags, the
+// credits, the cover key and the rating of the reviews that aren't hidden.
+// It scans with ScanBook.
+const BookColumns = `books.id, books.title, books.author, books.published_date, books.category, books.isbn_13, books.created_at, books.updated_at, books.version,
+	books.withdrawn_at, books.withdrawn_by::TEXT, books.withdrawn_reason,
+	(SELECT COUNT(*)::INT FROM bookcopies c WHERE c.book_id = books.id AND c.status NOT IN ('Lost', 'Withdrawn')),
+	(SELECT COUNT(*)::INT FROM bookcopies c WHERE c.book_id = books.id AND c.status = 'Available'),
+	ARRAY(SELECT t.name FROM booktags bt JOIN tags t ON t.id = bt.tag_id WHERE bt.book_id = books.id ORDER BY t.name),
+	` + CreditsColumn + `, COALESCE(books.cover_key, ''),
+	(SELECT ROUND(COALESCE(AVG(r.rating), 0), 2)::FLOAT8 FROM reviews r WHERE r.book_id = books.id AND r.hidden_at IS NULL),
+	(SELECT COUNT(*)::INT FROM reviews r WHERE r.book_id = books.id AND r.hidden_at IS NULL)`
+
+// Book is a books row selected with BookColumns, in the JSON form the REST
+// API answers with.
+type Book struct {
+	ID              string     `json:"id"`
+	Title           string     `json:"title"`
+	Author          string     `json:"author"`
+	PublishedDate   time.Time  `json:"published_date"`
+	Category        *string    `json:"category,omitempty"`
+	ISBN13          *string    `json:"isbn_13,omitempty"`
+	ISBN10          string     `json:"isbn_10,omitempty"` // derived from isbn_13 for 978 numbers
+	TotalCopies     int        `json:"total_copies"`
+	AvailableCopies int        `json:"available_copies"`
+	CreatedAt       time.Time  `json:"created_at"`
+	UpdatedAt       time.Time  `json:"updated_at"`
+	Version         int        `json:"version"`                // also sent as the ETag of the book
+	WithdrawnAt     *time.Time `json:"withdrawn_at,omitempty"` // only set on withdrawn books, which are hidden from the catalog
+	WithdrawnBy     *string    `json:"withdrawn_by,omitempty"`
+	WithdrawnReason *string    `json:"withdrawn_reason,omitempty"`
+	Tags            []string   `json:"tags"`                    // lowercase and sorted
+	Credits         []Credit   `json:"credits"`                 // authors, editors and translators in credit order, author is the byline
+	CoverURL        string     `json:"cover_url,omitempty"`     // path of the cover under /covers, only set for books with a cover
+	ThumbnailURL    string     `json:"thumbnail_url,omitempty"` // path of its JPEG thumbnail
+	AverageRating   float64    `json:"average_rating"`          // mean stars of the reviews that aren't hidden, 0 without reviews
+	ReviewCount     int        `json:"review_count"`
+}
+
+// ScanBook reads a row selected with BookColumns.
+func ScanBook(row pgx.Row) (Book, error) {
+	var (
+		book     Book
+		coverKey string
+	)
+	err := row.Scan(&book.ID, &book.Title, &book.Author, &book.PublishedDate, &book.Category, &book.ISBN13, &book.CreatedAt, &book.UpdatedAt, &book.Version,
+		&book.WithdrawnAt, &book.WithdrawnBy, &book.WithdrawnReason, &book.TotalCopies, &book.AvailableCopies, &book.Tags, &book.Credits, &coverKey,
+		&book.AverageRating, &book.ReviewCount)
+	if err != nil {
+		return Book{}, err
+	}
+	if book.ISBN13 != nil {
+		book.ISBN10, _ = isbn.To10(*book.ISBN13)
+	}
+	if coverKey != "" {
+		book.CoverURL = covers.URL(coverKey)
+		book.ThumbnailURL = covers.URL(covers.ThumbnailKey(coverKey))
+	}
+	return book, nil
+}
+
+// NormalizeISBN validates an optional ISBN and returns its ISBN-13 form, or
+// "" when none was given.
+func NormalizeISBN(s string) (string, error) {
+	if strings.TrimSpace(s) == "" {
+		return "", nil
+	}
+	return isbn.Normalize(s)
+}
+
+// ISBNTaken reports whether err is a unique violation on the ISBN of a book in
+// the catalog. Withdrawn books don't hold on to their ISBN.
+func ISBNTaken(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23505" && pgErr.ConstraintName == "books_isbn_13_idx"
+}
+
+// UnknownCategory reports whether err is a foreign key violation on the
+// category of a book.
+func UnknownCategory(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23503" && pgErr.ConstraintName == "books_category_fkey"
+}
+
+// BookVersion returns the version of a book in the catalog, or ErrNotFound.
+// Updates that expected another version use it to tell a stale version
+// from a book that is gone.
+func BookVersion(ctx context.Context, db Execer, bookID string) (int, error) {
+	var version int
+	err := db.QueryRow(ctx, `SELECT version FROM books WHERE id = $1 AND withdrawn_at IS NULL`, bookID).Scan(&version)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, ErrNotFound
+	}
+	return version, err
+}
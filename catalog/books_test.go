@@ -0,0 +1,23 @@
+package catalog
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/stretchr/testify/assert"
+)
+
+// unittest for telling the constraint violations of a book apart
+func TestBookViolations(t *testing.T) {
+	isbnErr := fmt.Errorf("insert book: %w", &pgconn.PgError{Code: "23505", ConstraintName: "books_isbn_13_idx"})
+	categoryErr := &pgconn.PgError{Code: "23503", ConstraintName: "books_category_fkey"}
+
+	assert.True(t, ISBNTaken(isbnErr))
+	assert.False(t, ISBNTaken(categoryErr))
+	assert.False(t, ISBNTaken(&pgconn.PgError{Code: "23505", ConstraintName: "authors_lower_name_idx"}))
+	assert.True(t, UnknownCategory(categoryErr))
+	assert.False(t, UnknownCategory(isbnErr))
+	assert.False(t, UnknownCategory(errors.New("connection reset")))
+}
@@ -0,0 +1,297 @@
+// Package catalog builds the filtered, sorted and paginated book listings
+// shared by the REST handlers and the gRPC server.
+package catalog
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"p3/gc2/bookstatus"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	DefaultPageSize = 20
+	MaxPageSize     = 100
+)
+
+// SortField is a column books can be listed by. Ties are broken by id so
+// every sort is a total order the page token can resume from.
+type SortField string
+
+const (
+	SortCreatedAt     SortField = "created_at"
+	SortTitle         SortField = "title"
+	SortAuthor        SortField = "author"
+	SortPublishedDate SortField = "published_date"
+	SortWithdrawnAt   SortField = "withdrawn_at" // only for listings of withdrawn books
+)
+
+// sortKeyTypes maps a sort field to the type its key is cast back to when
+// it is read from a page token.
+var sortKeyTypes = map[SortField]string{
+	SortCreatedAt:     "TIMESTAMP",
+	SortTitle:         "TEXT",
+	SortAuthor:        "TEXT",
+	SortPublishedDate: "TIMESTAMP",
+	SortWithdrawnAt:   "TIMESTAMP",
+}
+
+// ListOptions are the filters, sort and page of a book listing. The zero
+// value lists the first page of every book, oldest first.
+type ListOptions struct {
+	PageSize      int
+	PageToken     string
+	Status        string    // books with at least one copy in this status
+	Author        string    // case-insensitive substring of the author
+	PublishedFrom time.Time // inclusive, compared by day, zero for no lower bound
+	PublishedTo   time.Time // inclusive, compared by day, zero for no upper bound
+	BorrowerID    string    // books the user has an open loan on
+	Category      string    // books in the category or one of its subcategories
+	Tag           string    // books tagged with the tag
+	AuthorID      string    // books crediting the author in any role
+	SortBy        SortField // defaults to created_at
+	Descending    bool
+	Withdrawn     bool // list the withdrawn books instead of the catalog
+}
+
+// OptionError is returned for list options the caller has to fix.
+type OptionError struct {
+	Field, Reason string
+}
+
+func (e *OptionError) Error() string {
+	return e.Field + " " + e.Reason
+}
+
+// Querier is the subset of pgxpool.Pool and pgx.Tx used to run a listing.
+type Querier interface {
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+// Page is one page of a listing.
+type Page[T any] struct {
+	Items         []T
+	NextPageToken string // empty on the last page
+	TotalCount    int    // rows matching the filters across all pages
+}
+
+// cursor is the decoded form of a page token: the sort it was issued for and
+// the sort key and id of the last row of the page.
+type cursor struct {
+	SortBy     SortField `json:"s"`
+	Descending bool      `json:"d"`
+	Key        string    `json:"k"`
+	ID         string    `json:"i"`
+}
+
+func encodeCursor(c cursor) string {
+	raw, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+func decodeCursor(token string) (cursor, error) {
+	var c cursor
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return c, err
+	}
+	if err := json.Unmarshal(raw, &c); err != nil {
+		return c, err
+	}
+	if _, err := uuid.Parse(c.ID); err != nil {
+		return c, err
+	}
+	return c, nil
+}
+
+// query is a listing compiled to SQL.
+type query struct {
+	where     string // filters without the cursor, shared with the count
+	whereArgs []any
+	after     string // keyset condition resuming after the page token, if any
+	afterArgs []any
+	orderBy   string
+	sortKey   string // expression selected as the cursor key of each row
+	sortBy    SortField
+	desc      bool
+	limit     int
+}
+
+// buildQuery validates the options and compiles them to SQL fragments.
+func buildQuery(opts ListOptions) (*query, error) {
+	q := &query{limit: opts.PageSize, sortBy: opts.SortBy, desc: opts.Descending}
+	if q.limit == 0 {
+		q.limit = DefaultPageSize
+	}
+	if q.limit < 0 || q.limit > MaxPageSize {
+		return nil, &OptionError{Field: "page_size", Reason: fmt.Sprintf("must be between 1 and %d", MaxPageSize)}
+	}
+
+	if q.sortBy == "" {
+		q.sortBy = SortCreatedAt
+	}
+	keyType, ok := sortKeyTypes[q.sortBy]
+	if !ok || (q.sortBy == SortWithdrawnAt && !opts.Withdrawn) {
+		return nil, &OptionError{Field: "sort_by", Reason: "must be one of created_at, title, author or published_date"}
+	}
+
+	// Withdrawn books are hidden from the catalog until they are restored
+	conditions := []string{"books.withdrawn_at IS NULL"}
+	if opts.Withdrawn {
+		conditions[0] = "books.withdrawn_at IS NOT NULL"
+	}
+	arg := func(v any) string {
+		q.whereArgs = append(q.whereArgs, v)
+		return "$" + strconv.Itoa(len(q.whereArgs))
+	}
+
+	if opts.Status != "" {
+		status, err := bookstatus.Parse(opts.Status)
+		if err != nil {
+			return nil, &OptionError{Field: "status", Reason: "is not a known book status"}
+		}
+		conditions = append(conditions, `EXISTS (SELECT 1 FROM bookcopies c WHERE c.book_id = books.id AND c.status = `+arg(string(status))+`)`)
+	}
+	if author := strings.TrimSpace(opts.Author); author != "" {
+		conditions = append(conditions, `books.author ILIKE '%' || `+arg(escapeLike(author))+` || '%'`)
+	}
+	if !opts.PublishedFrom.IsZero() && !opts.PublishedTo.IsZero() && opts.PublishedFrom.After(opts.PublishedTo) {
+		return nil, &OptionError{Field: "published_from", Reason: "must not be after published_to"}
+	}
+	if !opts.PublishedFrom.IsZero() {
+		conditions = append(conditions, `books.published_date::DATE >= `+arg(opts.PublishedFrom)+`::DATE`)
+	}
+	if !opts.PublishedTo.IsZero() {
+		conditions = append(conditions, `books.published_date::DATE <= `+arg(opts.PublishedTo)+`::DATE`)
+	}
+	if opts.BorrowerID != "" {
+		if _, err := uuid.Parse(opts.BorrowerID); err != nil {
+			return nil, &OptionError{Field: "borrower_id", Reason: "is not a valid user id"}
+		}
+		conditions = append(conditions, `EXISTS (SELECT 1 FROM borrowedbooks bb WHERE bb.book_id = books.id AND bb.user_id = `+arg(opts.BorrowerID)+` AND bb.return_date IS NULL)`)
+	}
+	if opts.AuthorID != "" {
+		if _, err := uuid.Parse(opts.AuthorID); err != nil {
+			return nil, &OptionError{Field: "author_id", Reason: "is not a valid author id"}
+		}
+		// A merged author's id lists the works of the author it was merged into
+		conditions = append(conditions, `EXISTS (SELECT 1 FROM bookauthors ba JOIN authors a ON a.id = `+arg(opts.AuthorID)+` WHERE ba.book_id = books.id AND ba.author_id = COALESCE(a.merged_into, a.id))`)
+	}
+	if category := strings.TrimSpace(opts.Category); category != "" {
+		conditions = append(conditions, categoryCondition(arg(category)))
+	}
+	if tag := NormalizeTag(opts.Tag); tag != "" {
+		conditions = append(conditions, tagCondition(arg(tag)))
+	}
+	q.where = " WHERE " + strings.Join(conditions, " AND ")
+
+	column := "books." + string(q.sortBy)
+	direction, compare := "ASC", ">"
+	if opts.Descending {
+		direction, compare = "DESC", "<"
+	}
+	q.orderBy = fmt.Sprintf(" ORDER BY %s %s, books.id %s", column, direction, direction)
+	q.sortKey = column + "::TEXT"
+
+	if opts.PageToken != "" {
+		c, err := decodeCursor(opts.PageToken)
+		if err != nil {
+			return nil, &OptionError{Field: "page_token", Reason: "is invalid"}
+		}
+		if c.SortBy != q.sortBy || c.Descending != q.desc {
+			return nil, &OptionError{Field: "page_token", Reason: "was issued for a different sort"}
+		}
+		n := len(q.whereArgs)
+		q.after = fmt.Sprintf("(%s, books.id) %s ($%d::%s, $%d::UUID)", column, compare, n+1, keyType, n+2)
+		q.afterArgs = []any{c.Key, c.ID}
+	}
+	return q, nil
+}
+
+// categoryCondition matches the books in the category named by the
+// placeholder or in any of its subcategories.
+func categoryCondition(placeholder string) string {
+	return `books.category IN (
+		WITH RECURSIVE subtree AS (
+			SELECT id, name FROM categories WHERE LOWER(name) = LOWER(` + placeholder + `)
+			UNION
+			SELECT c.id, c.name FROM categories c JOIN subtree s ON c.parent_id = s.id
+		)
+		SELECT name FROM subtree)`
+}
+
+// tagCondition matches the books tagged with the normalized tag named by the placeholder.
+func tagCondition(placeholder string) string {
+	return `EXISTS (SELECT 1 FROM booktags bt JOIN tags t ON t.id = bt.tag_id WHERE bt.book_id = books.id AND t.name = ` + placeholder + `)`
+}
+
+// escapeLike escapes the LIKE wildcards in a user supplied pattern.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// prefixedRow reads the leading columns of a row that the catalog selects
+// for itself, like the cursor key of a listed row, before the columns read by
+// the caller's scan function.
+type prefixedRow struct {
+	pgx.Row
+	prefix []any
+}
+
+func (r prefixedRow) Scan(dest ...any) error {
+	return r.Row.Scan(append(append([]any{}, r.prefix...), dest...)...)
+}
+
+// List runs a listing over the books table. columns is the caller's select
+// list and scan reads one row of it. Invalid options are returned as an
+// *OptionError before the database is queried.
+func List[T any](ctx context.Context, db Querier, opts ListOptions, columns string, scan func(pgx.Row) (T, error)) (*Page[T], error) {
+	q, err := buildQuery(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	page := &Page[T]{Items: []T{}}
+	if err := db.QueryRow(ctx, `SELECT COUNT(*) FROM books`+q.where, q.whereArgs...).Scan(&page.TotalCount); err != nil {
+		return nil, fmt.Errorf("count books: %w", err)
+	}
+
+	where, args := q.where, q.whereArgs
+	if q.after != "" {
+		where += " AND " + q.after
+		args = append(append([]any{}, args...), q.afterArgs...)
+	}
+	// One row past the page tells whether there is a next page
+	sql := fmt.Sprintf(`SELECT %s, books.id::TEXT, %s FROM books%s%s LIMIT %d`, q.sortKey, columns, where, q.orderBy, q.limit+1)
+	rows, err := db.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, fmt.Errorf("list books: %w", err)
+	}
+	defer rows.Close()
+
+	var key, id string
+	for rows.Next() {
+		if len(page.Items) == q.limit {
+			page.NextPageToken = encodeCursor(cursor{SortBy: q.sortBy, Descending: q.desc, Key: key, ID: id})
+			break
+		}
+		item, err := scan(prefixedRow{Row: rows, prefix: []any{&key, &id}})
+		if err != nil {
+			return nil, fmt.Errorf("scan book: %w", err)
+		}
+		page.Items = append(page.Items, item)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("list books: %w", err)
+	}
+	return page, nil
+}
@@ -0,0 +1,112 @@
+package catalog
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// unittest for the defaults of an empty listing
+func TestBuildQueryDefaults(t *testing.T) {
+	q, err := buildQuery(ListOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, DefaultPageSize, q.limit)
+	assert.Equal(t, " WHERE books.withdrawn_at IS NULL", q.where)
+	assert.Equal(t, " ORDER BY books.created_at ASC, books.id ASC", q.orderBy)
+	assert.Equal(t, "", q.after)
+}
+
+// unittest for compiling filters to numbered parameters
+func TestBuildQueryFilters(t *testing.T) {
+	from := time.Date(1900, 1, 1, 0, 0, 0, 0, time.UTC)
+	q, err := buildQuery(ListOptions{
+		Status:        "Available",
+		Author:        "50%_off",
+		PublishedFrom: from,
+		BorrowerID:    "6f1c1f2e-8a37-4d83-9a3c-1b2b1d0e6c11",
+		SortBy:        SortTitle,
+		Descending:    true,
+	})
+	require.NoError(t, err)
+	assert.Contains(t, q.where, "c.status = $1")
+	assert.Contains(t, q.where, "books.author ILIKE '%' || $2 || '%'")
+	assert.Contains(t, q.where, "books.published_date::DATE >= $3::DATE")
+	assert.Contains(t, q.where, "bb.user_id = $4")
+	assert.Equal(t, []any{"Available", `50\%\_off`, from, "6f1c1f2e-8a37-4d83-9a3c-1b2b1d0e6c11"}, q.whereArgs)
+	assert.Equal(t, " ORDER BY books.title DESC, books.id DESC", q.orderBy)
+}
+
+// unittest for resuming a listing from a page token
+func TestBuildQueryPageToken(t *testing.T) {
+	token := encodeCursor(cursor{SortBy: SortTitle, Key: "Moby-Dick", ID: "6f1c1f2e-8a37-4d83-9a3c-1b2b1d0e6c11"})
+
+	q, err := buildQuery(ListOptions{Author: "Melville", SortBy: SortTitle, PageToken: token})
+	require.NoError(t, err)
+	assert.Equal(t, "(books.title, books.id) > ($2::TEXT, $3::UUID)", q.after)
+	assert.Equal(t, []any{"Moby-Dick", "6f1c1f2e-8a37-4d83-9a3c-1b2b1d0e6c11"}, q.afterArgs)
+
+	// The token only resumes the sort it was issued for
+	_, err = buildQuery(ListOptions{SortBy: SortTitle, Descending: true, PageToken: token})
+	var optErr *OptionError
+	require.True(t, errors.As(err, &optErr))
+	assert.Equal(t, "page_token", optErr.Field)
+}
+
+// unittest for rejecting invalid list options
+func TestBuildQueryInvalidOptions(t *testing.T) {
+	tests := []struct {
+		name  string
+		opts  ListOptions
+		field string
+	}{
+		{"page size too large", ListOptions{PageSize: MaxPageSize + 1}, "page_size"},
+		{"negative page size", ListOptions{PageSize: -1}, "page_size"},
+		{"unknown sort", ListOptions{SortBy: "id"}, "sort_by"},
+		{"withdrawal sort of the catalog", ListOptions{SortBy: SortWithdrawnAt}, "sort_by"},
+		{"unknown status", ListOptions{Status: "Shelved"}, "status"},
+		{"invalid borrower", ListOptions{BorrowerID: "user1"}, "borrower_id"},
+		{"inverted date range", ListOptions{PublishedFrom: time.Now(), PublishedTo: time.Now().AddDate(-1, 0, 0)}, "published_from"},
+		{"garbage token", ListOptions{PageToken: "not a token"}, "page_token"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := buildQuery(tt.opts)
+			var optErr *OptionError
+			require.True(t, errors.As(err, &optErr), "got %v", err)
+			assert.Equal(t, tt.field, optErr.Field)
+		})
+	}
+}
+
+// unittest for listing the withdrawn books instead of the catalog
+func TestBuildQueryWithdrawn(t *testing.T) {
+	q, err := buildQuery(ListOptions{Withdrawn: true, SortBy: SortWithdrawnAt, Descending: true})
+	require.NoError(t, err)
+	assert.Equal(t, " WHERE books.withdrawn_at IS NOT NULL", q.where)
+	assert.Equal(t, " ORDER BY books.withdrawn_at DESC, books.id DESC", q.orderBy)
+}
+
+// unittest for filtering by category subtree and normalized tag
+func TestBuildQueryCategoryAndTag(t *testing.T) {
+	q, err := buildQuery(ListOptions{Category: " Fiction ", Tag: "  Jazz   AGE "})
+	require.NoError(t, err)
+	assert.Contains(t, q.where, "WITH RECURSIVE subtree")
+	assert.Contains(t, q.where, "LOWER(name) = LOWER($1)")
+	assert.Contains(t, q.where, "t.name = $2")
+	assert.Equal(t, []any{"Fiction", "jazz age"}, q.whereArgs)
+}
+
+// unittest for listing the works of an author
+func TestBuildQueryAuthorID(t *testing.T) {
+	const authorID = "2f6d1c1e-8b1a-4f0e-9d55-4b7a3f0a9c11"
+	q, err := buildQuery(ListOptions{AuthorID: authorID})
+	require.NoError(t, err)
+	assert.Contains(t, q.where, "FROM bookauthors ba JOIN authors a ON a.id = $1")
+	assert.Equal(t, []any{authorID}, q.whereArgs)
+
+	_, err = buildQuery(ListOptions{AuthorID: "orwell"})
+	assert.ErrorContains(t, err, "author_id is not a valid author id")
+}
@@ -0,0 +1,150 @@
+package catalog
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"p3/gc2/isbn"
+)
+
+// BookPatch is a partial update of a book, nil fields are left unchanged.
+type BookPatch struct {
+	Title         *string
+	Author        *string
+	PublishedDate *time.Time
+	Category      *string // empty clears the category
+	ISBN          *string // ISBN-10 or ISBN-13, empty clears the ISBN
+}
+
+// ParseMergePatch reads a JSON Merge Patch (RFC 7396) of a book. Members set
+// to null clear optional fields, members left out keep their value.
+func ParseMergePatch(data []byte) (BookPatch, error) {
+	var patch BookPatch
+	var members map[string]json.RawMessage
+	if err := json.Unmarshal(data, &members); err != nil || members == nil {
+		return patch, &OptionError{Field: "body", Reason: "must be a JSON object"}
+	}
+
+	// Read the members in a fixed order so the same patch always reports the same problem
+	names := make([]string, 0, len(members))
+	for name := range members {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		raw := members[name]
+		isNull := bytes.Equal(bytes.TrimSpace(raw), []byte("null"))
+		var value string
+		if !isNull {
+			if err := json.Unmarshal(raw, &value); err != nil {
+				return patch, &OptionError{Field: name, Reason: "must be a string"}
+			}
+		}
+
+		switch name {
+		case "title", "author", "published_date":
+			if isNull {
+				return patch, &OptionError{Field: name, Reason: "is required and can't be null"}
+			}
+		case "category", "isbn":
+		default:
+			return patch, &OptionError{Field: name, Reason: "is unknown or can't be changed"}
+		}
+
+		switch name {
+		case "title":
+			patch.Title = &value
+		case "author":
+			patch.Author = &value
+		case "published_date":
+			published, err := time.Parse(time.DateOnly, value)
+			if err != nil {
+				return patch, &OptionError{Field: name, Reason: "must be a date in YYYY-MM-DD format"}
+			}
+			patch.PublishedDate = &published
+		case "category":
+			patch.Category = &value
+		case "isbn":
+			patch.ISBN = &value
+		}
+	}
+	return patch, patch.Validate()
+}
+
+// Validate checks the fields the patch sets, trims them and normalizes the
+// ISBN to its ISBN-13 form.
+func (p *BookPatch) Validate() error {
+	if p.Title == nil && p.Author == nil && p.PublishedDate == nil && p.Category == nil && p.ISBN == nil {
+		return &OptionError{Field: "patch", Reason: "changes no fields"}
+	}
+	for _, field := range []struct {
+		name  string
+		value *string
+	}{{"title", p.Title}, {"author", p.Author}} {
+		if field.value == nil {
+			continue
+		}
+		*field.value = strings.TrimSpace(*field.value)
+		if *field.value == "" {
+			return &OptionError{Field: field.name, Reason: "can't be empty"}
+		}
+	}
+	if p.PublishedDate != nil && p.PublishedDate.IsZero() {
+		return &OptionError{Field: "published_date", Reason: "can't be empty"}
+	}
+	if p.Category != nil {
+		*p.Category = strings.TrimSpace(*p.Category)
+	}
+	if p.ISBN != nil && strings.TrimSpace(*p.ISBN) != "" {
+		isbn13, err := isbn.Normalize(*p.ISBN)
+		if err != nil {
+			return &OptionError{Field: "isbn", Reason: strings.TrimPrefix(err.Error(), isbn.ErrInvalid.Error()+": ")}
+		}
+		p.ISBN = &isbn13
+	}
+	return nil
+}
+
+// ISBN13 is the normalized ISBN the patch sets, empty when it clears or
+// keeps the ISBN.
+func (p BookPatch) ISBN13() string {
+	if p.ISBN == nil {
+		return ""
+	}
+	return strings.TrimSpace(*p.ISBN)
+}
+
+// Assignments returns the SET list of an UPDATE of the books table applying
+// the patch, with placeholders numbered from first. Every patch bumps
+// updated_at and the version.
+func (p BookPatch) Assignments(first int) (string, []any) {
+	var (
+		sets []string
+		args []any
+	)
+	set := func(column, value string, arg any) {
+		args = append(args, arg)
+		sets = append(sets, fmt.Sprintf("%s = "+value, column, first+len(args)-1))
+	}
+	if p.Title != nil {
+		set("title", "$%d", *p.Title)
+	}
+	if p.Author != nil {
+		set("author", "$%d", *p.Author)
+	}
+	if p.PublishedDate != nil {
+		set("published_date", "$%d", *p.PublishedDate)
+	}
+	if p.Category != nil {
+		set("category", "NULLIF($%d, '')", *p.Category)
+	}
+	if p.ISBN != nil {
+		set("isbn_13", "NULLIF($%d, '')", p.ISBN13())
+	}
+	sets = append(sets, "updated_at = NOW()", "version = version + 1")
+	return strings.Join(sets, ", "), args
+}
@@ -0,0 +1,46 @@
+package catalog
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// unittest for reading a book merge patch
+func TestParseMergePatch(t *testing.T) {
+	patch, err := ParseMergePatch([]byte(`{"title":" Animal Farm ","published_date":"1945-08-17","category":null,"isbn":"0-451-52634-1"}`))
+	require.NoError(t, err)
+	assert.Equal(t, "Animal Farm", *patch.Title)
+	assert.Nil(t, patch.Author)
+	assert.Equal(t, time.Date(1945, 8, 17, 0, 0, 0, 0, time.UTC), *patch.PublishedDate)
+	assert.Equal(t, "", *patch.Category, "null clears the category")
+	assert.Equal(t, "9780451526342", patch.ISBN13())
+
+	assignments, args := patch.Assignments(1)
+	assert.Equal(t, "title = $1, published_date = $2, category = NULLIF($3, ''), isbn_13 = NULLIF($4, ''), updated_at = NOW(), version = version + 1", assignments)
+	assert.Equal(t, []any{"Animal Farm", *patch.PublishedDate, "", "9780451526342"}, args)
+}
+
+// unittest for rejecting merge patches that can't be applied
+func TestParseMergePatchInvalid(t *testing.T) {
+	tests := map[string]string{
+		`[]`:                          "body must be a JSON object",
+		`{}`:                          "patch changes no fields",
+		`{"title":null}`:              "title is required and can't be null",
+		`{"author":"  "}`:             "author can't be empty",
+		`{"title":42}`:                "title must be a string",
+		`{"published_date":"8/1945"}`: "published_date must be a date in YYYY-MM-DD format",
+		`{"isbn":"12345"}`:            "isbn must have 10 or 13 digits",
+		`{"copies":"2"}`:              "copies is unknown or can't be changed",
+	}
+	for body, want := range tests {
+		_, err := ParseMergePatch([]byte(body))
+		var optErr *OptionError
+		if assert.True(t, errors.As(err, &optErr), body) {
+			assert.Equal(t, want, optErr.Error(), body)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package catalog
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"regexp"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// searchConfig is the text search configuration books.search_vector is built with.
+const searchConfig = "english"
+
+// ts_headline marks the matched words with two private use characters that
+// are stripped from the field first. highlight escapes the rest of the text
+// as HTML and only then turns them into <mark> tags, so catalog data never
+// reaches a client as markup.
+const (
+	markStart = "\uE000"
+	markStop  = "\uE001"
+)
+
+// headlineOptions bound a highlighted field to a couple of short fragments
+// around its matches.
+const headlineOptions = "StartSel=" + markStart + ", StopSel=" + markStop + ", MaxWords=20, MinWords=10, MaxFragments=2"
+
+// highlightReplacer turns the markers of ts_headline into <mark> tags.
+var highlightReplacer = strings.NewReplacer(markStart, "<mark>", markStop, "</mark>")
+
+// highlight escapes a ts_headline result as HTML, keeping its matches marked.
+func highlight(headline string) string {
+	return highlightReplacer.Replace(html.EscapeString(headline))
+}
+
+// searchTerm matches the words a search query is split into. Everything else,
+// including the tsquery operators, is dropped.
+var searchTerm = regexp.MustCompile(`[\p{L}\p{N}]+`)
+
+// SearchOptions is a full-text search over the catalog.
+type SearchOptions struct {
+	Query    string // every word must match, as a whole word or a prefix
+	PageSize int    // defaults to DefaultPageSize
+	Category string // only books in the category or one of its subcategories
+	Tag      string // only books tagged with the tag
+}
+
+// Hit is a search result with its rank and the highlighted fields. The
+// highlights are HTML with the matched words in <mark> tags and everything
+// else escaped.
+type Hit[T any] struct {
+	Item            T
+	Rank            float32
+	TitleHighlight  string
+	AuthorHighlight string
+}
+
+// SearchResult is the best ranked hits of a search.
+type SearchResult[T any] struct {
+	Hits       []Hit[T]
+	TotalCount int // books matching the query, beyond the returned hits
+}
+
+// prefixQuery turns user input into a tsquery source that matches books
+// containing every word, each as a prefix so partial words typed so far
+// still match. It returns "" when the input has no words.
+func prefixQuery(input string) string {
+	words := searchTerm.FindAllString(strings.ToLower(input), -1)
+	for i, word := range words {
+		words[i] = word + ":*"
+	}
+	return strings.Join(words, " & ")
+}
+
+// Search ranks the books matching the query, title matches first. columns
+// is the caller's select list and scan reads one row of it. Invalid options
+// are returned as an *OptionError before the database is queried.
+func Search[T any](ctx context.Context, db Querier, opts SearchOptions, columns string, scan func(pgx.Row) (T, error)) (*SearchResult[T], error) {
+	tsquery := prefixQuery(opts.Query)
+	if tsquery == "" {
+		return nil, &OptionError{Field: "query", Reason: "must contain at least one word"}
+	}
+	limit := opts.PageSize
+	if limit == 0 {
+		limit = DefaultPageSize
+	}
+	if limit < 0 || limit > MaxPageSize {
+		return nil, &OptionError{Field: "page_size", Reason: fmt.Sprintf("must be between 1 and %d", MaxPageSize)}
+	}
+
+	args := []any{tsquery}
+	filters := " AND books.withdrawn_at IS NULL"
+	if category := strings.TrimSpace(opts.Category); category != "" {
+		args = append(args, category)
+		filters += " AND " + categoryCondition(fmt.Sprintf("$%d", len(args)))
+	}
+	if tag := NormalizeTag(opts.Tag); tag != "" {
+		args = append(args, tag)
+		filters += " AND " + tagCondition(fmt.Sprintf("$%d", len(args)))
+	}
+
+	result := &SearchResult[T]{Hits: []Hit[T]{}}
+	match := fmt.Sprintf(`books.search_vector @@ to_tsquery('%s', $1)`, searchConfig) + filters
+	if err := db.QueryRow(ctx, `SELECT COUNT(*) FROM books WHERE `+match, args...).Scan(&result.TotalCount); err != nil {
+		return nil, fmt.Errorf("count books: %w", err)
+	}
+
+	sql := fmt.Sprintf(`
+		SELECT ts_rank(books.search_vector, q.query),
+			ts_headline('%[1]s', translate(books.title, '%[6]s', ''), q.query, '%[2]s'),
+			ts_headline('%[1]s', translate(books.author, '%[6]s', ''), q.query, '%[2]s'),
+			%[3]s
+		FROM books, to_tsquery('%[1]s', $1) AS q(query)
+		WHERE books.search_vector @@ q.query%[5]s
+		ORDER BY 1 DESC, books.title, books.id
+		LIMIT %[4]d`, searchConfig, headlineOptions, columns, limit, filters, markStart+markStop)
+	rows, err := db.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, fmt.Errorf("search books: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var hit Hit[T]
+		hit.Item, err = scan(prefixedRow{Row: rows, prefix: []any{&hit.Rank, &hit.TitleHighlight, &hit.AuthorHighlight}})
+		if err != nil {
+			return nil, fmt.Errorf("scan book: %w", err)
+		}
+		hit.TitleHighlight, hit.AuthorHighlight = highlight(hit.TitleHighlight), highlight(hit.AuthorHighlight)
+		result.Hits = append(result.Hits, hit)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("search books: %w", err)
+	}
+	return result, nil
+}
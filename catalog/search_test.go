@@ -0,0 +1,51 @@
+package catalog
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// unittest for turning user input into a prefix tsquery
+func TestPrefixQuery(t *testing.T) {
+	tests := []struct {
+		input, want string
+	}{
+		{"mocking", "mocking:*"},
+		{"  Great   Gats ", "great:* & gats:*"},
+		{"moby-dick", "moby:* & dick:*"},
+		{"1984", "1984:*"},
+		{"orwell & !(animal | farm):*", "orwell:* & animal:* & farm:*"},
+		{"Brontë", "brontë:*"},
+		{"&|!", ""},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, prefixQuery(tt.input), tt.input)
+	}
+}
+
+// unittest for rejecting a search without words before the database is reached
+func TestSearchInvalidOptions(t *testing.T) {
+	scan := func(row pgx.Row) (string, error) { return "", nil }
+
+	_, err := Search(context.Background(), nil, SearchOptions{Query: " ?! "}, "id", scan)
+	var optErr *OptionError
+	require.True(t, errors.As(err, &optErr))
+	assert.Equal(t, "query", optErr.Field)
+
+	_, err = Search(context.Background(), nil, SearchOptions{Query: "gatsby", PageSize: MaxPageSize + 1}, "id", scan)
+	require.True(t, errors.As(err, &optErr))
+	assert.Equal(t, "page_size", optErr.Field)
+}
+
+// unittest for escaping highlights while keeping their matches marked
+func TestHighlight(t *testing.T) {
+	assert.Equal(t, "F. Scott <mark>Fitzgerald</mark>", highlight("F. Scott "+markStart+"Fitzgerald"+markStop))
+	assert.Equal(t, "&lt;script&gt;alert(1)&lt;/script&gt; <mark>Mockingbird</mark>",
+		highlight("<script>alert(1)</script> "+markStart+"Mockingbird"+markStop))
+	assert.Equal(t, "Tom &amp; Jerry", highlight("Tom & Jerry"))
+}
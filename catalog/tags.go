@@ -0,0 +1,42 @@
+package catalog
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	MaxTagLength   = 50
+	MaxTagsPerBook = 20
+)
+
+// NormalizeTag returns the stored form of a tag: trimmed, lowercase and with
+// runs of whitespace collapsed to a single space.
+func NormalizeTag(tag string) string {
+	return strings.ToLower(strings.Join(strings.Fields(tag), " "))
+}
+
+// NormalizeTags normalizes the tags of a book, dropping blanks and
+// duplicates, and returns them sorted.
+func NormalizeTags(tags []string) ([]string, error) {
+	seen := make(map[string]bool, len(tags))
+	normalized := []string{}
+	for _, tag := range tags {
+		tag = NormalizeTag(tag)
+		if tag == "" || seen[tag] {
+			continue
+		}
+		if utf8.RuneCountInString(tag) > MaxTagLength {
+			return nil, &OptionError{Field: "tags", Reason: fmt.Sprintf("must be at most %d characters each", MaxTagLength)}
+		}
+		seen[tag] = true
+		normalized = append(normalized, tag)
+	}
+	if len(normalized) > MaxTagsPerBook {
+		return nil, &OptionError{Field: "tags", Reason: fmt.Sprintf("must be at most %d per book", MaxTagsPerBook)}
+	}
+	sort.Strings(normalized)
+	return normalized, nil
+}
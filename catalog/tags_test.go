@@ -0,0 +1,30 @@
+package catalog
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// unittest for normalizing the tags of a book
+func TestNormalizeTags(t *testing.T) {
+	tags, err := NormalizeTags([]string{" Science  Fiction", "classic", "science fiction", "", "\t"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"classic", "science fiction"}, tags)
+
+	tags, err = NormalizeTags(nil)
+	require.NoError(t, err)
+	assert.Empty(t, tags)
+
+	_, err = NormalizeTags([]string{strings.Repeat("é", MaxTagLength+1)})
+	assert.ErrorContains(t, err, "at most 50 characters")
+
+	many := make([]string, MaxTagsPerBook+1)
+	for i := range many {
+		many[i] = strings.Repeat("a", i+1)
+	}
+	_, err = NormalizeTags(many)
+	assert.ErrorContains(t, err, "at most 20 per book")
+}
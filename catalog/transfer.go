@@ -0,0 +1,290 @@
+package catalog
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Format is a file format the catalog is imported from and exported to.
+type Format string
+
+const (
+	FormatCSV   Format = "csv"   // header row naming the columns, then one book per row
+	FormatJSONL Format = "jsonl" // one JSON object per line
+)
+
+// ParseFormat accepts a format name or a content type.
+func ParseFormat(s string) (Format, error) {
+	switch strings.ToLower(strings.TrimSpace(strings.SplitN(s, ";", 2)[0])) {
+	case "csv", "text/csv":
+		return FormatCSV, nil
+	case "jsonl", "ndjson", "application/jsonl", "application/x-ndjson":
+		return FormatJSONL, nil
+	}
+	return "", &OptionError{Field: "format", Reason: "must be csv or jsonl"}
+}
+
+// ImportRow is a book as read from an import file. Values are kept as
+// written, the server validates them so every problem of a row is reported
+// the same way whatever the file format.
+type ImportRow struct {
+	Row           int    `json:"-"` // line of the file, or record number for JSON Lines
+	Title         string `json:"title"`
+	Author        string `json:"author"`
+	PublishedDate string `json:"published_date"` // YYYY-MM-DD
+	Category      string `json:"category"`
+	ISBN          string `json:"isbn"`
+	Copies        string `json:"copies"` // defaults to 1
+}
+
+// RowError is a problem with a single row of an import.
+type RowError struct {
+	Row     int    `json:"row"`
+	Field   string `json:"field,omitempty"`
+	Message string `json:"message"`
+}
+
+func (e *RowError) Error() string {
+	if e.Field == "" {
+		return fmt.Sprintf("row %d: %s", e.Row, e.Message)
+	}
+	return fmt.Sprintf("row %d: %s %s", e.Row, e.Field, e.Message)
+}
+
+// RowReader reads the rows of an import file. Next returns io.EOF after the
+// last row and a *RowError for a row that can't be read, after which reading
+// may continue with the following row.
+type RowReader interface {
+	Next() (ImportRow, error)
+}
+
+// NewRowReader reads an import file of the given format.
+func NewRowReader(r io.Reader, format Format) (RowReader, error) {
+	switch format {
+	case FormatCSV:
+		return newCSVReader(r)
+	case FormatJSONL:
+		return &jsonlReader{scanner: newLineScanner(r)}, nil
+	}
+	return nil, &OptionError{Field: "format", Reason: "must be csv or jsonl"}
+}
+
+// csvColumns are the columns an import understands, the first three are required.
+var csvColumns = []string{"title", "author", "published_date", "category", "isbn", "copies"}
+
+type csvReader struct {
+	r       *csv.Reader
+	columns map[string]int
+}
+
+func newCSVReader(r io.Reader) (*csvReader, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+
+	header, err := cr.Read()
+	if err == io.EOF {
+		return nil, &OptionError{Field: "file", Reason: "is empty"}
+	}
+	if err != nil {
+		return nil, &OptionError{Field: "file", Reason: "has an unreadable header row"}
+	}
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))
+		if _, seen := columns[name]; !seen {
+			columns[name] = i
+		}
+	}
+	for _, name := range csvColumns[:3] {
+		if _, ok := columns[name]; !ok {
+			return nil, &OptionError{Field: "file", Reason: "is missing the " + name + " column"}
+		}
+	}
+	return &csvReader{r: cr, columns: columns}, nil
+}
+
+func (c *csvReader) Next() (ImportRow, error) {
+	for {
+		record, err := c.r.Read()
+		if err == io.EOF {
+			return ImportRow{}, io.EOF
+		}
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			return ImportRow{}, &RowError{Row: parseErr.StartLine, Message: parseErr.Err.Error()}
+		}
+		if err != nil {
+			return ImportRow{}, err
+		}
+		if len(record) == 1 && strings.TrimSpace(record[0]) == "" {
+			continue // blank line
+		}
+		line, _ := c.r.FieldPos(0)
+
+		value := func(name string) string {
+			if i, ok := c.columns[name]; ok && i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+		return ImportRow{
+			Row:           line,
+			Title:         value("title"),
+			Author:        value("author"),
+			PublishedDate: value("published_date"),
+			Category:      value("category"),
+			ISBN:          value("isbn"),
+			Copies:        value("copies"),
+		}, nil
+	}
+}
+
+// maxLineBytes caps a single JSON Lines record.
+const maxLineBytes = 64 * 1024
+
+func newLineScanner(r io.Reader) *bufio.Scanner {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 4096), maxLineBytes)
+	return scanner
+}
+
+type jsonlReader struct {
+	scanner *bufio.Scanner
+	line    int
+}
+
+func (j *jsonlReader) Next() (ImportRow, error) {
+	for j.scanner.Scan() {
+		j.line++
+		line := bytes.TrimSpace(j.scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		var record struct {
+			ImportRow
+			Copies json.RawMessage `json:"copies"`
+		}
+		if err := json.Unmarshal(line, &record); err != nil {
+			return ImportRow{}, &RowError{Row: j.line, Message: "is not a valid JSON object"}
+		}
+		row := record.ImportRow
+		row.Row = j.line
+		// copies may be written as a number or a string
+		if len(record.Copies) > 0 && string(record.Copies) != "null" {
+			if err := json.Unmarshal(record.Copies, &row.Copies); err != nil {
+				row.Copies = string(record.Copies)
+			}
+		}
+		return row, nil
+	}
+	if err := j.scanner.Err(); err != nil {
+		if errors.Is(err, bufio.ErrTooLong) {
+			return ImportRow{}, &OptionError{Field: "file", Reason: fmt.Sprintf("has a line longer than %d bytes", maxLineBytes)}
+		}
+		return ImportRow{}, err
+	}
+	return ImportRow{}, io.EOF
+}
+
+// ExportRecord is a book as written to an export file. It has the columns of
+// the import plus the id and the available copies, which the import ignores.
+// Importing an export adds every book as a new one with new copies, books that
+// still have their ISBN in the catalog are rejected as duplicates.
+type ExportRecord struct {
+	ID              string    `json:"id"`
+	Title           string    `json:"title"`
+	Author          string    `json:"author"`
+	PublishedDate   time.Time `json:"-"`
+	Category        string    `json:"category,omitempty"`
+	ISBN            string    `json:"isbn,omitempty"`
+	Copies          int       `json:"copies"`
+	AvailableCopies int       `json:"available_copies"`
+}
+
+// ExportWriter writes export records one at a time so the catalog never has
+// to be held in memory. Flush must be called after the last record.
+type ExportWriter interface {
+	Write(ExportRecord) error
+	Flush() error
+}
+
+// NewExportWriter writes an export file of the given format.
+func NewExportWriter(w io.Writer, format Format) (ExportWriter, error) {
+	switch format {
+	case FormatCSV:
+		return &csvWriter{w: csv.NewWriter(w)}, nil
+	case FormatJSONL:
+		return &jsonlWriter{w: bufio.NewWriter(w)}, nil
+	}
+	return nil, &OptionError{Field: "format", Reason: "must be csv or jsonl"}
+}
+
+type csvWriter struct {
+	w             *csv.Writer
+	headerWritten bool
+}
+
+// writeHeader writes the header row before the first record.
+func (c *csvWriter) writeHeader() error {
+	if c.headerWritten {
+		return nil
+	}
+	c.headerWritten = true
+	header := append([]string{"id"}, csvColumns...)
+	return c.w.Write(append(header, "available_copies"))
+}
+
+func (c *csvWriter) Write(rec ExportRecord) error {
+	if err := c.writeHeader(); err != nil {
+		return err
+	}
+	return c.w.Write([]string{
+		rec.ID,
+		rec.Title,
+		rec.Author,
+		rec.PublishedDate.Format(time.DateOnly),
+		rec.Category,
+		rec.ISBN,
+		strconv.Itoa(rec.Copies),
+		strconv.Itoa(rec.AvailableCopies),
+	})
+}
+
+func (c *csvWriter) Flush() error {
+	// An empty catalog still gets its header
+	if err := c.writeHeader(); err != nil {
+		return err
+	}
+	c.w.Flush()
+	return c.w.Error()
+}
+
+type jsonlWriter struct {
+	w *bufio.Writer
+}
+
+func (j *jsonlWriter) Write(rec ExportRecord) error {
+	line, err := json.Marshal(struct {
+		ExportRecord
+		PublishedDate string `json:"published_date"`
+	}{rec, rec.PublishedDate.Format(time.DateOnly)})
+	if err != nil {
+		return err
+	}
+	_, err = j.w.Write(append(line, '\n'))
+	return err
+}
+
+func (j *jsonlWriter) Flush() error {
+	return j.w.Flush()
+}
@@ -0,0 +1,147 @@
+package catalog
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// readAll collects the rows and row errors of an import file
+func readAll(t *testing.T, r RowReader) ([]ImportRow, []*RowError) {
+	t.Helper()
+	var (
+		rows      []ImportRow
+		rowErrors []*RowError
+	)
+	for {
+		row, err := r.Next()
+		if err == io.EOF {
+			return rows, rowErrors
+		}
+		var rowErr *RowError
+		if errors.As(err, &rowErr) {
+			rowErrors = append(rowErrors, rowErr)
+			continue
+		}
+		require.NoError(t, err)
+		rows = append(rows, row)
+	}
+}
+
+// unittest for reading a CSV import with columns in any order
+func TestCSVRowReader(t *testing.T) {
+	file := "\ufeffAuthor,Title,published_date,copies,notes\n" +
+		"George Orwell,1984,1949-06-08,3,ignored\n" +
+		"\n" +
+		"\"Melville, Herman\",Moby-Dick,1851-10-18\n"
+
+	r, err := NewRowReader(strings.NewReader(file), FormatCSV)
+	require.NoError(t, err)
+	rows, rowErrors := readAll(t, r)
+	assert.Empty(t, rowErrors)
+	require.Len(t, rows, 2)
+	assert.Equal(t, ImportRow{Row: 2, Title: "1984", Author: "George Orwell", PublishedDate: "1949-06-08", Copies: "3"}, rows[0])
+	assert.Equal(t, ImportRow{Row: 4, Title: "Moby-Dick", Author: "Melville, Herman", PublishedDate: "1851-10-18"}, rows[1])
+}
+
+// unittest for rejecting CSV files that can't be imported and reporting unreadable rows
+func TestCSVRowReaderErrors(t *testing.T) {
+	_, err := NewRowReader(strings.NewReader(""), FormatCSV)
+	var optErr *OptionError
+	assert.True(t, errors.As(err, &optErr))
+
+	_, err = NewRowReader(strings.NewReader("title,author\n1984,George Orwell\n"), FormatCSV)
+	if assert.True(t, errors.As(err, &optErr)) {
+		assert.Equal(t, "file is missing the published_date column", optErr.Error())
+	}
+
+	r, err := NewRowReader(strings.NewReader("title,author,published_date\n\"1984,George Orwell,1949-06-08\n"), FormatCSV)
+	require.NoError(t, err)
+	_, rowErrors := readAll(t, r)
+	if assert.Len(t, rowErrors, 1) {
+		assert.Equal(t, 2, rowErrors[0].Row)
+	}
+}
+
+// unittest for reading a JSON Lines import
+func TestJSONLRowReader(t *testing.T) {
+	file := `{"title":"1984","author":"George Orwell","published_date":"1949-06-08","copies":2}` + "\n" +
+		"\n" +
+		`not json` + "\n" +
+		`{"title":"Moby-Dick","author":"Herman Melville","published_date":"1851-10-18","copies":"1","isbn":"9781503280786"}` + "\n"
+
+	r, err := NewRowReader(strings.NewReader(file), FormatJSONL)
+	require.NoError(t, err)
+	rows, rowErrors := readAll(t, r)
+	require.Len(t, rows, 2)
+	assert.Equal(t, ImportRow{Row: 1, Title: "1984", Author: "George Orwell", PublishedDate: "1949-06-08", Copies: "2"}, rows[0])
+	assert.Equal(t, 4, rows[1].Row)
+	assert.Equal(t, "1", rows[1].Copies)
+	assert.Equal(t, "9781503280786", rows[1].ISBN)
+	if assert.Len(t, rowErrors, 1) {
+		assert.Equal(t, 3, rowErrors[0].Row)
+	}
+}
+
+// unittest for writing exports in both formats
+func TestExportWriter(t *testing.T) {
+	rec := ExportRecord{
+		ID:              "b1",
+		Title:           "Moby-Dick",
+		Author:          "Melville, Herman",
+		PublishedDate:   time.Date(1851, 10, 18, 0, 0, 0, 0, time.UTC),
+		Copies:          2,
+		AvailableCopies: 1,
+	}
+
+	var csvOut strings.Builder
+	w, err := NewExportWriter(&csvOut, FormatCSV)
+	require.NoError(t, err)
+	require.NoError(t, w.Write(rec))
+	require.NoError(t, w.Flush())
+	assert.Equal(t, "id,title,author,published_date,category,isbn,copies,available_copies\n"+
+		"b1,Moby-Dick,\"Melville, Herman\",1851-10-18,,,2,1\n", csvOut.String())
+
+	// An export is readable as an import
+	r, err := NewRowReader(strings.NewReader(csvOut.String()), FormatCSV)
+	require.NoError(t, err)
+	rows, _ := readAll(t, r)
+	if assert.Len(t, rows, 1) {
+		assert.Equal(t, "1851-10-18", rows[0].PublishedDate)
+		assert.Equal(t, "2", rows[0].Copies)
+	}
+
+	var jsonlOut strings.Builder
+	w, err = NewExportWriter(&jsonlOut, FormatJSONL)
+	require.NoError(t, err)
+	require.NoError(t, w.Write(rec))
+	require.NoError(t, w.Flush())
+	assert.Equal(t, `{"id":"b1","title":"Moby-Dick","author":"Melville, Herman","copies":2,"available_copies":1,"published_date":"1851-10-18"}`+"\n", jsonlOut.String())
+
+	// An empty catalog still gets a header
+	var empty strings.Builder
+	w, _ = NewExportWriter(&empty, FormatCSV)
+	require.NoError(t, w.Flush())
+	assert.Equal(t, "id,title,author,published_date,category,isbn,copies,available_copies\n", empty.String())
+}
+
+// unittest for reading a format from its name or content type
+func TestParseFormat(t *testing.T) {
+	for input, want := range map[string]Format{
+		"csv":                     FormatCSV,
+		"text/csv; charset=utf-8": FormatCSV,
+		"JSONL":                   FormatJSONL,
+		"application/x-ndjson":    FormatJSONL,
+	} {
+		got, err := ParseFormat(input)
+		assert.NoError(t, err, input)
+		assert.Equal(t, want, got, input)
+	}
+	_, err := ParseFormat("xml")
+	assert.Error(t, err)
+}
@@ -0,0 +1,102 @@
+package catalog
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+var (
+	// ErrNotFound is returned for a book id that matches no book in the
+	// state the operation needs, withdrawn books are not found by Withdraw.
+	ErrNotFound = errors.New("book not found")
+	// ErrOnLoan is returned by Withdraw for a book with a copy out on loan.
+	ErrOnLoan = errors.New("book has a copy out on loan")
+	// ErrNotWithdrawn is returned by Restore for a book in the catalog.
+	ErrNotWithdrawn = errors.New("book is not withdrawn")
+)
+
+// Execer runs statements, a *pgxpool.Pool and a pgx.Tx are both one.
+type Execer interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+// Withdraw hides a book from the catalog in tx, keeping its copies and loan
+// history until Purge removes it. A book with an open loan stays in the
+// catalog until the copy comes back. Holds on the book can't be filled any
+// more, they are cancelled. The copies of the book are locked until tx ends,
+// the caller sends the ones kept on the hold shelf back to Available through
+// the status model before committing.
+func Withdraw(ctx context.Context, tx pgx.Tx, bookID, actorID, reason string) error {
+	// Lock the copies so no loan can start between the check and the withdrawal
+	if _, err := tx.Exec(ctx, `SELECT id FROM bookcopies WHERE book_id = $1 ORDER BY id FOR UPDATE`, bookID); err != nil {
+		return err
+	}
+	var onLoan bool
+	err := tx.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM borrowedbooks WHERE book_id = $1 AND return_date IS NULL)`, bookID).Scan(&onLoan)
+	if err != nil {
+		return err
+	}
+	if onLoan {
+		return ErrOnLoan
+	}
+
+	res, err := tx.Exec(ctx, `
+		UPDATE books
+		SET withdrawn_at = NOW(), withdrawn_by = $2, withdrawn_reason = NULLIF($3, ''), updated_at = NOW(), version = version + 1
+		WHERE id = $1 AND withdrawn_at IS NULL`, bookID, actorID, reason)
+	if err != nil {
+		return err
+	}
+	if res.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+
+	_, err = tx.Exec(ctx, `UPDATE holds SET status = 'Cancelled', updated_at = NOW() WHERE book_id = $1 AND status IN ('Waiting', 'Ready')`, bookID)
+	return err
+}
+
+// Restore puts a withdrawn book back in the catalog. It fails with a unique
+// violation that ISBNTaken reports when a book added since has its ISBN.
+func Restore(ctx context.Context, db Execer, bookID string) error {
+	res, err := db.Exec(ctx, `
+		UPDATE books
+		SET withdrawn_at = NULL, withdrawn_by = NULL, withdrawn_reason = NULL, updated_at = NOW(), version = version + 1
+		WHERE id = $1 AND withdrawn_at IS NOT NULL`, bookID)
+	if err != nil {
+		return err
+	}
+	if res.RowsAffected() > 0 {
+		return nil
+	}
+
+	var exists bool
+	if err := db.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM books WHERE id = $1)`, bookID).Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		return ErrNotFound
+	}
+	return ErrNotWithdrawn
+}
+
+// Purge permanently deletes the books withdrawn before the cutoff, with
+// their copies, loans and history. It returns how many were deleted and the
+// keys of their covers, which the caller removes from the cover storage.
+func Purge(ctx context.Context, db Execer, cutoff time.Time) (int64, []string, error) {
+	var (
+		purged    int64
+		coverKeys []string
+	)
+	err := db.QueryRow(ctx, `
+		WITH purged AS (DELETE FROM books WHERE withdrawn_at < $1 RETURNING cover_key)
+		SELECT COUNT(*), COALESCE(array_agg(cover_key) FILTER (WHERE cover_key IS NOT NULL), '{}') FROM purged`, cutoff).Scan(&purged, &coverKeys)
+	if err != nil {
+		return 0, nil, err
+	}
+	return purged, coverKeys, nil
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"net/http"
 	"net/http/httptest"
 	"strings"
@@ -11,7 +12,11 @@ import (
 	"github.com/labstack/echo/v4"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
 
+	"p3/gc2/catalog"
 	"p3/gc2/pb"
 )
 
@@ -113,4 +118,75 @@ func TestReturnBook(t *testing.T) {
 		assert.Equal(t, http.StatusOK, rec.Code)
 		assert.Contains(t, rec.Body.String(), "Book returned successfully")
 	}
-}
\ No newline at end of file
+}
+
+// unittest for mapping gRPC errors to HTTP statuses
+func TestHTTPStatusFromGRPC(t *testing.T) {
+	assert.Equal(t, http.StatusNotFound, httpStatusFromGRPC(status.Error(codes.NotFound, "no open loan for this book")))
+	assert.Equal(t, http.StatusUnprocessableEntity, httpStatusFromGRPC(status.Error(codes.FailedPrecondition, "renewal limit reached")))
+	assert.Equal(t, http.StatusForbidden, httpStatusFromGRPC(status.Error(codes.PermissionDenied, "denied")))
+	assert.Equal(t, http.StatusInternalServerError, httpStatusFromGRPC(errors.New("connection refused")))
+}
+
+// unittest for converting book history entries to JSON
+func TestNewBookHistoryEntryResponse(t *testing.T) {
+	changedAt := timestamppb.Now()
+	res := newBookHistoryEntryResponse(&pb.BookHistoryEntry{
+		OccurredAt: changedAt,
+		Entry: &pb.BookHistoryEntry_StatusChange{StatusChange: &pb.BookStatusChange{
+			Id:        "change-id",
+			ToStatus:  pb.BookStatus_BOOK_STATUS_AVAILABLE,
+			Reason:    "Created",
+			ChangedAt: changedAt,
+		}},
+	})
+	assert.Equal(t, "status_change", res.Type)
+	assert.Nil(t, res.Loan)
+	assert.Equal(t, "", res.StatusChange.FromStatus)
+	assert.Equal(t, "Available", res.StatusChange.ToStatus)
+
+	res = newBookHistoryEntryResponse(&pb.BookHistoryEntry{
+		OccurredAt: changedAt,
+		Entry: &pb.BookHistoryEntry_Loan{Loan: &pb.Loan{
+			Id:           "loan-id",
+			BorrowedDate: changedAt,
+			DueDate:      changedAt,
+		}},
+	})
+	assert.Equal(t, "loan", res.Type)
+	assert.Equal(t, "loan-id", res.Loan.ID)
+	assert.Nil(t, res.Loan.ReturnDate)
+}
+
+// unittest for converting a gRPC copy to JSON
+func TestNewBookCopyResponse(t *testing.T) {
+	res := newBookCopyResponse(&pb.BookCopy{
+		Id:        "copy-id",
+		BookId:    "book-id",
+		Barcode:   "C00000001",
+		Status:    pb.BookStatus_BOOK_STATUS_ON_HOLD,
+		CreatedAt: timestamppb.Now(),
+		UpdatedAt: timestamppb.Now(),
+	})
+	assert.Equal(t, "copy-id", res.ID)
+	assert.Equal(t, "C00000001", res.Barcode)
+	assert.Equal(t, "OnHold", res.Status)
+	assert.Equal(t, "", res.UserID)
+}
+
+// unittest for merging unreadable rows into the server's import result
+func TestNewImportBooksResponse(t *testing.T) {
+	res := newImportBooksResponse(&pb.ImportBooksResponse{
+		Message:      "Dry run completed, nothing was imported",
+		TotalRows:    2,
+		ImportedRows: 1,
+		FailedRows:   1,
+		Errors:       []*pb.ImportRowError{{Row: 5, Field: "isbn", Message: "already belongs to book b1"}},
+	}, []catalog.RowError{{Row: 3, Message: "is not a valid JSON object"}})
+	assert.Equal(t, int32(3), res.TotalRows)
+	assert.Equal(t, int32(2), res.FailedRows)
+	if assert.Len(t, res.Errors, 2) {
+		assert.Equal(t, 3, res.Errors[0].Row)
+		assert.Equal(t, "isbn", res.Errors[1].Field)
+	}
+}
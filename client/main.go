@@ -2,10 +2,20 @@ package main
 
 import (
 	"context"
+	"errors"
+	"io"
 	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"os"
+	"p3/gc2/bookstatus"
+	"p3/gc2/catalog"
 	"p3/gc2/config/database"
+	"p3/gc2/covers"
 	book_handler "p3/gc2/handler/bookHandler"
 	user_handler "p3/gc2/handler/userHandler"
 	cust_middleware "p3/gc2/middleware"
@@ -16,155 +26,2181 @@ import (
 
 	"github.com/go-playground/validator/v10"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 
 	// path to swagger docs client and server
 	_ "p3/gc2/client/docs"
 	"github.com/swaggo/echo-swagger"
 )
 
-// BorrowBookRequest represents the request body for borrowing a book
+// BorrowBookRequest represents the request body for borrowing a book, any
+// available copy is lent unless a copy ID is given
 type BorrowBookRequest struct {
+    BookID string `json:"book_id" validate:"required_without=CopyID"`
+    CopyID string `json:"copy_id"`
+}
+
+// ReturnBookRequest represents the request body for returning a book by book or copy ID
+type ReturnBookRequest struct {
+    BookID string `json:"book_id" validate:"required_without=CopyID"`
+    CopyID string `json:"copy_id"`
+}
+
+// RenewBookRequest represents the request body for renewing a loan by book or copy ID
+type RenewBookRequest struct {
+    BookID string `json:"book_id" validate:"required_without=CopyID"`
+    CopyID string `json:"copy_id"`
+}
+
+// PlaceHoldRequest represents the request body for placing a hold
+type PlaceHoldRequest struct {
     BookID string `json:"book_id" validate:"required"`
 }
 
-// ReturnBookRequest represents the request body for returning a book
-type ReturnBookRequest struct {
-    BookID string `json:"book_id" validate:"required"`
+// HoldResponse is the JSON form of a hold returned by the gRPC server
+type HoldResponse struct {
+    ID             string     `json:"id"`
+    BookID         string     `json:"book_id"`
+    CopyID         string     `json:"copy_id,omitempty"`
+    UserID         string     `json:"user_id"`
+    Status         string     `json:"status"`
+    Position       int32      `json:"position"`
+    PickupDeadline *time.Time `json:"pickup_deadline,omitempty"`
+    CreatedAt      time.Time  `json:"created_at"`
+}
+
+// newHoldResponse converts a gRPC hold to its JSON form
+func newHoldResponse(hold *pb.Hold) HoldResponse {
+    res := HoldResponse{
+        ID:        hold.GetId(),
+        BookID:    hold.GetBookId(),
+        CopyID:    hold.GetCopyId(),
+        UserID:    hold.GetUserId(),
+        Status:    hold.GetStatus(),
+        Position:  hold.GetPosition(),
+        CreatedAt: hold.GetCreatedAt().AsTime(),
+    }
+    if hold.GetPickupDeadline() != nil {
+        deadline := hold.GetPickupDeadline().AsTime()
+        res.PickupDeadline = &deadline
+    }
+    return res
+}
+
+// FinePaymentRequest represents the request body for recording a payment or waiver
+type FinePaymentRequest struct {
+    UserID      string `json:"user_id" validate:"required"`
+    AmountCents int64  `json:"amount_cents" validate:"required,gt=0"`
+    EntryType   string `json:"entry_type" validate:"required,oneof=Payment Waiver"`
+    Note        string `json:"note"`
+}
+
+// FineEntryResponse is the JSON form of a fine ledger entry
+type FineEntryResponse struct {
+    ID             string    `json:"id"`
+    UserID         string    `json:"user_id"`
+    BorrowedBookID string    `json:"borrowed_book_id,omitempty"`
+    EntryType      string    `json:"entry_type"`
+    AmountCents    int64     `json:"amount_cents"`
+    Note           string    `json:"note,omitempty"`
+    RecordedBy     string    `json:"recorded_by,omitempty"`
+    CreatedAt      time.Time `json:"created_at"`
+}
+
+// FineBalanceResponse is the JSON form of a user's fine balance and ledger
+type FineBalanceResponse struct {
+    UserID       string              `json:"user_id"`
+    BalanceCents int64               `json:"balance_cents"`
+    Entries      []FineEntryResponse `json:"entries"`
+}
+
+// newFineEntryResponse converts a gRPC fine entry to its JSON form
+func newFineEntryResponse(entry *pb.FineEntry) FineEntryResponse {
+    return FineEntryResponse{
+        ID:             entry.GetId(),
+        UserID:         entry.GetUserId(),
+        BorrowedBookID: entry.GetBorrowedBookId(),
+        EntryType:      entry.GetEntryType(),
+        AmountCents:    entry.GetAmountCents(),
+        Note:           entry.GetNote(),
+        RecordedBy:     entry.GetRecordedBy(),
+        CreatedAt:      entry.GetCreatedAt().AsTime(),
+    }
+}
+
+// DeclareLostRequest represents the request body for declaring a book lost
+type DeclareLostRequest struct {
+    ReplacementCents int64  `json:"replacement_cents" validate:"gte=0"`
+    Note             string `json:"note"`
+}
+
+// UpdateBookStatusRequest represents the request body for changing a copy's status
+type UpdateBookStatusRequest struct {
+    Status string `json:"status" validate:"required"`
+    Reason string `json:"reason"`
+}
+
+// AddBookCopyRequest represents the request body for adding a copy of a book
+type AddBookCopyRequest struct {
+    Barcode string `json:"barcode"`
+}
+
+// BookCopyResponse is the JSON form of a physical copy returned by the gRPC server
+type BookCopyResponse struct {
+    ID        string            `json:"id"`
+    BookID    string            `json:"book_id"`
+    Barcode   string            `json:"barcode"`
+    Status    string            `json:"status"`
+    UserID    string            `json:"user_id,omitempty"`
+    CreatedAt time.Time         `json:"created_at"`
+    UpdatedAt time.Time         `json:"updated_at"`
+}
+
+// newBookCopyResponse converts a gRPC copy to its JSON form
+func newBookCopyResponse(bookCopy *pb.BookCopy) BookCopyResponse {
+    copyStatus, _ := bookstatus.FromProto(bookCopy.GetStatus())
+    return BookCopyResponse{
+        ID:        bookCopy.GetId(),
+        BookID:    bookCopy.GetBookId(),
+        Barcode:   bookCopy.GetBarcode(),
+        Status:    string(copyStatus),
+        UserID:    bookCopy.GetUserId(),
+        CreatedAt: bookCopy.GetCreatedAt().AsTime(),
+        UpdatedAt: bookCopy.GetUpdatedAt().AsTime(),
+    }
+}
+
+// LoanResponse is the JSON form of a loan returned by the gRPC server
+type LoanResponse struct {
+    ID           string     `json:"id"`
+    CopyID       string     `json:"copy_id"`
+    UserID       string     `json:"user_id"`
+    BorrowedDate time.Time  `json:"borrowed_date"`
+    DueDate      time.Time  `json:"due_date"`
+    ReturnDate   *time.Time `json:"return_date,omitempty"`
+    RenewalCount int32      `json:"renewal_count"`
+    BorrowedBy   string     `json:"borrowed_by,omitempty"`
+    ReturnedBy   string     `json:"returned_by,omitempty"`
+}
+
+// StatusChangeResponse is the JSON form of a recorded status transition
+type StatusChangeResponse struct {
+    ID         string    `json:"id"`
+    CopyID     string    `json:"copy_id"`
+    FromStatus string    `json:"from_status,omitempty"`
+    ToStatus   string    `json:"to_status"`
+    ActorID    string    `json:"actor_id,omitempty"`
+    Reason     string    `json:"reason,omitempty"`
+    ChangedAt  time.Time `json:"changed_at"`
+}
+
+// BookHistoryEntryResponse is a single timeline entry, type is loan, hold or
+// status_change and names the field that is set
+type BookHistoryEntryResponse struct {
+    Type         string                `json:"type"`
+    OccurredAt   time.Time             `json:"occurred_at"`
+    Loan         *LoanResponse         `json:"loan,omitempty"`
+    Hold         *HoldResponse         `json:"hold,omitempty"`
+    StatusChange *StatusChangeResponse `json:"status_change,omitempty"`
+}
+
+// newBookHistoryEntryResponse converts a gRPC timeline entry to its JSON form
+func newBookHistoryEntryResponse(entry *pb.BookHistoryEntry) BookHistoryEntryResponse {
+    res := BookHistoryEntryResponse{OccurredAt: entry.GetOccurredAt().AsTime()}
+    switch {
+    case entry.GetLoan() != nil:
+        loan := entry.GetLoan()
+        res.Type = "loan"
+        res.Loan = &LoanResponse{
+            ID:           loan.GetId(),
+            CopyID:       loan.GetCopyId(),
+            UserID:       loan.GetUserId(),
+            BorrowedDate: loan.GetBorrowedDate().AsTime(),
+            DueDate:      loan.GetDueDate().AsTime(),
+            RenewalCount: loan.GetRenewalCount(),
+            BorrowedBy:   loan.GetBorrowedBy(),
+            ReturnedBy:   loan.GetReturnedBy(),
+        }
+        if loan.GetReturnDate() != nil {
+            returned := loan.GetReturnDate().AsTime()
+            res.Loan.ReturnDate = &returned
+        }
+    case entry.GetHold() != nil:
+        hold := newHoldResponse(entry.GetHold())
+        res.Type = "hold"
+        res.Hold = &hold
+    case entry.GetStatusChange() != nil:
+        change := entry.GetStatusChange()
+        from, _ := bookstatus.FromProto(change.GetFromStatus())
+        to, _ := bookstatus.FromProto(change.GetToStatus())
+        res.Type = "status_change"
+        res.StatusChange = &StatusChangeResponse{
+            ID:         change.GetId(),
+            CopyID:     change.GetCopyId(),
+            FromStatus: string(from),
+            ToStatus:   string(to),
+            ActorID:    change.GetActorId(),
+            Reason:     change.GetReason(),
+            ChangedAt:  change.GetChangedAt().AsTime(),
+        }
+    }
+    return res
+}
+
+// dialLibrary connects to the gRPC server and returns a client together with
+// an outgoing context carrying the caller's token
+func dialLibrary(token *jwt.Token) (pb.LibraryServiceClient, context.Context, func() error, error) {
+    md := metadata.Pairs("authorization", "Bearer "+token.Raw)
+    ctx := metadata.NewOutgoingContext(context.Background(), md)
+
+    conn, err := grpc.Dial("localhost:50051", grpc.WithInsecure())
+    if err != nil {
+        return nil, nil, nil, err
+    }
+    return pb.NewLibraryServiceClient(conn), ctx, conn.Close, nil
+}
+
+// httpStatusFromGRPC maps a gRPC error code to the closest HTTP status
+func httpStatusFromGRPC(err error) int {
+    switch status.Code(err) {
+    case codes.InvalidArgument:
+        return http.StatusBadRequest
+    case codes.Unauthenticated:
+        return http.StatusUnauthorized
+    case codes.PermissionDenied:
+        return http.StatusForbidden
+    case codes.NotFound:
+        return http.StatusNotFound
+    case codes.AlreadyExists, codes.Aborted:
+        return http.StatusConflict
+    case codes.FailedPrecondition:
+        return http.StatusUnprocessableEntity
+    case codes.ResourceExhausted:
+        return http.StatusTooManyRequests
+    case codes.Unavailable:
+        return http.StatusServiceUnavailable
+    default:
+        return http.StatusInternalServerError
+    }
+}
+
+// grpcErrorJSON writes a gRPC error as a JSON response with the mapped status
+func grpcErrorJSON(c echo.Context, message string, err error) error {
+    return c.JSON(httpStatusFromGRPC(err), map[string]string{"message": message, "error": status.Convert(err).Message()})
+}
+
+// @Summary Borrow a book
+// @Description Borrow a book using gRPC, the borrower is taken from the token
+// @Tags Books
+// @Accept json
+// @Produce json
+// @Param Authorization header string true "Bearer token"
+// @Param body body BorrowBookRequest true "Book or copy ID to borrow"
+// @Success 200 {object} map[string]string
+// @Failure 401 {object} map[string]string
+// @Failure 500 {object} map[string]string
+// @Router /users/borrow-book [post]
+func BorrowBookHandler(c echo.Context) error {
+    // Retrieve the token from the context
+    token, ok := c.Get("user").(*jwt.Token)
+    if !ok || token == nil {
+        return c.JSON(http.StatusUnauthorized, map[string]string{"message": "Invalid or missing token"})
+    }
+
+    if !token.Valid {
+        return c.JSON(http.StatusUnauthorized, map[string]string{"message": "Invalid token"})
+    }
+
+    // Bind the incoming book_id or copy_id from the request body
+    var request BorrowBookRequest
+    if err := c.Bind(&request); err != nil {
+        return c.JSON(http.StatusBadRequest, map[string]string{"message": "Invalid request format"})
+    }
+    if err := c.Validate(&request); err != nil {
+        return c.JSON(http.StatusBadRequest, map[string]string{"message": "Validation failed", "error": err.Error()})
+    }
+
+    // Connect to the gRPC server, forwarding the token as metadata
+    client, ctx, closeConn, err := dialLibrary(token)
+    if err != nil {
+        return c.JSON(http.StatusInternalServerError, map[string]string{"message": "Failed to connect to gRPC server"})
+    }
+    defer closeConn()
+
+    // Call BorrowBook on the gRPC server
+    res, err := client.BorrowBook(ctx, &pb.BorrowBookRequest{
+        BookId: request.BookID,
+        CopyId: request.CopyID,
+    })
+    if err != nil {
+        return grpcErrorJSON(c, "Failed to borrow book", err)
+    }
+
+    // Return the gRPC server's response
+    return c.JSON(http.StatusOK, map[string]string{
+        "message":  res.GetMessage(),
+        "due_date": res.GetDueDate().AsTime().Format(time.RFC3339),
+        "copy_id":  res.GetCopyId(),
+        "barcode":  res.GetBarcode(),
+    })
+}
+
+// @Summary Return a borrowed book
+// @Description Allows a user to return a borrowed book by providing the book ID and JWT token for authentication.
+// @Tags Books
+// @Accept json
+// @Produce json
+// @Param Authorization header string true "Bearer token"
+// @Param body body ReturnBookRequest true "Book or copy ID to return"
+// @Success 200 {object} map[string]string
+// @Failure 400 {object} map[string]string
+// @Failure 401 {object} map[string]string
+// @Failure 500 {object} map[string]string
+// @Router /users/return-book [post]
+func ReturnBookHandler(c echo.Context) error {
+    // Retrieve the token from the context
+    token, ok := c.Get("user").(*jwt.Token)
+    if !ok || token == nil {
+        return c.JSON(http.StatusUnauthorized, map[string]string{"message": "Invalid or missing token"})
+    }
+
+    if !token.Valid {
+        return c.JSON(http.StatusUnauthorized, map[string]string{"message": "Invalid token"})
+    }
+
+    // Bind the incoming book_id or copy_id from the request body
+    var request ReturnBookRequest
+    if err := c.Bind(&request); err != nil {
+        return c.JSON(http.StatusBadRequest, map[string]string{"message": "Invalid request format"})
+    }
+    if err := c.Validate(&request); err != nil {
+        return c.JSON(http.StatusBadRequest, map[string]string{"message": "Validation failed", "error": err.Error()})
+    }
+
+    // Connect to the gRPC server, forwarding the token as metadata
+    client, ctx, closeConn, err := dialLibrary(token)
+    if err != nil {
+        return c.JSON(http.StatusInternalServerError, map[string]string{"message": "Failed to connect to gRPC server"})
+    }
+    defer closeConn()
+
+    // Call ReturnBook on the gRPC server
+    res, err := client.ReturnBook(ctx, &pb.ReturnBookRequest{
+        BookId: request.BookID,
+        CopyId: request.CopyID,
+    })
+    if err != nil {
+        return grpcErrorJSON(c, "Failed to return book", err)
+    }
+
+    // Return the gRPC server's response
+    return c.JSON(http.StatusOK, map[string]string{
+        "message": res.GetMessage(),
+    })
+}
+
+// @Summary Renew a borrowed book
+// @Description Extends the due date of the caller's open loan, refused once the renewal limit is reached or when another user has a hold on the book
+// @Tags Books
+// @Accept json
+// @Produce json
+// @Param Authorization header string true "Bearer token"
+// @Param body body RenewBookRequest true "Book or copy ID to renew"
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} map[string]string
+// @Failure 401 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Failure 422 {object} map[string]string
+// @Failure 500 {object} map[string]string
+// @Router /users/renew-book [post]
+func RenewBookHandler(c echo.Context) error {
+    // Retrieve the token from the context
+    token, ok := c.Get("user").(*jwt.Token)
+    if !ok || token == nil || !token.Valid {
+        return c.JSON(http.StatusUnauthorized, map[string]string{"message": "Invalid or missing token"})
+    }
+
+    var request RenewBookRequest
+    if err := c.Bind(&request); err != nil {
+        return c.JSON(http.StatusBadRequest, map[string]string{"message": "Invalid request format"})
+    }
+    if err := c.Validate(&request); err != nil {
+        return c.JSON(http.StatusBadRequest, map[string]string{"message": "Validation failed", "error": err.Error()})
+    }
+
+    client, ctx, closeConn, err := dialLibrary(token)
+    if err != nil {
+        return c.JSON(http.StatusInternalServerError, map[string]string{"message": "Failed to connect to gRPC server"})
+    }
+    defer closeConn()
+
+    res, err := client.RenewBook(ctx, &pb.RenewBookRequest{
+        BookId: request.BookID,
+        CopyId: request.CopyID,
+    })
+    if err != nil {
+        return grpcErrorJSON(c, "Failed to renew book", err)
+    }
+
+    return c.JSON(http.StatusOK, map[string]interface{}{
+        "message":            res.GetMessage(),
+        "due_date":           res.GetDueDate().AsTime().Format(time.RFC3339),
+        "renewals_remaining": res.GetRenewalsRemaining(),
+    })
+}
+
+// @Summary Declare a copy lost
+// @Description Marks a copy Lost (admin only). The open loan is closed and the borrower is charged the replacement cost.
+// @Tags Books
+// @Accept json
+// @Produce json
+// @Param Authorization header string true "Bearer token"
+// @Param id path string true "Copy ID"
+// @Param body body DeclareLostRequest true "Replacement charge"
+// @Success 200 {object} map[string]string
+// @Failure 400 {object} map[string]string
+// @Failure 401 {object} map[string]string
+// @Failure 403 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Failure 422 {object} map[string]string
+// @Failure 500 {object} map[string]string
+// @Router /users/copies/{id}/lost [post]
+func DeclareBookLostHandler(c echo.Context) error {
+    if !cust_middleware.IsAdmin(c) {
+        return c.JSON(http.StatusForbidden, map[string]string{"message": "Permission denied admin use only!"})
+    }
+
+    token, ok := c.Get("user").(*jwt.Token)
+    if !ok || token == nil || !token.Valid {
+        return c.JSON(http.StatusUnauthorized, map[string]string{"message": "Invalid or missing token"})
+    }
+
+    var request DeclareLostRequest
+    if err := c.Bind(&request); err != nil {
+        return c.JSON(http.StatusBadRequest, map[string]string{"message": "Invalid request format"})
+    }
+    if err := c.Validate(&request); err != nil {
+        return c.JSON(http.StatusBadRequest, map[string]string{"message": "Validation failed", "error": err.Error()})
+    }
+
+    client, ctx, closeConn, err := dialLibrary(token)
+    if err != nil {
+        return c.JSON(http.StatusInternalServerError, map[string]string{"message": "Failed to connect to gRPC server"})
+    }
+    defer closeConn()
+
+    res, err := client.DeclareBookLost(ctx, &pb.DeclareBookLostRequest{
+        CopyId:           c.Param("id"),
+        ReplacementCents: request.ReplacementCents,
+        Note:             request.Note,
+    })
+    if err != nil {
+        return grpcErrorJSON(c, "Failed to declare copy lost", err)
+    }
+
+    return c.JSON(http.StatusOK, map[string]string{
+        "message":         res.GetMessage(),
+        "charged_user_id": res.GetChargedUserId(),
+    })
+}
+
+// @Summary Change a copy's status
+// @Description Moves a copy to Available, InRepair, Lost or Withdrawn (admin only). Copies on loan or on the hold shelf must go through the return and hold endpoints, and illegal transitions are rejected with 422.
+// @Tags Books
+// @Accept json
+// @Produce json
+// @Param Authorization header string true "Bearer token"
+// @Param id path string true "Copy ID"
+// @Param body body UpdateBookStatusRequest true "New status and reason"
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} map[string]string
+// @Failure 401 {object} map[string]string
+// @Failure 403 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Failure 422 {object} map[string]string
+// @Failure 500 {object} map[string]string
+// @Router /users/copies/{id}/status [put]
+func UpdateBookStatusHandler(c echo.Context) error {
+    if !cust_middleware.IsAdmin(c) {
+        return c.JSON(http.StatusForbidden, map[string]string{"message": "Permission denied admin use only!"})
+    }
+
+    token, ok := c.Get("user").(*jwt.Token)
+    if !ok || token == nil || !token.Valid {
+        return c.JSON(http.StatusUnauthorized, map[string]string{"message": "Invalid or missing token"})
+    }
+
+    var request UpdateBookStatusRequest
+    if err := c.Bind(&request); err != nil {
+        return c.JSON(http.StatusBadRequest, map[string]string{"message": "Invalid request format"})
+    }
+    if err := c.Validate(&request); err != nil {
+        return c.JSON(http.StatusBadRequest, map[string]string{"message": "Validation failed", "error": err.Error()})
+    }
+    newStatus, err := bookstatus.Parse(request.Status)
+    if err != nil {
+        return c.JSON(http.StatusBadRequest, map[string]string{"message": "Validation failed", "error": err.Error()})
+    }
+
+    client, ctx, closeConn, err := dialLibrary(token)
+    if err != nil {
+        return c.JSON(http.StatusInternalServerError, map[string]string{"message": "Failed to connect to gRPC server"})
+    }
+    defer closeConn()
+
+    res, err := client.UpdateBookStatus(ctx, &pb.UpdateBookStatusRequest{
+        CopyId: c.Param("id"),
+        Status: bookstatus.ToProto(newStatus),
+        Reason: request.Reason,
+    })
+    if err != nil {
+        return grpcErrorJSON(c, "Failed to update copy status", err)
+    }
+
+    return c.JSON(http.StatusOK, map[string]interface{}{
+        "message": res.GetMessage(),
+        "copy":    newBookCopyResponse(res.GetCopy()),
+    })
+}
+
+// @Summary Delete a book
+// @Description Withdraws a book from the catalog (admin only). The book keeps its copies and loan history and can be restored until the retention period ends, then it is deleted for good. Its holds are cancelled and the copies kept for them go back on the shelf. A book with a copy out on loan can't be deleted.
+// @Tags Books
+// @Produce json
+// @Param Authorization header string true "Bearer token"
+// @Param id path string true "Book ID"
+// @Param reason query string false "Why the book is withdrawn"
+// @Success 200 {object} map[string]string
+// @Failure 400 {object} map[string]string
+// @Failure 401 {object} map[string]string
+// @Failure 403 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Failure 409 {object} map[string]string
+// @Failure 500 {object} map[string]string
+// @Router /users/books/{id} [delete]
+func DeleteBookHandler(c echo.Context) error {
+    if !cust_middleware.IsAdmin(c) {
+        return c.JSON(http.StatusForbidden, map[string]string{"message": "Permission denied admin use only!"})
+    }
+
+    token, ok := c.Get("user").(*jwt.Token)
+    if !ok || token == nil || !token.Valid {
+        return c.JSON(http.StatusUnauthorized, map[string]string{"message": "Invalid or missing token"})
+    }
+
+    // The server withdraws the book so watchers of its copies hear about the
+    // ones leaving the hold shelf
+    client, ctx, closeConn, err := dialLibrary(token)
+    if err != nil {
+        return c.JSON(http.StatusInternalServerError, map[string]string{"message": "Failed to connect to gRPC server"})
+    }
+    defer closeConn()
+
+    res, err := client.DeleteBook(ctx, &pb.DeleteBookRequest{
+        Id:     c.Param("id"),
+        Reason: c.QueryParam("reason"),
+    })
+    if status.Code(err) == codes.FailedPrecondition {
+        return c.JSON(http.StatusConflict, map[string]string{"message": "Failed to delete book", "error": status.Convert(err).Message()})
+    }
+    if err != nil {
+        return grpcErrorJSON(c, "Failed to delete book", err)
+    }
+
+    return c.JSON(http.StatusOK, map[string]string{"message": res.GetMessage()})
+}
+
+// @Summary Add a copy of a book
+// @Description Adds a physical copy of a book (admin only). A barcode is generated when none is given. If patrons are waiting the copy goes straight to the hold shelf.
+// @Tags Books
+// @Accept json
+// @Produce json
+// @Param Authorization header string true "Bearer token"
+// @Param id path string true "Book ID"
+// @Param body body AddBookCopyRequest false "Barcode of the copy"
+// @Success 201 {object} map[string]interface{}
+// @Failure 400 {object} map[string]string
+// @Failure 401 {object} map[string]string
+// @Failure 403 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Failure 409 {object} map[string]string
+// @Failure 500 {object} map[string]string
+// @Router /users/books/{id}/copies [post]
+func AddBookCopyHandler(c echo.Context) error {
+    if !cust_middleware.IsAdmin(c) {
+        return c.JSON(http.StatusForbidden, map[string]string{"message": "Permission denied admin use only!"})
+    }
+
+    token, ok := c.Get("user").(*jwt.Token)
+    if !ok || token == nil || !token.Valid {
+        return c.JSON(http.StatusUnauthorized, map[string]string{"message": "Invalid or missing token"})
+    }
+
+    var request AddBookCopyRequest
+    if err := c.Bind(&request); err != nil {
+        return c.JSON(http.StatusBadRequest, map[string]string{"message": "Invalid request format"})
+    }
+
+    client, ctx, closeConn, err := dialLibrary(token)
+    if err != nil {
+        return c.JSON(http.StatusInternalServerError, map[string]string{"message": "Failed to connect to gRPC server"})
+    }
+    defer closeConn()
+
+    res, err := client.AddBookCopy(ctx, &pb.AddBookCopyRequest{
+        BookId:  c.Param("id"),
+        Barcode: request.Barcode,
+    })
+    if err != nil {
+        return grpcErrorJSON(c, "Failed to add copy", err)
+    }
+
+    return c.JSON(http.StatusCreated, map[string]interface{}{
+        "message": res.GetMessage(),
+        "copy":    newBookCopyResponse(res.GetCopy()),
+    })
+}
+
+// @Summary List the copies of a book
+// @Description Returns every physical copy of a book with its barcode and status. The borrower is only shown to admins and to the borrower.
+// @Tags Books
+// @Produce json
+// @Param Authorization header string true "Bearer token"
+// @Param id path string true "Book ID"
+// @Success 200 {array} BookCopyResponse
+// @Failure 400 {object} map[string]string
+// @Failure 401 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Failure 500 {object} map[string]string
+// @Router /users/books/{id}/copies [get]
+func ListBookCopiesHandler(c echo.Context) error {
+    token, ok := c.Get("user").(*jwt.Token)
+    if !ok || token == nil || !token.Valid {
+        return c.JSON(http.StatusUnauthorized, map[string]string{"message": "Invalid or missing token"})
+    }
+
+    client, ctx, closeConn, err := dialLibrary(token)
+    if err != nil {
+        return c.JSON(http.StatusInternalServerError, map[string]string{"message": "Failed to connect to gRPC server"})
+    }
+    defer closeConn()
+
+    res, err := client.ListBookCopies(ctx, &pb.ListBookCopiesRequest{BookId: c.Param("id")})
+    if err != nil {
+        return grpcErrorJSON(c, "Failed to fetch copies", err)
+    }
+
+    copies := make([]BookCopyResponse, 0, len(res.GetCopies()))
+    for _, bookCopy := range res.GetCopies() {
+        copies = append(copies, newBookCopyResponse(bookCopy))
+    }
+    return c.JSON(http.StatusOK, copies)
+}
+
+// @Summary Get book history
+// @Description Returns the loans, holds and status changes of a book in chronological order (admin only)
+// @Tags Books
+// @Produce json
+// @Param Authorization header string true "Bearer token"
+// @Param id path string true "Book ID"
+// @Success 200 {array} BookHistoryEntryResponse
+// @Failure 400 {object} map[string]string
+// @Failure 401 {object} map[string]string
+// @Failure 403 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Failure 500 {object} map[string]string
+// @Router /users/books/{id}/history [get]
+func GetBookHistoryHandler(c echo.Context) error {
+    if !cust_middleware.IsAdmin(c) {
+        return c.JSON(http.StatusForbidden, map[string]string{"message": "Permission denied admin use only!"})
+    }
+
+    token, ok := c.Get("user").(*jwt.Token)
+    if !ok || token == nil || !token.Valid {
+        return c.JSON(http.StatusUnauthorized, map[string]string{"message": "Invalid or missing token"})
+    }
+
+    client, ctx, closeConn, err := dialLibrary(token)
+    if err != nil {
+        return c.JSON(http.StatusInternalServerError, map[string]string{"message": "Failed to connect to gRPC server"})
+    }
+    defer closeConn()
+
+    res, err := client.GetBookHistory(ctx, &pb.GetBookHistoryRequest{BookId: c.Param("id")})
+    if err != nil {
+        return grpcErrorJSON(c, "Failed to fetch book history", err)
+    }
+
+    entries := make([]BookHistoryEntryResponse, 0, len(res.GetEntries()))
+    for _, entry := range res.GetEntries() {
+        entries = append(entries, newBookHistoryEntryResponse(entry))
+    }
+    return c.JSON(http.StatusOK, entries)
+}
+
+// @Summary Place a hold on a book
+// @Description Joins the FIFO hold queue for a book that is currently not available. When the book is returned it is kept on the hold shelf for the first patron in the queue until the pickup deadline.
+// @Tags Holds
+// @Accept json
+// @Produce json
+// @Param Authorization header string true "Bearer token"
+// @Param body body PlaceHoldRequest true "Book ID to hold"
+// @Success 200 {object} HoldResponse
+// @Failure 400 {object} map[string]string
+// @Failure 401 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Failure 409 {object} map[string]string
+// @Failure 422 {object} map[string]string
+// @Failure 500 {object} map[string]string
+// @Router /users/holds [post]
+func PlaceHoldHandler(c echo.Context) error {
+    token, ok := c.Get("user").(*jwt.Token)
+    if !ok || token == nil || !token.Valid {
+        return c.JSON(http.StatusUnauthorized, map[string]string{"message": "Invalid or missing token"})
+    }
+
+    var request PlaceHoldRequest
+    if err := c.Bind(&request); err != nil {
+        return c.JSON(http.StatusBadRequest, map[string]string{"message": "Invalid request format"})
+    }
+    if err := c.Validate(&request); err != nil {
+        return c.JSON(http.StatusBadRequest, map[string]string{"message": "Validation failed", "error": err.Error()})
+    }
+
+    client, ctx, closeConn, err := dialLibrary(token)
+    if err != nil {
+        return c.JSON(http.StatusInternalServerError, map[string]string{"message": "Failed to connect to gRPC server"})
+    }
+    defer closeConn()
+
+    res, err := client.PlaceHold(ctx, &pb.PlaceHoldRequest{BookId: request.BookID})
+    if err != nil {
+        return grpcErrorJSON(c, "Failed to place hold", err)
+    }
+
+    return c.JSON(http.StatusOK, newHoldResponse(res.GetHold()))
+}
+
+// @Summary Cancel a hold
+// @Description Cancels one of the caller's active holds, a hold that is ready for pickup passes to the next patron
+// @Tags Holds
+// @Produce json
+// @Param Authorization header string true "Bearer token"
+// @Param id path string true "Hold ID"
+// @Success 200 {object} map[string]string
+// @Failure 400 {object} map[string]string
+// @Failure 401 {object} map[string]string
+// @Failure 403 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Failure 500 {object} map[string]string
+// @Router /users/holds/{id} [delete]
+func CancelHoldHandler(c echo.Context) error {
+    token, ok := c.Get("user").(*jwt.Token)
+    if !ok || token == nil || !token.Valid {
+        return c.JSON(http.StatusUnauthorized, map[string]string{"message": "Invalid or missing token"})
+    }
+
+    client, ctx, closeConn, err := dialLibrary(token)
+    if err != nil {
+        return c.JSON(http.StatusInternalServerError, map[string]string{"message": "Failed to connect to gRPC server"})
+    }
+    defer closeConn()
+
+    res, err := client.CancelHold(ctx, &pb.CancelHoldRequest{HoldId: c.Param("id")})
+    if err != nil {
+        return grpcErrorJSON(c, "Failed to cancel hold", err)
+    }
+
+    return c.JSON(http.StatusOK, map[string]string{"message": res.GetMessage()})
+}
+
+// @Summary List my holds
+// @Description Lists the caller's active holds with their position in the queue
+// @Tags Holds
+// @Produce json
+// @Param Authorization header string true "Bearer token"
+// @Success 200 {array} HoldResponse
+// @Failure 401 {object} map[string]string
+// @Failure 500 {object} map[string]string
+// @Router /users/holds [get]
+func ListHoldsHandler(c echo.Context) error {
+    token, ok := c.Get("user").(*jwt.Token)
+    if !ok || token == nil || !token.Valid {
+        return c.JSON(http.StatusUnauthorized, map[string]string{"message": "Invalid or missing token"})
+    }
+
+    client, ctx, closeConn, err := dialLibrary(token)
+    if err != nil {
+        return c.JSON(http.StatusInternalServerError, map[string]string{"message": "Failed to connect to gRPC server"})
+    }
+    defer closeConn()
+
+    res, err := client.ListHolds(ctx, &pb.ListHoldsRequest{})
+    if err != nil {
+        return grpcErrorJSON(c, "Failed to list holds", err)
+    }
+
+    holds := make([]HoldResponse, 0, len(res.GetHolds()))
+    for _, hold := range res.GetHolds() {
+        holds = append(holds, newHoldResponse(hold))
+    }
+    return c.JSON(http.StatusOK, holds)
+}
+
+// @Summary Get fine balance
+// @Description Returns the caller's unpaid fine balance and ledger, admins may pass user_id to look up another user
+// @Tags Fines
+// @Produce json
+// @Param Authorization header string true "Bearer token"
+// @Param user_id query string false "User ID (admin only)"
+// @Success 200 {object} FineBalanceResponse
+// @Failure 401 {object} map[string]string
+// @Failure 403 {object} map[string]string
+// @Failure 500 {object} map[string]string
+// @Router /users/fines [get]
+func GetFineBalanceHandler(c echo.Context) error {
+    token, ok := c.Get("user").(*jwt.Token)
+    if !ok || token == nil || !token.Valid {
+        return c.JSON(http.StatusUnauthorized, map[string]string{"message": "Invalid or missing token"})
+    }
+
+    client, ctx, closeConn, err := dialLibrary(token)
+    if err != nil {
+        return c.JSON(http.StatusInternalServerError, map[string]string{"message": "Failed to connect to gRPC server"})
+    }
+    defer closeConn()
+
+    res, err := client.GetFineBalance(ctx, &pb.GetFineBalanceRequest{UserId: c.QueryParam("user_id")})
+    if err != nil {
+        return grpcErrorJSON(c, "Failed to fetch fine balance", err)
+    }
+
+    entries := make([]FineEntryResponse, 0, len(res.GetEntries()))
+    for _, entry := range res.GetEntries() {
+        entries = append(entries, newFineEntryResponse(entry))
+    }
+    return c.JSON(http.StatusOK, FineBalanceResponse{
+        UserID:       res.GetUserId(),
+        BalanceCents: res.GetBalanceCents(),
+        Entries:      entries,
+    })
+}
+
+// @Summary Record a fine payment or waiver
+// @Description Records a payment or waiver against a user's fine balance (admin only)
+// @Tags Fines
+// @Accept json
+// @Produce json
+// @Param Authorization header string true "Bearer token"
+// @Param body body FinePaymentRequest true "Payment or waiver"
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} map[string]string
+// @Failure 401 {object} map[string]string
+// @Failure 403 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Failure 422 {object} map[string]string
+// @Failure 500 {object} map[string]string
+// @Router /users/fines/payments [post]
+func RecordFinePaymentHandler(c echo.Context) error {
+    if !cust_middleware.IsAdmin(c) {
+        return c.JSON(http.StatusForbidden, map[string]string{"message": "Permission denied admin use only!"})
+    }
+
+    token, ok := c.Get("user").(*jwt.Token)
+    if !ok || token == nil || !token.Valid {
+        return c.JSON(http.StatusUnauthorized, map[string]string{"message": "Invalid or missing token"})
+    }
+
+    var request FinePaymentRequest
+    if err := c.Bind(&request); err != nil {
+        return c.JSON(http.StatusBadRequest, map[string]string{"message": "Invalid request format"})
+    }
+    if err := c.Validate(&request); err != nil {
+        return c.JSON(http.StatusBadRequest, map[string]string{"message": "Validation failed", "error": err.Error()})
+    }
+
+    client, ctx, closeConn, err := dialLibrary(token)
+    if err != nil {
+        return c.JSON(http.StatusInternalServerError, map[string]string{"message": "Failed to connect to gRPC server"})
+    }
+    defer closeConn()
+
+    res, err := client.RecordFinePayment(ctx, &pb.RecordFinePaymentRequest{
+        UserId:      request.UserID,
+        AmountCents: request.AmountCents,
+        EntryType:   request.EntryType,
+        Note:        request.Note,
+    })
+    if err != nil {
+        return grpcErrorJSON(c, "Failed to record payment", err)
+    }
+
+    return c.JSON(http.StatusOK, map[string]interface{}{
+        "message":       res.GetMessage(),
+        "entry":         newFineEntryResponse(res.GetEntry()),
+        "balance_cents": res.GetBalanceCents(),
+    })
+}
+
+// maxImportBytes caps the size of an uploaded import file
+const maxImportBytes = 10 << 20
+
+// ImportBooksResponse is the JSON form of an import result, errors are sorted by row
+type ImportBooksResponse struct {
+    Message      string             `json:"message"`
+    DryRun       bool               `json:"dry_run"`
+    Committed    bool               `json:"committed"`
+    TotalRows    int32              `json:"total_rows"`
+    ImportedRows int32              `json:"imported_rows"`
+    FailedRows   int32              `json:"failed_rows"`
+    Errors       []ImportRowErrorResponse `json:"errors"`
+}
+
+// ImportRowErrorResponse is a problem with a single row of an import
+type ImportRowErrorResponse struct {
+    Row     int    `json:"row"`
+    Field   string `json:"field,omitempty"`
+    Message string `json:"message"`
+}
+
+// importFile opens the uploaded import file, either the "file" field of a
+// multipart form or the raw request body, and works out its format from the
+// format query parameter, the file name or the content type
+func importFile(c echo.Context) (io.ReadCloser, catalog.Format, error) {
+    formatHint := c.QueryParam("format")
+    body := http.MaxBytesReader(c.Response(), c.Request().Body, maxImportBytes)
+    c.Request().Body = body
+
+    if strings.HasPrefix(c.Request().Header.Get(echo.HeaderContentType), echo.MIMEMultipartForm) {
+        header, err := c.FormFile("file")
+        if err != nil {
+            return nil, "", &catalog.OptionError{Field: "file", Reason: "is required"}
+        }
+        if formatHint == "" {
+            formatHint = strings.TrimPrefix(strings.ToLower(filepath.Ext(header.Filename)), ".")
+        }
+        if formatHint == "" {
+            formatHint = header.Header.Get(echo.HeaderContentType)
+        }
+        format, err := catalog.ParseFormat(formatHint)
+        if err != nil {
+            return nil, "", err
+        }
+        file, err := header.Open()
+        if err != nil {
+            return nil, "", err
+        }
+        return file, format, nil
+    }
+
+    if formatHint == "" {
+        formatHint = c.Request().Header.Get(echo.HeaderContentType)
+    }
+    format, err := catalog.ParseFormat(formatHint)
+    if err != nil {
+        return nil, "", err
+    }
+    return body, format, nil
+}
+
+// @Summary Import books
+// @Description Adds the books of a CSV or JSON Lines file to the catalog (admin only). CSV files start with a header row, the title, author and published_date (YYYY-MM-DD) columns are required and category, isbn and copies are optional. In atomic mode (the default) nothing is imported unless every row is valid, in partial mode the valid rows are imported. A dry run reports the problems without importing anything. Send the file as the request body or as the "file" field of a multipart form.
+// @Tags Books
+// @Accept text/csv
+// @Accept application/x-ndjson
+// @Accept multipart/form-data
+// @Produce json
+// @Param Authorization header string true "Bearer token"
+// @Param format query string false "csv or jsonl, taken from the file name or content type when omitted"
+// @Param mode query string false "atomic (default) or partial"
+// @Param dry_run query bool false "Validate without importing"
+// @Success 200 {object} ImportBooksResponse
+// @Failure 400 {object} map[string]string
+// @Failure 401 {object} map[string]string
+// @Failure 403 {object} map[string]string
+// @Failure 413 {object} map[string]string
+// @Failure 422 {object} ImportBooksResponse
+// @Failure 500 {object} map[string]string
+// @Router /users/books/import [post]
+func ImportBooksHandler(c echo.Context) error {
+    if !cust_middleware.IsAdmin(c) {
+        return c.JSON(http.StatusForbidden, map[string]string{"message": "Permission denied admin use only!"})
+    }
+
+    token, ok := c.Get("user").(*jwt.Token)
+    if !ok || token == nil || !token.Valid {
+        return c.JSON(http.StatusUnauthorized, map[string]string{"message": "Invalid or missing token"})
+    }
+
+    options := &pb.ImportOptions{}
+    switch c.QueryParam("mode") {
+    case "", "atomic":
+        options.Mode = pb.ImportMode_IMPORT_MODE_ATOMIC
+    case "partial":
+        options.Mode = pb.ImportMode_IMPORT_MODE_PARTIAL
+    default:
+        return c.JSON(http.StatusBadRequest, map[string]string{"message": "Validation failed", "error": "mode must be atomic or partial"})
+    }
+    if v := c.QueryParam("dry_run"); v != "" {
+        dryRun, err := strconv.ParseBool(v)
+        if err != nil {
+            return c.JSON(http.StatusBadRequest, map[string]string{"message": "Validation failed", "error": "dry_run must be true or false"})
+        }
+        options.DryRun = dryRun
+    }
+
+    file, format, err := importFile(c)
+    if err != nil {
+        return importReadError(c, err)
+    }
+    defer file.Close()
+
+    // Read the whole file first, rows that can't be parsed are reported with
+    // the server's validation errors
+    reader, err := catalog.NewRowReader(file, format)
+    if err != nil {
+        return importReadError(c, err)
+    }
+    var (
+        rows      []*pb.ImportBookRow
+        rowErrors []catalog.RowError
+    )
+    for {
+        row, err := reader.Next()
+        if err == io.EOF {
+            break
+        }
+        var rowErr *catalog.RowError
+        if errors.As(err, &rowErr) {
+            rowErrors = append(rowErrors, *rowErr)
+            continue
+        }
+        if err != nil {
+            return importReadError(c, err)
+        }
+        rows = append(rows, &pb.ImportBookRow{
+            Row:           int32(row.Row),
+            Title:         row.Title,
+            Author:        row.Author,
+            PublishedDate: row.PublishedDate,
+            Category:      row.Category,
+            Isbn:          row.ISBN,
+            Copies:        row.Copies,
+        })
+    }
+
+    // An atomic import with unreadable rows can't succeed, still validate the
+    // rest so every problem is reported at once
+    dryRunRequested := options.DryRun
+    if len(rowErrors) > 0 && options.Mode == pb.ImportMode_IMPORT_MODE_ATOMIC {
+        options.DryRun = true
+    }
+
+    client, ctx, closeConn, err := dialLibrary(token)
+    if err != nil {
+        return c.JSON(http.StatusInternalServerError, map[string]string{"message": "Failed to connect to gRPC server"})
+    }
+    defer closeConn()
+
+    stream, err := client.ImportBooks(ctx)
+    if err != nil {
+        return grpcErrorJSON(c, "Failed to import books", err)
+    }
+    if err := stream.Send(&pb.ImportBooksRequest{Payload: &pb.ImportBooksRequest_Options{Options: options}}); err != nil && err != io.EOF {
+        return grpcErrorJSON(c, "Failed to import books", err)
+    }
+    for _, row := range rows {
+        // io.EOF means the server ended the stream, CloseAndRecv returns why
+        if err := stream.Send(&pb.ImportBooksRequest{Payload: &pb.ImportBooksRequest_Row{Row: row}}); err != nil {
+            break
+        }
+    }
+    res, err := stream.CloseAndRecv()
+    if err != nil {
+        return grpcErrorJSON(c, "Failed to import books", err)
+    }
+
+    response := newImportBooksResponse(res, rowErrors)
+    response.DryRun = dryRunRequested
+    if len(rowErrors) > 0 && !dryRunRequested && !res.GetCommitted() {
+        response.Message = "Import rolled back, no books were imported"
+    }
+    if !response.DryRun && !response.Committed && response.FailedRows > 0 {
+        return c.JSON(http.StatusUnprocessableEntity, response)
+    }
+    return c.JSON(http.StatusOK, response)
+}
+
+// importReadError answers a problem with the uploaded file itself
+func importReadError(c echo.Context, err error) error {
+    var tooLarge *http.MaxBytesError
+    if errors.As(err, &tooLarge) {
+        return c.JSON(http.StatusRequestEntityTooLarge, map[string]string{"message": "Import file is too large"})
+    }
+    var optErr *catalog.OptionError
+    if errors.As(err, &optErr) {
+        return c.JSON(http.StatusBadRequest, map[string]string{"message": "Validation failed", "error": optErr.Error()})
+    }
+    return c.JSON(http.StatusBadRequest, map[string]string{"message": "Failed to read import file"})
+}
+
+// newImportBooksResponse merges the server's import result with the rows the
+// client could not read
+func newImportBooksResponse(res *pb.ImportBooksResponse, readErrors []catalog.RowError) ImportBooksResponse {
+    response := ImportBooksResponse{
+        Message:      res.GetMessage(),
+        Committed:    res.GetCommitted(),
+        TotalRows:    res.GetTotalRows() + int32(len(readErrors)),
+        ImportedRows: res.GetImportedRows(),
+        FailedRows:   res.GetFailedRows() + int32(len(readErrors)),
+        Errors:       []ImportRowErrorResponse{},
+    }
+    for _, e := range readErrors {
+        response.Errors = append(response.Errors, ImportRowErrorResponse(e))
+    }
+    for _, e := range res.GetErrors() {
+        response.Errors = append(response.Errors, ImportRowErrorResponse{Row: int(e.GetRow()), Field: e.GetField(), Message: e.GetMessage()})
+    }
+    sort.SliceStable(response.Errors, func(i, j int) bool { return response.Errors[i].Row < response.Errors[j].Row })
+    return response
+}
+
+// exportRecord converts a gRPC book to a row of an export file
+func exportRecord(book *pb.Book) catalog.ExportRecord {
+    return catalog.ExportRecord{
+        ID:              book.GetId(),
+        Title:           book.GetTitle(),
+        Author:          book.GetAuthor(),
+        PublishedDate:   book.GetPublishedDate().AsTime(),
+        Category:        book.GetCategory(),
+        ISBN:            book.GetIsbn_13(),
+        Copies:          int(book.GetTotalCopies()),
+        AvailableCopies: int(book.GetAvailableCopies()),
+    }
+}
+
+// exportFlushEvery is how many books are written between flushes of an export
+const exportFlushEvery = 100
+
+// @Summary Export books
+// @Description Streams the whole catalog as CSV or JSON Lines (admin only). It has the columns of the import plus id and available_copies, which the import ignores. Importing an export adds its books as new books, the ones whose ISBN is still in the catalog are rejected.
+// @Tags Books
+// @Produce text/csv
+// @Produce application/x-ndjson
+// @Param Authorization header string true "Bearer token"
+// @Param format query string false "csv (default) or jsonl"
+// @Success 200 {file} file
+// @Failure 400 {object} map[string]string
+// @Failure 401 {object} map[string]string
+// @Failure 403 {object} map[string]string
+// @Failure 500 {object} map[string]string
+// @Router /users/books/export [get]
+func ExportBooksHandler(c echo.Context) error {
+    if !cust_middleware.IsAdmin(c) {
+        return c.JSON(http.StatusForbidden, map[string]string{"message": "Permission denied admin use only!"})
+    }
+
+    token, ok := c.Get("user").(*jwt.Token)
+    if !ok || token == nil || !token.Valid {
+        return c.JSON(http.StatusUnauthorized, map[string]string{"message": "Invalid or missing token"})
+    }
+
+    format := catalog.FormatCSV
+    if v := c.QueryParam("format"); v != "" {
+        parsed, err := catalog.ParseFormat(v)
+        if err != nil {
+            return c.JSON(http.StatusBadRequest, map[string]string{"message": "Validation failed", "error": err.Error()})
+        }
+        format = parsed
+    }
+
+    client, ctx, closeConn, err := dialLibrary(token)
+    if err != nil {
+        return c.JSON(http.StatusInternalServerError, map[string]string{"message": "Failed to connect to gRPC server"})
+    }
+    defer closeConn()
+
+    stream, err := client.ExportBooks(ctx, &pb.ExportBooksRequest{})
+    if err != nil {
+        return grpcErrorJSON(c, "Failed to export books", err)
+    }
+    // The first receive surfaces a refused export while an error status can still be sent
+    book, err := stream.Recv()
+    if err != nil && err != io.EOF {
+        return grpcErrorJSON(c, "Failed to export books", err)
+    }
+
+    contentType, extension := "text/csv", "csv"
+    if format == catalog.FormatJSONL {
+        contentType, extension = "application/x-ndjson", "jsonl"
+    }
+    c.Response().Header().Set(echo.HeaderContentType, contentType)
+    c.Response().Header().Set(echo.HeaderContentDisposition, `attachment; filename="catalog.`+extension+`"`)
+    c.Response().WriteHeader(http.StatusOK)
+
+    writer, _ := catalog.NewExportWriter(c.Response(), format)
+    for written := 0; err == nil; written++ {
+        if err := writer.Write(exportRecord(book)); err != nil {
+            return err
+        }
+        if written%exportFlushEvery == exportFlushEvery-1 {
+            if err := writer.Flush(); err != nil {
+                return err
+            }
+            c.Response().Flush()
+        }
+        book, err = stream.Recv()
+    }
+    if err != io.EOF {
+        // The status is already sent, the truncated file is all that can be reported
+        c.Logger().Errorf("export stopped early: %v", err)
+    }
+    return writer.Flush()
+}
+
+// CategoryRequest represents the request body for creating or updating a
+// category, an empty parent_id makes it a top level category
+type CategoryRequest struct {
+    Name     string `json:"name" validate:"required"`
+    ParentID string `json:"parent_id"`
+}
+
+// CategoryResponse is the JSON form of a category returned by the gRPC server
+type CategoryResponse struct {
+    ID        string    `json:"id"`
+    Name      string    `json:"name"`
+    ParentID  string    `json:"parent_id,omitempty"`
+    Path      []string  `json:"path"`       // names from the top level category down to this one
+    BookCount int32     `json:"book_count"` // books filed directly under the category
+    CreatedAt time.Time `json:"created_at"`
+    UpdatedAt time.Time `json:"updated_at"`
+}
+
+// newCategoryResponse converts a gRPC category to its JSON form
+func newCategoryResponse(category *pb.Category) CategoryResponse {
+    return CategoryResponse{
+        ID:        category.GetId(),
+        Name:      category.GetName(),
+        ParentID:  category.GetParentId(),
+        Path:      category.GetPath(),
+        BookCount: category.GetBookCount(),
+        CreatedAt: category.GetCreatedAt().AsTime(),
+        UpdatedAt: category.GetUpdatedAt().AsTime(),
+    }
+}
+
+// BookTagsRequest represents the request body for replacing the tags of a book
+type BookTagsRequest struct {
+    Tags []string `json:"tags"`
+}
+
+// TagResponse is the JSON form of a tag with the number of books carrying it
+type TagResponse struct {
+    Name      string `json:"name"`
+    BookCount int32  `json:"book_count"`
+}
+
+// @Summary List categories
+// @Description Returns the category tree sorted by path, parents come before their subcategories
+// @Tags Categories
+// @Produce json
+// @Param Authorization header string true "Bearer token"
+// @Success 200 {array} CategoryResponse
+// @Failure 401 {object} map[string]string
+// @Failure 500 {object} map[string]string
+// @Router /users/categories [get]
+func ListCategoriesHandler(c echo.Context) error {
+    token, ok := c.Get("user").(*jwt.Token)
+    if !ok || token == nil || !token.Valid {
+        return c.JSON(http.StatusUnauthorized, map[string]string{"message": "Invalid or missing token"})
+    }
+
+    client, ctx, closeConn, err := dialLibrary(token)
+    if err != nil {
+        return c.JSON(http.StatusInternalServerError, map[string]string{"message": "Failed to connect to gRPC server"})
+    }
+    defer closeConn()
+
+    res, err := client.ListCategories(ctx, &pb.ListCategoriesRequest{})
+    if err != nil {
+        return grpcErrorJSON(c, "Failed to fetch categories", err)
+    }
+
+    categories := make([]CategoryResponse, 0, len(res.GetCategories()))
+    for _, category := range res.GetCategories() {
+        categories = append(categories, newCategoryResponse(category))
+    }
+    return c.JSON(http.StatusOK, categories)
+}
+
+// @Summary Create a category
+// @Description Adds a category under parent_id, or at the top level when it is empty (admin only). Names are unique regardless of case.
+// @Tags Categories
+// @Accept json
+// @Produce json
+// @Param Authorization header string true "Bearer token"
+// @Param body body CategoryRequest true "Category name and parent"
+// @Success 201 {object} map[string]interface{}
+// @Failure 400 {object} map[string]string
+// @Failure 401 {object} map[string]string
+// @Failure 403 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Failure 409 {object} map[string]string
+// @Failure 500 {object} map[string]string
+// @Router /users/categories [post]
+func CreateCategoryHandler(c echo.Context) error {
+    if !cust_middleware.IsAdmin(c) {
+        return c.JSON(http.StatusForbidden, map[string]string{"message": "Permission denied admin use only!"})
+    }
+
+    token, ok := c.Get("user").(*jwt.Token)
+    if !ok || token == nil || !token.Valid {
+        return c.JSON(http.StatusUnauthorized, map[string]string{"message": "Invalid or missing token"})
+    }
+
+    var request CategoryRequest
+    if err := c.Bind(&request); err != nil {
+        return c.JSON(http.StatusBadRequest, map[string]string{"message": "Invalid request format"})
+    }
+    if err := c.Validate(&request); err != nil {
+        return c.JSON(http.StatusBadRequest, map[string]string{"message": "Validation failed", "error": err.Error()})
+    }
+
+    client, ctx, closeConn, err := dialLibrary(token)
+    if err != nil {
+        return c.JSON(http.StatusInternalServerError, map[string]string{"message": "Failed to connect to gRPC server"})
+    }
+    defer closeConn()
+
+    res, err := client.CreateCategory(ctx, &pb.CreateCategoryRequest{Name: request.Name, ParentId: request.ParentID})
+    if err != nil {
+        return grpcErrorJSON(c, "Failed to create category", err)
+    }
+
+    return c.JSON(http.StatusCreated, map[string]interface{}{
+        "message":  res.GetMessage(),
+        "category": newCategoryResponse(res.GetCategory()),
+    })
+}
+
+// @Summary Update a category
+// @Description Renames a category and moves it under parent_id, or to the top level when it is empty (admin only). Books and loan policies follow the rename. A category can't move under one of its subcategories.
+// @Tags Categories
+// @Accept json
+// @Produce json
+// @Param Authorization header string true "Bearer token"
+// @Param id path string true "Category ID"
+// @Param body body CategoryRequest true "New name and parent"
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} map[string]string
+// @Failure 401 {object} map[string]string
+// @Failure 403 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Failure 409 {object} map[string]string
+// @Failure 422 {object} map[string]string
+// @Failure 500 {object} map[string]string
+// @Router /users/categories/{id} [put]
+func UpdateCategoryHandler(c echo.Context) error {
+    if !cust_middleware.IsAdmin(c) {
+        return c.JSON(http.StatusForbidden, map[string]string{"message": "Permission denied admin use only!"})
+    }
+
+    token, ok := c.Get("user").(*jwt.Token)
+    if !ok || token == nil || !token.Valid {
+        return c.JSON(http.StatusUnauthorized, map[string]string{"message": "Invalid or missing token"})
+    }
+
+    var request CategoryRequest
+    if err := c.Bind(&request); err != nil {
+        return c.JSON(http.StatusBadRequest, map[string]string{"message": "Invalid request format"})
+    }
+    if err := c.Validate(&request); err != nil {
+        return c.JSON(http.StatusBadRequest, map[string]string{"message": "Validation failed", "error": err.Error()})
+    }
+
+    client, ctx, closeConn, err := dialLibrary(token)
+    if err != nil {
+        return c.JSON(http.StatusInternalServerError, map[string]string{"message": "Failed to connect to gRPC server"})
+    }
+    defer closeConn()
+
+    res, err := client.UpdateCategory(ctx, &pb.UpdateCategoryRequest{Id: c.Param("id"), Name: request.Name, ParentId: request.ParentID})
+    if err != nil {
+        return grpcErrorJSON(c, "Failed to update category", err)
+    }
+
+    return c.JSON(http.StatusOK, map[string]interface{}{
+        "message":  res.GetMessage(),
+        "category": newCategoryResponse(res.GetCategory()),
+    })
+}
+
+// @Summary Delete a category
+// @Description Deletes a category without subcategories or loan policies (admin only), its books move to the parent category
+// @Tags Categories
+// @Produce json
+// @Param Authorization header string true "Bearer token"
+// @Param id path string true "Category ID"
+// @Success 200 {object} map[string]string
+// @Failure 400 {object} map[string]string
+// @Failure 401 {object} map[string]string
+// @Failure 403 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Failure 422 {object} map[string]string
+// @Failure 500 {object} map[string]string
+// @Router /users/categories/{id} [delete]
+func DeleteCategoryHandler(c echo.Context) error {
+    if !cust_middleware.IsAdmin(c) {
+        return c.JSON(http.StatusForbidden, map[string]string{"message": "Permission denied admin use only!"})
+    }
+
+    token, ok := c.Get("user").(*jwt.Token)
+    if !ok || token == nil || !token.Valid {
+        return c.JSON(http.StatusUnauthorized, map[string]string{"message": "Invalid or missing token"})
+    }
+
+    client, ctx, closeConn, err := dialLibrary(token)
+    if err != nil {
+        return c.JSON(http.StatusInternalServerError, map[string]string{"message": "Failed to connect to gRPC server"})
+    }
+    defer closeConn()
+
+    res, err := client.DeleteCategory(ctx, &pb.DeleteCategoryRequest{Id: c.Param("id")})
+    if err != nil {
+        return grpcErrorJSON(c, "Failed to delete category", err)
+    }
+
+    return c.JSON(http.StatusOK, map[string]string{"message": res.GetMessage()})
+}
+
+// @Summary Set the tags of a book
+// @Description Replaces the tags of a book (admin only). Tags are trimmed and lowercased, duplicates are dropped and unknown tags are created.
+// @Tags Categories
+// @Accept json
+// @Produce json
+// @Param Authorization header string true "Bearer token"
+// @Param id path string true "Book ID"
+// @Param body body BookTagsRequest true "The new tags"
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} map[string]string
+// @Failure 401 {object} map[string]string
+// @Failure 403 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Failure 500 {object} map[string]string
+// @Router /users/books/{id}/tags [put]
+func SetBookTagsHandler(c echo.Context) error {
+    if !cust_middleware.IsAdmin(c) {
+        return c.JSON(http.StatusForbidden, map[string]string{"message": "Permission denied admin use only!"})
+    }
+
+    token, ok := c.Get("user").(*jwt.Token)
+    if !ok || token == nil || !token.Valid {
+        return c.JSON(http.StatusUnauthorized, map[string]string{"message": "Invalid or missing token"})
+    }
+
+    var request BookTagsRequest
+    if err := c.Bind(&request); err != nil {
+        return c.JSON(http.StatusBadRequest, map[string]string{"message": "Invalid request format"})
+    }
+
+    client, ctx, closeConn, err := dialLibrary(token)
+    if err != nil {
+        return c.JSON(http.StatusInternalServerError, map[string]string{"message": "Failed to connect to gRPC server"})
+    }
+    defer closeConn()
+
+    res, err := client.SetBookTags(ctx, &pb.SetBookTagsRequest{BookId: c.Param("id"), Tags: request.Tags})
+    if err != nil {
+        return grpcErrorJSON(c, "Failed to set tags", err)
+    }
+
+    return c.JSON(http.StatusOK, map[string]interface{}{
+        "message": res.GetMessage(),
+        "tags":    res.GetBook().GetTags(),
+        "version": res.GetBook().GetVersion(),
+    })
+}
+
+// @Summary List tags
+// @Description Returns every tag sorted by name with the number of books carrying it
+// @Tags Categories
+// @Produce json
+// @Param Authorization header string true "Bearer token"
+// @Success 200 {array} TagResponse
+// @Failure 401 {object} map[string]string
+// @Failure 500 {object} map[string]string
+// @Router /users/tags [get]
+func ListTagsHandler(c echo.Context) error {
+    token, ok := c.Get("user").(*jwt.Token)
+    if !ok || token == nil || !token.Valid {
+        return c.JSON(http.StatusUnauthorized, map[string]string{"message": "Invalid or missing token"})
+    }
+
+    client, ctx, closeConn, err := dialLibrary(token)
+    if err != nil {
+        return c.JSON(http.StatusInternalServerError, map[string]string{"message": "Failed to connect to gRPC server"})
+    }
+    defer closeConn()
+
+    res, err := client.ListTags(ctx, &pb.ListTagsRequest{})
+    if err != nil {
+        return grpcErrorJSON(c, "Failed to fetch tags", err)
+    }
+
+    tags := make([]TagResponse, 0, len(res.GetTags()))
+    for _, tag := range res.GetTags() {
+        tags = append(tags, TagResponse{Name: tag.GetName(), BookCount: tag.GetBookCount()})
+    }
+    return c.JSON(http.StatusOK, tags)
+}
+
+// @Summary Delete a tag
+// @Description Removes a tag from every book and deletes it (admin only)
+// @Tags Categories
+// @Produce json
+// @Param Authorization header string true "Bearer token"
+// @Param name path string true "Tag name"
+// @Success 200 {object} map[string]string
+// @Failure 400 {object} map[string]string
+// @Failure 401 {object} map[string]string
+// @Failure 403 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Failure 500 {object} map[string]string
+// @Router /users/tags/{name} [delete]
+func DeleteTagHandler(c echo.Context) error {
+    if !cust_middleware.IsAdmin(c) {
+        return c.JSON(http.StatusForbidden, map[string]string{"message": "Permission denied admin use only!"})
+    }
+
+    token, ok := c.Get("user").(*jwt.Token)
+    if !ok || token == nil || !token.Valid {
+        return c.JSON(http.StatusUnauthorized, map[string]string{"message": "Invalid or missing token"})
+    }
+
+    client, ctx, closeConn, err := dialLibrary(token)
+    if err != nil {
+        return c.JSON(http.StatusInternalServerError, map[string]string{"message": "Failed to connect to gRPC server"})
+    }
+    defer closeConn()
+
+    res, err := client.DeleteTag(ctx, &pb.DeleteTagRequest{Name: c.Param("name")})
+    if err != nil {
+        return grpcErrorJSON(c, "Failed to delete tag", err)
+    }
+
+    return c.JSON(http.StatusOK, map[string]string{"message": res.GetMessage()})
+}
+
+// AuthorRequest represents the request body for adding or renaming an author
+type AuthorRequest struct {
+    Name string `json:"name" validate:"required"`
+}
+
+// AuthorResponse is the JSON form of an author returned by the gRPC server
+type AuthorResponse struct {
+    ID        string    `json:"id"`
+    Name      string    `json:"name"`
+    BookCount int32     `json:"book_count"` // books crediting the author in any role
+    CreatedAt time.Time `json:"created_at"`
+    UpdatedAt time.Time `json:"updated_at"`
+}
+
+// newAuthorResponse converts a gRPC author to its JSON form
+func newAuthorResponse(author *pb.Author) AuthorResponse {
+    return AuthorResponse{
+        ID:        author.GetId(),
+        Name:      author.GetName(),
+        BookCount: author.GetBookCount(),
+        CreatedAt: author.GetCreatedAt().AsTime(),
+        UpdatedAt: author.GetUpdatedAt().AsTime(),
+    }
+}
+
+// BookCreditRequest credits an author on a book, role is author (default),
+// editor or translator
+type BookCreditRequest struct {
+    AuthorID string `json:"author_id"`
+    Role     string `json:"role"`
+}
+
+// BookAuthorsRequest represents the request body for replacing the credits of
+// a book, in credit order
+type BookAuthorsRequest struct {
+    Credits []BookCreditRequest `json:"credits"`
+}
+
+// MergeAuthorsRequest represents the request body for merging duplicate
+// authors into the author of the path
+type MergeAuthorsRequest struct {
+    SourceIDs []string `json:"source_ids"`
+}
+
+// @Summary List authors
+// @Description Returns authors sorted by name with the number of books crediting them. Authors merged into another one are left out.
+// @Tags Authors
+// @Produce json
+// @Param Authorization header string true "Bearer token"
+// @Param q query string false "Case-insensitive substring of the name"
+// @Param page_size query int false "Authors to return, defaults to 20, at most 100"
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} map[string]string
+// @Failure 401 {object} map[string]string
+// @Failure 500 {object} map[string]string
+// @Router /users/authors [get]
+func ListAuthorsHandler(c echo.Context) error {
+    token, ok := c.Get("user").(*jwt.Token)
+    if !ok || token == nil || !token.Valid {
+        return c.JSON(http.StatusUnauthorized, map[string]string{"message": "Invalid or missing token"})
+    }
+
+    var pageSize int
+    if v := c.QueryParam("page_size"); v != "" {
+        size, err := strconv.Atoi(v)
+        if err != nil {
+            return c.JSON(http.StatusBadRequest, map[string]string{"message": "Invalid query", "error": "page_size must be a number"})
+        }
+        pageSize = size
+    }
+
+    client, ctx, closeConn, err := dialLibrary(token)
+    if err != nil {
+        return c.JSON(http.StatusInternalServerError, map[string]string{"message": "Failed to connect to gRPC server"})
+    }
+    defer closeConn()
+
+    res, err := client.ListAuthors(ctx, &pb.ListAuthorsRequest{Query: c.QueryParam("q"), PageSize: int32(pageSize)})
+    if err != nil {
+        return grpcErrorJSON(c, "Failed to fetch authors", err)
+    }
+
+    authors := make([]AuthorResponse, 0, len(res.GetAuthors()))
+    for _, author := range res.GetAuthors() {
+        authors = append(authors, newAuthorResponse(author))
+    }
+    return c.JSON(http.StatusOK, map[string]interface{}{
+        "authors":     authors,
+        "total_count": res.GetTotalCount(),
+    })
+}
+
+// @Summary Get an author
+// @Description Returns an author, the id of an author merged into another one returns that author
+// @Tags Authors
+// @Produce json
+// @Param Authorization header string true "Bearer token"
+// @Param id path string true "Author ID"
+// @Success 200 {object} AuthorResponse
+// @Failure 400 {object} map[string]string
+// @Failure 401 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Failure 500 {object} map[string]string
+// @Router /users/authors/{id} [get]
+func GetAuthorHandler(c echo.Context) error {
+    token, ok := c.Get("user").(*jwt.Token)
+    if !ok || token == nil || !token.Valid {
+        return c.JSON(http.StatusUnauthorized, map[string]string{"message": "Invalid or missing token"})
+    }
+
+    client, ctx, closeConn, err := dialLibrary(token)
+    if err != nil {
+        return c.JSON(http.StatusInternalServerError, map[string]string{"message": "Failed to connect to gRPC server"})
+    }
+    defer closeConn()
+
+    res, err := client.GetAuthor(ctx, &pb.GetAuthorRequest{Id: c.Param("id")})
+    if err != nil {
+        return grpcErrorJSON(c, "Failed to fetch author", err)
+    }
+
+    return c.JSON(http.StatusOK, newAuthorResponse(res.GetAuthor()))
 }
 
-// @Summary Borrow a book
-// @Description Borrow a book using gRPC
-// @Tags Books
+// @Summary Add an author
+// @Description Adds an author (admin only). Names are unique regardless of case.
+// @Tags Authors
 // @Accept json
 // @Produce json
 // @Param Authorization header string true "Bearer token"
-// @Param body body BorrowBookRequest true "Book ID to borrow"
-// @Success 200 {object} map[string]string
+// @Param body body AuthorRequest true "Author name"
+// @Success 201 {object} map[string]interface{}
+// @Failure 400 {object} map[string]string
 // @Failure 401 {object} map[string]string
+// @Failure 403 {object} map[string]string
+// @Failure 409 {object} map[string]string
 // @Failure 500 {object} map[string]string
-// @Router /users/borrow-book [post]
-func BorrowBookHandler(c echo.Context) error {
-    // Retrieve the token from the context
+// @Router /users/authors [post]
+func CreateAuthorHandler(c echo.Context) error {
+    if !cust_middleware.IsAdmin(c) {
+        return c.JSON(http.StatusForbidden, map[string]string{"message": "Permission denied admin use only!"})
+    }
+
     token, ok := c.Get("user").(*jwt.Token)
-    if !ok || token == nil {
+    if !ok || token == nil || !token.Valid {
         return c.JSON(http.StatusUnauthorized, map[string]string{"message": "Invalid or missing token"})
     }
 
-    // Extract claims from the token
-    claims, ok := token.Claims.(jwt.MapClaims)
-    if !ok || !token.Valid {
-        return c.JSON(http.StatusUnauthorized, map[string]string{"message": "Invalid token"})
+    var request AuthorRequest
+    if err := c.Bind(&request); err != nil {
+        return c.JSON(http.StatusBadRequest, map[string]string{"message": "Invalid request format"})
+    }
+    if err := c.Validate(&request); err != nil {
+        return c.JSON(http.StatusBadRequest, map[string]string{"message": "Validation failed", "error": err.Error()})
+    }
+
+    client, ctx, closeConn, err := dialLibrary(token)
+    if err != nil {
+        return c.JSON(http.StatusInternalServerError, map[string]string{"message": "Failed to connect to gRPC server"})
+    }
+    defer closeConn()
+
+    res, err := client.CreateAuthor(ctx, &pb.CreateAuthorRequest{Name: request.Name})
+    if err != nil {
+        return grpcErrorJSON(c, "Failed to create author", err)
     }
 
-    // Extract user_id from claims
-    userID, ok := claims["user_id"].(string)
-    if !ok {
-        return c.JSON(http.StatusUnauthorized, map[string]string{"message": "Invalid user ID"})
+    return c.JSON(http.StatusCreated, map[string]interface{}{
+        "message": res.GetMessage(),
+        "author":  newAuthorResponse(res.GetAuthor()),
+    })
+}
+
+// @Summary Rename an author
+// @Description Renames an author (admin only), the bylines of their books follow. Renaming to the name of another author is a conflict, merge the two instead.
+// @Tags Authors
+// @Accept json
+// @Produce json
+// @Param Authorization header string true "Bearer token"
+// @Param id path string true "Author ID"
+// @Param body body AuthorRequest true "New name"
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} map[string]string
+// @Failure 401 {object} map[string]string
+// @Failure 403 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Failure 409 {object} map[string]string
+// @Failure 500 {object} map[string]string
+// @Router /users/authors/{id} [put]
+func UpdateAuthorHandler(c echo.Context) error {
+    if !cust_middleware.IsAdmin(c) {
+        return c.JSON(http.StatusForbidden, map[string]string{"message": "Permission denied admin use only!"})
     }
 
-    // Bind the incoming book_id from the request body
-    var request struct {
-        BookID string `json:"book_id" validate:"required"`
+    token, ok := c.Get("user").(*jwt.Token)
+    if !ok || token == nil || !token.Valid {
+        return c.JSON(http.StatusUnauthorized, map[string]string{"message": "Invalid or missing token"})
     }
+
+    var request AuthorRequest
     if err := c.Bind(&request); err != nil {
         return c.JSON(http.StatusBadRequest, map[string]string{"message": "Invalid request format"})
     }
+    if err := c.Validate(&request); err != nil {
+        return c.JSON(http.StatusBadRequest, map[string]string{"message": "Validation failed", "error": err.Error()})
+    }
 
-    // Add token to metadata for gRPC request
-    md := metadata.Pairs("authorization", "Bearer "+token.Raw)
-    ctx := metadata.NewOutgoingContext(context.Background(), md)
-
-    // Connect to the gRPC server
-    conn, err := grpc.Dial("localhost:50051", grpc.WithInsecure())
+    client, ctx, closeConn, err := dialLibrary(token)
     if err != nil {
         return c.JSON(http.StatusInternalServerError, map[string]string{"message": "Failed to connect to gRPC server"})
     }
-    defer conn.Close()
+    defer closeConn()
 
-    // Create a gRPC client
-    client := pb.NewLibraryServiceClient(conn)
+    res, err := client.UpdateAuthor(ctx, &pb.UpdateAuthorRequest{Id: c.Param("id"), Name: request.Name})
+    if err != nil {
+        return grpcErrorJSON(c, "Failed to update author", err)
+    }
 
-    // Call BorrowBook on the gRPC server
-    res, err := client.BorrowBook(ctx, &pb.BorrowBookRequest{
-        BookId: request.BookID,
-        UserId: userID,
+    return c.JSON(http.StatusOK, map[string]interface{}{
+        "message": res.GetMessage(),
+        "author":  newAuthorResponse(res.GetAuthor()),
     })
+}
+
+// @Summary Set the authors of a book
+// @Description Replaces the authors, editors and translators credited on a book (admin only). At least one credit must have the author role, the byline of the book lists those in order.
+// @Tags Authors
+// @Accept json
+// @Produce json
+// @Param Authorization header string true "Bearer token"
+// @Param id path string true "Book ID"
+// @Param body body BookAuthorsRequest true "The new credits"
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} map[string]string
+// @Failure 401 {object} map[string]string
+// @Failure 403 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Failure 500 {object} map[string]string
+// @Router /users/books/{id}/authors [put]
+func SetBookAuthorsHandler(c echo.Context) error {
+    if !cust_middleware.IsAdmin(c) {
+        return c.JSON(http.StatusForbidden, map[string]string{"message": "Permission denied admin use only!"})
+    }
+
+    token, ok := c.Get("user").(*jwt.Token)
+    if !ok || token == nil || !token.Valid {
+        return c.JSON(http.StatusUnauthorized, map[string]string{"message": "Invalid or missing token"})
+    }
+
+    var request BookAuthorsRequest
+    if err := c.Bind(&request); err != nil {
+        return c.JSON(http.StatusBadRequest, map[string]string{"message": "Invalid request format"})
+    }
+
+    client, ctx, closeConn, err := dialLibrary(token)
     if err != nil {
-        return c.JSON(http.StatusInternalServerError, map[string]string{"message": "Failed to borrow book", "error": err.Error()})
+        return c.JSON(http.StatusInternalServerError, map[string]string{"message": "Failed to connect to gRPC server"})
     }
+    defer closeConn()
 
-    // Return the gRPC server's response
-    return c.JSON(http.StatusOK, map[string]string{
+    credits := make([]*pb.BookCredit, 0, len(request.Credits))
+    for _, credit := range request.Credits {
+        credits = append(credits, &pb.BookCredit{AuthorId: credit.AuthorID, Role: credit.Role})
+    }
+    res, err := client.SetBookAuthors(ctx, &pb.SetBookAuthorsRequest{BookId: c.Param("id"), Credits: credits})
+    if err != nil {
+        return grpcErrorJSON(c, "Failed to set authors", err)
+    }
+
+    bookCredits := make([]catalog.Credit, 0, len(res.GetBook().GetCredits()))
+    for _, credit := range res.GetBook().GetCredits() {
+        bookCredits = append(bookCredits, catalog.Credit{AuthorID: credit.GetAuthorId(), Name: credit.GetName(), Role: catalog.Role(credit.GetRole())})
+    }
+    return c.JSON(http.StatusOK, map[string]interface{}{
         "message": res.GetMessage(),
+        "author":  res.GetBook().GetAuthor(),
+        "credits": bookCredits,
+        "version": res.GetBook().GetVersion(),
     })
 }
 
-// @Summary Return a borrowed book
-// @Description Allows a user to return a borrowed book by providing the book ID and JWT token for authentication.
-// @Tags Books
+// @Summary Merge duplicate authors
+// @Description Moves the credits of the source authors to the author of the path and retires the sources (admin only). The ids and names of the sources keep resolving to the merged author.
+// @Tags Authors
 // @Accept json
 // @Produce json
 // @Param Authorization header string true "Bearer token"
-// @Param body body ReturnBookRequest true "Book ID to return"
-// @Success 200 {object} map[string]string
+// @Param id path string true "ID of the author to keep"
+// @Param body body MergeAuthorsRequest true "Authors to merge into it"
+// @Success 200 {object} map[string]interface{}
 // @Failure 400 {object} map[string]string
 // @Failure 401 {object} map[string]string
+// @Failure 403 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Failure 422 {object} map[string]string
 // @Failure 500 {object} map[string]string
-// @Router /users/return-book [post]
-func ReturnBookHandler(c echo.Context) error {
-    // Retrieve the token from the context
+// @Router /users/authors/{id}/merge [post]
+func MergeAuthorsHandler(c echo.Context) error {
+    if !cust_middleware.IsAdmin(c) {
+        return c.JSON(http.StatusForbidden, map[string]string{"message": "Permission denied admin use only!"})
+    }
+
     token, ok := c.Get("user").(*jwt.Token)
-    if !ok || token == nil {
+    if !ok || token == nil || !token.Valid {
         return c.JSON(http.StatusUnauthorized, map[string]string{"message": "Invalid or missing token"})
     }
 
-    // Extract claims from the token
-    claims, ok := token.Claims.(jwt.MapClaims)
-    if !ok || !token.Valid {
-        return c.JSON(http.StatusUnauthorized, map[string]string{"message": "Invalid token"})
+    var request MergeAuthorsRequest
+    if err := c.Bind(&request); err != nil {
+        return c.JSON(http.StatusBadRequest, map[string]string{"message": "Invalid request format"})
+    }
+
+    client, ctx, closeConn, err := dialLibrary(token)
+    if err != nil {
+        return c.JSON(http.StatusInternalServerError, map[string]string{"message": "Failed to connect to gRPC server"})
+    }
+    defer closeConn()
+
+    res, err := client.MergeAuthors(ctx, &pb.MergeAuthorsRequest{TargetId: c.Param("id"), SourceIds: request.SourceIDs})
+    if err != nil {
+        return grpcErrorJSON(c, "Failed to merge authors", err)
+    }
+
+    return c.JSON(http.StatusOK, map[string]interface{}{
+        "message": res.GetMessage(),
+        "author":  newAuthorResponse(res.GetAuthor()),
+    })
+}
+
+// ReviewRequest represents the request body for writing or editing a review
+type ReviewRequest struct {
+    Rating int32  `json:"rating" validate:"required,min=1,max=5"`
+    Text   string `json:"text"`
+}
+
+// HideReviewRequest represents the request body for hiding a review, false
+// shows it again
+type HideReviewRequest struct {
+    Hidden bool `json:"hidden"`
+}
+
+// ReviewResponse is the JSON form of a review returned by the gRPC server
+type ReviewResponse struct {
+    ID        string    `json:"id"`
+    BookID    string    `json:"book_id"`
+    UserID    string    `json:"user_id"`
+    Username  string    `json:"username"`
+    Rating    int32     `json:"rating"`
+    Text      string    `json:"text"`
+    Hidden    bool      `json:"hidden,omitempty"` // hidden reviews are only listed for admins
+    CreatedAt time.Time `json:"created_at"`
+    UpdatedAt time.Time `json:"updated_at"`
+}
+
+// newReviewResponse converts a gRPC review to its JSON form
+func newReviewResponse(review *pb.Review) ReviewResponse {
+    return ReviewResponse{
+        ID:        review.GetId(),
+        BookID:    review.GetBookId(),
+        UserID:    review.GetUserId(),
+        Username:  review.GetUsername(),
+        Rating:    review.GetRating(),
+        Text:      review.GetText(),
+        Hidden:    review.GetHidden(),
+        CreatedAt: review.GetCreatedAt().AsTime(),
+        UpdatedAt: review.GetUpdatedAt().AsTime(),
+    }
+}
+
+// ReviewListResponse is a page of the reviews of a book with its rating
+type ReviewListResponse struct {
+    Reviews       []ReviewResponse `json:"reviews"`
+    NextPageToken string           `json:"next_page_token,omitempty"`
+    AverageRating float64          `json:"average_rating"` // over the reviews that aren't hidden
+    ReviewCount   int32            `json:"review_count"`
+}
+
+// @Summary List the reviews of a book
+// @Description Returns a page of the reviews of a book, newest first, with its average rating. Pass next_page_token back as page_token for the following page. Admins may include the hidden reviews.
+// @Tags Reviews
+// @Produce json
+// @Param Authorization header string true "Bearer token"
+// @Param id path string true "Book ID"
+// @Param page_size query int false "Reviews per page, defaults to 20, at most 100"
+// @Param page_token query string false "next_page_token of the previous page"
+// @Param include_hidden query bool false "Also list hidden reviews (admin only)"
+// @Success 200 {object} ReviewListResponse
+// @Failure 400 {object} map[string]string
+// @Failure 401 {object} map[string]string
+// @Failure 403 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Failure 500 {object} map[string]string
+// @Router /users/books/{id}/reviews [get]
+func ListReviewsHandler(c echo.Context) error {
+    token, ok := c.Get("user").(*jwt.Token)
+    if !ok || token == nil || !token.Valid {
+        return c.JSON(http.StatusUnauthorized, map[string]string{"message": "Invalid or missing token"})
+    }
+
+    request := &pb.ListReviewsRequest{BookId: c.Param("id"), PageToken: c.QueryParam("page_token")}
+    if v := c.QueryParam("page_size"); v != "" {
+        size, err := strconv.Atoi(v)
+        if err != nil {
+            return c.JSON(http.StatusBadRequest, map[string]string{"message": "Invalid query", "error": "page_size must be a number"})
+        }
+        request.PageSize = int32(size)
+    }
+    if v := c.QueryParam("include_hidden"); v != "" {
+        includeHidden, err := strconv.ParseBool(v)
+        if err != nil {
+            return c.JSON(http.StatusBadRequest, map[string]string{"message": "Invalid query", "error": "include_hidden must be true or false"})
+        }
+        request.IncludeHidden = includeHidden
+    }
+
+    client, ctx, closeConn, err := dialLibrary(token)
+    if err != nil {
+        return c.JSON(http.StatusInternalServerError, map[string]string{"message": "Failed to connect to gRPC server"})
+    }
+    defer closeConn()
+
+    res, err := client.ListReviews(ctx, request)
+    if err != nil {
+        return grpcErrorJSON(c, "Failed to fetch reviews", err)
     }
 
-    // Extract user_id from claims
-    userID, ok := claims["user_id"].(string)
-    if !ok {
-        return c.JSON(http.StatusUnauthorized, map[string]string{"message": "Invalid user ID"})
+    reviews := make([]ReviewResponse, 0, len(res.GetReviews()))
+    for _, review := range res.GetReviews() {
+        reviews = append(reviews, newReviewResponse(review))
     }
+    return c.JSON(http.StatusOK, ReviewListResponse{
+        Reviews:       reviews,
+        NextPageToken: res.GetNextPageToken(),
+        AverageRating: res.GetAverageRating(),
+        ReviewCount:   res.GetReviewCount(),
+    })
+}
 
-    // Bind the incoming book_id from the request body
-    var request struct {
-        BookID string `json:"book_id" validate:"required"`
+// @Summary Review a book
+// @Description Rates a book from 1 to 5 stars with an optional text of at most 5000 characters. Only users who borrowed the book and returned it may review it, once.
+// @Tags Reviews
+// @Accept json
+// @Produce json
+// @Param Authorization header string true "Bearer token"
+// @Param id path string true "Book ID"
+// @Param body body ReviewRequest true "Rating and text"
+// @Success 201 {object} map[string]interface{}
+// @Failure 400 {object} map[string]string
+// @Failure 401 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Failure 409 {object} map[string]string
+// @Failure 422 {object} map[string]string
+// @Failure 500 {object} map[string]string
+// @Router /users/books/{id}/reviews [post]
+func CreateReviewHandler(c echo.Context) error {
+    token, ok := c.Get("user").(*jwt.Token)
+    if !ok || token == nil || !token.Valid {
+        return c.JSON(http.StatusUnauthorized, map[string]string{"message": "Invalid or missing token"})
     }
+
+    var request ReviewRequest
     if err := c.Bind(&request); err != nil {
         return c.JSON(http.StatusBadRequest, map[string]string{"message": "Invalid request format"})
     }
+    if err := c.Validate(&request); err != nil {
+        return c.JSON(http.StatusBadRequest, map[string]string{"message": "Validation failed", "error": err.Error()})
+    }
 
-    // Add token to metadata for gRPC request
-    md := metadata.Pairs("authorization", "Bearer "+token.Raw)
-    ctx := metadata.NewOutgoingContext(context.Background(), md)
+    client, ctx, closeConn, err := dialLibrary(token)
+    if err != nil {
+        return c.JSON(http.StatusInternalServerError, map[string]string{"message": "Failed to connect to gRPC server"})
+    }
+    defer closeConn()
 
-    // Connect to the gRPC server
-    conn, err := grpc.Dial("localhost:50051", grpc.WithInsecure())
+    res, err := client.CreateReview(ctx, &pb.CreateReviewRequest{BookId: c.Param("id"), Rating: request.Rating, Text: request.Text})
+    if err != nil {
+        return grpcErrorJSON(c, "Failed to create review", err)
+    }
+
+    return c.JSON(http.StatusCreated, map[string]interface{}{
+        "message": res.GetMessage(),
+        "review":  newReviewResponse(res.GetReview()),
+    })
+}
+
+// @Summary Edit a review
+// @Description Changes the rating and text of the caller's own review. A hidden review stays hidden.
+// @Tags Reviews
+// @Accept json
+// @Produce json
+// @Param Authorization header string true "Bearer token"
+// @Param id path string true "Review ID"
+// @Param body body ReviewRequest true "New rating and text"
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} map[string]string
+// @Failure 401 {object} map[string]string
+// @Failure 403 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Failure 500 {object} map[string]string
+// @Router /users/reviews/{id} [put]
+func UpdateReviewHandler(c echo.Context) error {
+    token, ok := c.Get("user").(*jwt.Token)
+    if !ok || token == nil || !token.Valid {
+        return c.JSON(http.StatusUnauthorized, map[string]string{"message": "Invalid or missing token"})
+    }
+
+    var request ReviewRequest
+    if err := c.Bind(&request); err != nil {
+        return c.JSON(http.StatusBadRequest, map[string]string{"message": "Invalid request format"})
+    }
+    if err := c.Validate(&request); err != nil {
+        return c.JSON(http.StatusBadRequest, map[string]string{"message": "Validation failed", "error": err.Error()})
+    }
+
+    client, ctx, closeConn, err := dialLibrary(token)
     if err != nil {
         return c.JSON(http.StatusInternalServerError, map[string]string{"message": "Failed to connect to gRPC server"})
     }
-    defer conn.Close()
+    defer closeConn()
 
-    // Create a gRPC client
-    client := pb.NewLibraryServiceClient(conn)
+    res, err := client.UpdateReview(ctx, &pb.UpdateReviewRequest{Id: c.Param("id"), Rating: request.Rating, Text: request.Text})
+    if err != nil {
+        return grpcErrorJSON(c, "Failed to update review", err)
+    }
 
-    // Call ReturnBook on the gRPC server
-    res, err := client.ReturnBook(ctx, &pb.ReturnBookRequest{
-        BookId: request.BookID,
-        UserId: userID,
+    return c.JSON(http.StatusOK, map[string]interface{}{
+        "message": res.GetMessage(),
+        "review":  newReviewResponse(res.GetReview()),
     })
+}
+
+// @Summary Delete a review
+// @Description Deletes a review, by its author or an admin
+// @Tags Reviews
+// @Produce json
+// @Param Authorization header string true "Bearer token"
+// @Param id path string true "Review ID"
+// @Success 200 {object} map[string]string
+// @Failure 400 {object} map[string]string
+// @Failure 401 {object} map[string]string
+// @Failure 403 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Failure 500 {object} map[string]string
+// @Router /users/reviews/{id} [delete]
+func DeleteReviewHandler(c echo.Context) error {
+    token, ok := c.Get("user").(*jwt.Token)
+    if !ok || token == nil || !token.Valid {
+        return c.JSON(http.StatusUnauthorized, map[string]string{"message": "Invalid or missing token"})
+    }
+
+    client, ctx, closeConn, err := dialLibrary(token)
     if err != nil {
-        return c.JSON(http.StatusInternalServerError, map[string]string{"message": "Failed to return book", "error": err.Error()})
+        return c.JSON(http.StatusInternalServerError, map[string]string{"message": "Failed to connect to gRPC server"})
     }
+    defer closeConn()
 
-    // Return the gRPC server's response
-    return c.JSON(http.StatusOK, map[string]string{
+    res, err := client.DeleteReview(ctx, &pb.DeleteReviewRequest{Id: c.Param("id")})
+    if err != nil {
+        return grpcErrorJSON(c, "Failed to delete review", err)
+    }
+
+    return c.JSON(http.StatusOK, map[string]string{"message": res.GetMessage()})
+}
+
+// @Summary Hide or show a review
+// @Description Hides a review from the listings and the rating of its book, or shows it again (admin only)
+// @Tags Reviews
+// @Accept json
+// @Produce json
+// @Param Authorization header string true "Bearer token"
+// @Param id path string true "Review ID"
+// @Param body body HideReviewRequest true "Whether the review is hidden"
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} map[string]string
+// @Failure 401 {object} map[string]string
+// @Failure 403 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Failure 500 {object} map[string]string
+// @Router /users/reviews/{id}/hidden [put]
+func HideReviewHandler(c echo.Context) error {
+    if !cust_middleware.IsAdmin(c) {
+        return c.JSON(http.StatusForbidden, map[string]string{"message": "Permission denied admin use only!"})
+    }
+
+    token, ok := c.Get("user").(*jwt.Token)
+    if !ok || token == nil || !token.Valid {
+        return c.JSON(http.StatusUnauthorized, map[string]string{"message": "Invalid or missing token"})
+    }
+
+    var request HideReviewRequest
+    if err := c.Bind(&request); err != nil {
+        return c.JSON(http.StatusBadRequest, map[string]string{"message": "Invalid request format"})
+    }
+
+    client, ctx, closeConn, err := dialLibrary(token)
+    if err != nil {
+        return c.JSON(http.StatusInternalServerError, map[string]string{"message": "Failed to connect to gRPC server"})
+    }
+    defer closeConn()
+
+    res, err := client.HideReview(ctx, &pb.HideReviewRequest{Id: c.Param("id"), Hidden: request.Hidden})
+    if err != nil {
+        return grpcErrorJSON(c, "Failed to update review", err)
+    }
+
+    return c.JSON(http.StatusOK, map[string]interface{}{
         "message": res.GetMessage(),
+        "review":  newReviewResponse(res.GetReview()),
     })
 }
 
@@ -191,10 +2227,20 @@ func main(){
 	e := echo.New()
 	e.Validator = &cust_middleware.CustomValidator{Validator: validator.New()}
 
+	// storage for the uploaded book covers
+	coverStorage, err := covers.FromEnv()
+	if err != nil {
+		e.Logger.Fatal(err)
+	}
+	book_handler.CoverStorage = coverStorage
+
 	// public routes for users
 	e.POST("/users/register", user_handler.RegisterUser)	
 	e.POST("/users/login", user_handler.LoginUser)
 
+	// public route for cover images, their URLs go in img tags
+	e.GET("/covers/*", book_handler.GetCover)
+
 	// protected routes for users using JWT middleware
 	usersGroup := e.Group("/users")
 	usersGroup.Use(cust_middleware.JWTMiddleware)
@@ -202,13 +2248,52 @@ func main(){
 	// routes for admin (which has it's own authentication protection scheme)
 	usersGroup.POST("/books/create", book_handler.CreateBook)
 	usersGroup.GET("/books/get", book_handler.GetAllBooks)	
+	usersGroup.GET("/books/search", book_handler.SearchBooks)
+	usersGroup.GET("/books/isbn/:isbn", book_handler.GetBookByISBN)
 	usersGroup.GET("/books/get/:id", book_handler.GetBookByID)
 	usersGroup.PUT("/books/:id", book_handler.UpdateBook)
-	usersGroup.DELETE("/books/:id", book_handler.DeleteBook)
+	usersGroup.PATCH("/books/:id", book_handler.PatchBook)
+	usersGroup.DELETE("/books/:id", DeleteBookHandler)
+	usersGroup.GET("/books/withdrawn", book_handler.ListWithdrawnBooks)
+	usersGroup.POST("/books/:id/restore", book_handler.RestoreBook)
+	usersGroup.PUT("/books/:id/cover", book_handler.UploadBookCover)
+	usersGroup.DELETE("/books/:id/cover", book_handler.DeleteBookCover)
+	usersGroup.GET("/authors/:id/books", book_handler.GetAuthorBooks)
 
 	// gRPC route
 	usersGroup.POST("/borrow-book", BorrowBookHandler)
 	usersGroup.POST("/return-book", ReturnBookHandler)
+	usersGroup.POST("/renew-book", RenewBookHandler)
+	usersGroup.POST("/books/:id/copies", AddBookCopyHandler)
+	usersGroup.GET("/books/:id/copies", ListBookCopiesHandler)
+	usersGroup.POST("/copies/:id/lost", DeclareBookLostHandler)
+	usersGroup.PUT("/copies/:id/status", UpdateBookStatusHandler)
+	usersGroup.GET("/books/:id/history", GetBookHistoryHandler)
+	usersGroup.POST("/books/import", ImportBooksHandler)
+	usersGroup.GET("/books/export", ExportBooksHandler)
+	usersGroup.POST("/holds", PlaceHoldHandler)
+	usersGroup.GET("/holds", ListHoldsHandler)
+	usersGroup.DELETE("/holds/:id", CancelHoldHandler)
+	usersGroup.GET("/fines", GetFineBalanceHandler)
+	usersGroup.POST("/fines/payments", RecordFinePaymentHandler)
+	usersGroup.GET("/categories", ListCategoriesHandler)
+	usersGroup.POST("/categories", CreateCategoryHandler)
+	usersGroup.PUT("/categories/:id", UpdateCategoryHandler)
+	usersGroup.DELETE("/categories/:id", DeleteCategoryHandler)
+	usersGroup.PUT("/books/:id/tags", SetBookTagsHandler)
+	usersGroup.GET("/tags", ListTagsHandler)
+	usersGroup.DELETE("/tags/:name", DeleteTagHandler)
+	usersGroup.GET("/authors", ListAuthorsHandler)
+	usersGroup.POST("/authors", CreateAuthorHandler)
+	usersGroup.GET("/authors/:id", GetAuthorHandler)
+	usersGroup.PUT("/authors/:id", UpdateAuthorHandler)
+	usersGroup.POST("/authors/:id/merge", MergeAuthorsHandler)
+	usersGroup.PUT("/books/:id/authors", SetBookAuthorsHandler)
+	usersGroup.GET("/books/:id/reviews", ListReviewsHandler)
+	usersGroup.POST("/books/:id/reviews", CreateReviewHandler)
+	usersGroup.PUT("/reviews/:id", UpdateReviewHandler)
+	usersGroup.DELETE("/reviews/:id", DeleteReviewHandler)
+	usersGroup.PUT("/reviews/:id/hidden", HideReviewHandler)
 	
 	// Add this route for Swagger
 	e.GET("/swagger/*", echoSwagger.WrapHandler)
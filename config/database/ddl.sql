@@ -1,7 +1,19 @@
 -- Drop tables if they exist to avoid conflicts
+DROP TABLE IF EXISTS Reviews;
+DROP TABLE IF EXISTS BookStatusHistory;
+DROP TABLE IF EXISTS FineLedger;
+DROP TABLE IF EXISTS Holds;
+DROP TABLE IF EXISTS LoanPolicies;
 DROP TABLE IF EXISTS BorrowedBooks;
+DROP TABLE IF EXISTS BookCopies;
+DROP TABLE IF EXISTS BookTags;
+DROP TABLE IF EXISTS Tags;
+DROP TABLE IF EXISTS BookAuthors;
 DROP TABLE IF EXISTS Books;
+DROP TABLE IF EXISTS Authors;
+DROP TABLE IF EXISTS Categories;
 DROP TABLE IF EXISTS Users;
+DROP SEQUENCE IF EXISTS BookCopyBarcodes;
 
 -- Create Users table
 CREATE TABLE Users (
@@ -14,27 +26,213 @@ CREATE TABLE Users (
     jwt_token TEXT
 );
 
--- Create Books table
+-- Create the Categories table, a tree of genres. Books and loan policies
+-- refer to a category by name, renames carry over to them
+CREATE TABLE Categories (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    name VARCHAR(100) NOT NULL UNIQUE,
+    parent_id UUID REFERENCES Categories(id),  -- NULL for top level categories
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE UNIQUE INDEX categories_lower_name_idx ON Categories (LOWER(name));
+
+-- Create the Authors table, anyone credited on a book. A merged author is
+-- kept pointing at the author it was merged into so its name still resolves
+CREATE TABLE Authors (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    name VARCHAR(255) NOT NULL,
+    merged_into UUID REFERENCES Authors(id),  -- NULL unless merged into another author
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE UNIQUE INDEX authors_lower_name_idx ON Authors (LOWER(name));
+
+-- Create Books table, one row per title
 CREATE TABLE Books (
     id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
     title VARCHAR(255) NOT NULL,
     author VARCHAR(255) NOT NULL,
     published_date TIMESTAMP NOT NULL,
-    status VARCHAR(50) DEFAULT 'Available' NOT NULL,
-    user_id UUID REFERENCES Users(id) ON DELETE SET NULL,
+    category VARCHAR(100) REFERENCES Categories(name) ON UPDATE CASCADE ON DELETE SET NULL,
+    isbn_13 CHAR(13),  -- normalized by package isbn, an ISBN-10 is stored in its ISBN-13 form, unique in the catalog
+    -- NOT NULL like every column books are sorted by, page tokens carry the sort key
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    -- bumped by every update, compared against If-Match and expected_version
+    version INTEGER NOT NULL DEFAULT 1,
+    -- set when the book is withdrawn from the catalog, withdrawn books keep
+    -- their copies and loans until the retention job deletes them
+    withdrawn_at TIMESTAMP,
+    withdrawn_by UUID REFERENCES Users(id) ON DELETE SET NULL,
+    withdrawn_reason TEXT,
+    -- storage key of the cover image, the thumbnail key is derived from it
+    -- by package covers
+    cover_key VARCHAR(255),
+    -- full-text search document, title matches rank above author matches
+    search_vector TSVECTOR GENERATED ALWAYS AS (
+        setweight(to_tsvector('english', title), 'A') ||
+        setweight(to_tsvector('english', author), 'B')
+    ) STORED
+);
+
+CREATE INDEX books_search_idx ON Books USING GIN (search_vector);
+CREATE INDEX books_withdrawn_idx ON Books (withdrawn_at) WHERE withdrawn_at IS NOT NULL;
+-- Withdrawn books give up their ISBN, a new book may take it while they can
+-- still be restored
+CREATE UNIQUE INDEX books_isbn_13_idx ON Books (isbn_13) WHERE withdrawn_at IS NULL;
+CREATE INDEX books_category_idx ON Books (category);
+
+-- Create the Tags table, free-form lowercase labels created the first time
+-- a book is tagged with them
+CREATE TABLE Tags (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    name VARCHAR(50) NOT NULL UNIQUE,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE BookTags (
+    book_id UUID NOT NULL REFERENCES Books(id) ON DELETE CASCADE,
+    tag_id UUID NOT NULL REFERENCES Tags(id) ON DELETE CASCADE,
+    PRIMARY KEY (book_id, tag_id)
+);
+
+CREATE INDEX booktags_tag_idx ON BookTags (tag_id);
+
+-- Create the BookAuthors table, the credits of a book in order. books.author
+-- is the byline built from the credits with the author role
+CREATE TABLE BookAuthors (
+    book_id UUID NOT NULL REFERENCES Books(id) ON DELETE CASCADE,
+    author_id UUID NOT NULL REFERENCES Authors(id),
+    role VARCHAR(20) NOT NULL DEFAULT 'author' CHECK (role IN ('author', 'editor', 'translator')),
+    position INT NOT NULL DEFAULT 0,
+    PRIMARY KEY (book_id, author_id, role)
+);
+
+CREATE INDEX bookauthors_author_idx ON BookAuthors (author_id);
+
+-- Generates barcodes for copies added without one
+CREATE SEQUENCE BookCopyBarcodes;
+
+-- Create the BookCopies table, the physical items of a title that are lent out
+CREATE TABLE BookCopies (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    book_id UUID NOT NULL REFERENCES Books(id) ON DELETE CASCADE,
+    barcode VARCHAR(50) UNIQUE NOT NULL DEFAULT 'C' || LPAD(nextval('BookCopyBarcodes')::TEXT, 8, '0'),
+    status VARCHAR(50) DEFAULT 'Available' NOT NULL
+        CHECK (status IN ('Available', 'Borrowed', 'OnHold', 'Missing', 'Lost', 'InRepair', 'Withdrawn')),   -- keep in sync with package bookstatus
+    user_id UUID REFERENCES Users(id) ON DELETE SET NULL,  -- who has the copy out while Borrowed or Missing
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
     updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 );
 
+CREATE INDEX bookcopies_book_idx ON BookCopies (book_id, status);
+
 -- Create the BorrowedBooks table
 CREATE TABLE BorrowedBooks (
     id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
     book_id UUID NOT NULL REFERENCES Books(id) ON DELETE CASCADE,
+    copy_id UUID NOT NULL REFERENCES BookCopies(id) ON DELETE CASCADE,
     user_id UUID NOT NULL REFERENCES Users(id) ON DELETE CASCADE,
     borrowed_date TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
-    return_date TIMESTAMP
+    due_date TIMESTAMP NOT NULL,
+    return_date TIMESTAMP,   -- set when the loan is closed, by a return or by declaring the copy lost
+    missing_at TIMESTAMP,    -- set when the overdue job marked the copy Missing
+    lost_at TIMESTAMP,       -- set when an admin declared the copy Lost, closing the loan
+    renewal_count INT NOT NULL DEFAULT 0,
+    borrowed_by UUID REFERENCES Users(id) ON DELETE SET NULL, -- who recorded the loan, differs from user_id when an admin acts on behalf
+    returned_by UUID REFERENCES Users(id) ON DELETE SET NULL
 );
 
+-- Create the LoanPolicies table, the most specific match for the borrower's
+-- role and the book's category decides the loan period
+CREATE TABLE LoanPolicies (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    role VARCHAR(255) NOT NULL, -- '*' applies to every role
+    category VARCHAR(100) REFERENCES Categories(name) ON UPDATE CASCADE,  -- NULL applies to every category, a category's policy also covers its subcategories
+    loan_days INT NOT NULL CHECK (loan_days > 0),
+    max_renewals INT NOT NULL DEFAULT 2 CHECK (max_renewals >= 0),
+    fine_per_day_cents INT NOT NULL DEFAULT 25 CHECK (fine_per_day_cents >= 0),
+    max_fine_cents INT NOT NULL DEFAULT 1000 CHECK (max_fine_cents >= 0), -- cap on accrued fines per loan
+    borrowable BOOLEAN NOT NULL DEFAULT TRUE,  -- FALSE keeps the books in the library, they can't be borrowed
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE UNIQUE INDEX loanpolicies_role_category_idx ON LoanPolicies (role, COALESCE(category, ''));
+
+-- Create the Holds table, a FIFO queue per book. Waiting holds are served in
+-- created_at order, the head becomes Ready with a pickup deadline when a
+-- copy is returned, then Fulfilled, Expired or Cancelled
+CREATE TABLE Holds (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    book_id UUID NOT NULL REFERENCES Books(id) ON DELETE CASCADE,
+    user_id UUID NOT NULL REFERENCES Users(id) ON DELETE CASCADE,
+    status VARCHAR(50) DEFAULT 'Waiting' NOT NULL
+        CHECK (status IN ('Waiting', 'Ready', 'Fulfilled', 'Cancelled', 'Expired')),
+    ready_at TIMESTAMP,
+    pickup_deadline TIMESTAMP,
+    copy_id UUID REFERENCES BookCopies(id) ON DELETE SET NULL, -- the copy kept on the hold shelf once Ready
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- One active hold per user and book
+CREATE UNIQUE INDEX holds_active_user_book_idx ON Holds (book_id, user_id) WHERE status IN ('Waiting', 'Ready');
+
+-- Create the FineLedger table, a user's balance is the sum of their charges
+-- minus their payments and waivers
+CREATE TABLE FineLedger (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID NOT NULL REFERENCES Users(id) ON DELETE CASCADE,
+    borrowed_book_id UUID REFERENCES BorrowedBooks(id) ON DELETE SET NULL,
+    entry_type VARCHAR(50) NOT NULL CHECK (entry_type IN ('Accrual', 'Replacement', 'Payment', 'Waiver')),
+    amount_cents BIGINT NOT NULL CHECK (amount_cents > 0),
+    accrual_date DATE, -- set for accruals, at most one per loan per day
+    note TEXT,
+    recorded_by UUID REFERENCES Users(id) ON DELETE SET NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE UNIQUE INDEX fineledger_daily_accrual_idx ON FineLedger (borrowed_book_id, accrual_date) WHERE entry_type = 'Accrual';
+CREATE INDEX fineledger_user_idx ON FineLedger (user_id);
+
+-- Create the BookStatusHistory table, one row per status transition of a
+-- copy. from_status is NULL for the row written when a copy is added and
+-- actor_id is NULL for transitions made by scheduled jobs
+CREATE TABLE BookStatusHistory (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    book_id UUID NOT NULL REFERENCES Books(id) ON DELETE CASCADE,
+    copy_id UUID NOT NULL REFERENCES BookCopies(id) ON DELETE CASCADE,
+    from_status VARCHAR(50),
+    to_status VARCHAR(50) NOT NULL,
+    actor_id UUID REFERENCES Users(id) ON DELETE SET NULL,
+    reason TEXT,
+    changed_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX bookstatushistory_book_idx ON BookStatusHistory (book_id, changed_at);
+
+-- Create the Reviews table, one review per user and book. Hidden reviews are
+-- kept for moderation but left out of listings and ratings
+CREATE TABLE Reviews (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    book_id UUID NOT NULL REFERENCES Books(id) ON DELETE CASCADE,
+    user_id UUID NOT NULL REFERENCES Users(id) ON DELETE CASCADE,
+    rating SMALLINT NOT NULL CHECK (rating BETWEEN 1 AND 5),
+    body TEXT NOT NULL DEFAULT '',
+    hidden_at TIMESTAMP,
+    hidden_by UUID REFERENCES Users(id) ON DELETE SET NULL,
+    -- NOT NULL like every column reviews are paged by, page tokens carry the sort key
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (book_id, user_id)
+);
+
+CREATE INDEX reviews_book_idx ON Reviews (book_id, created_at);
+
 -- Insert three dummy users into the Users table
 INSERT INTO Users (username, password, role)
 VALUES
@@ -42,24 +240,71 @@ VALUES
 ('user2', 'hashed_password_2', 'user'),
 ('user3', 'hashed_password_3', 'user');
 
+-- Insert the sample categories, rare books are a kind of reference book
+INSERT INTO Categories (name, parent_id)
+VALUES
+('Fiction', NULL),
+('Reference', NULL);
+
+INSERT INTO Categories (name, parent_id)
+VALUES
+('Classics', (SELECT id FROM Categories WHERE name = 'Fiction')),
+('Rare Books', (SELECT id FROM Categories WHERE name = 'Reference'));
+
 -- Insert sample books into the Books table
-INSERT INTO Books (title, author, published_date, status, user_id)
+INSERT INTO Books (title, author, published_date, category, isbn_13)
+VALUES
+('The Great Gatsby', 'F. Scott Fitzgerald', '1925-04-10 00:00:00', 'Fiction', '9780743273565'),
+('1984', 'George Orwell', '1949-06-08 00:00:00', 'Fiction', '9780451524935'),
+('To Kill a Mockingbird', 'Harper Lee', '1960-07-11 00:00:00', 'Fiction', '9780061120084'),
+('Pride and Prejudice', 'Jane Austen', '1813-01-28 00:00:00', 'Fiction', '9780141439518'),
+('Moby-Dick', 'Herman Melville', '1851-10-18 00:00:00', 'Fiction', '9780142437247');
+
+-- Credit the sample books to their authors
+INSERT INTO Authors (name)
+SELECT DISTINCT author FROM Books;
+
+INSERT INTO BookAuthors (book_id, author_id, role)
+SELECT b.id, a.id, 'author' FROM Books b JOIN Authors a ON a.name = b.author;
+
+-- Insert the copies of the sample books, the library owns three copies of '1984'
+INSERT INTO BookCopies (book_id, barcode, status, user_id)
 VALUES
-('The Great Gatsby', 'F. Scott Fitzgerald', '1925-04-10 00:00:00', 'Available', NULL),
-('1984', 'George Orwell', '1949-06-08 00:00:00', 'Borrowed', (SELECT id FROM Users WHERE username = 'user1')),
-('To Kill a Mockingbird', 'Harper Lee', '1960-07-11 00:00:00', 'Available', NULL),
-('Pride and Prejudice', 'Jane Austen', '1813-01-28 00:00:00', 'Borrowed', (SELECT id FROM Users WHERE username = 'user2')),
-('Moby-Dick', 'Herman Melville', '1851-10-18 00:00:00', 'Available', NULL);
+((SELECT id FROM Books WHERE title = 'The Great Gatsby'), 'GATSBY-1', 'Available', NULL),
+((SELECT id FROM Books WHERE title = '1984'), '1984-1', 'Borrowed', (SELECT id FROM Users WHERE username = 'user1')),
+((SELECT id FROM Books WHERE title = '1984'), '1984-2', 'Available', NULL),
+((SELECT id FROM Books WHERE title = '1984'), '1984-3', 'Available', NULL),
+((SELECT id FROM Books WHERE title = 'To Kill a Mockingbird'), 'MOCKINGBIRD-1', 'Available', NULL),
+((SELECT id FROM Books WHERE title = 'Pride and Prejudice'), 'PRIDE-1', 'Available', NULL),
+((SELECT id FROM Books WHERE title = 'Moby-Dick'), 'MOBYDICK-1', 'Available', NULL);
 
 -- Insert borrowed books into the BorrowedBooks table
-INSERT INTO BorrowedBooks (book_id, user_id, borrowed_date, return_date)
+INSERT INTO BorrowedBooks (book_id, copy_id, user_id, borrowed_date, due_date, return_date)
 VALUES
 ((SELECT id FROM Books WHERE title = '1984'),
+ (SELECT id FROM BookCopies WHERE barcode = '1984-1'),
  (SELECT id FROM Users WHERE username = 'user1'),
  '2025-01-01 10:00:00',
+ '2025-01-29 10:00:00',
  NULL), -- User1 borrowed '1984' and has not yet returned it
 
 ((SELECT id FROM Books WHERE title = 'Pride and Prejudice'),
+ (SELECT id FROM BookCopies WHERE barcode = 'PRIDE-1'),
  (SELECT id FROM Users WHERE username = 'user2'),
  '2025-01-02 14:30:00',
+ '2025-01-23 14:30:00',
  '2025-01-05 15:00:00'); -- User2 borrowed 'Pride and Prejudice' and returned it
+
+-- Insert default loan policies: three weeks for everyone, four for admins,
+-- one week without renewals and a steeper fine for reference books and rare
+-- books never leave the library
+INSERT INTO LoanPolicies (role, category, loan_days, max_renewals, fine_per_day_cents, max_fine_cents, borrowable)
+VALUES
+('*', NULL, 21, 2, 25, 1000, TRUE),
+('admin', NULL, 28, 2, 25, 1000, TRUE),
+('*', 'Reference', 7, 0, 100, 2000, TRUE),
+('*', 'Rare Books', 7, 0, 100, 2000, FALSE);
+
+-- Record the initial status of the sample copies
+INSERT INTO BookStatusHistory (book_id, copy_id, to_status, reason, changed_at)
+SELECT book_id, id, status, 'Created', created_at FROM BookCopies;
@@ -0,0 +1,102 @@
+// Package covers checks uploaded book covers, makes their thumbnails and
+// keeps both in a Storage.
+package covers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// ErrNotFound is returned by Storage.Get for a key without a cover.
+var ErrNotFound = errors.New("cover not found")
+
+// Storage keeps cover images by key.
+type Storage interface {
+	// Put stores data under key, replacing what was there.
+	Put(ctx context.Context, key, contentType string, data []byte) error
+	// Get returns the image stored under key and its content type, or
+	// ErrNotFound. The caller closes the reader.
+	Get(ctx context.Context, key string) (io.ReadCloser, string, error)
+	// Delete removes the image stored under key, a missing key is not an error.
+	Delete(ctx context.Context, key string) error
+}
+
+// URLPrefix is the path the REST API serves covers under.
+const URLPrefix = "/covers/"
+
+// keyPattern matches the keys NewKey and ThumbnailKey make, a book id and a
+// random name, so a key from a URL can't point outside the storage.
+var keyPattern = regexp.MustCompile(`^[0-9a-f-]{36}/[0-9a-f-]{36}(-thumb)?\.(jpg|png|gif)$`)
+
+// NewKey returns a fresh key for a cover of the book, ext is the extension of
+// its image type. Every upload gets a new key so cached URLs never go stale.
+func NewKey(bookID, ext string) string {
+	return bookID + "/" + uuid.NewString() + ext
+}
+
+// ThumbnailKey returns the key of the thumbnail of the cover stored under key.
+func ThumbnailKey(key string) string {
+	return strings.TrimSuffix(key, path.Ext(key)) + "-thumb.jpg"
+}
+
+// ValidKey reports whether key is a cover or thumbnail key.
+func ValidKey(key string) bool {
+	return keyPattern.MatchString(key)
+}
+
+// DeleteWithThumbnail removes the cover stored under key and its thumbnail.
+// Both are attempted, the errors of either are returned joined.
+func DeleteWithThumbnail(ctx context.Context, storage Storage, key string) error {
+	var errs []error
+	for _, key := range []string{key, ThumbnailKey(key)} {
+		if err := storage.Delete(ctx, key); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// URL returns the path the cover stored under key is served at, or "" for a
+// book without a cover.
+func URL(key string) string {
+	if key == "" {
+		return ""
+	}
+	return URLPrefix + key
+}
+
+// FromEnv returns the storage selected by COVER_STORAGE. "local", the
+// default, keeps covers below COVER_DIR (./uploads/covers when unset). "s3"
+// keeps them in S3_BUCKET at S3_ENDPOINT, signed with S3_ACCESS_KEY_ID and
+// S3_SECRET_ACCESS_KEY for S3_REGION (us-east-1 when unset).
+func FromEnv() (Storage, error) {
+	switch kind := os.Getenv("COVER_STORAGE"); kind {
+	case "", "local":
+		dir := os.Getenv("COVER_DIR")
+		if dir == "" {
+			dir = filepath.Join("uploads", "covers")
+		}
+		return NewLocalStorage(dir), nil
+	case "s3":
+		region := os.Getenv("S3_REGION")
+		if region == "" {
+			region = "us-east-1"
+		}
+		storage := NewS3Storage(os.Getenv("S3_ENDPOINT"), os.Getenv("S3_BUCKET"), region, os.Getenv("S3_ACCESS_KEY_ID"), os.Getenv("S3_SECRET_ACCESS_KEY"))
+		if storage.Endpoint == "" || storage.Bucket == "" {
+			return nil, errors.New("S3_ENDPOINT and S3_BUCKET are required for s3 cover storage")
+		}
+		return storage, nil
+	default:
+		return nil, fmt.Errorf("unknown COVER_STORAGE %q, must be local or s3", kind)
+	}
+}
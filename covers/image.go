@@ -0,0 +1,123 @@
+package covers
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"net/http"
+
+	_ "image/gif" // register the decoders of the accepted types
+	_ "image/png"
+)
+
+const (
+	// MaxSize is the largest cover upload accepted, in bytes.
+	MaxSize = 5 << 20
+	// MaxDimension caps the width and height of a cover so decoding a small
+	// file can't allocate a huge image.
+	MaxDimension = 6000
+	// ThumbnailWidth and ThumbnailHeight bound the thumbnails, which keep the
+	// aspect ratio of the cover and are never larger than it.
+	ThumbnailWidth  = 200
+	ThumbnailHeight = 300
+)
+
+var (
+	// ErrTooLarge is returned for an upload over MaxSize.
+	ErrTooLarge = fmt.Errorf("cover must be at most %d MB", MaxSize>>20)
+	// ErrUnsupportedType is returned for an upload that isn't a JPEG, PNG or GIF.
+	ErrUnsupportedType = errors.New("cover must be a JPEG, PNG or GIF image")
+	// ErrInvalidImage is returned for an upload of an accepted type that
+	// can't be decoded or is over MaxDimension.
+	ErrInvalidImage = errors.New("cover is not a valid image")
+)
+
+// extensions maps the accepted content types to the extension of their keys.
+var extensions = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+}
+
+// Image is a checked cover upload with its thumbnail.
+type Image struct {
+	Data        []byte
+	ContentType string // sniffed from Data, whatever the client claimed
+	Ext         string // extension for NewKey
+	Thumbnail   []byte // JPEG
+}
+
+// Prepare checks an uploaded cover and makes its thumbnail. The type is
+// sniffed from the data rather than trusted from the upload.
+func Prepare(data []byte) (*Image, error) {
+	if len(data) > MaxSize {
+		return nil, ErrTooLarge
+	}
+	contentType := http.DetectContentType(data)
+	ext, ok := extensions[contentType]
+	if !ok {
+		return nil, ErrUnsupportedType
+	}
+
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || config.Width > MaxDimension || config.Height > MaxDimension {
+		return nil, ErrInvalidImage
+	}
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrInvalidImage
+	}
+
+	var thumbnail bytes.Buffer
+	if err := jpeg.Encode(&thumbnail, resize(src, ThumbnailWidth, ThumbnailHeight), &jpeg.Options{Quality: 85}); err != nil {
+		return nil, err
+	}
+	return &Image{Data: data, ContentType: contentType, Ext: ext, Thumbnail: thumbnail.Bytes()}, nil
+}
+
+// resize scales src down to fit in maxWidth by maxHeight, averaging the
+// source pixels under each thumbnail pixel. Transparent areas turn white as
+// JPEG has no alpha.
+func resize(src image.Image, maxWidth, maxHeight int) image.Image {
+	bounds := src.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width > maxWidth {
+		height = max(1, height*maxWidth/width)
+		width = maxWidth
+	}
+	if height > maxHeight {
+		width = max(1, width*maxHeight/height)
+		height = maxHeight
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0 := bounds.Min.Y + y*bounds.Dy()/height
+		y1 := max(y0+1, bounds.Min.Y+(y+1)*bounds.Dy()/height)
+		for x := 0; x < width; x++ {
+			x0 := bounds.Min.X + x*bounds.Dx()/width
+			x1 := max(x0+1, bounds.Min.X+(x+1)*bounds.Dx()/width)
+
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					pr, pg, pb, pa := src.At(sx, sy).RGBA()
+					r, g, b, a, n = r+uint64(pr), g+uint64(pg), b+uint64(pb), a+uint64(pa), n+1
+				}
+			}
+			// Colors are alpha-premultiplied, so adding the missing
+			// coverage as white puts the pixel on a white background
+			white := 0xffff - a/n
+			dst.Set(x, y, color.RGBA64{
+				R: uint16(r/n + white),
+				G: uint16(g/n + white),
+				B: uint16(b/n + white),
+				A: 0xffff,
+			})
+		}
+	}
+	return dst
+}
@@ -0,0 +1,95 @@
+package covers
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// encodePNG returns a width by height PNG filled with c
+func encodePNG(t *testing.T, width, height int, c color.Color) []byte {
+	t.Helper()
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, c)
+		}
+	}
+	var buf bytes.Buffer
+	require.NoError(t, png.Encode(&buf, img))
+	return buf.Bytes()
+}
+
+// unittest for checking a cover and scaling its thumbnail to fit the bounds
+func TestPrepare(t *testing.T) {
+	data := encodePNG(t, 600, 800, color.NRGBA{R: 200, A: 255})
+
+	img, err := Prepare(data)
+	require.NoError(t, err)
+	assert.Equal(t, "image/png", img.ContentType)
+	assert.Equal(t, ".png", img.Ext)
+	assert.Equal(t, data, img.Data)
+
+	thumbnail, err := jpeg.Decode(bytes.NewReader(img.Thumbnail))
+	require.NoError(t, err)
+	assert.Equal(t, image.Rect(0, 0, 200, 266), thumbnail.Bounds(), "fits the width and keeps the aspect ratio")
+	r, g, b, _ := thumbnail.At(100, 100).RGBA()
+	assert.InDelta(t, 200, r>>8, 8)
+	assert.InDelta(t, 0, g>>8, 8)
+	assert.InDelta(t, 0, b>>8, 8)
+}
+
+// unittest for keeping small covers at their size and flattening transparency onto white
+func TestPrepareSmallTransparent(t *testing.T) {
+	img, err := Prepare(encodePNG(t, 40, 60, color.NRGBA{}))
+	require.NoError(t, err)
+
+	thumbnail, err := jpeg.Decode(bytes.NewReader(img.Thumbnail))
+	require.NoError(t, err)
+	assert.Equal(t, image.Rect(0, 0, 40, 60), thumbnail.Bounds())
+	r, g, b, _ := thumbnail.At(20, 30).RGBA()
+	assert.Greater(t, r>>8, uint32(245))
+	assert.Greater(t, g>>8, uint32(245))
+	assert.Greater(t, b>>8, uint32(245))
+}
+
+// unittest for rejecting uploads that aren't usable covers
+func TestPrepareInvalid(t *testing.T) {
+	valid := encodePNG(t, 10, 10, color.Black)
+	tests := []struct {
+		name string
+		data []byte
+		want error
+	}{
+		{"text", []byte("not an image at all"), ErrUnsupportedType},
+		{"pdf", []byte("%PDF-1.4\n"), ErrUnsupportedType},
+		{"truncated png", valid[:len(valid)/2], ErrInvalidImage},
+		{"too large", append(valid, make([]byte, MaxSize)...), ErrTooLarge},
+	}
+	for _, tt := range tests {
+		_, err := Prepare(tt.data)
+		assert.ErrorIs(t, err, tt.want, tt.name)
+	}
+}
+
+// unittest for the keys and URLs of covers
+func TestKeys(t *testing.T) {
+	const bookID = "6f1c7e2a-1d1f-4e57-8d7b-3b8f7c1f2a10"
+	key := NewKey(bookID, ".png")
+	assert.True(t, ValidKey(key))
+	assert.True(t, ValidKey(ThumbnailKey(key)))
+	assert.Regexp(t, `^`+bookID+`/[0-9a-f-]{36}-thumb\.jpg$`, ThumbnailKey(key))
+	assert.NotEqual(t, key, NewKey(bookID, ".png"), "every upload gets a new key")
+	assert.Equal(t, "/covers/"+key, URL(key))
+	assert.Empty(t, URL(""))
+
+	for _, key := range []string{"", "../etc/passwd", bookID + "/../../secret.jpg", bookID + "/cover.jpg", bookID + "/" + bookID + ".exe"} {
+		assert.False(t, ValidKey(key), key)
+	}
+}
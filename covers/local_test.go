@@ -0,0 +1,60 @@
+package covers
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// unittest for storing, reading and deleting covers on the local filesystem
+func TestLocalStorage(t *testing.T) {
+	ctx := context.Background()
+	storage := NewLocalStorage(filepath.Join(t.TempDir(), "covers"))
+	key := NewKey("6f1c7e2a-1d1f-4e57-8d7b-3b8f7c1f2a10", ".png")
+
+	_, _, err := storage.Get(ctx, key)
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	require.NoError(t, storage.Put(ctx, key, "image/png", []byte("first")))
+	require.NoError(t, storage.Put(ctx, key, "image/png", []byte("second")))
+	r, contentType, err := storage.Get(ctx, key)
+	require.NoError(t, err)
+	data, err := io.ReadAll(r)
+	r.Close()
+	require.NoError(t, err)
+	assert.Equal(t, "second", string(data))
+	assert.Equal(t, "image/png", contentType)
+
+	entries, err := os.ReadDir(filepath.Dir(filepath.Join(storage.Dir, key)))
+	require.NoError(t, err)
+	assert.Len(t, entries, 1, "no temporary files are left behind")
+
+	require.NoError(t, storage.Delete(ctx, key))
+	require.NoError(t, storage.Delete(ctx, key), "deleting twice is fine")
+	_, _, err = storage.Get(ctx, key)
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	assert.Error(t, storage.Put(ctx, "../escape.png", "image/png", []byte("x")))
+	_, _, err = storage.Get(ctx, "../escape.png")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+// unittest for deleting a cover together with its thumbnail
+func TestDeleteWithThumbnail(t *testing.T) {
+	ctx := context.Background()
+	storage := NewLocalStorage(t.TempDir())
+	key := NewKey("6f1c7e2a-1d1f-4e57-8d7b-3b8f7c1f2a10", ".png")
+	require.NoError(t, storage.Put(ctx, key, "image/png", []byte("cover")))
+	require.NoError(t, storage.Put(ctx, ThumbnailKey(key), "image/jpeg", []byte("thumbnail")))
+
+	require.NoError(t, DeleteWithThumbnail(ctx, storage, key))
+	for _, key := range []string{key, ThumbnailKey(key)} {
+		_, _, err := storage.Get(ctx, key)
+		assert.ErrorIs(t, err, ErrNotFound, key)
+	}
+}
@@ -2,27 +2,67 @@ package handler
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"p3/gc2/catalog"
 	config "p3/gc2/config/database"
+	"p3/gc2/isbn"
 	cust_middleware "p3/gc2/middleware"
+	"strconv"
+	"strings"
 
 	"time"
 
 	"github.com/labstack/echo/v4"
 	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
 )
 
-// Book struct to temporarily store book information
-type Book struct {
-	ID            string    `json:"id"`
-	Title         string    `json:"title"`
-	Author        string    `json:"author"`
-	PublishedDate time.Time `json:"published_date"`
-	Status        string    `json:"status"`
-	UserID        *string    `json:"user_id,omitempty"`
-	CreatedAt     time.Time `json:"created_at"`
-	UpdatedAt     time.Time `json:"updated_at"`
+// Book is a book in the form the API answers with, see catalog.Book
+type Book = catalog.Book
+
+// Response struct for a book that would duplicate an existing one
+type ConflictResponse struct {
+	Message      string `json:"message"`
+	ExistingBook Book   `json:"existing_book"`
+}
+
+// isbnConflict answers 409 pointing at the book that already has the ISBN
+// when err is a unique violation on books.isbn_13, and reports whether it did
+func isbnConflict(c echo.Context, ctx context.Context, err error, isbn13 string) (bool, error) {
+	if !catalog.ISBNTaken(err) {
+		return false, nil
+	}
+	existing, err := catalog.ScanBook(config.Pool.QueryRow(ctx, `SELECT `+catalog.BookColumns+` FROM books WHERE isbn_13 = $1 AND withdrawn_at IS NULL`, isbn13))
+	if err != nil {
+		return true, c.JSON(http.StatusConflict, map[string]string{"message": "A book with this ISBN already exists"})
+	}
+	c.Response().Header().Set(echo.HeaderLocation, "/users/books/get/"+existing.ID)
+	return true, c.JSON(http.StatusConflict, ConflictResponse{
+		Message:      "A book with this ISBN already exists",
+		ExistingBook: existing,
+	})
+}
+
+// unknownCategory answers 400 when err is a foreign key violation on the
+// category of a book, and reports whether it did
+func unknownCategory(c echo.Context, err error) (bool, error) {
+	if !catalog.UnknownCategory(err) {
+		return false, nil
+	}
+	return true, c.JSON(http.StatusBadRequest, map[string]string{"message": "Validation failed", "error": "category does not exist"})
+}
+
+// creditAuthor credits the book to the authors of the byline it was saved
+// with, replacing its other author credits, and returns the book with its
+// final byline
+func creditAuthor(ctx context.Context, tx pgx.Tx, bookID, author string) (Book, error) {
+	if _, err := catalog.LinkByline(ctx, tx, bookID, author); err != nil {
+		return Book{}, err
+	}
+	return catalog.ScanBook(tx.QueryRow(ctx, `SELECT `+catalog.BookColumns+` FROM books WHERE id = $1`, bookID))
 }
 
 // Request struct for creating/updating a book
@@ -30,6 +70,19 @@ type BookRequest struct {
 	Title         string    `json:"title" validate:"required"`
 	Author        string    `json:"author" validate:"required"`
 	PublishedDate string 	`json:"published_date" validate:"required"`
+	Category      string    `json:"category"`
+	Copies        int       `json:"copies" validate:"omitempty,min=1,max=100"` // copies to add when creating, defaults to 1
+	ISBN          string    `json:"isbn"`                                      // optional ISBN-10 or ISBN-13, hyphens allowed
+}
+
+// Request struct documenting the members of a book merge patch, every member
+// is optional and null clears category or isbn
+type BookPatchRequest struct {
+	Title         *string `json:"title,omitempty"`
+	Author        *string `json:"author,omitempty"`
+	PublishedDate *string `json:"published_date,omitempty"` // YYYY-MM-DD
+	Category      *string `json:"category,omitempty"`
+	ISBN          *string `json:"isbn,omitempty"`
 }
 
 // Response struct for success messages
@@ -38,9 +91,74 @@ type SuccessResponse struct {
 	Data    interface{} `json:"data,omitempty"`
 }
 
+// Response struct for a page of books
+type BookListResponse struct {
+	Message       string `json:"message"`
+	Data          []Book `json:"data"`
+	NextPageToken string `json:"next_page_token,omitempty"` // empty on the last page
+	TotalCount    int    `json:"total_count"`               // books matching the filters across all pages
+}
+
+// BookSearchHit is a search result with the matched words of its title and
+// author wrapped in <mark> tags. The rest of the highlights is HTML-escaped.
+type BookSearchHit struct {
+	Book            Book    `json:"book"`
+	Rank            float32 `json:"rank"`
+	TitleHighlight  string  `json:"title_highlight"`
+	AuthorHighlight string  `json:"author_highlight"`
+}
+
+// Response struct for search results
+type BookSearchResponse struct {
+	Message    string          `json:"message"`
+	Data       []BookSearchHit `json:"data"`
+	TotalCount int             `json:"total_count"` // books matching the query, beyond the returned results
+}
+
+// listOptionsFromQuery reads the filters, sort and page of GetAllBooks from the query string
+func listOptionsFromQuery(c echo.Context) (catalog.ListOptions, error) {
+	opts := catalog.ListOptions{
+		PageToken:  c.QueryParam("page_token"),
+		Status:     c.QueryParam("status"),
+		Author:     c.QueryParam("author"),
+		BorrowerID: c.QueryParam("borrower_id"),
+		Category:   c.QueryParam("category"),
+		Tag:        c.QueryParam("tag"),
+		AuthorID:   c.QueryParam("author_id"),
+		SortBy:     catalog.SortField(c.QueryParam("sort_by")),
+	}
+	if v := c.QueryParam("page_size"); v != "" {
+		size, err := strconv.Atoi(v)
+		if err != nil {
+			return opts, &catalog.OptionError{Field: "page_size", Reason: "must be a number"}
+		}
+		opts.PageSize = size
+	}
+	switch c.QueryParam("order") {
+	case "", "asc":
+	case "desc":
+		opts.Descending = true
+	default:
+		return opts, &catalog.OptionError{Field: "order", Reason: "must be asc or desc"}
+	}
+	for _, p := range []struct {
+		name string
+		dest *time.Time
+	}{{"published_from", &opts.PublishedFrom}, {"published_to", &opts.PublishedTo}} {
+		if v := c.QueryParam(p.name); v != "" {
+			date, err := time.Parse("2006-01-02", v)
+			if err != nil {
+				return opts, &catalog.OptionError{Field: p.name, Reason: "must be a date in YYYY-MM-DD format"}
+			}
+			*p.dest = date
+		}
+	}
+	return opts, nil
+}
+
 // CreateBook handler
 // @Summary Create a new book
-// @Description Create a new book with title, author, and published date
+// @Description Create a new book with title, author, published date, an optional category and ISBN and the number of copies to add. A book with the same ISBN is reported as a conflict pointing at the existing book.
 // @Tags Books
 // @Accept json
 // @Produce json
@@ -49,6 +167,7 @@ type SuccessResponse struct {
 // @Success 200 {object} SuccessResponse
 // @Failure 400 {object} map[string]string
 // @Failure 401 {object} map[string]string
+// @Failure 409 {object} ConflictResponse
 // @Failure 500 {object} map[string]string
 // @Router /books/create [post]
 func CreateBook(c echo.Context) error {
@@ -66,19 +185,60 @@ func CreateBook(c echo.Context) error {
 		return c.JSON(http.StatusBadRequest, map[string]string{"message": "Validation failed", "error": err.Error()})
 	}
 
+	isbn13, err := catalog.NormalizeISBN(req.ISBN)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"message": "Validation failed", "error": err.Error()})
+	}
+
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
 	// Generate a new UUID for the book
 	bookID := uuid.New().String()
 
-	// Query to insert the book into the database
-	query := `INSERT INTO books (id, title, author, published_date, status) VALUES ($1, $2, $3, $4, 'Available')`
-	_, err := config.Pool.Exec(ctx, query, bookID, req.Title, req.Author, req.PublishedDate)
+	copies := req.Copies
+	if copies == 0 {
+		copies = 1
+	}
+
+	tx, err := config.Pool.Begin(ctx)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"message": "Failed to begin transaction"})
+	}
+	defer tx.Rollback(ctx)
+
+	// Query to insert the book into the database together with its copies
+	// and the first entry of their status history
+	query := `
+		WITH book AS (
+			INSERT INTO books (id, title, author, published_date, category, isbn_13)
+			VALUES ($1, $2, $3, $4, NULLIF($5, ''), NULLIF($6, ''))
+			RETURNING id
+		), copies AS (
+			INSERT INTO bookcopies (book_id)
+			SELECT book.id FROM book, generate_series(1, $7::INT)
+			RETURNING id, book_id, status
+		)
+		INSERT INTO bookstatushistory (book_id, copy_id, to_status, actor_id, reason)
+		SELECT book_id, id, status, NULLIF($8, '')::UUID, 'Created' FROM copies`
+	_, err = tx.Exec(ctx, query, bookID, req.Title, req.Author, req.PublishedDate, req.Category, isbn13, copies, cust_middleware.UserID(c))
+	if conflict, res := isbnConflict(c, ctx, err, isbn13); conflict {
+		return res
+	}
+	if invalid, res := unknownCategory(c, err); invalid {
+		return res
+	}
 	if err != nil {
 		fmt.Println("Error inserting into books table:", err)
 		return c.JSON(http.StatusInternalServerError, map[string]string{"message": "Failed to create book"})
 	}
+	if _, err := catalog.LinkByline(ctx, tx, bookID, req.Author); err != nil {
+		fmt.Println("Error crediting book:", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"message": "Failed to create book"})
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"message": "Failed to commit transaction"})
+	}
 
 	return c.JSON(http.StatusOK, SuccessResponse{
 		Message: "Book created successfully",
@@ -88,67 +248,275 @@ func CreateBook(c echo.Context) error {
 
 // GetAllBooks handler
 // @Summary Get all books
-// @Description Retrieve all books with their details
+// @Description Retrieve a page of books with their details and how many of their copies are available. Pass next_page_token back as page_token to fetch the following page with the same filters and sort. Only admins may filter by another user's loans.
 // @Tags Books
 // @Produce json
-// @Success 200 {object} SuccessResponse
+// @Param Authorization header string true "Bearer token"
+// @Param page_size query int false "Books per page, defaults to 20, at most 100"
+// @Param page_token query string false "next_page_token of the previous page"
+// @Param status query string false "Only books with a copy in this status"
+// @Param author query string false "Case-insensitive substring of the author"
+// @Param published_from query string false "Published on or after this date (YYYY-MM-DD)"
+// @Param published_to query string false "Published on or before this date (YYYY-MM-DD)"
+// @Param borrower_id query string false "Only books this user has on loan"
+// @Param category query string false "Only books in this category or one of its subcategories"
+// @Param tag query string false "Only books with this tag"
+// @Param author_id query string false "Only books crediting this author as author, editor or translator"
+// @Param sort_by query string false "created_at (default), title, author or published_date"
+// @Param order query string false "asc (default) or desc"
+// @Success 200 {object} BookListResponse
+// @Failure 400 {object} map[string]string
+// @Failure 403 {object} map[string]string
 // @Failure 500 {object} map[string]string
 // @Router /books/get [get]
 func GetAllBooks(c echo.Context) error {
+	opts, err := listOptionsFromQuery(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"message": "Invalid query", "error": err.Error()})
+	}
+	if opts.BorrowerID != "" && opts.BorrowerID != cust_middleware.UserID(c) && !cust_middleware.IsAdmin(c) {
+		return c.JSON(http.StatusForbidden, map[string]string{"message": "Permission denied admin use only!"})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	page, err := catalog.List(ctx, config.Pool, opts, catalog.BookColumns, catalog.ScanBook)
+	var optErr *catalog.OptionError
+	if errors.As(err, &optErr) {
+		return c.JSON(http.StatusBadRequest, map[string]string{"message": "Invalid query", "error": optErr.Error()})
+	}
+	if err != nil {
+		fmt.Println("Error fetching books:", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"message": "Failed to fetch books"})
+	}
+
+	return c.JSON(http.StatusOK, BookListResponse{
+		Message:       "Books fetched successfully",
+		Data:          page.Items,
+		NextPageToken: page.NextPageToken,
+		TotalCount:    page.TotalCount,
+	})
+}
+
+// GetAuthorBooks handler
+// @Summary List the books of an author
+// @Description Retrieve a page of the books crediting an author as author, editor or translator. Authors merged into another one list the books of that author. Accepts the filters, paging and sort of /books/get.
+// @Tags Authors
+// @Produce json
+// @Param Authorization header string true "Bearer token"
+// @Param id path string true "Author ID"
+// @Param page_size query int false "Books per page, defaults to 20, at most 100"
+// @Param page_token query string false "next_page_token of the previous page"
+// @Param sort_by query string false "created_at (default), title, author or published_date"
+// @Param order query string false "asc (default) or desc"
+// @Success 200 {object} BookListResponse
+// @Failure 400 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Failure 500 {object} map[string]string
+// @Router /authors/{id}/books [get]
+func GetAuthorBooks(c echo.Context) error {
+	opts, err := listOptionsFromQuery(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"message": "Invalid query", "error": err.Error()})
+	}
+	opts.AuthorID = c.Param("id")
+	if _, err := uuid.Parse(opts.AuthorID); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"message": "Validation failed", "error": "id must be a UUID"})
+	}
+	if opts.BorrowerID != "" && opts.BorrowerID != cust_middleware.UserID(c) && !cust_middleware.IsAdmin(c) {
+		return c.JSON(http.StatusForbidden, map[string]string{"message": "Permission denied admin use only!"})
+	}
+
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	// Query to get all books from the database
-	query := `SELECT id, title, author, published_date, status, user_id, created_at, updated_at FROM books`
-	rows, err := config.Pool.Query(ctx, query)
+	var exists bool
+	if err := config.Pool.QueryRow(ctx, `SELECT EXISTS(SELECT 1 FROM authors WHERE id = $1)`, opts.AuthorID).Scan(&exists); err != nil {
+		fmt.Println("Error fetching author:", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"message": "Failed to fetch books"})
+	}
+	if !exists {
+		return c.JSON(http.StatusNotFound, map[string]string{"message": "Author not found"})
+	}
+
+	page, err := catalog.List(ctx, config.Pool, opts, catalog.BookColumns, catalog.ScanBook)
+	var optErr *catalog.OptionError
+	if errors.As(err, &optErr) {
+		return c.JSON(http.StatusBadRequest, map[string]string{"message": "Invalid query", "error": optErr.Error()})
+	}
 	if err != nil {
 		fmt.Println("Error fetching books:", err)
 		return c.JSON(http.StatusInternalServerError, map[string]string{"message": "Failed to fetch books"})
 	}
-	defer rows.Close()
 
-	// Iterate through the rows and build the response
-	var books []Book
-	for rows.Next() {
-		var book Book
-		if err := rows.Scan(&book.ID, &book.Title, &book.Author, &book.PublishedDate, &book.Status, &book.UserID, &book.CreatedAt, &book.UpdatedAt); err != nil {
-			fmt.Println("Error scanning book:", err)
-			return c.JSON(http.StatusInternalServerError, map[string]string{"message": "Failed to parse books"})
+	return c.JSON(http.StatusOK, BookListResponse{
+		Message:       "Books fetched successfully",
+		Data:          page.Items,
+		NextPageToken: page.NextPageToken,
+		TotalCount:    page.TotalCount,
+	})
+}
+
+// SearchBooks handler
+// @Summary Search books
+// @Description Full-text search over titles and authors, best matches first. Every word must match as a whole word or a prefix, so partial input works for typeahead.
+// @Tags Books
+// @Produce json
+// @Param Authorization header string true "Bearer token"
+// @Param q query string true "Words to search for"
+// @Param page_size query int false "Results to return, defaults to 20, at most 100"
+// @Param category query string false "Only books in this category or one of its subcategories"
+// @Param tag query string false "Only books with this tag"
+// @Success 200 {object} BookSearchResponse
+// @Failure 400 {object} map[string]string
+// @Failure 500 {object} map[string]string
+// @Router /books/search [get]
+func SearchBooks(c echo.Context) error {
+	opts := catalog.SearchOptions{Query: c.QueryParam("q"), Category: c.QueryParam("category"), Tag: c.QueryParam("tag")}
+	if v := c.QueryParam("page_size"); v != "" {
+		size, err := strconv.Atoi(v)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"message": "Invalid query", "error": "page_size must be a number"})
 		}
-		books = append(books, book)
+		opts.PageSize = size
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	found, err := catalog.Search(ctx, config.Pool, opts, catalog.BookColumns, catalog.ScanBook)
+	var optErr *catalog.OptionError
+	if errors.As(err, &optErr) {
+		return c.JSON(http.StatusBadRequest, map[string]string{"message": "Invalid query", "error": optErr.Error()})
+	}
+	if err != nil {
+		fmt.Println("Error searching books:", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"message": "Failed to search books"})
+	}
+
+	hits := make([]BookSearchHit, 0, len(found.Hits))
+	for _, hit := range found.Hits {
+		hits = append(hits, BookSearchHit{
+			Book:            hit.Item,
+			Rank:            hit.Rank,
+			TitleHighlight:  hit.TitleHighlight,
+			AuthorHighlight: hit.AuthorHighlight,
+		})
+	}
+	return c.JSON(http.StatusOK, BookSearchResponse{
+		Message:    "Books found",
+		Data:       hits,
+		TotalCount: found.TotalCount,
+	})
+}
+
+// GetBookByISBN handler
+// @Summary Get a book by ISBN
+// @Description Retrieve the book with the given ISBN-10 or ISBN-13, hyphens allowed
+// @Tags Books
+// @Produce json
+// @Param Authorization header string true "Bearer token"
+// @Param isbn path string true "ISBN-10 or ISBN-13"
+// @Success 200 {object} SuccessResponse
+// @Failure 400 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Failure 500 {object} map[string]string
+// @Router /books/isbn/{isbn} [get]
+func GetBookByISBN(c echo.Context) error {
+	isbn13, err := isbn.Normalize(c.Param("isbn"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"message": "Invalid ISBN", "error": err.Error()})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	book, err := catalog.ScanBook(config.Pool.QueryRow(ctx, `SELECT `+catalog.BookColumns+` FROM books WHERE isbn_13 = $1 AND withdrawn_at IS NULL`, isbn13))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return c.JSON(http.StatusNotFound, map[string]string{"message": "Book not found"})
+	}
+	if err != nil {
+		fmt.Println("Error fetching book:", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"message": "Failed to fetch book"})
 	}
 
 	return c.JSON(http.StatusOK, SuccessResponse{
-		Message: "Books fetched successfully",
-		Data:    books,
+		Message: "Book fetched successfully",
+		Data:    book,
 	})
 }
 
+// bookIDParam reads the :id path parameter, which must be a UUID
+func bookIDParam(c echo.Context) (string, error) {
+	bookID := c.Param("id")
+	if _, err := uuid.Parse(bookID); err != nil {
+		return "", errors.New("id must be a UUID")
+	}
+	return bookID, nil
+}
+
+// bookETag is the entity tag of a book version, for If-Match only. The copy
+// counts and rating change without a new version, so it is no validator for
+// caching a book
+func bookETag(version int) string {
+	return `"` + strconv.Itoa(version) + `"`
+}
+
+// ifMatchVersions reads the book versions an If-Match header accepts. anyVersion
+// is true when the header is missing or "*", otherwise only the returned versions
+// match, possibly none for tags that were never issued by this API. Weak tags
+// never match, If-Match uses the strong comparison.
+func ifMatchVersions(header string) (versions []int32, anyVersion bool) {
+	header = strings.TrimSpace(header)
+	if header == "" || header == "*" {
+		return nil, true
+	}
+	versions = []int32{}
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if len(tag) < 2 || tag[0] != '"' || tag[len(tag)-1] != '"' {
+			continue
+		}
+		if v, err := strconv.ParseInt(tag[1:len(tag)-1], 10, 32); err == nil {
+			versions = append(versions, int32(v))
+		}
+	}
+	return versions, false
+}
+
 // GetBookByID handler
 // @Summary Get book by ID
-// @Description Retrieve details of a specific book by its ID
+// @Description Retrieve details of a specific book by its ID. The ETag header carries the version of the book, send it back in If-Match when updating the book.
 // @Tags Books
 // @Produce json
 // @Param id path string true "Book ID"
 // @Success 200 {object} SuccessResponse
+// @Failure 400 {object} map[string]string
 // @Failure 404 {object} map[string]string
 // @Failure 500 {object} map[string]string
 // @Router /books/get/{id} [get]
 func GetBookByID(c echo.Context) error {
-	bookID := c.Param("id")
+	bookID, err := bookIDParam(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"message": "Validation failed", "error": err.Error()})
+	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
 	// Query to get a specific book by ID
-	query := `SELECT id, title, author, published_date, status, user_id, created_at, updated_at FROM books WHERE id = $1`
-	var book Book
-	err := config.Pool.QueryRow(ctx, query, bookID).Scan(&book.ID, &book.Title, &book.Author, &book.PublishedDate, &book.Status, &book.UserID, &book.CreatedAt, &book.UpdatedAt)
+	book, err := catalog.ScanBook(config.Pool.QueryRow(ctx, `SELECT `+catalog.BookColumns+` FROM books WHERE id = $1 AND withdrawn_at IS NULL`, bookID))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return c.JSON(http.StatusNotFound, map[string]string{"message": "Book not found"})
+	}
 	if err != nil {
 		fmt.Println("Error fetching book:", err)
-		return c.JSON(http.StatusNotFound, map[string]string{"message": "Book not found"})
+		return c.JSON(http.StatusInternalServerError, map[string]string{"message": "Failed to fetch book"})
 	}
 
+	c.Response().Header().Set("ETag", bookETag(book.Version))
+
 	return c.JSON(http.StatusOK, SuccessResponse{
 		Message: "Book fetched successfully",
 		Data:    book,
@@ -157,16 +525,20 @@ func GetBookByID(c echo.Context) error {
 
 // UpdateBook handler
 // @Summary Update book details
-// @Description Update the details of a specific book
+// @Description Update the details of a specific book. Send the ETag from GetBookByID in If-Match to only update the version that was read, the update is refused with 412 when the book has changed since.
 // @Tags Books
 // @Accept json
 // @Produce json
 // @Param Authorization header string true "Bearer token"
+// @Param If-Match header string false "ETag of the version being updated"
 // @Param id path string true "Book ID"
 // @Param body body BookRequest true "Book data"
 // @Success 200 {object} SuccessResponse
 // @Failure 400 {object} map[string]string
 // @Failure 401 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Failure 409 {object} ConflictResponse
+// @Failure 412 {object} map[string]string
 // @Failure 500 {object} map[string]string
 // @Router /books/{id} [put]
 func UpdateBook(c echo.Context) error {
@@ -174,7 +546,10 @@ func UpdateBook(c echo.Context) error {
 		return c.JSON(http.StatusForbidden, map[string]string{"message": "Permission denied admin use only!"})
 	}
 	
-	bookID := c.Param("id")
+	bookID, err := bookIDParam(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"message": "Validation failed", "error": err.Error()})
+	}
 	var req BookRequest
 	if err := c.Bind(&req); err != nil {
 		return c.JSON(http.StatusBadRequest, map[string]string{"message": "Invalid request"})
@@ -185,48 +560,265 @@ func UpdateBook(c echo.Context) error {
 		return c.JSON(http.StatusBadRequest, map[string]string{"message": "Validation failed", "error": err.Error()})
 	}
 
+	isbn13, err := catalog.NormalizeISBN(req.ISBN)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"message": "Validation failed", "error": err.Error()})
+	}
+
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	// Query to update the book details
-	query := `UPDATE books SET title = $1, author = $2, published_date = $3, updated_at = NOW() WHERE id = $4`
-	_, err := config.Pool.Exec(ctx, query, req.Title, req.Author, req.PublishedDate, bookID)
+	tx, err := config.Pool.Begin(ctx)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"message": "Failed to begin transaction"})
+	}
+	defer tx.Rollback(ctx)
+
+	previousAuthor, err := catalog.LockByline(ctx, tx, bookID)
+	if err != nil {
+		fmt.Println("Error fetching book:", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"message": "Failed to update book"})
+	}
+
+	// Query to update the book details, only while it still has a version If-Match accepts
+	versions, anyVersion := ifMatchVersions(c.Request().Header.Get("If-Match"))
+	query := `UPDATE books SET title = $1, author = $2, published_date = $3, category = NULLIF($4, ''), isbn_13 = NULLIF($5, ''), updated_at = NOW(), version = version + 1
+		WHERE id = $6 AND withdrawn_at IS NULL AND ($7 OR version = ANY($8)) RETURNING ` + catalog.BookColumns
+	book, err := catalog.ScanBook(tx.QueryRow(ctx, query, req.Title, req.Author, req.PublishedDate, req.Category, isbn13, bookID, anyVersion, versions))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return versionMismatch(c, ctx, bookID)
+	}
+	if conflict, res := isbnConflict(c, ctx, err, isbn13); conflict {
+		return res
+	}
+	if invalid, res := unknownCategory(c, err); invalid {
+		return res
+	}
 	if err != nil {
 		fmt.Println("Error updating book:", err)
 		return c.JSON(http.StatusInternalServerError, map[string]string{"message": "Failed to update book"})
 	}
+	if author := strings.TrimSpace(req.Author); author != previousAuthor {
+		if book, err = creditAuthor(ctx, tx, bookID, author); err != nil {
+			fmt.Println("Error crediting book:", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"message": "Failed to update book"})
+		}
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"message": "Failed to commit transaction"})
+	}
 
-	return c.JSON(http.StatusOK, SuccessResponse{Message: "Book updated successfully"})
+	c.Response().Header().Set("ETag", bookETag(book.Version))
+	return c.JSON(http.StatusOK, SuccessResponse{Message: "Book updated successfully", Data: book})
 }
 
-// DeleteBook handler
-// @Summary Delete a book
-// @Description Delete a book by its ID
+// maxPatchBytes caps the size of a merge patch body
+const maxPatchBytes = 64 << 10
+
+// PatchBook handler
+// @Summary Partially update a book
+// @Description Change some fields of a book with a JSON Merge Patch (RFC 7396). Members left out keep their value, null clears category or isbn. Only the fields sent are validated. Send the ETag from GetBookByID in If-Match to only update the version that was read.
 // @Tags Books
+// @Accept json
+// @Accept application/merge-patch+json
 // @Produce json
 // @Param Authorization header string true "Bearer token"
+// @Param If-Match header string false "ETag of the version being updated"
 // @Param id path string true "Book ID"
+// @Param body body BookPatchRequest true "Fields to change"
 // @Success 200 {object} SuccessResponse
+// @Failure 400 {object} map[string]string
 // @Failure 401 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Failure 409 {object} ConflictResponse
+// @Failure 412 {object} map[string]string
+// @Failure 415 {object} map[string]string
 // @Failure 500 {object} map[string]string
-// @Router /books/{id} [delete]
-func DeleteBook(c echo.Context) error {
+// @Router /books/{id} [patch]
+func PatchBook(c echo.Context) error {
 	if !cust_middleware.IsAdmin(c) {
 		return c.JSON(http.StatusForbidden, map[string]string{"message": "Permission denied admin use only!"})
 	}
 
-	bookID := c.Param("id")
+	bookID, err := bookIDParam(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"message": "Validation failed", "error": err.Error()})
+	}
+
+	contentType := strings.TrimSpace(strings.SplitN(c.Request().Header.Get(echo.HeaderContentType), ";", 2)[0])
+	if contentType != "application/merge-patch+json" && contentType != echo.MIMEApplicationJSON {
+		return c.JSON(http.StatusUnsupportedMediaType, map[string]string{"message": "Send the patch as application/merge-patch+json"})
+	}
+
+	body, err := io.ReadAll(io.LimitReader(c.Request().Body, maxPatchBytes+1))
+	if err != nil || len(body) > maxPatchBytes {
+		return c.JSON(http.StatusBadRequest, map[string]string{"message": "Invalid request"})
+	}
+	patch, err := catalog.ParseMergePatch(body)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"message": "Validation failed", "error": err.Error()})
+	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	// Query to delete the book by ID
-	query := `DELETE FROM books WHERE id = $1`
-	_, err := config.Pool.Exec(ctx, query, bookID)
+	tx, err := config.Pool.Begin(ctx)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"message": "Failed to begin transaction"})
+	}
+	defer tx.Rollback(ctx)
+
+	var previousAuthor string
+	if patch.Author != nil {
+		if previousAuthor, err = catalog.LockByline(ctx, tx, bookID); err != nil {
+			fmt.Println("Error fetching book:", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"message": "Failed to update book"})
+		}
+	}
+
+	// Query to update the patched columns, only while the book still has a version If-Match accepts
+	versions, anyVersion := ifMatchVersions(c.Request().Header.Get("If-Match"))
+	assignments, args := patch.Assignments(1)
+	query := fmt.Sprintf(`UPDATE books SET %s WHERE id = $%d AND withdrawn_at IS NULL AND ($%d OR version = ANY($%d)) RETURNING `, assignments, len(args)+1, len(args)+2, len(args)+3) + catalog.BookColumns
+	book, err := catalog.ScanBook(tx.QueryRow(ctx, query, append(args, bookID, anyVersion, versions)...))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return versionMismatch(c, ctx, bookID)
+	}
+	if conflict, res := isbnConflict(c, ctx, err, patch.ISBN13()); conflict {
+		return res
+	}
+	if invalid, res := unknownCategory(c, err); invalid {
+		return res
+	}
 	if err != nil {
-		fmt.Println("Error deleting book:", err)
-		return c.JSON(http.StatusInternalServerError, map[string]string{"message": "Failed to delete book"})
+		fmt.Println("Error patching book:", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"message": "Failed to update book"})
+	}
+	if patch.Author != nil && strings.TrimSpace(*patch.Author) != previousAuthor {
+		if book, err = creditAuthor(ctx, tx, bookID, *patch.Author); err != nil {
+			fmt.Println("Error crediting book:", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"message": "Failed to update book"})
+		}
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"message": "Failed to commit transaction"})
+	}
+
+	c.Response().Header().Set("ETag", bookETag(book.Version))
+	return c.JSON(http.StatusOK, SuccessResponse{Message: "Book updated successfully", Data: book})
+}
+
+// versionMismatch answers an update that matched no book, 404 when the book
+// is gone and 412 with the current ETag when it has changed since it was read
+func versionMismatch(c echo.Context, ctx context.Context, bookID string) error {
+	version, err := catalog.BookVersion(ctx, config.Pool, bookID)
+	if errors.Is(err, catalog.ErrNotFound) {
+		return c.JSON(http.StatusNotFound, map[string]string{"message": "Book not found"})
+	}
+	if err != nil {
+		fmt.Println("Error checking book version:", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"message": "Failed to update book"})
+	}
+	c.Response().Header().Set("ETag", bookETag(version))
+	return c.JSON(http.StatusPreconditionFailed, map[string]string{"message": "Book was modified by someone else, fetch it again and retry"})
+}
+
+// ListWithdrawnBooks handler
+// @Summary List withdrawn books
+// @Description Retrieve a page of the books withdrawn from the catalog (admin only). Takes the filters and sort of GetAllBooks, sort_by may also be withdrawn_at.
+// @Tags Books
+// @Produce json
+// @Param Authorization header string true "Bearer token"
+// @Param page_size query int false "Books per page, defaults to 20, at most 100"
+// @Param page_token query string false "next_page_token of the previous page"
+// @Param author query string false "Case-insensitive substring of the author"
+// @Param sort_by query string false "created_at (default), title, author, published_date or withdrawn_at"
+// @Param order query string false "asc (default) or desc"
+// @Success 200 {object} BookListResponse
+// @Failure 400 {object} map[string]string
+// @Failure 403 {object} map[string]string
+// @Failure 500 {object} map[string]string
+// @Router /books/withdrawn [get]
+func ListWithdrawnBooks(c echo.Context) error {
+	if !cust_middleware.IsAdmin(c) {
+		return c.JSON(http.StatusForbidden, map[string]string{"message": "Permission denied admin use only!"})
+	}
+
+	opts, err := listOptionsFromQuery(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"message": "Invalid query", "error": err.Error()})
+	}
+	opts.Withdrawn = true
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	page, err := catalog.List(ctx, config.Pool, opts, catalog.BookColumns, catalog.ScanBook)
+	var optErr *catalog.OptionError
+	if errors.As(err, &optErr) {
+		return c.JSON(http.StatusBadRequest, map[string]string{"message": "Invalid query", "error": optErr.Error()})
+	}
+	if err != nil {
+		fmt.Println("Error fetching withdrawn books:", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"message": "Failed to fetch books"})
+	}
+
+	return c.JSON(http.StatusOK, BookListResponse{
+		Message:       "Withdrawn books fetched successfully",
+		Data:          page.Items,
+		NextPageToken: page.NextPageToken,
+		TotalCount:    page.TotalCount,
+	})
+}
+
+// RestoreBook handler
+// @Summary Restore a withdrawn book
+// @Description Put a withdrawn book back in the catalog (admin only), 409 when another book has taken its ISBN
+// @Tags Books
+// @Produce json
+// @Param Authorization header string true "Bearer token"
+// @Param id path string true "Book ID"
+// @Success 200 {object} SuccessResponse
+// @Failure 400 {object} map[string]string
+// @Failure 401 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Failure 409 {object} map[string]string
+// @Failure 500 {object} map[string]string
+// @Router /books/{id}/restore [post]
+func RestoreBook(c echo.Context) error {
+	if !cust_middleware.IsAdmin(c) {
+		return c.JSON(http.StatusForbidden, map[string]string{"message": "Permission denied admin use only!"})
+	}
+
+	bookID, err := bookIDParam(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"message": "Validation failed", "error": err.Error()})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err = catalog.Restore(ctx, config.Pool, bookID)
+	if errors.Is(err, catalog.ErrNotFound) {
+		return c.JSON(http.StatusNotFound, map[string]string{"message": "Book not found"})
+	}
+	if errors.Is(err, catalog.ErrNotWithdrawn) {
+		return c.JSON(http.StatusConflict, map[string]string{"message": "Book is not withdrawn"})
+	}
+	if catalog.ISBNTaken(err) {
+		return c.JSON(http.StatusConflict, map[string]string{"message": "Another book in the catalog has the ISBN of this book, change one of them first"})
+	}
+	if err != nil {
+		fmt.Println("Error restoring book:", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"message": "Failed to restore book"})
+	}
+
+	book, err := catalog.ScanBook(config.Pool.QueryRow(ctx, `SELECT `+catalog.BookColumns+` FROM books WHERE id = $1`, bookID))
+	if err != nil {
+		fmt.Println("Error fetching book:", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"message": "Failed to fetch book"})
 	}
 
-	return c.JSON(http.StatusOK, SuccessResponse{Message: "Book deleted successfully"})
+	c.Response().Header().Set("ETag", bookETag(book.Version))
+	return c.JSON(http.StatusOK, SuccessResponse{Message: "Book restored successfully", Data: book})
 }
\ No newline at end of file
@@ -0,0 +1,160 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"p3/gc2/catalog"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+// unittest for reading the listing options of GetAllBooks from the query string
+func TestListOptionsFromQuery(t *testing.T) {
+	e := echo.New()
+	req := httptest.NewRequest(http.MethodGet, "/users/books/get?page_size=5&author=orwell&sort_by=title&order=desc&published_from=1940-01-01&category=Fiction&tag=classic&author_id=6f1c2f7e-3a9b-4c1d-8e2f-0b5a7d9c4e11", nil)
+	c := e.NewContext(req, httptest.NewRecorder())
+
+	opts, err := listOptionsFromQuery(c)
+	assert.NoError(t, err)
+	assert.Equal(t, 5, opts.PageSize)
+	assert.Equal(t, "orwell", opts.Author)
+	assert.Equal(t, "Fiction", opts.Category)
+	assert.Equal(t, "classic", opts.Tag)
+	assert.Equal(t, "6f1c2f7e-3a9b-4c1d-8e2f-0b5a7d9c4e11", opts.AuthorID)
+	assert.Equal(t, catalog.SortTitle, opts.SortBy)
+	assert.True(t, opts.Descending)
+	assert.Equal(t, time.Date(1940, 1, 1, 0, 0, 0, 0, time.UTC), opts.PublishedFrom)
+	assert.True(t, opts.PublishedTo.IsZero())
+}
+
+// unittest for rejecting a bad query before the database is reached
+func TestGetAllBooksInvalidQuery(t *testing.T) {
+	e := echo.New()
+	for _, query := range []string{"page_size=abc", "order=sideways", "published_to=31-12-1950", "page_size=1000", "sort_by=id", "author_id=orwell"} {
+		req := httptest.NewRequest(http.MethodGet, "/users/books/get?"+query, nil)
+		rec := httptest.NewRecorder()
+
+		if assert.NoError(t, GetAllBooks(e.NewContext(req, rec)), query) {
+			assert.Equal(t, http.StatusBadRequest, rec.Code, query)
+		}
+	}
+}
+
+// unittest for rejecting a search without words before the database is reached
+func TestSearchBooksInvalidQuery(t *testing.T) {
+	e := echo.New()
+	for _, query := range []string{"", "q=%21%3F", "q=gatsby&page_size=abc", "q=gatsby&page_size=-1"} {
+		req := httptest.NewRequest(http.MethodGet, "/users/books/search?"+query, nil)
+		rec := httptest.NewRecorder()
+
+		if assert.NoError(t, SearchBooks(e.NewContext(req, rec)), query) {
+			assert.Equal(t, http.StatusBadRequest, rec.Code, query)
+		}
+	}
+}
+
+// unittest for rejecting a malformed ISBN before the database is reached
+func TestGetBookByISBNInvalid(t *testing.T) {
+	e := echo.New()
+	req := httptest.NewRequest(http.MethodGet, "/users/books/isbn/978-0-451-52493-6", nil)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	c.SetParamNames("isbn")
+	c.SetParamValues("978-0-451-52493-6")
+
+	if assert.NoError(t, GetBookByISBN(c)) {
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+		assert.Contains(t, rec.Body.String(), "check digit")
+	}
+}
+
+// unittest for reading the versions an If-Match header accepts
+func TestIfMatchVersions(t *testing.T) {
+	versions, anyVersion := ifMatchVersions("")
+	assert.True(t, anyVersion)
+	assert.Nil(t, versions)
+
+	_, anyVersion = ifMatchVersions("*")
+	assert.True(t, anyVersion)
+
+	versions, anyVersion = ifMatchVersions(`"3", W/"4", "x", "5"`)
+	assert.False(t, anyVersion)
+	assert.Equal(t, []int32{3, 5}, versions)
+
+	versions, anyVersion = ifMatchVersions(`W/"4"`)
+	assert.False(t, anyVersion)
+	assert.Empty(t, versions, "weak tags never match")
+	assert.Equal(t, `"2"`, bookETag(2))
+}
+
+// unittest for rejecting a patch that can't be applied before the database is reached
+func TestPatchBookInvalid(t *testing.T) {
+	const bookID = "6f1c7e2a-1d1f-4e57-8d7b-3b8f7c1f2a10"
+	e := echo.New()
+	tests := []struct {
+		contentType, body string
+		want              int
+	}{
+		{"text/plain", `{"title":"Animal Farm"}`, http.StatusUnsupportedMediaType},
+		{"application/merge-patch+json", `{"title":null}`, http.StatusBadRequest},
+		{"application/merge-patch+json; charset=utf-8", `{"published_date":"1945"}`, http.StatusBadRequest},
+		{"application/json", `{}`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPatch, "/users/books/"+bookID, strings.NewReader(tt.body))
+		req.Header.Set(echo.HeaderContentType, tt.contentType)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.Set("user", &jwt.Token{Valid: true, Claims: jwt.MapClaims{"role": "admin"}})
+		c.SetParamNames("id")
+		c.SetParamValues(bookID)
+
+		if assert.NoError(t, PatchBook(c), tt.body) {
+			assert.Equal(t, tt.want, rec.Code, tt.body)
+		}
+	}
+}
+
+// unittest for rejecting a book id that isn't a UUID before the database is reached
+func TestBookHandlersInvalidID(t *testing.T) {
+	e := echo.New()
+	handlers := map[string]echo.HandlerFunc{
+		http.MethodGet:   GetBookByID,
+		http.MethodPut:   UpdateBook,
+		http.MethodPatch: PatchBook,
+		http.MethodPost:  RestoreBook,
+	}
+	for method, handler := range handlers {
+		req := httptest.NewRequest(method, "/users/books/42", strings.NewReader(`{"title":"Animal Farm"}`))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.Set("user", &jwt.Token{Valid: true, Claims: jwt.MapClaims{"role": "admin"}})
+		c.SetParamNames("id")
+		c.SetParamValues("42")
+
+		if assert.NoError(t, handler(c), method) {
+			assert.Equal(t, http.StatusBadRequest, rec.Code, method)
+			assert.Contains(t, rec.Body.String(), "id must be a UUID", method)
+		}
+	}
+}
+
+// unittest for keeping the withdrawn books to admins
+func TestListWithdrawnBooksForbidden(t *testing.T) {
+	e := echo.New()
+	req := httptest.NewRequest(http.MethodGet, "/users/books/withdrawn", nil)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	c.Set("user", &jwt.Token{Valid: true, Claims: jwt.MapClaims{"role": "user"}})
+
+	if assert.NoError(t, ListWithdrawnBooks(c)) {
+		assert.Equal(t, http.StatusForbidden, rec.Code)
+	}
+}
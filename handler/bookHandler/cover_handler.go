@@ -0,0 +1,263 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"p3/gc2/catalog"
+	config "p3/gc2/config/database"
+	"p3/gc2/covers"
+	cust_middleware "p3/gc2/middleware"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/labstack/echo/v4"
+)
+
+// CoverStorage keeps the uploaded covers and their thumbnails, set at startup
+// from covers.FromEnv
+var CoverStorage covers.Storage
+
+// maxCoverRequestBytes caps a cover upload request, the image plus room for
+// the multipart framing
+const maxCoverRequestBytes = covers.MaxSize + 64<<10
+
+// coverError answers an upload covers.Prepare refused
+func coverError(c echo.Context, err error) error {
+	switch {
+	case errors.Is(err, covers.ErrTooLarge):
+		return c.JSON(http.StatusRequestEntityTooLarge, map[string]string{"message": "Validation failed", "error": err.Error()})
+	case errors.Is(err, covers.ErrUnsupportedType):
+		return c.JSON(http.StatusUnsupportedMediaType, map[string]string{"message": "Validation failed", "error": err.Error()})
+	case errors.Is(err, covers.ErrInvalidImage):
+		return c.JSON(http.StatusBadRequest, map[string]string{"message": "Validation failed", "error": err.Error()})
+	}
+	fmt.Println("Error preparing cover:", err)
+	return c.JSON(http.StatusInternalServerError, map[string]string{"message": "Failed to upload cover"})
+}
+
+// readCover reads the "cover" file of a multipart upload, at most
+// covers.MaxSize bytes of it
+func readCover(c echo.Context) ([]byte, error) {
+	c.Request().Body = http.MaxBytesReader(c.Response(), c.Request().Body, maxCoverRequestBytes)
+	file, err := c.FormFile("cover")
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return nil, covers.ErrTooLarge
+	}
+	if err != nil {
+		return nil, err
+	}
+	if file.Size > covers.MaxSize {
+		return nil, covers.ErrTooLarge
+	}
+	f, err := file.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(io.LimitReader(f, covers.MaxSize+1))
+}
+
+// deleteCover removes a cover and its thumbnail from the storage, failures
+// only leave an unreferenced file behind so they are logged
+func deleteCover(ctx context.Context, key string) {
+	if err := covers.DeleteWithThumbnail(ctx, CoverStorage, key); err != nil {
+		fmt.Println("Error deleting cover:", err)
+	}
+}
+
+// lockCover locks a book that is in the catalog at a version If-Match accepts
+// and returns the key of its cover, "" when it has none
+func lockCover(c echo.Context, ctx context.Context, tx pgx.Tx, bookID string) (string, error) {
+	versions, anyVersion := ifMatchVersions(c.Request().Header.Get("If-Match"))
+	var key string
+	err := tx.QueryRow(ctx, `SELECT COALESCE(cover_key, '') FROM books WHERE id = $1 AND withdrawn_at IS NULL AND ($2 OR version = ANY($3)) FOR UPDATE`,
+		bookID, anyVersion, versions).Scan(&key)
+	return key, err
+}
+
+// UploadBookCover handler
+// @Summary Upload a book cover
+// @Description Upload a JPEG, PNG or GIF cover as the multipart file "cover", at most 5 MB. The type is read from the image itself rather than the upload. A JPEG thumbnail of at most 200x300 is made with it, and any earlier cover is replaced. Send the ETag in If-Match to only change the version that was read.
+// @Tags Books
+// @Accept multipart/form-data
+// @Produce json
+// @Param Authorization header string true "Bearer token"
+// @Param If-Match header string false "ETag of the version being updated"
+// @Param id path string true "Book ID"
+// @Param cover formData file true "Cover image"
+// @Success 200 {object} SuccessResponse
+// @Failure 400 {object} map[string]string
+// @Failure 401 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Failure 412 {object} map[string]string
+// @Failure 413 {object} map[string]string
+// @Failure 415 {object} map[string]string
+// @Failure 500 {object} map[string]string
+// @Router /books/{id}/cover [put]
+func UploadBookCover(c echo.Context) error {
+	if !cust_middleware.IsAdmin(c) {
+		return c.JSON(http.StatusForbidden, map[string]string{"message": "Permission denied admin use only!"})
+	}
+
+	bookID, err := bookIDParam(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"message": "Validation failed", "error": err.Error()})
+	}
+	data, err := readCover(c)
+	if errors.Is(err, covers.ErrTooLarge) {
+		return coverError(c, err)
+	}
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"message": "Validation failed", "error": "cover must be uploaded as the multipart file cover"})
+	}
+	img, err := covers.Prepare(data)
+	if err != nil {
+		return coverError(c, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	// Store the new images before locking the book, so the uploads don't hold
+	// the lock. They are removed again when the book can't take them
+	key := covers.NewKey(bookID, img.Ext)
+	if err := CoverStorage.Put(ctx, key, img.ContentType, img.Data); err != nil {
+		fmt.Println("Error storing cover:", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"message": "Failed to store cover"})
+	}
+	if err := CoverStorage.Put(ctx, covers.ThumbnailKey(key), "image/jpeg", img.Thumbnail); err != nil {
+		fmt.Println("Error storing cover thumbnail:", err)
+		deleteCover(ctx, key)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"message": "Failed to store cover"})
+	}
+
+	tx, err := config.Pool.Begin(ctx)
+	if err != nil {
+		deleteCover(ctx, key)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"message": "Failed to begin transaction"})
+	}
+	defer tx.Rollback(ctx)
+
+	oldKey, err := lockCover(c, ctx, tx, bookID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		deleteCover(ctx, key)
+		return versionMismatch(c, ctx, bookID)
+	}
+	if err != nil {
+		fmt.Println("Error fetching book:", err)
+		deleteCover(ctx, key)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"message": "Failed to upload cover"})
+	}
+
+	book, err := catalog.ScanBook(tx.QueryRow(ctx, `UPDATE books SET cover_key = $1, updated_at = NOW(), version = version + 1 WHERE id = $2 RETURNING `+catalog.BookColumns, key, bookID))
+	if err == nil {
+		err = tx.Commit(ctx)
+	}
+	if err != nil {
+		fmt.Println("Error saving cover:", err)
+		deleteCover(ctx, key)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"message": "Failed to upload cover"})
+	}
+	if oldKey != "" {
+		deleteCover(ctx, oldKey)
+	}
+
+	c.Response().Header().Set("ETag", bookETag(book.Version))
+	return c.JSON(http.StatusOK, SuccessResponse{Message: "Cover uploaded successfully", Data: book})
+}
+
+// DeleteBookCover handler
+// @Summary Remove a book cover
+// @Description Remove the cover of a book and its thumbnail. Send the ETag in If-Match to only change the version that was read.
+// @Tags Books
+// @Produce json
+// @Param Authorization header string true "Bearer token"
+// @Param If-Match header string false "ETag of the version being updated"
+// @Param id path string true "Book ID"
+// @Success 200 {object} SuccessResponse
+// @Failure 400 {object} map[string]string
+// @Failure 401 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Failure 412 {object} map[string]string
+// @Failure 500 {object} map[string]string
+// @Router /books/{id}/cover [delete]
+func DeleteBookCover(c echo.Context) error {
+	if !cust_middleware.IsAdmin(c) {
+		return c.JSON(http.StatusForbidden, map[string]string{"message": "Permission denied admin use only!"})
+	}
+
+	bookID, err := bookIDParam(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"message": "Validation failed", "error": err.Error()})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	tx, err := config.Pool.Begin(ctx)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"message": "Failed to begin transaction"})
+	}
+	defer tx.Rollback(ctx)
+
+	key, err := lockCover(c, ctx, tx, bookID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return versionMismatch(c, ctx, bookID)
+	}
+	if err != nil {
+		fmt.Println("Error fetching book:", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"message": "Failed to remove cover"})
+	}
+	if key == "" {
+		return c.JSON(http.StatusNotFound, map[string]string{"message": "Book has no cover"})
+	}
+
+	book, err := catalog.ScanBook(tx.QueryRow(ctx, `UPDATE books SET cover_key = NULL, updated_at = NOW(), version = version + 1 WHERE id = $1 RETURNING `+catalog.BookColumns, bookID))
+	if err == nil {
+		err = tx.Commit(ctx)
+	}
+	if err != nil {
+		fmt.Println("Error removing cover:", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"message": "Failed to remove cover"})
+	}
+	deleteCover(ctx, key)
+
+	c.Response().Header().Set("ETag", bookETag(book.Version))
+	return c.JSON(http.StatusOK, SuccessResponse{Message: "Cover removed successfully", Data: book})
+}
+
+// GetCover handler
+// @Summary Get a cover image
+// @Description Serve a cover or thumbnail at the cover_url or thumbnail_url of a book. Every upload gets a new URL, so the images can be cached for good.
+// @Tags Books
+// @Produce image/jpeg
+// @Produce image/png
+// @Produce image/gif
+// @Param key path string true "Cover key"
+// @Success 200 {file} file
+// @Failure 404 {object} map[string]string
+// @Failure 500 {object} map[string]string
+// @Router /covers/{key} [get]
+func GetCover(c echo.Context) error {
+	key := c.Param("*")
+	if !covers.ValidKey(key) {
+		return c.JSON(http.StatusNotFound, map[string]string{"message": "Cover not found"})
+	}
+
+	r, contentType, err := CoverStorage.Get(c.Request().Context(), key)
+	if errors.Is(err, covers.ErrNotFound) {
+		return c.JSON(http.StatusNotFound, map[string]string{"message": "Cover not found"})
+	}
+	if err != nil {
+		fmt.Println("Error fetching cover:", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"message": "Failed to fetch cover"})
+	}
+	defer r.Close()
+
+	c.Response().Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	return c.Stream(http.StatusOK, contentType, r)
+}
@@ -0,0 +1,87 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"p3/gc2/covers"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// multipartCover returns a multipart body with data as the file of the field
+func multipartCover(t *testing.T, field string, data []byte) (*bytes.Buffer, string) {
+	t.Helper()
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	part, err := w.CreateFormFile(field, "cover.png")
+	require.NoError(t, err)
+	_, err = part.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	return &body, w.FormDataContentType()
+}
+
+// unittest for rejecting a cover upload that isn't a usable image before the database is reached
+func TestUploadBookCoverInvalid(t *testing.T) {
+	const bookID = "6f1c7e2a-1d1f-4e57-8d7b-3b8f7c1f2a10"
+	e := echo.New()
+	tests := []struct {
+		name  string
+		field string
+		data  []byte
+		want  int
+	}{
+		{"wrong field", "image", []byte("\x89PNG\r\n\x1a\n"), http.StatusBadRequest},
+		{"text", "cover", []byte("not an image at all"), http.StatusUnsupportedMediaType},
+		{"broken png", "cover", []byte("\x89PNG\r\n\x1a\nbroken"), http.StatusBadRequest},
+		{"too large", "cover", make([]byte, covers.MaxSize+1), http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		body, contentType := multipartCover(t, tt.field, tt.data)
+		req := httptest.NewRequest(http.MethodPut, "/users/books/"+bookID+"/cover", body)
+		req.Header.Set(echo.HeaderContentType, contentType)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.Set("user", &jwt.Token{Valid: true, Claims: jwt.MapClaims{"role": "admin"}})
+		c.SetParamNames("id")
+		c.SetParamValues(bookID)
+
+		if assert.NoError(t, UploadBookCover(c), tt.name) {
+			assert.Equal(t, tt.want, rec.Code, tt.name)
+		}
+	}
+}
+
+// unittest for serving covers from the storage
+func TestGetCover(t *testing.T) {
+	CoverStorage = covers.NewLocalStorage(t.TempDir())
+	defer func() { CoverStorage = nil }()
+	key := covers.NewKey("6f1c7e2a-1d1f-4e57-8d7b-3b8f7c1f2a10", ".png")
+	require.NoError(t, CoverStorage.Put(context.Background(), key, "image/png", []byte("cover")))
+
+	e := echo.New()
+	for key, want := range map[string]int{
+		key:                      http.StatusOK,
+		covers.ThumbnailKey(key): http.StatusNotFound,
+		"../../etc/passwd":       http.StatusNotFound,
+	} {
+		rec := httptest.NewRecorder()
+		c := e.NewContext(httptest.NewRequest(http.MethodGet, covers.URL(key), nil), rec)
+		c.SetParamNames("*")
+		c.SetParamValues(key)
+
+		if assert.NoError(t, GetCover(c), key) && assert.Equal(t, want, rec.Code, key) && want == http.StatusOK {
+			assert.Equal(t, "cover", rec.Body.String())
+			assert.Equal(t, "image/png", rec.Header().Get(echo.HeaderContentType))
+			assert.Contains(t, rec.Header().Get("Cache-Control"), "immutable")
+		}
+	}
+}
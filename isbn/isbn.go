@@ -0,0 +1,99 @@
+// Package isbn validates ISBN-10 and ISBN-13 numbers and normalizes them to
+// the ISBN-13 form books are stored under.
+package isbn
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrInvalid is wrapped by every error returned for a malformed ISBN.
+var ErrInvalid = errors.New("invalid isbn")
+
+// Normalize validates an ISBN-10 or ISBN-13, written with or without hyphens,
+// spaces or an "ISBN" prefix, and returns its 13 digit ISBN-13 form.
+func Normalize(s string) (string, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	for _, prefix := range []string{"ISBN-13", "ISBN-10", "ISBN"} {
+		if strings.HasPrefix(s, prefix) {
+			s = strings.TrimLeft(strings.TrimPrefix(s, prefix), ": ")
+			break
+		}
+	}
+	s = strings.NewReplacer("-", "", " ", "").Replace(s)
+
+	switch len(s) {
+	case 10:
+		if !allDigits(s[:9]) || !(isDigit(s[9]) || s[9] == 'X') {
+			return "", fmt.Errorf("%w: an ISBN-10 is 9 digits and a check digit or X", ErrInvalid)
+		}
+		if checkDigit10(s[:9]) != s[9] {
+			return "", fmt.Errorf("%w: ISBN-10 check digit does not match", ErrInvalid)
+		}
+		core := "978" + s[:9]
+		return core + string(checkDigit13(core)), nil
+	case 13:
+		if !allDigits(s) {
+			return "", fmt.Errorf("%w: an ISBN-13 is 13 digits", ErrInvalid)
+		}
+		if !strings.HasPrefix(s, "978") && !strings.HasPrefix(s, "979") {
+			return "", fmt.Errorf("%w: an ISBN-13 starts with 978 or 979", ErrInvalid)
+		}
+		if checkDigit13(s[:12]) != s[12] {
+			return "", fmt.Errorf("%w: ISBN-13 check digit does not match", ErrInvalid)
+		}
+		return s, nil
+	default:
+		return "", fmt.Errorf("%w: must have 10 or 13 digits", ErrInvalid)
+	}
+}
+
+// To10 returns the ISBN-10 form of a normalized ISBN-13. Only 978 numbers
+// have one.
+func To10(isbn13 string) (string, bool) {
+	if len(isbn13) != 13 || !strings.HasPrefix(isbn13, "978") {
+		return "", false
+	}
+	core := isbn13[3:12]
+	return core + string(checkDigit10(core)), true
+}
+
+// checkDigit10 computes the ISBN-10 check digit of the first 9 digits.
+func checkDigit10(core string) byte {
+	sum := 0
+	for i := 0; i < 9; i++ {
+		sum += (10 - i) * int(core[i]-'0')
+	}
+	check := (11 - sum%11) % 11
+	if check == 10 {
+		return 'X'
+	}
+	return byte('0' + check)
+}
+
+// checkDigit13 computes the ISBN-13 check digit of the first 12 digits.
+func checkDigit13(core string) byte {
+	sum := 0
+	for i := 0; i < 12; i++ {
+		weight := 1
+		if i%2 == 1 {
+			weight = 3
+		}
+		sum += weight * int(core[i]-'0')
+	}
+	return byte('0' + (10-sum%10)%10)
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func allDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if !isDigit(s[i]) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,55 @@
+package isbn
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// unittest for normalizing valid ISBNs to ISBN-13
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		input, want string
+	}{
+		{"9780451524935", "9780451524935"},
+		{"978-0-451-52493-5", "9780451524935"},
+		{"0451524934", "9780451524935"},
+		{"0-451-52493-4", "9780451524935"},
+		{"ISBN 0-8044-2957-X", "9780804429573"},
+		{"isbn-10: 080442957x", "9780804429573"},
+		{"ISBN-13: 979-10-90636-07-1", "9791090636071"},
+	}
+	for _, tt := range tests {
+		got, err := Normalize(tt.input)
+		if assert.NoError(t, err, tt.input) {
+			assert.Equal(t, tt.want, got, tt.input)
+		}
+	}
+}
+
+// unittest for rejecting malformed ISBNs
+func TestNormalizeInvalid(t *testing.T) {
+	for _, input := range []string{
+		"",
+		"12345",
+		"9780451524936", // wrong ISBN-13 check digit
+		"0451524935",    // wrong ISBN-10 check digit
+		"X451524934",    // X is only valid as the ISBN-10 check digit
+		"9770451524935", // not a 978 or 979 number
+		"97804515249A5",
+	} {
+		_, err := Normalize(input)
+		assert.True(t, errors.Is(err, ErrInvalid), input)
+	}
+}
+
+// unittest for deriving the ISBN-10 of an ISBN-13
+func TestTo10(t *testing.T) {
+	isbn10, ok := To10("9780804429573")
+	assert.True(t, ok)
+	assert.Equal(t, "080442957X", isbn10)
+
+	_, ok = To10("9791090636071")
+	assert.False(t, ok, "979 numbers have no ISBN-10")
+}
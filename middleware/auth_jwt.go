@@ -27,9 +27,7 @@ func JWTMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
 		tokenString := parts[1]
 
 		// Parse the token
-		token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-			return jwtSecret, nil
-		})
+		token, err := jwt.Parse(tokenString, keyFunc)
 		if err != nil || !token.Valid {
 			return c.JSON(http.StatusUnauthorized, map[string]string{"message": "Invalid token"})
 		}
@@ -53,6 +51,15 @@ func IsAdmin(c echo.Context) bool {
 	return false
 }
 
+// Helper function to get the id of the user the JWT token was issued to
+func UserID(c echo.Context) string {
+	user := c.Get("user").(*jwt.Token)
+	claims := user.Claims.(jwt.MapClaims)
+
+	userID, _ := claims["user_id"].(string)
+	return userID
+}
+
 // CustomValidator wraps the validator package
 type CustomValidator struct {
 	Validator *validator.Validate
@@ -0,0 +1,46 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// Claims are the JWT claims issued by LoginUser.
+type Claims struct {
+	UserID   string `json:"user_id"`
+	Username string `json:"username"`
+	Role     string `json:"role"`
+	jwt.RegisteredClaims
+}
+
+// keyFunc only hands out the secret for HS256 tokens so a token can't pick
+// its own verification algorithm (e.g. "none").
+func keyFunc(token *jwt.Token) (interface{}, error) {
+	if token.Method.Alg() != jwt.SigningMethodHS256.Alg() {
+		return nil, fmt.Errorf("unexpected signing method %q", token.Header["alg"])
+	}
+	return jwtSecret, nil
+}
+
+// ParseToken verifies the signature, algorithm and expiry of a raw token and
+// returns its claims. Tokens without an exp claim or a user_id are rejected.
+func ParseToken(tokenString string) (*Claims, error) {
+	claims := &Claims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, keyFunc)
+	if err != nil {
+		return nil, err
+	}
+	if !token.Valid {
+		return nil, errors.New("invalid token")
+	}
+	if !claims.VerifyExpiresAt(time.Now(), true) {
+		return nil, errors.New("token has no expiry or is expired")
+	}
+	if claims.UserID == "" {
+		return nil, errors.New("token has no user_id")
+	}
+	return claims, nil
+}
@@ -0,0 +1,62 @@
+package middleware_test
+
+import (
+	"testing"
+	"time"
+
+	cust_middleware "p3/gc2/middleware"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func signToken(t *testing.T, method jwt.SigningMethod, key interface{}, claims jwt.MapClaims) string {
+	t.Helper()
+	tokenString, err := jwt.NewWithClaims(method, claims).SignedString(key)
+	if err != nil {
+		t.Fatalf("failed to sign token: %v", err)
+	}
+	return tokenString
+}
+
+// unittest for parsing a valid token into typed claims
+func TestParseTokenValid(t *testing.T) {
+	tokenString := signToken(t, jwt.SigningMethodHS256, []byte("12345"), jwt.MapClaims{
+		"user_id": "test-user-id",
+		"role":    "admin",
+		"exp":     time.Now().Add(time.Hour).Unix(),
+	})
+
+	claims, err := cust_middleware.ParseToken(tokenString)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "test-user-id", claims.UserID)
+		assert.Equal(t, "admin", claims.Role)
+	}
+}
+
+// unittest for rejecting tokens that must not authenticate
+func TestParseTokenRejects(t *testing.T) {
+	valid := jwt.MapClaims{"user_id": "test-user-id", "exp": time.Now().Add(time.Hour).Unix()}
+
+	cases := map[string]string{
+		"wrong secret": signToken(t, jwt.SigningMethodHS256, []byte("wrong"), valid),
+		"alg none":     signToken(t, jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, valid),
+		"expired": signToken(t, jwt.SigningMethodHS256, []byte("12345"), jwt.MapClaims{
+			"user_id": "test-user-id",
+			"exp":     time.Now().Add(-time.Hour).Unix(),
+		}),
+		"missing exp": signToken(t, jwt.SigningMethodHS256, []byte("12345"), jwt.MapClaims{
+			"user_id": "test-user-id",
+		}),
+		"missing user_id": signToken(t, jwt.SigningMethodHS256, []byte("12345"), jwt.MapClaims{
+			"exp": time.Now().Add(time.Hour).Unix(),
+		}),
+	}
+
+	for name, tokenString := range cases {
+		t.Run(name, func(t *testing.T) {
+			_, err := cust_middleware.ParseToken(tokenString)
+			assert.Error(t, err)
+		})
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strings"
+
+	cust_middleware "p3/gc2/middleware"
+	"p3/gc2/pb"
+
+	"github.com/google/uuid"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// unauthenticatedMethods lists the RPCs that may be called without a token.
+// A token that is sent anyway is still validated.
+var unauthenticatedMethods = map[string]bool{
+	pb.LibraryService_GetBook_FullMethodName:        true,
+	pb.LibraryService_ListBooks_FullMethodName:      true,
+	pb.LibraryService_SearchBooks_FullMethodName:    true,
+	pb.LibraryService_ListCategories_FullMethodName: true,
+	pb.LibraryService_ListTags_FullMethodName:       true,
+	pb.LibraryService_GetAuthor_FullMethodName:      true,
+	pb.LibraryService_ListAuthors_FullMethodName:    true,
+	pb.LibraryService_ListReviews_FullMethodName:    true,
+}
+
+// Principal is the authenticated caller of an RPC.
+type Principal struct {
+	UserID string
+	Role   string
+}
+
+// IsAdmin reports whether the caller has the admin role.
+func (p *Principal) IsAdmin() bool {
+	return p.Role == "admin"
+}
+
+type principalKey struct{}
+
+// withPrincipal returns a copy of ctx carrying the principal.
+func withPrincipal(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// principalFromContext returns the principal set by the auth interceptors, if any.
+func principalFromContext(ctx context.Context) (*Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(*Principal)
+	return p, ok
+}
+
+// requirePrincipal returns the caller or Unauthenticated for anonymous calls.
+func requirePrincipal(ctx context.Context) (*Principal, error) {
+	p, ok := principalFromContext(ctx)
+	if !ok {
+		return nil, status.Error(codes.Unauthenticated, "missing or invalid token")
+	}
+	return p, nil
+}
+
+// requireAdmin checks that the caller carries the admin role.
+func requireAdmin(ctx context.Context) error {
+	p, err := requirePrincipal(ctx)
+	if err != nil {
+		return err
+	}
+	if !p.IsAdmin() {
+		return status.Error(codes.PermissionDenied, "permission denied admin use only")
+	}
+	return nil
+}
+
+// actingUserID returns the user an RPC acts for: the caller itself, or
+// requestedUserID when an admin acts on behalf of another user.
+func actingUserID(p *Principal, requestedUserID string) (string, error) {
+	if requestedUserID == "" || requestedUserID == p.UserID {
+		return p.UserID, nil
+	}
+	if !p.IsAdmin() {
+		return "", status.Error(codes.PermissionDenied, "only admins may act on behalf of another user")
+	}
+	if _, err := uuid.Parse(requestedUserID); err != nil {
+		return "", status.Error(codes.InvalidArgument, "invalid user id")
+	}
+	return requestedUserID, nil
+}
+
+// UnaryAuthInterceptor is a gRPC interceptor for token validation.
+func UnaryAuthInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, err := authenticate(ctx, info.FullMethod)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+// authenticatedStream overrides the context of a server stream with one carrying the principal.
+type authenticatedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authenticatedStream) Context() context.Context {
+	return s.ctx
+}
+
+// StreamAuthInterceptor applies the same token validation to streaming RPCs.
+func StreamAuthInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := authenticate(ss.Context(), info.FullMethod)
+	if err != nil {
+		return err
+	}
+	return handler(srv, &authenticatedStream{ServerStream: ss, ctx: ctx})
+}
+
+// authenticate validates the bearer token in the metadata and stores the
+// caller's principal in the returned context. Methods in
+// unauthenticatedMethods pass through when no token is sent.
+func authenticate(ctx context.Context, fullMethod string) (context.Context, error) {
+	var token string
+	if md, ok := metadata.FromIncomingContext(ctx); ok && len(md["authorization"]) > 0 {
+		token = md["authorization"][0]
+	}
+
+	if token == "" {
+		if unauthenticatedMethods[fullMethod] {
+			return ctx, nil
+		}
+		log.Printf("Missing token for %s", fullMethod)
+		return nil, status.Error(codes.Unauthenticated, "Unauthorized")
+	}
+
+	claims, err := cust_middleware.ParseToken(strings.TrimPrefix(token, "Bearer "))
+	if err != nil {
+		log.Printf("Invalid token for %s: %v", fullMethod, err)
+		return nil, status.Error(codes.Unauthenticated, "invalid token")
+	}
+
+	return withPrincipal(ctx, &Principal{UserID: claims.UserID, Role: claims.Role}), nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// unittest for resolving which user a borrow/return acts for
+func TestActingUserID(t *testing.T) {
+	const (
+		callerID = "6f1c7e2a-1d1f-4e57-8d7b-3b8f7c1f2a10"
+		otherID  = "0b9d4a8e-53c2-4b7e-9a43-9c6f5e2d1b77"
+	)
+	user := &Principal{UserID: callerID, Role: "user"}
+	admin := &Principal{UserID: callerID, Role: "admin"}
+
+	id, err := actingUserID(user, "")
+	assert.NoError(t, err)
+	assert.Equal(t, callerID, id)
+
+	id, err = actingUserID(user, callerID)
+	assert.NoError(t, err)
+	assert.Equal(t, callerID, id)
+
+	_, err = actingUserID(user, otherID)
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	id, err = actingUserID(admin, otherID)
+	assert.NoError(t, err)
+	assert.Equal(t, otherID, id)
+
+	_, err = actingUserID(admin, "not-a-uuid")
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"p3/gc2/catalog"
+	"p3/gc2/config/database"
+	"p3/gc2/pb"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// maxAuthorNameLength matches the authors.name and books.author columns.
+const maxAuthorNameLength = 255
+
+// authorColumns selects an authors row aliased a with the number of books in
+// the catalog crediting the author.
+const authorColumns = `a.id, a.name,
+	(SELECT COUNT(DISTINCT ba.book_id)::INT FROM bookauthors ba JOIN books b ON b.id = ba.book_id WHERE ba.author_id = a.id AND b.withdrawn_at IS NULL),
+	a.created_at, a.updated_at`
+
+// scanAuthor reads an authors row selected with authorColumns into a pb.Author.
+func scanAuthor(row pgx.Row) (*pb.Author, error) {
+	var (
+		author               pb.Author
+		createdAt, updatedAt time.Time
+	)
+	if err := row.Scan(&author.Id, &author.Name, &author.BookCount, &createdAt, &updatedAt); err != nil {
+		return nil, err
+	}
+	author.CreatedAt = timestamppb.New(createdAt)
+	author.UpdatedAt = timestamppb.New(updatedAt)
+	return &author, nil
+}
+
+// fetchAuthor reads an author, the id of a merged author reads the author
+// it was merged into.
+func fetchAuthor(ctx context.Context, q querier, id string) (*pb.Author, error) {
+	return scanAuthor(q.QueryRow(ctx, `SELECT `+authorColumns+` FROM authors a WHERE a.id = (SELECT COALESCE(merged_into, id) FROM authors WHERE id = $1)`, id))
+}
+
+// validateAuthorName checks the name of an author and returns it trimmed.
+func validateAuthorName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", status.Error(codes.InvalidArgument, "name is required")
+	}
+	if utf8.RuneCountInString(name) > maxAuthorNameLength {
+		return "", status.Errorf(codes.InvalidArgument, "name must be at most %d characters", maxAuthorNameLength)
+	}
+	return name, nil
+}
+
+// authorNameTaken reports whether err is a unique violation on the author names.
+func authorNameTaken(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23505"
+}
+
+// refreshBylines rebuilds the byline of the books matched by the condition
+// on bookauthors ba from their author credits and bumps their versions.
+func refreshBylines(ctx context.Context, tx pgx.Tx, books string, arg any) error {
+	_, err := tx.Exec(ctx, fmt.Sprintf(`
+		UPDATE books SET author = s.byline, updated_at = NOW(), version = version + 1
+		FROM (
+			SELECT ba.book_id, LEFT(string_agg(a.name, ', ' ORDER BY ba.position, a.name), %d) AS byline
+			FROM bookauthors ba JOIN authors a ON a.id = ba.author_id
+			WHERE ba.role = 'author' AND %s
+			GROUP BY ba.book_id
+		) s
+		WHERE books.id = s.book_id`, maxAuthorNameLength, books), arg)
+	return err
+}
+
+// CreateAuthor adds an author without any books yet (admin only).
+func (s *LibraryServer) CreateAuthor(ctx context.Context, req *pb.CreateAuthorRequest) (*pb.CreateAuthorResponse, error) {
+	if err := requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+	name, err := validateAuthorName(req.GetName())
+	if err != nil {
+		return nil, err
+	}
+
+	author, err := scanAuthor(config.Pool.QueryRow(ctx, `INSERT INTO authors AS a (name) VALUES ($1) RETURNING `+authorColumns, name))
+	if authorNameTaken(err) {
+		return nil, status.Error(codes.AlreadyExists, "an author with this name already exists")
+	}
+	if err != nil {
+		log.Printf("Error inserting into authors table: %v", err)
+		return nil, status.Error(codes.Internal, "failed to create author")
+	}
+	return &pb.CreateAuthorResponse{
+		Message: "Author created successfully",
+		Author:  author,
+	}, nil
+}
+
+// GetAuthor fetches an author, following merges.
+func (s *LibraryServer) GetAuthor(ctx context.Context, req *pb.GetAuthorRequest) (*pb.GetAuthorResponse, error) {
+	if err := validateID(req.GetId(), "author"); err != nil {
+		return nil, err
+	}
+	author, err := fetchAuthor(ctx, config.Pool, req.GetId())
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, status.Error(codes.NotFound, "author not found")
+	}
+	if err != nil {
+		log.Printf("Error fetching author: %v", err)
+		return nil, status.Error(codes.Internal, "failed to fetch author")
+	}
+	return &pb.GetAuthorResponse{Author: author}, nil
+}
+
+// ListAuthors returns the authors whose name contains the query, sorted by
+// name. Merged authors are left out.
+func (s *LibraryServer) ListAuthors(ctx context.Context, req *pb.ListAuthorsRequest) (*pb.ListAuthorsResponse, error) {
+	limit := int(req.GetPageSize())
+	if limit == 0 {
+		limit = catalog.DefaultPageSize
+	}
+	if limit < 0 || limit > catalog.MaxPageSize {
+		return nil, status.Errorf(codes.InvalidArgument, "page_size must be between 1 and %d", catalog.MaxPageSize)
+	}
+	match := `a.merged_into IS NULL AND strpos(LOWER(a.name), LOWER($1)) > 0`
+	query := strings.TrimSpace(req.GetQuery())
+
+	res := &pb.ListAuthorsResponse{Authors: []*pb.Author{}}
+	if err := config.Pool.QueryRow(ctx, `SELECT COUNT(*) FROM authors a WHERE `+match, query).Scan(&res.TotalCount); err != nil {
+		log.Printf("Error counting authors: %v", err)
+		return nil, status.Error(codes.Internal, "failed to fetch authors")
+	}
+	rows, err := config.Pool.Query(ctx, `SELECT `+authorColumns+` FROM authors a WHERE `+match+` ORDER BY LOWER(a.name), a.id LIMIT $2`, query, limit)
+	if err != nil {
+		log.Printf("Error fetching authors: %v", err)
+		return nil, status.Error(codes.Internal, "failed to fetch authors")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		author, err := scanAuthor(rows)
+		if err != nil {
+			log.Printf("Error scanning author: %v", err)
+			return nil, status.Error(codes.Internal, "failed to fetch authors")
+		}
+		res.Authors = append(res.Authors, author)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, status.Error(codes.Internal, "failed to fetch authors")
+	}
+	return res, nil
+}
+
+// UpdateAuthor renames an author and the bylines of their books (admin only).
+func (s *LibraryServer) UpdateAuthor(ctx context.Context, req *pb.UpdateAuthorRequest) (*pb.UpdateAuthorResponse, error) {
+	if err := requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+	if err := validateID(req.GetId(), "author"); err != nil {
+		return nil, err
+	}
+	name, err := validateAuthorName(req.GetName())
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := config.Pool.Begin(ctx)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to begin transaction")
+	}
+	defer tx.Rollback(ctx)
+
+	res, err := tx.Exec(ctx, `UPDATE authors SET name = $2, updated_at = NOW() WHERE id = $1 AND merged_into IS NULL`, req.GetId(), name)
+	if authorNameTaken(err) {
+		return nil, status.Error(codes.AlreadyExists, "an author with this name already exists, merge the two instead")
+	}
+	if err != nil {
+		log.Printf("Error updating author: %v", err)
+		return nil, status.Error(codes.Internal, "failed to update author")
+	}
+	if res.RowsAffected() == 0 {
+		return nil, status.Error(codes.NotFound, "author not found")
+	}
+	if err := refreshBylines(ctx, tx, `ba.book_id IN (SELECT book_id FROM bookauthors WHERE author_id = $1)`, req.GetId()); err != nil {
+		log.Printf("Error updating bylines of author %s: %v", req.GetId(), err)
+		return nil, status.Error(codes.Internal, "failed to update author")
+	}
+
+	author, err := fetchAuthor(ctx, tx, req.GetId())
+	if err != nil {
+		log.Printf("Error fetching author: %v", err)
+		return nil, status.Error(codes.Internal, "failed to fetch author")
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, status.Error(codes.Internal, "failed to commit transaction")
+	}
+	return &pb.UpdateAuthorResponse{
+		Message: "Author updated successfully",
+		Author:  author,
+	}, nil
+}
+
+// SetBookAuthors replaces the credits of a book and rebuilds its byline
+// (admin only). Merged authors are credited as the author they were merged into.
+func (s *LibraryServer) SetBookAuthors(ctx context.Context, req *pb.SetBookAuthorsRequest) (*pb.SetBookAuthorsResponse, error) {
+	if err := requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+	if err := validateBookID(req.GetBookId()); err != nil {
+		return nil, err
+	}
+	if len(req.GetCredits()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "credits are required")
+	}
+
+	var (
+		authorIDs, roles []string
+		hasAuthor        bool
+		seen             = map[string]bool{}
+	)
+	for _, credit := range req.GetCredits() {
+		if err := validateID(credit.GetAuthorId(), "author"); err != nil {
+			return nil, err
+		}
+		role, err := catalog.ParseRole(credit.GetRole())
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		key := credit.GetAuthorId() + " " + string(role)
+		if seen[key] {
+			return nil, status.Errorf(codes.InvalidArgument, "author %s is credited as %s more than once", credit.GetAuthorId(), role)
+		}
+		seen[key] = true
+		hasAuthor = hasAuthor || role == catalog.RoleAuthor
+		authorIDs = append(authorIDs, credit.GetAuthorId())
+		roles = append(roles, string(role))
+	}
+	if !hasAuthor {
+		return nil, status.Error(codes.InvalidArgument, "a book needs at least one credit with the author role")
+	}
+
+	tx, err := config.Pool.Begin(ctx)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to begin transaction")
+	}
+	defer tx.Rollback(ctx)
+
+	var bookID string
+	err = tx.QueryRow(ctx, `SELECT id FROM books WHERE id = $1 AND withdrawn_at IS NULL FOR UPDATE`, req.GetBookId()).Scan(&bookID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, status.Error(codes.NotFound, "book not found")
+	}
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to fetch book")
+	}
+	var missing int
+	err = tx.QueryRow(ctx, `SELECT COUNT(*) FROM unnest($1::UUID[]) AS c(id) WHERE NOT EXISTS (SELECT 1 FROM authors a WHERE a.id = c.id)`, authorIDs).Scan(&missing)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to fetch authors")
+	}
+	if missing > 0 {
+		return nil, status.Error(codes.NotFound, "author not found")
+	}
+
+	if _, err := tx.Exec(ctx, `DELETE FROM bookauthors WHERE book_id = $1`, req.GetBookId()); err != nil {
+		log.Printf("Error clearing credits of book %s: %v", req.GetBookId(), err)
+		return nil, status.Error(codes.Internal, "failed to set authors")
+	}
+	_, err = tx.Exec(ctx, `
+		INSERT INTO bookauthors (book_id, author_id, role, position)
+		SELECT $1, COALESCE(a.merged_into, a.id), c.role, c.position
+		FROM unnest($2::UUID[], $3::TEXT[]) WITH ORDINALITY AS c(author_id, role, position)
+		JOIN authors a ON a.id = c.author_id
+		ON CONFLICT DO NOTHING`, req.GetBookId(), authorIDs, roles)
+	if err != nil {
+		log.Printf("Error crediting book %s: %v", req.GetBookId(), err)
+		return nil, status.Error(codes.Internal, "failed to set authors")
+	}
+	if err := refreshBylines(ctx, tx, `ba.book_id = $1`, req.GetBookId()); err != nil {
+		log.Printf("Error updating byline of book %s: %v", req.GetBookId(), err)
+		return nil, status.Error(codes.Internal, "failed to set authors")
+	}
+
+	book, err := scanBook(tx.QueryRow(ctx, `SELECT `+catalog.BookColumns+` FROM books WHERE id = $1`, req.GetBookId()))
+	if err != nil {
+		log.Printf("Error fetching book: %v", err)
+		return nil, status.Error(codes.Internal, "failed to fetch book")
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, status.Error(codes.Internal, "failed to commit transaction")
+	}
+	return &pb.SetBookAuthorsResponse{
+		Message: "Authors updated successfully",
+		Book:    book,
+	}, nil
+}
+
+// MergeAuthors moves every credit of the source authors to the target and
+// leaves the sources pointing at it (admin only), for duplicates such as
+// "Orwell" and "George Orwell". Books crediting both keep a single credit.
+func (s *LibraryServer) MergeAuthors(ctx context.Context, req *pb.MergeAuthorsRequest) (*pb.MergeAuthorsResponse, error) {
+	principal, err := requirePrincipal(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !principal.IsAdmin() {
+		return nil, status.Error(codes.PermissionDenied, "permission denied admin use only")
+	}
+	if err := validateID(req.GetTargetId(), "author"); err != nil {
+		return nil, err
+	}
+	if len(req.GetSourceIds()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "source_ids are required")
+	}
+	var sourceIDs []string
+	seen := map[string]bool{}
+	for _, id := range req.GetSourceIds() {
+		if err := validateID(id, "author"); err != nil {
+			return nil, err
+		}
+		if id == req.GetTargetId() {
+			return nil, status.Error(codes.InvalidArgument, "an author can't be merged into itself")
+		}
+		if !seen[id] {
+			seen[id] = true
+			sourceIDs = append(sourceIDs, id)
+		}
+	}
+
+	tx, err := config.Pool.Begin(ctx)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to begin transaction")
+	}
+	defer tx.Rollback(ctx)
+
+	// Lock the authors in id order so concurrent merges can't deadlock
+	rows, err := tx.Query(ctx, `SELECT id, merged_into IS NOT NULL FROM authors WHERE id = ANY($1::UUID[]) ORDER BY id FOR UPDATE`, append([]string{req.GetTargetId()}, sourceIDs...))
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to fetch authors")
+	}
+	found := 0
+	for rows.Next() {
+		var (
+			id     string
+			merged bool
+		)
+		if err := rows.Scan(&id, &merged); err != nil {
+			rows.Close()
+			return nil, status.Error(codes.Internal, "failed to fetch authors")
+		}
+		if merged {
+			rows.Close()
+			return nil, status.Errorf(codes.FailedPrecondition, "author %s was already merged into another author", id)
+		}
+		found++
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, status.Error(codes.Internal, "failed to fetch authors")
+	}
+	if found != len(sourceIDs)+1 {
+		return nil, status.Error(codes.NotFound, "author not found")
+	}
+
+	// Authors merged into a source earlier follow it to the target
+	_, err = tx.Exec(ctx, `
+		WITH moved AS (
+			INSERT INTO bookauthors (book_id, author_id, role, position)
+			SELECT book_id, $1, role, position FROM bookauthors WHERE author_id = ANY($2::UUID[])
+			ON CONFLICT DO NOTHING
+		), removed AS (
+			DELETE FROM bookauthors WHERE author_id = ANY($2::UUID[])
+		)
+		UPDATE authors SET merged_into = $1, updated_at = NOW() WHERE id = ANY($2::UUID[]) OR merged_into = ANY($2::UUID[])`, req.GetTargetId(), sourceIDs)
+	if err != nil {
+		log.Printf("Error merging authors into %s: %v", req.GetTargetId(), err)
+		return nil, status.Error(codes.Internal, "failed to merge authors")
+	}
+	if err := refreshBylines(ctx, tx, `ba.book_id IN (SELECT book_id FROM bookauthors WHERE author_id = $1)`, req.GetTargetId()); err != nil {
+		log.Printf("Error updating bylines of author %s: %v", req.GetTargetId(), err)
+		return nil, status.Error(codes.Internal, "failed to merge authors")
+	}
+
+	author, err := fetchAuthor(ctx, tx, req.GetTargetId())
+	if err != nil {
+		log.Printf("Error fetching author: %v", err)
+		return nil, status.Error(codes.Internal, "failed to fetch author")
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, status.Error(codes.Internal, "failed to commit transaction")
+	}
+
+	log.Printf("Admin %s merged %d authors into %s", principal.UserID, len(sourceIDs), req.GetTargetId())
+	return &pb.MergeAuthorsResponse{
+		Message: "Authors merged successfully",
+		Author:  author,
+	}, nil
+}
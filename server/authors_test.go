@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"p3/gc2/pb"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// integration test for crediting several authors on a book and browsing their works
+func TestBookAuthors(t *testing.T) {
+	setupTestDB(t)
+	ctx := context.Background()
+	server := &LibraryServer{}
+	admin := withPrincipal(ctx, &Principal{UserID: testUserID(t, "user1"), Role: "admin"})
+	user2 := withPrincipal(ctx, &Principal{UserID: testUserID(t, "user2"), Role: "user"})
+
+	// Seeded books are credited to their author
+	orwell, err := server.ListAuthors(ctx, &pb.ListAuthorsRequest{Query: "orwell"})
+	require.NoError(t, err)
+	require.Len(t, orwell.GetAuthors(), 1)
+	assert.Equal(t, "George Orwell", orwell.GetAuthors()[0].GetName())
+	assert.Equal(t, int32(1), orwell.GetAuthors()[0].GetBookCount())
+
+	_, err = server.CreateAuthor(user2, &pb.CreateAuthorRequest{Name: "Constance Garnett"})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = server.CreateAuthor(admin, &pb.CreateAuthorRequest{Name: "george orwell"})
+	assert.Equal(t, codes.AlreadyExists, status.Code(err), "names are unique regardless of case")
+	garnett, err := server.CreateAuthor(admin, &pb.CreateAuthorRequest{Name: " Constance Garnett "})
+	require.NoError(t, err)
+	assert.Equal(t, "Constance Garnett", garnett.GetAuthor().GetName())
+	huxley, err := server.CreateAuthor(admin, &pb.CreateAuthorRequest{Name: "Aldous Huxley"})
+	require.NoError(t, err)
+
+	nineteen, err := server.GetBook(ctx, &pb.GetBookRequest{Isbn: "9780451524935"})
+	require.NoError(t, err)
+	nineteenID := nineteen.GetBook().GetId()
+	require.Len(t, nineteen.GetBook().GetCredits(), 1)
+	orwellID := nineteen.GetBook().GetCredits()[0].GetAuthorId()
+
+	_, err = server.SetBookAuthors(admin, &pb.SetBookAuthorsRequest{BookId: nineteenID, Credits: []*pb.BookCredit{
+		{AuthorId: garnett.GetAuthor().GetId(), Role: "translator"},
+	}})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err), "a book needs an author")
+	_, err = server.SetBookAuthors(admin, &pb.SetBookAuthorsRequest{BookId: nineteenID, Credits: []*pb.BookCredit{
+		{AuthorId: orwellID, Role: "illustrator"},
+	}})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	res, err := server.SetBookAuthors(admin, &pb.SetBookAuthorsRequest{BookId: nineteenID, Credits: []*pb.BookCredit{
+		{AuthorId: orwellID},
+		{AuthorId: huxley.GetAuthor().GetId(), Role: "Author"},
+		{AuthorId: garnett.GetAuthor().GetId(), Role: "translator"},
+	}})
+	require.NoError(t, err)
+	assert.Equal(t, "George Orwell, Aldous Huxley", res.GetBook().GetAuthor())
+	assert.Equal(t, nineteen.GetBook().GetVersion()+1, res.GetBook().GetVersion())
+	require.Len(t, res.GetBook().GetCredits(), 3)
+	assert.Equal(t, "translator", res.GetBook().GetCredits()[2].GetRole())
+
+	// The works of an author include the books they translated
+	works, err := server.ListBooks(ctx, &pb.ListBooksRequest{AuthorId: garnett.GetAuthor().GetId()})
+	require.NoError(t, err)
+	require.Len(t, works.GetBooks(), 1)
+	assert.Equal(t, "1984", works.GetBooks()[0].GetTitle())
+
+	// Renames carry over to the bylines
+	_, err = server.UpdateAuthor(admin, &pb.UpdateAuthorRequest{Id: huxley.GetAuthor().GetId(), Name: "George Orwell"})
+	assert.Equal(t, codes.AlreadyExists, status.Code(err))
+	_, err = server.UpdateAuthor(admin, &pb.UpdateAuthorRequest{Id: huxley.GetAuthor().GetId(), Name: "A. Huxley"})
+	require.NoError(t, err)
+	nineteen, err = server.GetBook(ctx, &pb.GetBookRequest{Id: nineteenID})
+	require.NoError(t, err)
+	assert.Equal(t, "George Orwell, A. Huxley", nineteen.GetBook().GetAuthor())
+
+	// Sending the byline back unchanged keeps the credits it was built from
+	book := nineteen.GetBook()
+	updated, err := server.UpdateBook(admin, &pb.UpdateBookRequest{Id: nineteenID, Title: "Nineteen Eighty-Four", Author: book.GetAuthor(), PublishedDate: book.GetPublishedDate(), Isbn: book.GetIsbn_13()})
+	require.NoError(t, err)
+	assert.Equal(t, "George Orwell, A. Huxley", updated.GetBook().GetAuthor())
+	assert.Equal(t, book.GetCredits(), updated.GetBook().GetCredits())
+
+	// and so does importing it again, no author is named after the whole byline
+	created, err := server.CreateBook(admin, &pb.CreateBookRequest{Title: "Brave New 1984", Author: "george orwell, a. huxley", PublishedDate: book.GetPublishedDate()})
+	require.NoError(t, err)
+	assert.Equal(t, "George Orwell, A. Huxley", created.GetBook().GetAuthor())
+	require.Len(t, created.GetBook().GetCredits(), 2)
+	assert.Equal(t, orwellID, created.GetBook().GetCredits()[0].GetAuthorId())
+	assert.Equal(t, huxley.GetAuthor().GetId(), created.GetBook().GetCredits()[1].GetAuthorId())
+	combined, err := server.ListAuthors(ctx, &pb.ListAuthorsRequest{Query: "huxley"})
+	require.NoError(t, err)
+	assert.Len(t, combined.GetAuthors(), 1)
+
+	// Setting a plain author replaces the authors but keeps the translator
+	updated, err = server.UpdateBook(admin, &pb.UpdateBookRequest{Id: nineteenID, Author: "George Orwell", UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"author"}}})
+	require.NoError(t, err)
+	assert.Equal(t, "George Orwell", updated.GetBook().GetAuthor())
+	require.Len(t, updated.GetBook().GetCredits(), 2)
+	assert.Equal(t, garnett.GetAuthor().GetId(), updated.GetBook().GetCredits()[1].GetAuthorId())
+
+	// A changed byline of known authors credits each of them again
+	updated, err = server.UpdateBook(admin, &pb.UpdateBookRequest{Id: nineteenID, Author: " a. huxley, George Orwell ", UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"author"}}})
+	require.NoError(t, err)
+	assert.Equal(t, "A. Huxley, George Orwell", updated.GetBook().GetAuthor())
+	require.Len(t, updated.GetBook().GetCredits(), 3)
+	assert.Equal(t, huxley.GetAuthor().GetId(), updated.GetBook().GetCredits()[0].GetAuthorId())
+	assert.Equal(t, orwellID, updated.GetBook().GetCredits()[1].GetAuthorId())
+	combined, err = server.ListAuthors(ctx, &pb.ListAuthorsRequest{Query: "huxley"})
+	require.NoError(t, err)
+	assert.Len(t, combined.GetAuthors(), 1)
+}
+
+// integration test for merging duplicate author records
+func TestMergeAuthors(t *testing.T) {
+	setupTestDB(t)
+	ctx := context.Background()
+	server := &LibraryServer{}
+	admin := withPrincipal(ctx, &Principal{UserID: testUserID(t, "user1"), Role: "admin"})
+	user2 := withPrincipal(ctx, &Principal{UserID: testUserID(t, "user2"), Role: "user"})
+
+	nineteen, err := server.GetBook(ctx, &pb.GetBookRequest{Isbn: "9780451524935"})
+	require.NoError(t, err)
+	orwellID := nineteen.GetBook().GetCredits()[0].GetAuthorId()
+
+	// A duplicate record sneaks in through a book typed with a different name
+	created, err := server.CreateBook(admin, &pb.CreateBookRequest{Title: "Animal Farm", Author: "Orwell", Category: "Fiction", PublishedDate: timestamppb.Now()})
+	require.NoError(t, err)
+	farmID := created.GetBook().GetId()
+	duplicateID := created.GetBook().GetCredits()[0].GetAuthorId()
+	require.NotEqual(t, orwellID, duplicateID)
+
+	_, err = server.MergeAuthors(user2, &pb.MergeAuthorsRequest{TargetId: orwellID, SourceIds: []string{duplicateID}})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = server.MergeAuthors(admin, &pb.MergeAuthorsRequest{TargetId: orwellID, SourceIds: []string{orwellID}})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	merged, err := server.MergeAuthors(admin, &pb.MergeAuthorsRequest{TargetId: orwellID, SourceIds: []string{duplicateID}})
+	require.NoError(t, err)
+	assert.Equal(t, int32(2), merged.GetAuthor().GetBookCount())
+
+	farm, err := server.GetBook(ctx, &pb.GetBookRequest{Id: farmID})
+	require.NoError(t, err)
+	assert.Equal(t, "George Orwell", farm.GetBook().GetAuthor())
+
+	// The merged record keeps resolving to the author it was merged into
+	resolved, err := server.GetAuthor(ctx, &pb.GetAuthorRequest{Id: duplicateID})
+	require.NoError(t, err)
+	assert.Equal(t, orwellID, resolved.GetAuthor().GetId())
+	works, err := server.ListBooks(ctx, &pb.ListBooksRequest{AuthorId: duplicateID})
+	require.NoError(t, err)
+	assert.Equal(t, int32(2), works.GetTotalCount())
+	list, err := server.ListAuthors(ctx, &pb.ListAuthorsRequest{Query: "orwell"})
+	require.NoError(t, err)
+	assert.Len(t, list.GetAuthors(), 1)
+
+	_, err = server.MergeAuthors(admin, &pb.MergeAuthorsRequest{TargetId: orwellID, SourceIds: []string{duplicateID}})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err), "already merged")
+
+	// Typing the merged name again credits the surviving author
+	reprint, err := server.CreateBook(admin, &pb.CreateBookRequest{Title: "Homage to Catalonia", Author: "orwell", Category: "Fiction", PublishedDate: timestamppb.Now()})
+	require.NoError(t, err)
+	assert.Equal(t, "George Orwell", reprint.GetBook().GetAuthor())
+	assert.Equal(t, orwellID, reprint.GetBook().GetCredits()[0].GetAuthorId())
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"p3/gc2/bookstatus"
+	"p3/gc2/pb"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// subscriberBuffer is how many events a watcher may lag behind before it is dropped.
+const subscriberBuffer = 64
+
+// availability fans copy status transitions out to WatchBookAvailability streams.
+var availability = newAvailabilityHub()
+
+// availabilitySub is a single watcher. An empty bookIDs set watches every book.
+type availabilitySub struct {
+	bookIDs map[string]bool
+	events  chan *pb.BookAvailabilityEvent
+}
+
+type availabilityHub struct {
+	mu   sync.Mutex
+	subs map[*availabilitySub]struct{}
+}
+
+func newAvailabilityHub() *availabilityHub {
+	return &availabilityHub{subs: make(map[*availabilitySub]struct{})}
+}
+
+// subscribe registers a watcher for the given book ids (or the whole catalog when empty).
+func (h *availabilityHub) subscribe(bookIDs []string) *availabilitySub {
+	sub := &availabilitySub{
+		bookIDs: make(map[string]bool, len(bookIDs)),
+		events:  make(chan *pb.BookAvailabilityEvent, subscriberBuffer),
+	}
+	for _, id := range bookIDs {
+		sub.bookIDs[id] = true
+	}
+
+	h.mu.Lock()
+	h.subs[sub] = struct{}{}
+	h.mu.Unlock()
+	return sub
+}
+
+// unsubscribe removes a watcher and closes its channel if still open.
+func (h *availabilityHub) unsubscribe(sub *availabilitySub) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.subs[sub]; ok {
+		delete(h.subs, sub)
+		close(sub.events)
+	}
+}
+
+// publish delivers a copy's move from previousStatus to its current status
+// to every watcher of its book, and does nothing when the status is
+// unchanged. Watchers whose buffer is full are dropped rather than blocking
+// the caller, so they see their stream end and can reconnect.
+func (h *availabilityHub) publish(c *lockedCopy, previousStatus bookstatus.Status) {
+	if c.Status == previousStatus {
+		return
+	}
+	bookID := c.BookID
+	event := &pb.BookAvailabilityEvent{
+		BookId:         bookID,
+		CopyId:         c.ID,
+		Status:         bookstatus.ToProto(c.Status),
+		PreviousStatus: bookstatus.ToProto(previousStatus),
+		ChangedAt:      timestamppb.New(time.Now()),
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for sub := range h.subs {
+		if len(sub.bookIDs) > 0 && !sub.bookIDs[bookID] {
+			continue
+		}
+		select {
+		case sub.events <- event:
+		default:
+			delete(h.subs, sub)
+			close(sub.events)
+		}
+	}
+}
+
+// WatchBookAvailability streams status transitions of the copies of the requested books until the client disconnects.
+func (s *LibraryServer) WatchBookAvailability(req *pb.WatchBookAvailabilityRequest, stream grpc.ServerStreamingServer[pb.BookAvailabilityEvent]) error {
+	for _, id := range req.GetBookIds() {
+		if err := validateBookID(id); err != nil {
+			return err
+		}
+	}
+
+	sub := availability.subscribe(req.GetBookIds())
+	defer availability.unsubscribe(sub)
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case event, ok := <-sub.events:
+			if !ok {
+				return status.Error(codes.ResourceExhausted, "watcher fell behind, please reconnect")
+			}
+			if err := stream.Send(event); err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+
+	"p3/gc2/bookstatus"
+	"p3/gc2/pb"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// unittest for filtering availability events by book id and skipping unchanged statuses
+func TestAvailabilityHubFiltersByBookID(t *testing.T) {
+	hub := newAvailabilityHub()
+
+	all := hub.subscribe(nil)
+	one := hub.subscribe([]string{"book-1"})
+	defer hub.unsubscribe(all)
+	defer hub.unsubscribe(one)
+
+	hub.publish(&lockedCopy{ID: "copy-1", BookID: "book-1", Status: bookstatus.Borrowed}, bookstatus.Available)
+	hub.publish(&lockedCopy{ID: "copy-2", BookID: "book-2", Status: bookstatus.Available}, bookstatus.Borrowed)
+	hub.publish(&lockedCopy{ID: "copy-3", BookID: "book-1", Status: bookstatus.Available}, bookstatus.Available)
+
+	assert.Len(t, all.events, 2)
+	if assert.Len(t, one.events, 1) {
+		event := <-one.events
+		assert.Equal(t, "book-1", event.GetBookId())
+		assert.Equal(t, "copy-1", event.GetCopyId())
+		assert.Equal(t, pb.BookStatus_BOOK_STATUS_AVAILABLE, event.GetPreviousStatus())
+		assert.Equal(t, pb.BookStatus_BOOK_STATUS_BORROWED, event.GetStatus())
+	}
+}
+
+// unittest for dropping watchers that stop reading
+func TestAvailabilityHubDropsSlowSubscriber(t *testing.T) {
+	hub := newAvailabilityHub()
+	sub := hub.subscribe(nil)
+
+	for i := 0; i <= subscriberBuffer; i++ {
+		hub.publish(&lockedCopy{ID: "copy-1", BookID: "book-1", Status: bookstatus.Borrowed}, bookstatus.Available)
+	}
+
+	for range sub.events {
+	}
+	_, ok := <-sub.events
+	assert.False(t, ok)
+	assert.Empty(t, hub.subs)
+
+	// unsubscribing an already dropped watcher must not panic
+	hub.unsubscribe(sub)
+}
@@ -0,0 +1,554 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"p3/gc2/bookstatus"
+	"p3/gc2/catalog"
+	"p3/gc2/config/database"
+	"p3/gc2/pb"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// scanBook reads a single books row selected with catalog.BookColumns into a pb.Book.
+func scanBook(row pgx.Row) (*pb.Book, error) {
+	b, err := catalog.ScanBook(row)
+	if err != nil {
+		return nil, err
+	}
+	book := &pb.Book{
+		Id:              b.ID,
+		Title:           b.Title,
+		Author:          b.Author,
+		PublishedDate:   timestamppb.New(b.PublishedDate),
+		Isbn_10:         b.ISBN10,
+		TotalCopies:     int32(b.TotalCopies),
+		AvailableCopies: int32(b.AvailableCopies),
+		CreatedAt:       timestamppb.New(b.CreatedAt),
+		UpdatedAt:       timestamppb.New(b.UpdatedAt),
+		Version:         int32(b.Version),
+		Tags:            b.Tags,
+		CoverUrl:        b.CoverURL,
+		ThumbnailUrl:    b.ThumbnailURL,
+		AverageRating:   b.AverageRating,
+		ReviewCount:     int32(b.ReviewCount),
+	}
+	for _, credit := range b.Credits {
+		book.Credits = append(book.Credits, &pb.BookCredit{AuthorId: credit.AuthorID, Name: credit.Name, Role: string(credit.Role)})
+	}
+	if b.Category != nil {
+		book.Category = *b.Category
+	}
+	if b.ISBN13 != nil {
+		book.Isbn_13 = *b.ISBN13
+	}
+	if b.WithdrawnAt != nil {
+		book.WithdrawnAt = timestamppb.New(*b.WithdrawnAt)
+	}
+	if b.WithdrawnBy != nil {
+		book.WithdrawnBy = *b.WithdrawnBy
+	}
+	if b.WithdrawnReason != nil {
+		book.WithdrawnReason = *b.WithdrawnReason
+	}
+	return book, nil
+}
+
+// validateBookFields checks the fields shared by CreateBook and UpdateBook.
+func validateBookFields(title, author string, publishedDate *timestamppb.Timestamp) error {
+	if strings.TrimSpace(title) == "" {
+		return status.Error(codes.InvalidArgument, "title is required")
+	}
+	if strings.TrimSpace(author) == "" {
+		return status.Error(codes.InvalidArgument, "author is required")
+	}
+	if publishedDate == nil || !publishedDate.IsValid() {
+		return status.Error(codes.InvalidArgument, "published_date is required")
+	}
+	return nil
+}
+
+// normalizeISBN validates an optional ISBN from a request and returns its
+// ISBN-13 form, or "" when none was given.
+func normalizeISBN(s string) (string, error) {
+	isbn13, err := catalog.NormalizeISBN(s)
+	if err != nil {
+		return "", status.Error(codes.InvalidArgument, err.Error())
+	}
+	return isbn13, nil
+}
+
+// isbnTaken reports whether err is a unique violation on the ISBN of a book
+// in the catalog and returns the id of the book holding it, or "" when q
+// can't see it.
+func isbnTaken(ctx context.Context, q querier, err error, isbn13 string) (string, bool) {
+	if !catalog.ISBNTaken(err) {
+		return "", false
+	}
+	var existingID string
+	if err := q.QueryRow(ctx, `SELECT id FROM books WHERE isbn_13 = $1 AND withdrawn_at IS NULL`, isbn13).Scan(&existingID); err != nil {
+		return "", true
+	}
+	return existingID, true
+}
+
+// isbnConflict turns a unique violation on the ISBN of a book into AlreadyExists
+// naming the book that already has the ISBN. It returns nil for other errors.
+func isbnConflict(ctx context.Context, err error, isbn13 string) error {
+	existingID, taken := isbnTaken(ctx, config.Pool, err, isbn13)
+	if !taken {
+		return nil
+	}
+	if existingID == "" {
+		return status.Error(codes.AlreadyExists, "a book with this isbn already exists")
+	}
+	return status.Errorf(codes.AlreadyExists, "a book with this isbn already exists: %s", existingID)
+}
+
+// unknownCategory turns a foreign key violation on the category of a book
+// into InvalidArgument. It returns nil for other errors.
+func unknownCategory(err error) error {
+	if !catalog.UnknownCategory(err) {
+		return nil
+	}
+	return status.Error(codes.InvalidArgument, "category does not exist")
+}
+
+// validateID rejects ids that are not UUIDs before they reach the database.
+func validateID(id, kind string) error {
+	if _, err := uuid.Parse(id); err != nil {
+		return status.Errorf(codes.InvalidArgument, "invalid %s id", kind)
+	}
+	return nil
+}
+
+// validateBookID is validateID for book ids.
+func validateBookID(id string) error {
+	return validateID(id, "book")
+}
+
+// maxCopiesPerRequest caps how many copies CreateBook adds at once.
+const maxCopiesPerRequest = 100
+
+// newBook is a validated book to add to the catalog.
+type newBook struct {
+	Title, Author, Category, ISBN13 string
+	PublishedDate                   time.Time
+	Copies                          int32
+}
+
+// insertBook adds a book credited to the authors of its byline with its
+// copies and the first entry of their status history, and returns the id of
+// the book. A byline exported from books with several authors credits each
+// of them again.
+func insertBook(ctx context.Context, tx pgx.Tx, b newBook, actorID string) (string, error) {
+	bookID := uuid.New().String()
+	_, err := tx.Exec(ctx, `INSERT INTO books (id, title, author, published_date, category, isbn_13) VALUES ($1, $2, $3, $4, NULLIF($5, ''), NULLIF($6, ''))`,
+		bookID, b.Title, b.Author, b.PublishedDate, b.Category, b.ISBN13)
+	if err != nil {
+		return "", err
+	}
+	if _, err := catalog.LinkByline(ctx, tx, bookID, b.Author); err != nil {
+		return "", err
+	}
+
+	// Add the copies with generated barcodes and the first entry of their status history
+	_, err = tx.Exec(ctx, `
+		WITH copies AS (
+			INSERT INTO bookcopies (book_id, status)
+			SELECT $1::UUID, $3 FROM generate_series(1, $2::INT)
+			RETURNING id, book_id, status
+		)
+		INSERT INTO bookstatushistory (book_id, copy_id, to_status, actor_id, reason)
+		SELECT book_id, id, status, $4::UUID, 'Created' FROM copies`, bookID, b.Copies, string(bookstatus.Available), actorID)
+	if err != nil {
+		return "", err
+	}
+	return bookID, nil
+}
+
+// CreateBook adds a new book to the catalog together with its copies.
+func (s *LibraryServer) CreateBook(ctx context.Context, req *pb.CreateBookRequest) (*pb.CreateBookResponse, error) {
+	principal, err := requirePrincipal(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !principal.IsAdmin() {
+		return nil, status.Error(codes.PermissionDenied, "permission denied admin use only")
+	}
+	if err := validateBookFields(req.GetTitle(), req.GetAuthor(), req.GetPublishedDate()); err != nil {
+		return nil, err
+	}
+	isbn13, err := normalizeISBN(req.GetIsbn())
+	if err != nil {
+		return nil, err
+	}
+	copies := req.GetCopies()
+	if copies == 0 {
+		copies = 1
+	}
+	if copies < 0 || copies > maxCopiesPerRequest {
+		return nil, status.Errorf(codes.InvalidArgument, "copies must be between 1 and %d", maxCopiesPerRequest)
+	}
+
+	tx, err := config.Pool.Begin(ctx)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to begin transaction")
+	}
+	defer tx.Rollback(ctx)
+
+	bookID, err := insertBook(ctx, tx, newBook{
+		Title:         req.GetTitle(),
+		Author:        req.GetAuthor(),
+		Category:      req.GetCategory(),
+		ISBN13:        isbn13,
+		PublishedDate: req.GetPublishedDate().AsTime(),
+		Copies:        copies,
+	}, principal.UserID)
+	if err != nil {
+		if conflict := isbnConflict(ctx, err, isbn13); conflict != nil {
+			return nil, conflict
+		}
+		if invalid := unknownCategory(err); invalid != nil {
+			return nil, invalid
+		}
+		log.Printf("Error inserting into books table: %v", err)
+		return nil, status.Error(codes.Internal, "failed to create book")
+	}
+
+	book, err := scanBook(tx.QueryRow(ctx, `SELECT `+catalog.BookColumns+` FROM books WHERE id = $1`, bookID))
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to fetch book")
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, status.Error(codes.Internal, "failed to commit transaction")
+	}
+
+	return &pb.CreateBookResponse{
+		Message: "Book created successfully",
+		Book:    book,
+	}, nil
+}
+
+// GetBook fetches a single book by id or ISBN.
+func (s *LibraryServer) GetBook(ctx context.Context, req *pb.GetBookRequest) (*pb.GetBookResponse, error) {
+	where, arg := `id = $1`, req.GetId()
+	if req.GetId() == "" && req.GetIsbn() != "" {
+		isbn13, err := normalizeISBN(req.GetIsbn())
+		if err != nil {
+			return nil, err
+		}
+		where, arg = `isbn_13 = $1`, isbn13
+	} else if err := validateBookID(req.GetId()); err != nil {
+		return nil, err
+	}
+
+	book, err := scanBook(config.Pool.QueryRow(ctx, `SELECT `+catalog.BookColumns+` FROM books WHERE withdrawn_at IS NULL AND `+where, arg))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, status.Error(codes.NotFound, "book not found")
+	}
+	if err != nil {
+		log.Printf("Error fetching book: %v", err)
+		return nil, status.Error(codes.Internal, "failed to fetch book")
+	}
+
+	return &pb.GetBookResponse{Book: book}, nil
+}
+
+// ListBooks returns a page of the catalog, filtered and sorted as requested.
+// Filtering by borrower is limited to admins and the borrower themself.
+func (s *LibraryServer) ListBooks(ctx context.Context, req *pb.ListBooksRequest) (*pb.ListBooksResponse, error) {
+	opts := catalog.ListOptions{
+		PageSize:   int(req.GetPageSize()),
+		PageToken:  req.GetPageToken(),
+		Author:     req.GetAuthor(),
+		SortBy:     catalog.SortField(req.GetSortBy()),
+		Descending: req.GetDescending(),
+		Withdrawn:  req.GetWithdrawn(),
+		Category:   req.GetCategory(),
+		Tag:        req.GetTag(),
+		AuthorID:   req.GetAuthorId(),
+	}
+	if opts.Withdrawn {
+		if err := requireAdmin(ctx); err != nil {
+			return nil, err
+		}
+	}
+	if req.GetStatus() != pb.BookStatus_BOOK_STATUS_UNSPECIFIED {
+		bookStatus, ok := bookstatus.FromProto(req.GetStatus())
+		if !ok {
+			return nil, status.Error(codes.InvalidArgument, "unknown book status")
+		}
+		opts.Status = string(bookStatus)
+	}
+	if req.GetPublishedFrom() != nil {
+		opts.PublishedFrom = req.GetPublishedFrom().AsTime()
+	}
+	if req.GetPublishedTo() != nil {
+		opts.PublishedTo = req.GetPublishedTo().AsTime()
+	}
+	if req.GetBorrowerId() != "" {
+		principal, err := requirePrincipal(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if req.GetBorrowerId() != principal.UserID && !principal.IsAdmin() {
+			return nil, status.Error(codes.PermissionDenied, "only admins may list the books of another borrower")
+		}
+		opts.BorrowerID = req.GetBorrowerId()
+	}
+
+	page, err := catalog.List(ctx, config.Pool, opts, catalog.BookColumns, scanBook)
+	var optErr *catalog.OptionError
+	if errors.As(err, &optErr) {
+		return nil, status.Error(codes.InvalidArgument, optErr.Error())
+	}
+	if err != nil {
+		log.Printf("Error fetching books: %v", err)
+		return nil, status.Error(codes.Internal, "failed to fetch books")
+	}
+
+	return &pb.ListBooksResponse{
+		Books:         page.Items,
+		NextPageToken: page.NextPageToken,
+		TotalCount:    int32(page.TotalCount),
+	}, nil
+}
+
+// SearchBooks ranks the books whose title or author match the query.
+func (s *LibraryServer) SearchBooks(ctx context.Context, req *pb.SearchBooksRequest) (*pb.SearchBooksResponse, error) {
+	found, err := catalog.Search(ctx, config.Pool, catalog.SearchOptions{
+		Query:    req.GetQuery(),
+		PageSize: int(req.GetPageSize()),
+		Category: req.GetCategory(),
+		Tag:      req.GetTag(),
+	}, catalog.BookColumns, scanBook)
+	var optErr *catalog.OptionError
+	if errors.As(err, &optErr) {
+		return nil, status.Error(codes.InvalidArgument, optErr.Error())
+	}
+	if err != nil {
+		log.Printf("Error searching books: %v", err)
+		return nil, status.Error(codes.Internal, "failed to search books")
+	}
+
+	results := make([]*pb.BookSearchResult, 0, len(found.Hits))
+	for _, hit := range found.Hits {
+		results = append(results, &pb.BookSearchResult{
+			Book:            hit.Item,
+			Rank:            hit.Rank,
+			TitleHighlight:  hit.TitleHighlight,
+			AuthorHighlight: hit.AuthorHighlight,
+		})
+	}
+	return &pb.SearchBooksResponse{
+		Results:    results,
+		TotalCount: int32(found.TotalCount),
+	}, nil
+}
+
+// UpdateBook changes the fields of a book named by the update mask, or all
+// of them when the mask is empty (admin only).
+func (s *LibraryServer) UpdateBook(ctx context.Context, req *pb.UpdateBookRequest) (*pb.UpdateBookResponse, error) {
+	if err := requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+	if err := validateBookID(req.GetId()); err != nil {
+		return nil, err
+	}
+	if req.GetExpectedVersion() < 0 {
+		return nil, status.Error(codes.InvalidArgument, "expected_version must not be negative")
+	}
+	patch, err := bookPatch(req)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := config.Pool.Begin(ctx)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to begin transaction")
+	}
+	defer tx.Rollback(ctx)
+
+	var previousAuthor string
+	if patch.Author != nil {
+		if previousAuthor, err = catalog.LockByline(ctx, tx, req.GetId()); err != nil {
+			return nil, status.Error(codes.Internal, "failed to fetch book")
+		}
+	}
+
+	assignments, args := patch.Assignments(1)
+	query := fmt.Sprintf(`UPDATE books SET %s WHERE id = $%d AND withdrawn_at IS NULL AND ($%d = 0 OR version = $%d) RETURNING `, assignments, len(args)+1, len(args)+2, len(args)+2) + catalog.BookColumns
+	book, err := scanBook(tx.QueryRow(ctx, query, append(args, req.GetId(), req.GetExpectedVersion())...))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, versionMismatch(ctx, req.GetId())
+	}
+	if conflict := isbnConflict(ctx, err, patch.ISBN13()); conflict != nil {
+		return nil, conflict
+	}
+	if invalid := unknownCategory(err); invalid != nil {
+		return nil, invalid
+	}
+	if err != nil {
+		log.Printf("Error updating book: %v", err)
+		return nil, status.Error(codes.Internal, "failed to update book")
+	}
+
+	// A new byline replaces the author credits of the book, the byline sent
+	// back unchanged keeps them
+	if patch.Author != nil && strings.TrimSpace(*patch.Author) != previousAuthor {
+		if _, err := catalog.LinkByline(ctx, tx, req.GetId(), *patch.Author); err != nil {
+			log.Printf("Error crediting book %s: %v", req.GetId(), err)
+			return nil, status.Error(codes.Internal, "failed to update book")
+		}
+		if book, err = scanBook(tx.QueryRow(ctx, `SELECT `+catalog.BookColumns+` FROM books WHERE id = $1`, req.GetId())); err != nil {
+			return nil, status.Error(codes.Internal, "failed to fetch book")
+		}
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, status.Error(codes.Internal, "failed to commit transaction")
+	}
+
+	return &pb.UpdateBookResponse{
+		Message: "Book updated successfully",
+		Book:    book,
+	}, nil
+}
+
+// bookPatch validates the fields an UpdateBook request changes.
+func bookPatch(req *pb.UpdateBookRequest) (catalog.BookPatch, error) {
+	var patch catalog.BookPatch
+	paths := req.GetUpdateMask().GetPaths()
+	if len(paths) == 0 {
+		if err := validateBookFields(req.GetTitle(), req.GetAuthor(), req.GetPublishedDate()); err != nil {
+			return patch, err
+		}
+		paths = []string{"title", "author", "published_date", "category", "isbn"}
+	}
+
+	// Validate trims the strings in place, point at copies rather than the request
+	title, author, category, isbnText := req.GetTitle(), req.GetAuthor(), req.GetCategory(), req.GetIsbn()
+	for _, path := range paths {
+		switch path {
+		case "title":
+			patch.Title = &title
+		case "author":
+			patch.Author = &author
+		case "published_date":
+			if !req.GetPublishedDate().IsValid() {
+				return patch, status.Error(codes.InvalidArgument, "published_date is required")
+			}
+			publishedDate := req.GetPublishedDate().AsTime()
+			patch.PublishedDate = &publishedDate
+		case "category":
+			patch.Category = &category
+		case "isbn":
+			patch.ISBN = &isbnText
+		default:
+			return patch, status.Errorf(codes.InvalidArgument, "update_mask path %q is not a field that can be updated", path)
+		}
+	}
+
+	var optErr *catalog.OptionError
+	if err := patch.Validate(); errors.As(err, &optErr) {
+		return patch, status.Error(codes.InvalidArgument, optErr.Error())
+	} else if err != nil {
+		return patch, err
+	}
+	return patch, nil
+}
+
+// versionMismatch explains why a versioned update of a book matched no row,
+// either the book is gone or another update got there first.
+func versionMismatch(ctx context.Context, bookID string) error {
+	current, err := catalog.BookVersion(ctx, config.Pool, bookID)
+	if errors.Is(err, catalog.ErrNotFound) {
+		return status.Error(codes.NotFound, "book not found")
+	}
+	if err != nil {
+		log.Printf("Error checking book version: %v", err)
+		return status.Error(codes.Internal, "failed to update book")
+	}
+	return status.Errorf(codes.Aborted, "book was modified by someone else, current version is %d", current)
+}
+
+// DeleteBook withdraws a book from the catalog, unless a copy is out on
+// loan. The book keeps its copies and loans until purgeWithdrawnBooks
+// deletes it and can be restored until then. Its holds are cancelled and the
+// copies kept for them on the hold shelf go back to Available.
+func (s *LibraryServer) DeleteBook(ctx context.Context, req *pb.DeleteBookRequest) (*pb.DeleteBookResponse, error) {
+	principal, err := requirePrincipal(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !principal.IsAdmin() {
+		return nil, status.Error(codes.PermissionDenied, "permission denied admin use only")
+	}
+	if err := validateBookID(req.GetId()); err != nil {
+		return nil, err
+	}
+
+	tx, err := config.Pool.Begin(ctx)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to begin transaction")
+	}
+	defer tx.Rollback(ctx)
+
+	err = catalog.Withdraw(ctx, tx, req.GetId(), principal.UserID, strings.TrimSpace(req.GetReason()))
+	if errors.Is(err, catalog.ErrNotFound) {
+		return nil, status.Error(codes.NotFound, "book not found")
+	}
+	if errors.Is(err, catalog.ErrOnLoan) {
+		return nil, status.Error(codes.FailedPrecondition, "book has a copy out on loan, it can be deleted once the copy is returned")
+	}
+	if err != nil {
+		log.Printf("Error withdrawing book: %v", err)
+		return nil, status.Error(codes.Internal, "failed to delete book")
+	}
+
+	// The holds are cancelled, free the copies that were waiting for them
+	rows, err := tx.Query(ctx, `SELECT `+lockedCopyColumns+` FROM bookcopies WHERE book_id = $1 AND status = $2 ORDER BY id`, req.GetId(), string(bookstatus.OnHold))
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to fetch copies")
+	}
+	var released []*lockedCopy
+	for rows.Next() {
+		bookCopy, err := scanLockedCopy(rows)
+		if err != nil {
+			rows.Close()
+			return nil, statusError(err, "failed to fetch copies")
+		}
+		released = append(released, bookCopy)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, status.Error(codes.Internal, "failed to fetch copies")
+	}
+	for _, bookCopy := range released {
+		change := statusChange{To: bookstatus.Available, ActorID: &principal.UserID, Reason: "Book withdrawn"}
+		if err := setCopyStatus(ctx, tx, bookCopy, change); err != nil {
+			return nil, statusError(err, "failed to release copy")
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, status.Error(codes.Internal, "failed to commit transaction")
+	}
+
+	log.Printf("Admin %s withdrew book %s", principal.UserID, req.GetId())
+	for _, bookCopy := range released {
+		availability.publish(bookCopy, bookstatus.OnHold)
+	}
+	return &pb.DeleteBookResponse{Message: "Book deleted successfully"}, nil
+}
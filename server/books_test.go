@@ -0,0 +1,464 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"p3/gc2/config/database"
+	"p3/gc2/covers"
+	"p3/gc2/pb"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// integration test for paging through the catalog sorted by title
+func TestListBooksPagination(t *testing.T) {
+	setupTestDB(t)
+	ctx := context.Background()
+	server := &LibraryServer{}
+
+	var titles []string
+	req := &pb.ListBooksRequest{PageSize: 2, SortBy: "title"}
+	for pages := 0; ; pages++ {
+		require.Less(t, pages, 3, "five books fit in three pages")
+		res, err := server.ListBooks(ctx, req)
+		require.NoError(t, err)
+		assert.Equal(t, int32(5), res.GetTotalCount())
+		for _, book := range res.GetBooks() {
+			titles = append(titles, book.GetTitle())
+		}
+		if res.GetNextPageToken() == "" {
+			break
+		}
+		req.PageToken = res.GetNextPageToken()
+	}
+	assert.Equal(t, []string{"1984", "Moby-Dick", "Pride and Prejudice", "The Great Gatsby", "To Kill a Mockingbird"}, titles)
+
+	// A token only continues the sort it was issued for
+	_, err := server.ListBooks(ctx, &pb.ListBooksRequest{PageToken: req.GetPageToken(), SortBy: "author"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+// integration test for paging by creation time through books created at the same moment
+func TestListBooksCreatedAt(t *testing.T) {
+	setupTestDB(t)
+	ctx := context.Background()
+	server := &LibraryServer{}
+
+	// Every book has a sort key, ties are broken by id
+	_, err := config.Pool.Exec(ctx, `UPDATE books SET created_at = NULL WHERE title = '1984'`)
+	require.Error(t, err)
+	_, err = config.Pool.Exec(ctx, `UPDATE books SET created_at = '2025-01-01 00:00:00'`)
+	require.NoError(t, err)
+
+	seen := map[string]bool{}
+	req := &pb.ListBooksRequest{PageSize: 2}
+	for pages := 0; ; pages++ {
+		require.Less(t, pages, 3, "five books fit in three pages")
+		res, err := server.ListBooks(ctx, req)
+		require.NoError(t, err)
+		for _, book := range res.GetBooks() {
+			assert.False(t, seen[book.GetId()], "no book is listed twice")
+			seen[book.GetId()] = true
+		}
+		if res.GetNextPageToken() == "" {
+			break
+		}
+		req.PageToken = res.GetNextPageToken()
+	}
+	assert.Len(t, seen, 5)
+}
+
+// integration test for the listing filters
+func TestListBooksFilters(t *testing.T) {
+	setupTestDB(t)
+	ctx := context.Background()
+	server := &LibraryServer{}
+	user1ID := testUserID(t, "user1")
+
+	res, err := server.ListBooks(ctx, &pb.ListBooksRequest{
+		PublishedFrom: timestamppb.New(time.Date(1900, 1, 1, 0, 0, 0, 0, time.UTC)),
+		PublishedTo:   timestamppb.New(time.Date(1949, 6, 8, 0, 0, 0, 0, time.UTC)),
+		SortBy:        "published_date",
+		Descending:    true,
+	})
+	require.NoError(t, err)
+	require.Len(t, res.GetBooks(), 2)
+	assert.Equal(t, "1984", res.GetBooks()[0].GetTitle())
+	assert.Equal(t, "The Great Gatsby", res.GetBooks()[1].GetTitle())
+
+	res, err = server.ListBooks(ctx, &pb.ListBooksRequest{Author: "MELVILLE"})
+	require.NoError(t, err)
+	require.Len(t, res.GetBooks(), 1)
+	assert.Equal(t, "Moby-Dick", res.GetBooks()[0].GetTitle())
+
+	// Only a copy of 1984 is out on loan
+	res, err = server.ListBooks(ctx, &pb.ListBooksRequest{Status: pb.BookStatus_BOOK_STATUS_BORROWED})
+	require.NoError(t, err)
+	assert.Equal(t, int32(1), res.GetTotalCount())
+
+	user1 := withPrincipal(ctx, &Principal{UserID: user1ID, Role: "admin"})
+	res, err = server.ListBooks(user1, &pb.ListBooksRequest{BorrowerId: user1ID})
+	require.NoError(t, err)
+	require.Len(t, res.GetBooks(), 1)
+	assert.Equal(t, "1984", res.GetBooks()[0].GetTitle())
+
+	user2 := withPrincipal(ctx, &Principal{UserID: testUserID(t, "user2"), Role: "user"})
+	_, err = server.ListBooks(user2, &pb.ListBooksRequest{BorrowerId: user1ID})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = server.ListBooks(ctx, &pb.ListBooksRequest{BorrowerId: user1ID})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+}
+
+// integration test for full-text search with prefix matching and highlights
+func TestSearchBooks(t *testing.T) {
+	setupTestDB(t)
+	ctx := context.Background()
+	server := &LibraryServer{}
+
+	res, err := server.SearchBooks(ctx, &pb.SearchBooksRequest{Query: "mocking"})
+	require.NoError(t, err)
+	require.Len(t, res.GetResults(), 1)
+	assert.Equal(t, "To Kill a Mockingbird", res.GetResults()[0].GetBook().GetTitle())
+	assert.Contains(t, res.GetResults()[0].GetTitleHighlight(), "<mark>Mockingbird</mark>")
+
+	// Words may match the title or the author
+	res, err = server.SearchBooks(ctx, &pb.SearchBooksRequest{Query: "gatsby fitz"})
+	require.NoError(t, err)
+	require.Len(t, res.GetResults(), 1)
+	assert.Equal(t, "F. Scott <mark>Fitzgerald</mark>", res.GetResults()[0].GetAuthorHighlight())
+
+	res, err = server.SearchBooks(ctx, &pb.SearchBooksRequest{Query: "dickens"})
+	require.NoError(t, err)
+	assert.Empty(t, res.GetResults())
+	assert.Equal(t, int32(0), res.GetTotalCount())
+
+	_, err = server.SearchBooks(ctx, &pb.SearchBooksRequest{Query: "&!"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+// integration test for looking up books by ISBN and refusing duplicates
+func TestBookISBN(t *testing.T) {
+	setupTestDB(t)
+	ctx := context.Background()
+	server := &LibraryServer{}
+	admin := withPrincipal(ctx, &Principal{UserID: testUserID(t, "user1"), Role: "admin"})
+
+	// The seeded 1984 is found by its ISBN-10 too
+	res, err := server.GetBook(ctx, &pb.GetBookRequest{Isbn: "0-451-52493-4"})
+	require.NoError(t, err)
+	assert.Equal(t, "1984", res.GetBook().GetTitle())
+	assert.Equal(t, "9780451524935", res.GetBook().GetIsbn_13())
+	assert.Equal(t, "0451524934", res.GetBook().GetIsbn_10())
+
+	_, err = server.CreateBook(admin, &pb.CreateBookRequest{
+		Title:         "Nineteen Eighty-Four",
+		Author:        "George Orwell",
+		PublishedDate: timestamppb.Now(),
+		Isbn:          "978-0-451-52493-5",
+	})
+	assert.Equal(t, codes.AlreadyExists, status.Code(err))
+	assert.Contains(t, status.Convert(err).Message(), res.GetBook().GetId())
+
+	_, err = server.CreateBook(admin, &pb.CreateBookRequest{
+		Title:         "Animal Farm",
+		Author:        "George Orwell",
+		PublishedDate: timestamppb.Now(),
+		Isbn:          "9780451526343",
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err), "wrong check digit")
+}
+
+// integration test for refusing an update based on a stale version
+func TestUpdateBookExpectedVersion(t *testing.T) {
+	setupTestDB(t)
+	ctx := context.Background()
+	server := &LibraryServer{}
+	admin := withPrincipal(ctx, &Principal{UserID: testUserID(t, "user1"), Role: "admin"})
+
+	got, err := server.GetBook(ctx, &pb.GetBookRequest{Isbn: "9780451524935"})
+	require.NoError(t, err)
+	book := got.GetBook()
+	assert.Equal(t, int32(1), book.GetVersion())
+
+	update := &pb.UpdateBookRequest{
+		Id:              book.GetId(),
+		Title:           "Nineteen Eighty-Four",
+		Author:          book.GetAuthor(),
+		PublishedDate:   book.GetPublishedDate(),
+		Isbn:            book.GetIsbn_13(),
+		ExpectedVersion: book.GetVersion(),
+	}
+	res, err := server.UpdateBook(admin, update)
+	require.NoError(t, err)
+	assert.Equal(t, int32(2), res.GetBook().GetVersion())
+
+	// A second admin still holding version 1 is refused
+	update.Title = "1984"
+	_, err = server.UpdateBook(admin, update)
+	assert.Equal(t, codes.Aborted, status.Code(err))
+	assert.Contains(t, status.Convert(err).Message(), "current version is 2")
+
+	// Without an expected version the update always applies
+	update.ExpectedVersion = 0
+	res, err = server.UpdateBook(admin, update)
+	require.NoError(t, err)
+	assert.Equal(t, int32(3), res.GetBook().GetVersion())
+}
+
+// integration test for updating only the fields named by the update mask
+func TestUpdateBookMask(t *testing.T) {
+	setupTestDB(t)
+	ctx := context.Background()
+	server := &LibraryServer{}
+	admin := withPrincipal(ctx, &Principal{UserID: testUserID(t, "user1"), Role: "admin"})
+
+	got, err := server.GetBook(ctx, &pb.GetBookRequest{Isbn: "9780451524935"})
+	require.NoError(t, err)
+	book := got.GetBook()
+
+	// Fields outside the mask are neither validated nor changed
+	res, err := server.UpdateBook(admin, &pb.UpdateBookRequest{
+		Id:         book.GetId(),
+		Category:   "Classics",
+		UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"category"}},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "Classics", res.GetBook().GetCategory())
+	assert.Equal(t, book.GetTitle(), res.GetBook().GetTitle())
+	assert.Equal(t, book.GetIsbn_13(), res.GetBook().GetIsbn_13())
+	assert.Equal(t, book.GetVersion()+1, res.GetBook().GetVersion())
+
+	// Clearing the ISBN
+	res, err = server.UpdateBook(admin, &pb.UpdateBookRequest{
+		Id:         book.GetId(),
+		UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"isbn"}},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "", res.GetBook().GetIsbn_13())
+
+	for _, paths := range [][]string{{"title"}, {"published_date"}, {"version"}} {
+		_, err = server.UpdateBook(admin, &pb.UpdateBookRequest{
+			Id:         book.GetId(),
+			UpdateMask: &fieldmaskpb.FieldMask{Paths: paths},
+		})
+		assert.Equal(t, codes.InvalidArgument, status.Code(err), paths)
+	}
+}
+
+// integration test for withdrawing, listing and restoring books
+func TestDeleteBook(t *testing.T) {
+	setupTestDB(t)
+	ctx := context.Background()
+	server := &LibraryServer{}
+	admin := withPrincipal(ctx, &Principal{UserID: testUserID(t, "user1"), Role: "admin"})
+
+	// A copy of 1984 is borrowed by user1
+	nineteen, err := server.GetBook(ctx, &pb.GetBookRequest{Isbn: "9780451524935"})
+	require.NoError(t, err)
+	_, err = server.DeleteBook(admin, &pb.DeleteBookRequest{Id: nineteen.GetBook().GetId()})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	gatsby, err := server.GetBook(ctx, &pb.GetBookRequest{Isbn: "9780743273565"})
+	require.NoError(t, err)
+	gatsbyID := gatsby.GetBook().GetId()
+	_, err = server.DeleteBook(admin, &pb.DeleteBookRequest{Id: gatsbyID, Reason: "Damaged beyond repair"})
+	require.NoError(t, err)
+
+	// The withdrawn book is hidden from the catalog but listed for admins
+	_, err = server.GetBook(ctx, &pb.GetBookRequest{Id: gatsbyID})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+	_, err = server.BorrowBook(admin, &pb.BorrowBookRequest{BookId: gatsbyID})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+	_, err = server.DeleteBook(admin, &pb.DeleteBookRequest{Id: gatsbyID})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	list, err := server.ListBooks(ctx, &pb.ListBooksRequest{})
+	require.NoError(t, err)
+	assert.Equal(t, int32(4), list.GetTotalCount())
+	_, err = server.ListBooks(withPrincipal(ctx, &Principal{UserID: testUserID(t, "user2"), Role: "user"}), &pb.ListBooksRequest{Withdrawn: true})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	withdrawn, err := server.ListBooks(admin, &pb.ListBooksRequest{Withdrawn: true, SortBy: "withdrawn_at"})
+	require.NoError(t, err)
+	require.Len(t, withdrawn.GetBooks(), 1)
+	assert.Equal(t, "Damaged beyond repair", withdrawn.GetBooks()[0].GetWithdrawnReason())
+	assert.NotNil(t, withdrawn.GetBooks()[0].GetWithdrawnAt())
+
+	// The ISBN of the withdrawn book is free for a new edition until it is restored
+	edition, err := server.CreateBook(admin, &pb.CreateBookRequest{
+		Title:         "The Great Gatsby",
+		Author:        "F. Scott Fitzgerald",
+		PublishedDate: timestamppb.Now(),
+		Isbn:          "9780743273565",
+	})
+	require.NoError(t, err)
+	_, err = server.RestoreBook(admin, &pb.RestoreBookRequest{Id: gatsbyID})
+	assert.Equal(t, codes.AlreadyExists, status.Code(err))
+	_, err = server.DeleteBook(admin, &pb.DeleteBookRequest{Id: edition.GetBook().GetId()})
+	require.NoError(t, err)
+
+	restored, err := server.RestoreBook(admin, &pb.RestoreBookRequest{Id: gatsbyID})
+	require.NoError(t, err)
+	assert.Nil(t, restored.GetBook().GetWithdrawnAt())
+	assert.Equal(t, int32(1), restored.GetBook().GetTotalCopies(), "copies are kept")
+	_, err = server.RestoreBook(admin, &pb.RestoreBookRequest{Id: gatsbyID})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	_, err = server.RestoreBook(admin, &pb.RestoreBookRequest{Id: edition.GetBook().GetId()})
+	assert.Equal(t, codes.AlreadyExists, status.Code(err))
+
+	_, err = server.DeleteBook(admin, &pb.DeleteBookRequest{Id: "not-a-uuid"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+// integration test for deleting books once their retention period is over
+func TestPurgeWithdrawnBooks(t *testing.T) {
+	setupTestDB(t)
+	ctx := context.Background()
+	server := &LibraryServer{}
+	admin := withPrincipal(ctx, &Principal{UserID: testUserID(t, "user1"), Role: "admin"})
+
+	for _, isbn := range []string{"9780743273565", "9780142437247"} {
+		got, err := server.GetBook(ctx, &pb.GetBookRequest{Isbn: isbn})
+		require.NoError(t, err)
+		_, err = server.DeleteBook(admin, &pb.DeleteBookRequest{Id: got.GetBook().GetId()})
+		require.NoError(t, err)
+	}
+	// Only Gatsby is past the retention period, its cover goes with it
+	coverStorage = covers.NewLocalStorage(t.TempDir())
+	defer func() { coverStorage = nil }()
+	var gatsbyID string
+	require.NoError(t, config.Pool.QueryRow(ctx, `SELECT id FROM books WHERE isbn_13 = '9780743273565'`).Scan(&gatsbyID))
+	coverKey := covers.NewKey(gatsbyID, ".png")
+	require.NoError(t, coverStorage.Put(ctx, coverKey, "image/png", []byte("cover")))
+	require.NoError(t, coverStorage.Put(ctx, covers.ThumbnailKey(coverKey), "image/jpeg", []byte("thumbnail")))
+	_, err := config.Pool.Exec(ctx, `UPDATE books SET withdrawn_at = NOW() - INTERVAL '400 days', cover_key = $1 WHERE id = $2`, coverKey, gatsbyID)
+	require.NoError(t, err)
+
+	purgeWithdrawnBooks()
+
+	var remaining int
+	require.NoError(t, config.Pool.QueryRow(ctx, `SELECT COUNT(*) FROM books WHERE withdrawn_at IS NOT NULL`).Scan(&remaining))
+	assert.Equal(t, 1, remaining)
+	require.NoError(t, config.Pool.QueryRow(ctx, `SELECT COUNT(*) FROM books WHERE isbn_13 = '9780743273565'`).Scan(&remaining))
+	assert.Equal(t, 0, remaining)
+	for _, key := range []string{coverKey, covers.ThumbnailKey(coverKey)} {
+		_, _, err = coverStorage.Get(ctx, key)
+		assert.ErrorIs(t, err, covers.ErrNotFound, key)
+	}
+}
+
+// integration test for creating, fetching, updating and deleting a book
+func TestBookCRUD(t *testing.T) {
+	setupTestDB(t)
+	ctx := context.Background()
+	server := &LibraryServer{}
+	admin := withPrincipal(ctx, &Principal{UserID: testUserID(t, "user1"), Role: "admin"})
+	user2 := withPrincipal(ctx, &Principal{UserID: testUserID(t, "user2"), Role: "user"})
+	published := timestamppb.New(time.Date(1945, 8, 17, 0, 0, 0, 0, time.UTC))
+
+	for _, req := range []*pb.CreateBookRequest{
+		{Author: "George Orwell", PublishedDate: published},
+		{Title: "Animal Farm", Author: "  ", PublishedDate: published},
+		{Title: "Animal Farm", Author: "George Orwell"},
+		{Title: "Animal Farm", Author: "George Orwell", PublishedDate: published, Copies: maxCopiesPerRequest + 1},
+		{Title: "Animal Farm", Author: "George Orwell", PublishedDate: published, Category: "No Such Category"},
+	} {
+		_, err := server.CreateBook(admin, req)
+		assert.Equal(t, codes.InvalidArgument, status.Code(err), req)
+	}
+	_, err := server.CreateBook(user2, &pb.CreateBookRequest{Title: "Animal Farm", Author: "George Orwell", PublishedDate: published})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	created, err := server.CreateBook(admin, &pb.CreateBookRequest{Title: "Animal Farm", Author: "George Orwell", PublishedDate: published, Copies: 2})
+	require.NoError(t, err)
+	bookID := created.GetBook().GetId()
+	assert.Equal(t, int32(2), created.GetBook().GetTotalCopies())
+	assert.Equal(t, int32(1), created.GetBook().GetVersion())
+
+	got, err := server.GetBook(ctx, &pb.GetBookRequest{Id: bookID})
+	require.NoError(t, err)
+	assert.Equal(t, "Animal Farm", got.GetBook().GetTitle())
+	assert.Equal(t, "George Orwell", got.GetBook().GetAuthor())
+
+	updated, err := server.UpdateBook(admin, &pb.UpdateBookRequest{Id: bookID, Title: "Animal Farm: A Fairy Story", Author: "George Orwell", PublishedDate: published})
+	require.NoError(t, err)
+	assert.Equal(t, "Animal Farm: A Fairy Story", updated.GetBook().GetTitle())
+	_, err = server.UpdateBook(admin, &pb.UpdateBookRequest{Id: bookID, Author: "George Orwell", PublishedDate: published})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err), "title is required")
+	_, err = server.UpdateBook(user2, &pb.UpdateBookRequest{Id: bookID, Title: "Animal Farm", Author: "George Orwell", PublishedDate: published})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	_, err = server.DeleteBook(admin, &pb.DeleteBookRequest{Id: bookID})
+	require.NoError(t, err)
+
+	// Unknown and malformed ids
+	missing := "6f1c7e2a-1d1f-4e57-8d7b-3b8f7c1f2a10"
+	_, err = server.GetBook(ctx, &pb.GetBookRequest{Id: bookID})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+	_, err = server.GetBook(ctx, &pb.GetBookRequest{Id: missing})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+	_, err = server.GetBook(ctx, &pb.GetBookRequest{Id: "42"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = server.UpdateBook(admin, &pb.UpdateBookRequest{Id: missing, Title: "Animal Farm", Author: "George Orwell", PublishedDate: published})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+	_, err = server.UpdateBook(admin, &pb.UpdateBookRequest{Id: "42", Title: "Animal Farm", Author: "George Orwell", PublishedDate: published})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = server.DeleteBook(admin, &pb.DeleteBookRequest{Id: missing})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
+
+// integration test for releasing the holds of a withdrawn book and refusing new copies
+func TestDeleteBookReleasesHolds(t *testing.T) {
+	setupTestDB(t)
+	ctx := context.Background()
+	server := &LibraryServer{}
+	admin := withPrincipal(ctx, &Principal{UserID: testUserID(t, "user1"), Role: "admin"})
+	user2 := withPrincipal(ctx, &Principal{UserID: testUserID(t, "user2"), Role: "user"})
+	user3 := withPrincipal(ctx, &Principal{UserID: testUserID(t, "user3"), Role: "user"})
+
+	// The only copy of Moby-Dick waits on the hold shelf for user3, user1 queues behind
+	var bookID string
+	require.NoError(t, config.Pool.QueryRow(ctx, `SELECT id FROM books WHERE title = 'Moby-Dick'`).Scan(&bookID))
+	_, err := server.BorrowBook(user2, &pb.BorrowBookRequest{BookId: bookID})
+	require.NoError(t, err)
+	_, err = server.PlaceHold(user3, &pb.PlaceHoldRequest{BookId: bookID})
+	require.NoError(t, err)
+	_, err = server.PlaceHold(admin, &pb.PlaceHoldRequest{BookId: bookID})
+	require.NoError(t, err)
+	_, err = server.ReturnBook(user2, &pb.ReturnBookRequest{BookId: bookID})
+	require.NoError(t, err)
+
+	sub := availability.subscribe([]string{bookID})
+	defer availability.unsubscribe(sub)
+	_, err = server.DeleteBook(admin, &pb.DeleteBookRequest{Id: bookID})
+	require.NoError(t, err)
+	if assert.Len(t, sub.events, 1) {
+		event := <-sub.events
+		assert.Equal(t, pb.BookStatus_BOOK_STATUS_ON_HOLD, event.GetPreviousStatus())
+		assert.Equal(t, pb.BookStatus_BOOK_STATUS_AVAILABLE, event.GetStatus())
+	}
+
+	var active int
+	require.NoError(t, config.Pool.QueryRow(ctx, `SELECT COUNT(*) FROM holds WHERE book_id = $1 AND status IN ('Waiting', 'Ready')`, bookID).Scan(&active))
+	assert.Zero(t, active)
+	var copyStatus string
+	var userID *string
+	require.NoError(t, config.Pool.QueryRow(ctx, `SELECT status, user_id FROM bookcopies WHERE book_id = $1`, bookID).Scan(&copyStatus, &userID))
+	assert.Equal(t, "Available", copyStatus)
+	assert.Nil(t, userID)
+	var reason string
+	require.NoError(t, config.Pool.QueryRow(ctx, `SELECT reason FROM bookstatushistory WHERE book_id = $1 ORDER BY changed_at DESC LIMIT 1`, bookID).Scan(&reason))
+	assert.Equal(t, "Book withdrawn", reason)
+
+	// No new copy can start a hold queue again
+	_, err = server.AddBookCopy(admin, &pb.AddBookCopyRequest{BookId: bookID})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	_, err = server.AddBookCopy(admin, &pb.AddBookCopyRequest{BookId: "6f1c7e2a-1d1f-4e57-8d7b-3b8f7c1f2a10"})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
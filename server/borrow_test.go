@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"p3/gc2/config/database"
+	"p3/gc2/pb"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// integration test proving only one of many concurrent borrowers wins
+func TestBorrowBookConcurrentOnlyOneWins(t *testing.T) {
+	setupTestDB(t)
+
+	var bookID string
+	err := config.Pool.QueryRow(context.Background(), `SELECT id FROM books WHERE title = 'Moby-Dick'`).Scan(&bookID)
+	if err != nil {
+		t.Fatalf("failed to fetch book: %v", err)
+	}
+
+	borrowers := []string{testUserID(t, "user2"), testUserID(t, "user3")}
+	server := &LibraryServer{}
+
+	const attempts = 20
+	var (
+		wg     sync.WaitGroup
+		start  = make(chan struct{})
+		codesC = make(chan codes.Code, attempts)
+	)
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func(userID string) {
+			defer wg.Done()
+			ctx := withPrincipal(context.Background(), &Principal{UserID: userID, Role: "user"})
+			<-start
+			_, err := server.BorrowBook(ctx, &pb.BorrowBookRequest{BookId: bookID})
+			codesC <- status.Code(err)
+		}(borrowers[i%len(borrowers)])
+	}
+	close(start)
+	wg.Wait()
+	close(codesC)
+
+	counts := map[codes.Code]int{}
+	for code := range codesC {
+		counts[code]++
+	}
+	assert.Equal(t, 1, counts[codes.OK])
+	assert.Equal(t, attempts-1, counts[codes.FailedPrecondition])
+
+	var openLoans int
+	err = config.Pool.QueryRow(context.Background(), `SELECT COUNT(*) FROM borrowedbooks WHERE book_id = $1 AND return_date IS NULL`, bookID).Scan(&openLoans)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 1, openLoans)
+	}
+}
+
+// integration test for the renewal limit and the loans that can't be renewed
+func TestRenewBook(t *testing.T) {
+	setupTestDB(t)
+	ctx := context.Background()
+	server := &LibraryServer{}
+	borrower := withPrincipal(ctx, &Principal{UserID: testUserID(t, "user2"), Role: "user"})
+	waiter := withPrincipal(ctx, &Principal{UserID: testUserID(t, "user3"), Role: "user"})
+
+	var bookID string
+	require.NoError(t, config.Pool.QueryRow(ctx, `SELECT id FROM books WHERE title = 'Moby-Dick'`).Scan(&bookID))
+	borrowed, err := server.BorrowBook(borrower, &pb.BorrowBookRequest{BookId: bookID})
+	require.NoError(t, err)
+
+	_, err = server.RenewBook(waiter, &pb.RenewBookRequest{BookId: bookID})
+	assert.Equal(t, codes.NotFound, status.Code(err), "only the borrower renews")
+
+	// The default policy allows two renewals, each from today and never shortening the loan
+	renewed, err := server.RenewBook(borrower, &pb.RenewBookRequest{BookId: bookID})
+	require.NoError(t, err)
+	assert.Equal(t, int32(1), renewed.GetRenewalsRemaining())
+	assert.False(t, renewed.GetDueDate().AsTime().Before(borrowed.GetDueDate().AsTime()))
+	renewed, err = server.RenewBook(borrower, &pb.RenewBookRequest{BookId: bookID})
+	require.NoError(t, err)
+	assert.Equal(t, int32(0), renewed.GetRenewalsRemaining())
+	_, err = server.RenewBook(borrower, &pb.RenewBookRequest{BookId: bookID})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	assert.Contains(t, status.Convert(err).Message(), "renewal limit")
+
+	// A fresh loan that has gone overdue must be returned instead
+	_, err = config.Pool.Exec(ctx, `UPDATE borrowedbooks SET renewal_count = 0, due_date = NOW() - INTERVAL '1 day' WHERE book_id = $1 AND return_date IS NULL`, bookID)
+	require.NoError(t, err)
+	updateOverdueBooks()
+	_, err = server.RenewBook(borrower, &pb.RenewBookRequest{BookId: bookID})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	assert.Contains(t, status.Convert(err).Message(), "overdue")
+
+	// Back on time, a patron waiting for the book blocks the renewal
+	_, err = config.Pool.Exec(ctx, `UPDATE bookcopies SET status = 'Borrowed' WHERE book_id = $1`, bookID)
+	require.NoError(t, err)
+	_, err = config.Pool.Exec(ctx, `UPDATE borrowedbooks SET due_date = NOW() + INTERVAL '1 day' WHERE book_id = $1 AND return_date IS NULL`, bookID)
+	require.NoError(t, err)
+	_, err = server.PlaceHold(waiter, &pb.PlaceHoldRequest{BookId: bookID})
+	require.NoError(t, err)
+	_, err = server.RenewBook(borrower, &pb.RenewBookRequest{BookId: bookID})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	assert.Contains(t, status.Convert(err).Message(), "on hold")
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"p3/gc2/catalog"
+	"p3/gc2/config/database"
+	"p3/gc2/pb"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// maxCategoryNameLength matches the categories.name column.
+const maxCategoryNameLength = 100
+
+// categoryTree computes the path of every category, it is joined as t on
+// the categories table aliased c.
+const categoryTree = `
+	WITH RECURSIVE tree AS (
+		SELECT id, ARRAY[name::TEXT] AS path FROM categories WHERE parent_id IS NULL
+		UNION ALL
+		SELECT c.id, t.path || c.name::TEXT FROM categories c JOIN tree t ON c.parent_id = t.id
+	)`
+
+// categoryColumns selects a category with its path and the number of books
+// in the catalog filed under it.
+const categoryColumns = `c.id, c.name, c.parent_id::TEXT, t.path,
+	(SELECT COUNT(*)::INT FROM books b WHERE b.category = c.name AND b.withdrawn_at IS NULL),
+	c.created_at, c.updated_at`
+
+// scanCategory reads a categories row selected with categoryColumns into a pb.Category.
+func scanCategory(row pgx.Row) (*pb.Category, error) {
+	var (
+		category             pb.Category
+		parentID             *string
+		createdAt, updatedAt time.Time
+	)
+	if err := row.Scan(&category.Id, &category.Name, &parentID, &category.Path, &category.BookCount, &createdAt, &updatedAt); err != nil {
+		return nil, err
+	}
+	if parentID != nil {
+		category.ParentId = *parentID
+	}
+	category.CreatedAt = timestamppb.New(createdAt)
+	category.UpdatedAt = timestamppb.New(updatedAt)
+	return &category, nil
+}
+
+// fetchCategory reads a single category with its path.
+func fetchCategory(ctx context.Context, q querier, id string) (*pb.Category, error) {
+	return scanCategory(q.QueryRow(ctx, categoryTree+` SELECT `+categoryColumns+` FROM categories c JOIN tree t ON t.id = c.id WHERE c.id = $1`, id))
+}
+
+// validateCategory checks the name and parent of a category and returns the
+// trimmed name.
+func validateCategory(name, parentID string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", status.Error(codes.InvalidArgument, "name is required")
+	}
+	if utf8.RuneCountInString(name) > maxCategoryNameLength {
+		return "", status.Errorf(codes.InvalidArgument, "name must be at most %d characters", maxCategoryNameLength)
+	}
+	if parentID != "" {
+		if err := validateID(parentID, "parent category"); err != nil {
+			return "", err
+		}
+	}
+	return name, nil
+}
+
+// categoryError turns the constraint violations of a category write into
+// their status, or nil for other errors.
+func categoryError(err error) error {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return nil
+	}
+	switch {
+	case pgErr.Code == "23505":
+		return status.Error(codes.AlreadyExists, "a category with this name already exists")
+	case pgErr.Code == "23503" && pgErr.ConstraintName == "categories_parent_id_fkey":
+		return status.Error(codes.NotFound, "parent category not found")
+	}
+	return nil
+}
+
+// CreateCategory adds a category, under parent_id or at the top level (admin only).
+func (s *LibraryServer) CreateCategory(ctx context.Context, req *pb.CreateCategoryRequest) (*pb.CreateCategoryResponse, error) {
+	if err := requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+	name, err := validateCategory(req.GetName(), req.GetParentId())
+	if err != nil {
+		return nil, err
+	}
+
+	var id string
+	err = config.Pool.QueryRow(ctx, `INSERT INTO categories (name, parent_id) VALUES ($1, NULLIF($2, '')::UUID) RETURNING id`, name, req.GetParentId()).Scan(&id)
+	if invalid := categoryError(err); invalid != nil {
+		return nil, invalid
+	}
+	if err != nil {
+		log.Printf("Error inserting into categories table: %v", err)
+		return nil, status.Error(codes.Internal, "failed to create category")
+	}
+
+	category, err := fetchCategory(ctx, config.Pool, id)
+	if err != nil {
+		log.Printf("Error fetching category: %v", err)
+		return nil, status.Error(codes.Internal, "failed to fetch category")
+	}
+	return &pb.CreateCategoryResponse{
+		Message:  "Category created successfully",
+		Category: category,
+	}, nil
+}
+
+// ListCategories returns every category sorted by path, so parents come
+// before their subcategories.
+func (s *LibraryServer) ListCategories(ctx context.Context, req *pb.ListCategoriesRequest) (*pb.ListCategoriesResponse, error) {
+	rows, err := config.Pool.Query(ctx, categoryTree+` SELECT `+categoryColumns+` FROM categories c JOIN tree t ON t.id = c.id ORDER BY t.path`)
+	if err != nil {
+		log.Printf("Error fetching categories: %v", err)
+		return nil, status.Error(codes.Internal, "failed to fetch categories")
+	}
+	defer rows.Close()
+
+	categories := []*pb.Category{}
+	for rows.Next() {
+		category, err := scanCategory(rows)
+		if err != nil {
+			log.Printf("Error scanning category: %v", err)
+			return nil, status.Error(codes.Internal, "failed to fetch categories")
+		}
+		categories = append(categories, category)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, status.Error(codes.Internal, "failed to fetch categories")
+	}
+	return &pb.ListCategoriesResponse{Categories: categories}, nil
+}
+
+// UpdateCategory renames a category and moves it under another parent
+// (admin only). Books and loan policies follow the rename, a category can't
+// move under itself or one of its subcategories.
+func (s *LibraryServer) UpdateCategory(ctx context.Context, req *pb.UpdateCategoryRequest) (*pb.UpdateCategoryResponse, error) {
+	if err := requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+	if err := validateID(req.GetId(), "category"); err != nil {
+		return nil, err
+	}
+	name, err := validateCategory(req.GetName(), req.GetParentId())
+	if err != nil {
+		return nil, err
+	}
+	if req.GetParentId() == req.GetId() {
+		return nil, status.Error(codes.InvalidArgument, "a category can't be its own parent")
+	}
+
+	tx, err := config.Pool.Begin(ctx)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to begin transaction")
+	}
+	defer tx.Rollback(ctx)
+
+	// Serialize changes to the tree so two concurrent moves can't form a cycle
+	if _, err := tx.Exec(ctx, `LOCK TABLE categories IN SHARE ROW EXCLUSIVE MODE`); err != nil {
+		return nil, status.Error(codes.Internal, "failed to lock categories")
+	}
+	if req.GetParentId() != "" {
+		var cycle bool
+		err := tx.QueryRow(ctx, `
+			WITH RECURSIVE subtree AS (
+				SELECT id FROM categories WHERE id = $1
+				UNION
+				SELECT c.id FROM categories c JOIN subtree s ON c.parent_id = s.id
+			)
+			SELECT EXISTS (SELECT 1 FROM subtree WHERE id = $2)`, req.GetId(), req.GetParentId()).Scan(&cycle)
+		if err != nil {
+			return nil, status.Error(codes.Internal, "failed to check category tree")
+		}
+		if cycle {
+			return nil, status.Error(codes.FailedPrecondition, "a category can't move under one of its subcategories")
+		}
+	}
+
+	res, err := tx.Exec(ctx, `UPDATE categories SET name = $2, parent_id = NULLIF($3, '')::UUID, updated_at = NOW() WHERE id = $1`, req.GetId(), name, req.GetParentId())
+	if invalid := categoryError(err); invalid != nil {
+		return nil, invalid
+	}
+	if err != nil {
+		log.Printf("Error updating category: %v", err)
+		return nil, status.Error(codes.Internal, "failed to update category")
+	}
+	if res.RowsAffected() == 0 {
+		return nil, status.Error(codes.NotFound, "category not found")
+	}
+
+	category, err := fetchCategory(ctx, tx, req.GetId())
+	if err != nil {
+		log.Printf("Error fetching category: %v", err)
+		return nil, status.Error(codes.Internal, "failed to fetch category")
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, status.Error(codes.Internal, "failed to commit transaction")
+	}
+	return &pb.UpdateCategoryResponse{
+		Message:  "Category updated successfully",
+		Category: category,
+	}, nil
+}
+
+// DeleteCategory deletes a category without subcategories or loan policies
+// (admin only). Its books move to the parent category, or lose their
+// category when it is a top level one.
+func (s *LibraryServer) DeleteCategory(ctx context.Context, req *pb.DeleteCategoryRequest) (*pb.DeleteCategoryResponse, error) {
+	if err := requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+	if err := validateID(req.GetId(), "category"); err != nil {
+		return nil, err
+	}
+
+	tx, err := config.Pool.Begin(ctx)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to begin transaction")
+	}
+	defer tx.Rollback(ctx)
+
+	// The row lock holds back new subcategories and policies until the delete is done
+	var (
+		name                     string
+		parentName               *string
+		hasChildren, hasPolicies bool
+	)
+	err = tx.QueryRow(ctx, `
+		SELECT c.name, p.name,
+			EXISTS (SELECT 1 FROM categories s WHERE s.parent_id = c.id),
+			EXISTS (SELECT 1 FROM loanpolicies lp WHERE lp.category = c.name)
+		FROM categories c LEFT JOIN categories p ON p.id = c.parent_id
+		WHERE c.id = $1
+		FOR UPDATE OF c`, req.GetId()).Scan(&name, &parentName, &hasChildren, &hasPolicies)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, status.Error(codes.NotFound, "category not found")
+	}
+	if err != nil {
+		log.Printf("Error fetching category: %v", err)
+		return nil, status.Error(codes.Internal, "failed to fetch category")
+	}
+	if hasChildren {
+		return nil, status.Error(codes.FailedPrecondition, "category has subcategories, move or delete them first")
+	}
+	if hasPolicies {
+		return nil, status.Error(codes.FailedPrecondition, "category has loan policies, delete them first")
+	}
+
+	_, err = tx.Exec(ctx, `UPDATE books SET category = $2, updated_at = NOW(), version = version + 1 WHERE category = $1`, name, parentName)
+	if err != nil {
+		log.Printf("Error moving books of category %s: %v", name, err)
+		return nil, status.Error(codes.Internal, "failed to delete category")
+	}
+	if _, err := tx.Exec(ctx, `DELETE FROM categories WHERE id = $1`, req.GetId()); err != nil {
+		log.Printf("Error deleting category: %v", err)
+		return nil, status.Error(codes.Internal, "failed to delete category")
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, status.Error(codes.Internal, "failed to commit transaction")
+	}
+	return &pb.DeleteCategoryResponse{Message: "Category deleted successfully"}, nil
+}
+
+// SetBookTags replaces the tags of a book (admin only). Tags are normalized
+// and created on first use.
+func (s *LibraryServer) SetBookTags(ctx context.Context, req *pb.SetBookTagsRequest) (*pb.SetBookTagsResponse, error) {
+	if err := requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+	if err := validateBookID(req.GetBookId()); err != nil {
+		return nil, err
+	}
+	tags, err := catalog.NormalizeTags(req.GetTags())
+	var optErr *catalog.OptionError
+	if errors.As(err, &optErr) {
+		return nil, status.Error(codes.InvalidArgument, optErr.Error())
+	}
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to set tags")
+	}
+
+	tx, err := config.Pool.Begin(ctx)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to begin transaction")
+	}
+	defer tx.Rollback(ctx)
+
+	// The tags are part of the book, changing them bumps its version
+	res, err := tx.Exec(ctx, `UPDATE books SET updated_at = NOW(), version = version + 1 WHERE id = $1 AND withdrawn_at IS NULL`, req.GetBookId())
+	if err != nil {
+		log.Printf("Error updating book: %v", err)
+		return nil, status.Error(codes.Internal, "failed to set tags")
+	}
+	if res.RowsAffected() == 0 {
+		return nil, status.Error(codes.NotFound, "book not found")
+	}
+
+	if _, err := tx.Exec(ctx, `INSERT INTO tags (name) SELECT unnest($1::TEXT[]) ON CONFLICT (name) DO NOTHING`, tags); err != nil {
+		log.Printf("Error inserting into tags table: %v", err)
+		return nil, status.Error(codes.Internal, "failed to set tags")
+	}
+	for _, stmt := range []string{
+		`DELETE FROM booktags WHERE book_id = $1 AND tag_id NOT IN (SELECT id FROM tags WHERE name = ANY($2::TEXT[]))`,
+		`INSERT INTO booktags (book_id, tag_id) SELECT $1, id FROM tags WHERE name = ANY($2::TEXT[]) ON CONFLICT DO NOTHING`,
+	} {
+		if _, err := tx.Exec(ctx, stmt, req.GetBookId(), tags); err != nil {
+			log.Printf("Error setting tags of book %s: %v", req.GetBookId(), err)
+			return nil, status.Error(codes.Internal, "failed to set tags")
+		}
+	}
+
+	book, err := scanBook(tx.QueryRow(ctx, `SELECT `+catalog.BookColumns+` FROM books WHERE id = $1`, req.GetBookId()))
+	if err != nil {
+		log.Printf("Error fetching book: %v", err)
+		return nil, status.Error(codes.Internal, "failed to fetch book")
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, status.Error(codes.Internal, "failed to commit transaction")
+	}
+	return &pb.SetBookTagsResponse{
+		Message: "Tags updated successfully",
+		Book:    book,
+	}, nil
+}
+
+// ListTags returns every tag with the number of books in the catalog
+// carrying it, sorted by name.
+func (s *LibraryServer) ListTags(ctx context.Context, req *pb.ListTagsRequest) (*pb.ListTagsResponse, error) {
+	rows, err := config.Pool.Query(ctx, `
+		SELECT t.name, COUNT(b.id)::INT
+		FROM tags t
+		LEFT JOIN booktags bt ON bt.tag_id = t.id
+		LEFT JOIN books b ON b.id = bt.book_id AND b.withdrawn_at IS NULL
+		GROUP BY t.name
+		ORDER BY t.name`)
+	if err != nil {
+		log.Printf("Error fetching tags: %v", err)
+		return nil, status.Error(codes.Internal, "failed to fetch tags")
+	}
+	defer rows.Close()
+
+	tags := []*pb.Tag{}
+	for rows.Next() {
+		var tag pb.Tag
+		if err := rows.Scan(&tag.Name, &tag.BookCount); err != nil {
+			log.Printf("Error scanning tag: %v", err)
+			return nil, status.Error(codes.Internal, "failed to fetch tags")
+		}
+		tags = append(tags, &tag)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, status.Error(codes.Internal, "failed to fetch tags")
+	}
+	return &pb.ListTagsResponse{Tags: tags}, nil
+}
+
+// DeleteTag removes a tag from every book and deletes it (admin only).
+func (s *LibraryServer) DeleteTag(ctx context.Context, req *pb.DeleteTagRequest) (*pb.DeleteTagResponse, error) {
+	if err := requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+	name := catalog.NormalizeTag(req.GetName())
+	if name == "" {
+		return nil, status.Error(codes.InvalidArgument, "tag name is required")
+	}
+
+	// The books that carried the tag change, bump their versions with the delete
+	var deleted int
+	err := config.Pool.QueryRow(ctx, `
+		WITH deleted AS (
+			DELETE FROM tags WHERE name = $1 RETURNING id
+		), tagged AS (
+			UPDATE books SET updated_at = NOW(), version = version + 1
+			WHERE id IN (SELECT bt.book_id FROM booktags bt JOIN deleted d ON d.id = bt.tag_id)
+		)
+		SELECT COUNT(*) FROM deleted`, name).Scan(&deleted)
+	if err != nil {
+		log.Printf("Error deleting tag: %v", err)
+		return nil, status.Error(codes.Internal, "failed to delete tag")
+	}
+	if deleted == 0 {
+		return nil, status.Error(codes.NotFound, "tag not found")
+	}
+	return &pb.DeleteTagResponse{Message: "Tag deleted successfully"}, nil
+}
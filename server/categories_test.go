@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"p3/gc2/pb"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+)
+
+// integration test for managing the category tree and filtering books by category
+func TestCategories(t *testing.T) {
+	setupTestDB(t)
+	ctx := context.Background()
+	server := &LibraryServer{}
+	admin := withPrincipal(ctx, &Principal{UserID: testUserID(t, "user1"), Role: "admin"})
+	user2 := withPrincipal(ctx, &Principal{UserID: testUserID(t, "user2"), Role: "user"})
+
+	list, err := server.ListCategories(ctx, &pb.ListCategoriesRequest{})
+	require.NoError(t, err)
+	byName := map[string]*pb.Category{}
+	for _, category := range list.GetCategories() {
+		byName[category.GetName()] = category
+	}
+	require.Contains(t, byName, "Classics")
+	assert.Equal(t, []string{"Fiction", "Classics"}, byName["Classics"].GetPath())
+	assert.Equal(t, int32(5), byName["Fiction"].GetBookCount())
+
+	_, err = server.CreateCategory(user2, &pb.CreateCategoryRequest{Name: "Poetry"})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = server.CreateCategory(admin, &pb.CreateCategoryRequest{Name: "fiction"})
+	assert.Equal(t, codes.AlreadyExists, status.Code(err), "names are unique regardless of case")
+	dystopian, err := server.CreateCategory(admin, &pb.CreateCategoryRequest{Name: " Dystopian ", ParentId: byName["Fiction"].GetId()})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"Fiction", "Dystopian"}, dystopian.GetCategory().GetPath())
+
+	// A category can't move below itself
+	_, err = server.UpdateCategory(admin, &pb.UpdateCategoryRequest{Id: byName["Fiction"].GetId(), Name: "Fiction", ParentId: dystopian.GetCategory().GetId()})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	// Filing 1984 under the subcategory keeps it in listings of the parent
+	nineteen, err := server.GetBook(ctx, &pb.GetBookRequest{Isbn: "9780451524935"})
+	require.NoError(t, err)
+	nineteenID := nineteen.GetBook().GetId()
+	_, err = server.UpdateBook(admin, &pb.UpdateBookRequest{Id: nineteenID, Category: "Utopian", UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"category"}}})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err), "unknown category")
+	_, err = server.UpdateBook(admin, &pb.UpdateBookRequest{Id: nineteenID, Category: "Dystopian", UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"category"}}})
+	require.NoError(t, err)
+
+	filtered, err := server.ListBooks(ctx, &pb.ListBooksRequest{Category: "dystopian"})
+	require.NoError(t, err)
+	require.Len(t, filtered.GetBooks(), 1)
+	assert.Equal(t, "1984", filtered.GetBooks()[0].GetTitle())
+	filtered, err = server.ListBooks(ctx, &pb.ListBooksRequest{Category: "Fiction"})
+	require.NoError(t, err)
+	assert.Equal(t, int32(5), filtered.GetTotalCount())
+
+	// Renames carry over to the books
+	renamed, err := server.UpdateCategory(admin, &pb.UpdateCategoryRequest{Id: dystopian.GetCategory().GetId(), Name: "Dystopias", ParentId: byName["Fiction"].GetId()})
+	require.NoError(t, err)
+	assert.Equal(t, "Dystopias", renamed.GetCategory().GetName())
+	nineteen, err = server.GetBook(ctx, &pb.GetBookRequest{Id: nineteenID})
+	require.NoError(t, err)
+	assert.Equal(t, "Dystopias", nineteen.GetBook().GetCategory())
+
+	// Deleting a category files its books under the parent
+	_, err = server.DeleteCategory(admin, &pb.DeleteCategoryRequest{Id: byName["Reference"].GetId()})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err), "Reference has a subcategory")
+	_, err = server.DeleteCategory(admin, &pb.DeleteCategoryRequest{Id: dystopian.GetCategory().GetId()})
+	require.NoError(t, err)
+	nineteen, err = server.GetBook(ctx, &pb.GetBookRequest{Id: nineteenID})
+	require.NoError(t, err)
+	assert.Equal(t, "Fiction", nineteen.GetBook().GetCategory())
+}
+
+// integration test for tagging books and filtering by tag
+func TestBookTags(t *testing.T) {
+	setupTestDB(t)
+	ctx := context.Background()
+	server := &LibraryServer{}
+	admin := withPrincipal(ctx, &Principal{UserID: testUserID(t, "user1"), Role: "admin"})
+
+	gatsby, err := server.GetBook(ctx, &pb.GetBookRequest{Isbn: "9780743273565"})
+	require.NoError(t, err)
+	gatsbyID := gatsby.GetBook().GetId()
+
+	res, err := server.SetBookTags(admin, &pb.SetBookTagsRequest{BookId: gatsbyID, Tags: []string{"Jazz  Age", "new york", "jazz age", " "}})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"jazz age", "new york"}, res.GetBook().GetTags())
+	assert.Equal(t, gatsby.GetBook().GetVersion()+1, res.GetBook().GetVersion())
+
+	res, err = server.SetBookTags(admin, &pb.SetBookTagsRequest{BookId: gatsbyID, Tags: []string{"New York", "american dream"}})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"american dream", "new york"}, res.GetBook().GetTags())
+
+	found, err := server.SearchBooks(ctx, &pb.SearchBooksRequest{Query: "great", Tag: "American Dream"})
+	require.NoError(t, err)
+	require.Len(t, found.GetResults(), 1)
+	found, err = server.SearchBooks(ctx, &pb.SearchBooksRequest{Query: "great", Tag: "new york", Category: "Reference"})
+	require.NoError(t, err)
+	assert.Empty(t, found.GetResults())
+
+	tags, err := server.ListTags(ctx, &pb.ListTagsRequest{})
+	require.NoError(t, err)
+	counts := map[string]int32{}
+	for _, tag := range tags.GetTags() {
+		counts[tag.GetName()] = tag.GetBookCount()
+	}
+	assert.Equal(t, map[string]int32{"american dream": 1, "jazz age": 0, "new york": 1}, counts)
+
+	_, err = server.DeleteTag(admin, &pb.DeleteTagRequest{Name: "New York"})
+	require.NoError(t, err)
+	_, err = server.DeleteTag(admin, &pb.DeleteTagRequest{Name: "new york"})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+	list, err := server.ListBooks(ctx, &pb.ListBooksRequest{Tag: "american dream"})
+	require.NoError(t, err)
+	require.Len(t, list.GetBooks(), 1)
+	assert.Equal(t, []string{"american dream"}, list.GetBooks()[0].GetTags())
+
+	_, err = server.SetBookTags(admin, &pb.SetBookTagsRequest{BookId: gatsbyID, Tags: []string{strings.Repeat("a", 51)}})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+// integration test for keeping the books of a non-borrowable category in the library
+func TestBorrowNonBorrowableCategory(t *testing.T) {
+	setupTestDB(t)
+	ctx := context.Background()
+	server := &LibraryServer{}
+	admin := withPrincipal(ctx, &Principal{UserID: testUserID(t, "user1"), Role: "admin"})
+	user2 := withPrincipal(ctx, &Principal{UserID: testUserID(t, "user2"), Role: "user"})
+
+	moby, err := server.GetBook(ctx, &pb.GetBookRequest{Isbn: "9780142437247"})
+	require.NoError(t, err)
+	mobyID := moby.GetBook().GetId()
+	_, err = server.UpdateBook(admin, &pb.UpdateBookRequest{Id: mobyID, Category: "Rare Books", UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"category"}}})
+	require.NoError(t, err)
+
+	_, err = server.BorrowBook(user2, &pb.BorrowBookRequest{BookId: mobyID})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	// Reference books go out for a week
+	_, err = server.UpdateBook(admin, &pb.UpdateBookRequest{Id: mobyID, Category: "Reference", UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"category"}}})
+	require.NoError(t, err)
+	_, err = server.BorrowBook(user2, &pb.BorrowBookRequest{BookId: mobyID})
+	assert.NoError(t, err)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"p3/gc2/bookstatus"
+	"p3/gc2/config/database"
+	"p3/gc2/pb"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const copyColumns = `id, book_id, barcode, status, user_id, created_at, updated_at`
+
+// scanCopy reads a bookcopies row selected with copyColumns into a pb.BookCopy.
+func scanCopy(row pgx.Row) (*pb.BookCopy, error) {
+	var (
+		bookCopy             pb.BookCopy
+		copyStatus           string
+		userID               *string
+		createdAt, updatedAt time.Time
+	)
+	if err := row.Scan(&bookCopy.Id, &bookCopy.BookId, &bookCopy.Barcode, &copyStatus, &userID, &createdAt, &updatedAt); err != nil {
+		return nil, err
+	}
+	bookCopy.Status = bookstatus.ToProto(bookstatus.Status(copyStatus))
+	if userID != nil {
+		bookCopy.UserId = *userID
+	}
+	bookCopy.CreatedAt = timestamppb.New(createdAt)
+	bookCopy.UpdatedAt = timestamppb.New(updatedAt)
+	return &bookCopy, nil
+}
+
+// AddBookCopy adds a physical copy to a book (admin only). The new copy goes
+// straight to the hold shelf when patrons are waiting for the book. Withdrawn
+// books take no new copies until they are restored.
+func (s *LibraryServer) AddBookCopy(ctx context.Context, req *pb.AddBookCopyRequest) (*pb.AddBookCopyResponse, error) {
+	principal, err := requirePrincipal(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !principal.IsAdmin() {
+		return nil, status.Error(codes.PermissionDenied, "permission denied admin use only")
+	}
+	if err := validateBookID(req.GetBookId()); err != nil {
+		return nil, err
+	}
+
+	tx, err := config.Pool.Begin(ctx)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to begin transaction")
+	}
+	defer tx.Rollback(ctx)
+
+	// Share-lock the book so it can't be withdrawn while the copy is added
+	var withdrawn bool
+	err = tx.QueryRow(ctx, `SELECT withdrawn_at IS NOT NULL FROM books WHERE id = $1 FOR SHARE`, req.GetBookId()).Scan(&withdrawn)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, status.Error(codes.NotFound, "book not found")
+	}
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to fetch book")
+	}
+	if withdrawn {
+		return nil, status.Error(codes.FailedPrecondition, "book is withdrawn, restore it before adding copies")
+	}
+
+	// An empty barcode falls back to the generated column default
+	query := `INSERT INTO bookcopies (book_id, status, barcode) VALUES ($1, $2, $3) RETURNING ` + lockedCopyColumns
+	args := []any{req.GetBookId(), string(bookstatus.Available), req.GetBarcode()}
+	if req.GetBarcode() == "" {
+		query = `INSERT INTO bookcopies (book_id, status) VALUES ($1, $2) RETURNING ` + lockedCopyColumns
+		args = args[:2]
+	}
+	bookCopy, err := scanLockedCopy(tx.QueryRow(ctx, query, args...))
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+			return nil, status.Error(codes.AlreadyExists, "barcode is already in use")
+		}
+		log.Printf("Error inserting into bookcopies table: %v", err)
+		return nil, status.Error(codes.Internal, "failed to add copy")
+	}
+
+	_, err = tx.Exec(ctx, `
+		INSERT INTO bookstatushistory (book_id, copy_id, to_status, actor_id, reason)
+		VALUES ($1, $2, $3, $4, 'Created')`, bookCopy.BookID, bookCopy.ID, string(bookCopy.Status), principal.UserID)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to record copy status")
+	}
+
+	if err := advanceHoldQueue(ctx, tx, bookCopy, &principal.UserID, "Added"); err != nil {
+		return nil, statusError(err, "failed to advance hold queue")
+	}
+
+	added, err := scanCopy(tx.QueryRow(ctx, `SELECT `+copyColumns+` FROM bookcopies WHERE id = $1`, bookCopy.ID))
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to fetch copy")
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, status.Error(codes.Internal, "failed to commit transaction")
+	}
+
+	availability.publish(bookCopy, bookstatus.Available)
+
+	return &pb.AddBookCopyResponse{
+		Message: "Copy added successfully",
+		Copy:    added,
+	}, nil
+}
+
+// ListBookCopies returns the copies of a book ordered by barcode. Borrowers
+// are only shown to admins and to the borrowers themselves.
+func (s *LibraryServer) ListBookCopies(ctx context.Context, req *pb.ListBookCopiesRequest) (*pb.ListBookCopiesResponse, error) {
+	principal, err := requirePrincipal(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateBookID(req.GetBookId()); err != nil {
+		return nil, err
+	}
+
+	var exists bool
+	if err := config.Pool.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM books WHERE id = $1)`, req.GetBookId()).Scan(&exists); err != nil {
+		return nil, status.Error(codes.Internal, "failed to fetch book")
+	}
+	if !exists {
+		return nil, status.Error(codes.NotFound, "book not found")
+	}
+
+	copies, err := collectRows(ctx, `SELECT `+copyColumns+` FROM bookcopies WHERE book_id = $1 ORDER BY barcode`, req.GetBookId(), scanCopy)
+	if err != nil {
+		log.Printf("Error fetching copies: %v", err)
+		return nil, status.Error(codes.Internal, "failed to fetch copies")
+	}
+	for _, bookCopy := range copies {
+		if !principal.IsAdmin() && bookCopy.GetUserId() != principal.UserID {
+			bookCopy.UserId = ""
+		}
+	}
+
+	return &pb.ListBookCopiesResponse{Copies: copies}, nil
+}
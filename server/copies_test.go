@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"p3/gc2/config/database"
+	"p3/gc2/pb"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// integration test for borrowing any available copy of a title
+func TestBorrowAnyCopy(t *testing.T) {
+	setupTestDB(t)
+	ctx := context.Background()
+
+	var bookID string
+	require.NoError(t, config.Pool.QueryRow(ctx, `SELECT id FROM books WHERE title = '1984'`).Scan(&bookID))
+
+	server := &LibraryServer{}
+	admin := withPrincipal(ctx, &Principal{UserID: testUserID(t, "user1"), Role: "admin"})
+	user2 := withPrincipal(ctx, &Principal{UserID: testUserID(t, "user2"), Role: "user"})
+	user3 := withPrincipal(ctx, &Principal{UserID: testUserID(t, "user3"), Role: "user"})
+
+	// user1 has the first of three copies out, the other two go in barcode order
+	first, err := server.BorrowBook(user2, &pb.BorrowBookRequest{BookId: bookID})
+	require.NoError(t, err)
+	assert.Equal(t, "1984-2", first.GetBarcode())
+
+	second, err := server.BorrowBook(user3, &pb.BorrowBookRequest{BookId: bookID})
+	require.NoError(t, err)
+	assert.Equal(t, "1984-3", second.GetBarcode())
+
+	book, err := server.GetBook(ctx, &pb.GetBookRequest{Id: bookID})
+	require.NoError(t, err)
+	assert.Equal(t, int32(3), book.GetBook().GetTotalCopies())
+	assert.Equal(t, int32(0), book.GetBook().GetAvailableCopies())
+
+	_, err = server.BorrowBook(user2, &pb.BorrowBookRequest{BookId: bookID})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	// A new copy goes straight to the patron waiting for the book
+	hold, err := server.PlaceHold(user2, &pb.PlaceHoldRequest{BookId: bookID})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err), "user2 already has a copy")
+	assert.Nil(t, hold)
+
+	_, err = server.ReturnBook(user2, &pb.ReturnBookRequest{BookId: bookID})
+	require.NoError(t, err)
+	_, err = server.BorrowBook(user3, &pb.BorrowBookRequest{CopyId: first.GetCopyId()})
+	require.NoError(t, err)
+
+	hold, err = server.PlaceHold(user2, &pb.PlaceHoldRequest{BookId: bookID})
+	require.NoError(t, err)
+
+	added, err := server.AddBookCopy(admin, &pb.AddBookCopyRequest{BookId: bookID, Barcode: "1984-4"})
+	require.NoError(t, err)
+	assert.Equal(t, pb.BookStatus_BOOK_STATUS_ON_HOLD, added.GetCopy().GetStatus())
+
+	_, err = server.AddBookCopy(admin, &pb.AddBookCopyRequest{BookId: bookID, Barcode: "1984-4"})
+	assert.Equal(t, codes.AlreadyExists, status.Code(err))
+
+	borrowed, err := server.BorrowBook(user2, &pb.BorrowBookRequest{BookId: bookID})
+	require.NoError(t, err)
+	assert.Equal(t, added.GetCopy().GetId(), borrowed.GetCopyId())
+
+	var holdStatus string
+	require.NoError(t, config.Pool.QueryRow(ctx, `SELECT status FROM holds WHERE id = $1`, hold.GetHold().GetId()).Scan(&holdStatus))
+	assert.Equal(t, "Fulfilled", holdStatus)
+
+	copies, err := server.ListBookCopies(user3, &pb.ListBookCopiesRequest{BookId: bookID})
+	require.NoError(t, err)
+	require.Len(t, copies.GetCopies(), 4)
+	assert.Empty(t, copies.GetCopies()[0].GetUserId(), "other borrowers are hidden from patrons")
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"p3/gc2/config/database"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// setupTestDB points config.Pool at the database in TEST_DATABASE_URL and
+// recreates the schema from ddl.sql. Tests that need PostgreSQL are skipped
+// when the variable is not set. The database is wiped, never point it at real data.
+func setupTestDB(t *testing.T) {
+	t.Helper()
+
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL not set, skipping database test")
+	}
+
+	ctx := context.Background()
+	pool, err := pgxpool.New(ctx, url)
+	if err != nil {
+		t.Fatalf("failed to connect to test database: %v", err)
+	}
+
+	ddl, err := config.ReadSQLCommands("../config/database/ddl.sql")
+	if err != nil {
+		t.Fatalf("failed to read ddl: %v", err)
+	}
+	if err := config.ExecuteSQLCommands(ctx, pool, ddl); err != nil {
+		t.Fatalf("failed to apply ddl: %v", err)
+	}
+
+	previous := config.Pool
+	config.Pool = pool
+	t.Cleanup(func() {
+		config.Pool = previous
+		pool.Close()
+	})
+}
+
+// testUserID returns the id of one of the users seeded by ddl.sql.
+func testUserID(t *testing.T, username string) string {
+	t.Helper()
+
+	var id string
+	if err := config.Pool.QueryRow(context.Background(), `SELECT id FROM users WHERE username = $1`, username).Scan(&id); err != nil {
+		t.Fatalf("failed to fetch user %s: %v", username, err)
+	}
+	return id
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"p3/gc2/config/database"
+	"p3/gc2/pb"
+
+	"github.com/jackc/pgx/v5"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// fineBlockThresholdCents is the unpaid balance above which BorrowBook refuses
+// new loans. It can be overridden with FINE_BLOCK_THRESHOLD_CENTS.
+var fineBlockThresholdCents int64 = 1000
+
+const fineEntryColumns = `id, user_id, borrowed_book_id, entry_type, amount_cents, note, recorded_by, created_at`
+
+// scanFineEntry reads a fineledger row selected with fineEntryColumns into a pb.FineEntry.
+func scanFineEntry(row pgx.Row) (*pb.FineEntry, error) {
+	var (
+		entry                            pb.FineEntry
+		borrowedBookID, note, recordedBy *string
+		createdAt                        time.Time
+	)
+	if err := row.Scan(&entry.Id, &entry.UserId, &borrowedBookID, &entry.EntryType, &entry.AmountCents, &note, &recordedBy, &createdAt); err != nil {
+		return nil, err
+	}
+	if borrowedBookID != nil {
+		entry.BorrowedBookId = *borrowedBookID
+	}
+	if note != nil {
+		entry.Note = *note
+	}
+	if recordedBy != nil {
+		entry.RecordedBy = *recordedBy
+	}
+	entry.CreatedAt = timestamppb.New(createdAt)
+	return &entry, nil
+}
+
+// fineBalance returns the user's unpaid balance: charges minus payments and waivers.
+func fineBalance(ctx context.Context, q querier, userID string) (int64, error) {
+	var balance int64
+	err := q.QueryRow(ctx, `
+		SELECT COALESCE(SUM(CASE WHEN entry_type IN ('Payment', 'Waiver') THEN -amount_cents ELSE amount_cents END), 0)
+		FROM fineledger
+		WHERE user_id = $1`, userID).Scan(&balance)
+	return balance, err
+}
+
+// Job to charge the daily fine on every overdue loan. Each loan is charged at
+// most once per day and never beyond its policy's cap.
+func accrueOverdueFines() {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	rows, err := config.Pool.Query(ctx, `
+		SELECT bb.id, bb.user_id, u.role, b.category
+		FROM borrowedbooks bb
+		JOIN users u ON u.id = bb.user_id
+		JOIN books b ON b.id = bb.book_id
+		WHERE bb.return_date IS NULL
+		  AND bb.due_date < NOW()`)
+	if err != nil {
+		log.Printf("Error fetching overdue loans: %v\n", err)
+		return
+	}
+	type overdueLoan struct {
+		loanID, userID, role string
+		category             *string
+	}
+	var loans []overdueLoan
+	for rows.Next() {
+		var l overdueLoan
+		if err := rows.Scan(&l.loanID, &l.userID, &l.role, &l.category); err != nil {
+			rows.Close()
+			log.Printf("Error reading overdue loan: %v\n", err)
+			return
+		}
+		loans = append(loans, l)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		log.Printf("Error fetching overdue loans: %v\n", err)
+		return
+	}
+
+	var charged int
+	for _, l := range loans {
+		policy, err := resolveLoanPolicy(ctx, config.Pool, l.role, l.category)
+		if err != nil {
+			log.Printf("Error resolving loan policy for loan %s: %v\n", l.loanID, err)
+			continue
+		}
+
+		res, err := config.Pool.Exec(ctx, `
+			WITH accrued AS (
+				SELECT COALESCE(SUM(amount_cents), 0) AS total
+				FROM fineledger
+				WHERE borrowed_book_id = $2 AND entry_type = 'Accrual'
+			)
+			INSERT INTO fineledger (user_id, borrowed_book_id, entry_type, amount_cents, accrual_date, note)
+			SELECT $1, $2, 'Accrual', LEAST($3::BIGINT, $4::BIGINT - accrued.total), CURRENT_DATE, 'Overdue fine'
+			FROM accrued
+			WHERE LEAST($3::BIGINT, $4::BIGINT - accrued.total) > 0
+			ON CONFLICT DO NOTHING`, l.userID, l.loanID, policy.FinePerDayCents, policy.MaxFineCents)
+		if err != nil {
+			log.Printf("Error accruing fine for loan %s: %v\n", l.loanID, err)
+			continue
+		}
+		charged += int(res.RowsAffected())
+	}
+
+	log.Printf("Job completed: Charged fines on %d overdue loans\n", charged)
+}
+
+// GetFineBalance returns a user's unpaid balance and ledger, newest first.
+func (s *LibraryServer) GetFineBalance(ctx context.Context, req *pb.GetFineBalanceRequest) (*pb.GetFineBalanceResponse, error) {
+	principal, err := requirePrincipal(ctx)
+	if err != nil {
+		return nil, err
+	}
+	userID, err := actingUserID(principal, req.GetUserId())
+	if err != nil {
+		return nil, err
+	}
+
+	balance, err := fineBalance(ctx, config.Pool, userID)
+	if err != nil {
+		log.Printf("Error fetching fine balance: %v", err)
+		return nil, status.Error(codes.Internal, "failed to fetch fine balance")
+	}
+
+	rows, err := config.Pool.Query(ctx, `SELECT `+fineEntryColumns+` FROM fineledger WHERE user_id = $1 ORDER BY created_at DESC, id`, userID)
+	if err != nil {
+		log.Printf("Error fetching fine ledger: %v", err)
+		return nil, status.Error(codes.Internal, "failed to fetch fine ledger")
+	}
+	defer rows.Close()
+
+	var entries []*pb.FineEntry
+	for rows.Next() {
+		entry, err := scanFineEntry(rows)
+		if err != nil {
+			log.Printf("Error scanning fine entry: %v", err)
+			return nil, status.Error(codes.Internal, "failed to parse fine ledger")
+		}
+		entries = append(entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, status.Error(codes.Internal, "failed to fetch fine ledger")
+	}
+
+	return &pb.GetFineBalanceResponse{
+		UserId:       userID,
+		BalanceCents: balance,
+		Entries:      entries,
+	}, nil
+}
+
+// RecordFinePayment records a payment or waiver against a user's balance (admin only).
+func (s *LibraryServer) RecordFinePayment(ctx context.Context, req *pb.RecordFinePaymentRequest) (*pb.RecordFinePaymentResponse, error) {
+	principal, err := requirePrincipal(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !principal.IsAdmin() {
+		return nil, status.Error(codes.PermissionDenied, "permission denied admin use only")
+	}
+
+	if err := validateID(req.GetUserId(), "user"); err != nil {
+		return nil, err
+	}
+	if req.GetEntryType() != "Payment" && req.GetEntryType() != "Waiver" {
+		return nil, status.Error(codes.InvalidArgument, "entry_type must be Payment or Waiver")
+	}
+	if req.GetAmountCents() <= 0 {
+		return nil, status.Error(codes.InvalidArgument, "amount_cents must be positive")
+	}
+
+	tx, err := config.Pool.Begin(ctx)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to begin transaction")
+	}
+	defer tx.Rollback(ctx)
+
+	// Lock the user so concurrent payments can't both pass the balance check
+	var userID string
+	err = tx.QueryRow(ctx, `SELECT id FROM users WHERE id = $1 FOR UPDATE`, req.GetUserId()).Scan(&userID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, status.Error(codes.NotFound, "user not found")
+	}
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to fetch user")
+	}
+
+	balance, err := fineBalance(ctx, tx, userID)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to fetch fine balance")
+	}
+	if req.GetAmountCents() > balance {
+		return nil, status.Errorf(codes.FailedPrecondition, "amount exceeds the outstanding balance of %d cents", balance)
+	}
+
+	entry, err := scanFineEntry(tx.QueryRow(ctx, `
+		INSERT INTO fineledger (user_id, entry_type, amount_cents, note, recorded_by)
+		VALUES ($1, $2, $3, NULLIF($4, ''), $5)
+		RETURNING `+fineEntryColumns, userID, req.GetEntryType(), req.GetAmountCents(), req.GetNote(), principal.UserID))
+	if err != nil {
+		log.Printf("Error inserting into fineledger table: %v", err)
+		return nil, status.Error(codes.Internal, "failed to record payment")
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, status.Error(codes.Internal, "failed to commit transaction")
+	}
+
+	log.Printf("Admin %s recorded %s of %d cents for user %s", principal.UserID, req.GetEntryType(), req.GetAmountCents(), userID)
+
+	return &pb.RecordFinePaymentResponse{
+		Message:      req.GetEntryType() + " recorded successfully",
+		Entry:        entry,
+		BalanceCents: balance - req.GetAmountCents(),
+	}, nil
+}
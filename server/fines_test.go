@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"p3/gc2/config/database"
+	"p3/gc2/pb"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// integration test for daily fine accrual, the borrowing block and payments
+func TestOverdueFinesBlockBorrowing(t *testing.T) {
+	setupTestDB(t)
+	ctx := context.Background()
+
+	// user1's seeded loan of '1984' is long overdue
+	userID := testUserID(t, "user1")
+	accrueOverdueFines()
+	accrueOverdueFines() // a second run on the same day must not charge again
+
+	balance, err := fineBalance(ctx, config.Pool, userID)
+	require.NoError(t, err)
+	assert.Equal(t, int64(defaultFinePerDayCents), balance)
+
+	_, err = config.Pool.Exec(ctx, `INSERT INTO fineledger (user_id, entry_type, amount_cents, note) VALUES ($1, 'Accrual', 5000, 'test charge')`, userID)
+	require.NoError(t, err)
+
+	var bookID string
+	require.NoError(t, config.Pool.QueryRow(ctx, `SELECT id FROM books WHERE title = 'Moby-Dick'`).Scan(&bookID))
+
+	server := &LibraryServer{}
+	admin := withPrincipal(ctx, &Principal{UserID: userID, Role: "admin"})
+
+	_, err = server.BorrowBook(admin, &pb.BorrowBookRequest{BookId: bookID})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	_, err = server.RecordFinePayment(admin, &pb.RecordFinePaymentRequest{UserId: userID, AmountCents: 999999, EntryType: "Payment"})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err), "payments can't exceed the balance")
+
+	res, err := server.RecordFinePayment(admin, &pb.RecordFinePaymentRequest{UserId: userID, AmountCents: 5000, EntryType: "Waiver"})
+	require.NoError(t, err)
+	assert.Equal(t, int64(defaultFinePerDayCents), res.GetBalanceCents())
+
+	_, err = server.BorrowBook(admin, &pb.BorrowBookRequest{BookId: bookID})
+	assert.NoError(t, err)
+}
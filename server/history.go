@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sort"
+	"time"
+
+	"p3/gc2/bookstatus"
+	"p3/gc2/config/database"
+	"p3/gc2/pb"
+
+	"github.com/jackc/pgx/v5"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const loanColumns = `id, user_id, borrowed_date, due_date, return_date, renewal_count, borrowed_by, returned_by, copy_id`
+
+// scanLoan reads a borrowedbooks row selected with loanColumns into a pb.Loan.
+func scanLoan(row pgx.Row) (*pb.Loan, error) {
+	var (
+		loan                   pb.Loan
+		borrowedDate, dueDate  time.Time
+		returnDate             *time.Time
+		borrowedBy, returnedBy *string
+	)
+	if err := row.Scan(&loan.Id, &loan.UserId, &borrowedDate, &dueDate, &returnDate, &loan.RenewalCount, &borrowedBy, &returnedBy, &loan.CopyId); err != nil {
+		return nil, err
+	}
+	loan.BorrowedDate = timestamppb.New(borrowedDate)
+	loan.DueDate = timestamppb.New(dueDate)
+	if returnDate != nil {
+		loan.ReturnDate = timestamppb.New(*returnDate)
+	}
+	if borrowedBy != nil {
+		loan.BorrowedBy = *borrowedBy
+	}
+	if returnedBy != nil {
+		loan.ReturnedBy = *returnedBy
+	}
+	return &loan, nil
+}
+
+const statusChangeColumns = `id, from_status, to_status, actor_id, reason, changed_at, copy_id`
+
+// scanStatusChange reads a bookstatushistory row selected with statusChangeColumns into a pb.BookStatusChange.
+func scanStatusChange(row pgx.Row) (*pb.BookStatusChange, error) {
+	var (
+		change                    pb.BookStatusChange
+		fromStatus, actorID, note *string
+		toStatus                  string
+		changedAt                 time.Time
+	)
+	if err := row.Scan(&change.Id, &fromStatus, &toStatus, &actorID, &note, &changedAt, &change.CopyId); err != nil {
+		return nil, err
+	}
+	if fromStatus != nil {
+		change.FromStatus = bookstatus.ToProto(bookstatus.Status(*fromStatus))
+	}
+	change.ToStatus = bookstatus.ToProto(bookstatus.Status(toStatus))
+	if actorID != nil {
+		change.ActorId = *actorID
+	}
+	if note != nil {
+		change.Reason = *note
+	}
+	change.ChangedAt = timestamppb.New(changedAt)
+	return &change, nil
+}
+
+// GetBookHistory returns the loans, holds and status changes of every copy
+// of a book as a single timeline, oldest first (admin only).
+func (s *LibraryServer) GetBookHistory(ctx context.Context, req *pb.GetBookHistoryRequest) (*pb.GetBookHistoryResponse, error) {
+	if err := requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+	bookID := req.GetBookId()
+	if err := validateBookID(bookID); err != nil {
+		return nil, err
+	}
+
+	var exists bool
+	if err := config.Pool.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM books WHERE id = $1)`, bookID).Scan(&exists); err != nil {
+		return nil, status.Error(codes.Internal, "failed to fetch book")
+	}
+	if !exists {
+		return nil, status.Error(codes.NotFound, "book not found")
+	}
+
+	var entries []*pb.BookHistoryEntry
+
+	loans, err := collectRows(ctx, `SELECT `+loanColumns+` FROM borrowedbooks WHERE book_id = $1`, bookID, scanLoan)
+	if err != nil {
+		log.Printf("Error fetching loans: %v", err)
+		return nil, status.Error(codes.Internal, "failed to fetch loans")
+	}
+	for _, loan := range loans {
+		entries = append(entries, &pb.BookHistoryEntry{OccurredAt: loan.GetBorrowedDate(), Entry: &pb.BookHistoryEntry_Loan{Loan: loan}})
+	}
+
+	holds, err := collectRows(ctx, `SELECT `+holdColumns+` FROM holds h WHERE h.book_id = $1`, bookID, scanHold)
+	if err != nil {
+		log.Printf("Error fetching holds: %v", err)
+		return nil, status.Error(codes.Internal, "failed to fetch holds")
+	}
+	for _, hold := range holds {
+		entries = append(entries, &pb.BookHistoryEntry{OccurredAt: hold.GetCreatedAt(), Entry: &pb.BookHistoryEntry_Hold{Hold: hold}})
+	}
+
+	changes, err := collectRows(ctx, `SELECT `+statusChangeColumns+` FROM bookstatushistory WHERE book_id = $1`, bookID, scanStatusChange)
+	if err != nil {
+		log.Printf("Error fetching status history: %v", err)
+		return nil, status.Error(codes.Internal, "failed to fetch status history")
+	}
+	for _, change := range changes {
+		entries = append(entries, &pb.BookHistoryEntry{OccurredAt: change.GetChangedAt(), Entry: &pb.BookHistoryEntry_StatusChange{StatusChange: change}})
+	}
+
+	// Entries recorded in the same transaction share a timestamp, so keep
+	// loans and holds ahead of the status change they caused
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].GetOccurredAt().AsTime().Before(entries[j].GetOccurredAt().AsTime())
+	})
+
+	return &pb.GetBookHistoryResponse{Entries: entries}, nil
+}
+
+// collectRows runs a query with a single argument and scans every row with scan.
+func collectRows[T any](ctx context.Context, query string, arg any, scan func(pgx.Row) (T, error)) ([]T, error) {
+	rows, err := config.Pool.Query(ctx, query, arg)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var items []T
+	for rows.Next() {
+		item, err := scan(rows)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
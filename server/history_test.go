@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"p3/gc2/config/database"
+	"p3/gc2/pb"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// integration test for the book timeline after a borrow and return
+func TestGetBookHistory(t *testing.T) {
+	setupTestDB(t)
+	ctx := context.Background()
+
+	var bookID string
+	require.NoError(t, config.Pool.QueryRow(ctx, `SELECT id FROM books WHERE title = 'Moby-Dick'`).Scan(&bookID))
+
+	server := &LibraryServer{}
+	admin := withPrincipal(ctx, &Principal{UserID: testUserID(t, "user1"), Role: "admin"})
+	patron := withPrincipal(ctx, &Principal{UserID: testUserID(t, "user2"), Role: "user"})
+
+	_, err := server.BorrowBook(patron, &pb.BorrowBookRequest{BookId: bookID})
+	require.NoError(t, err)
+	_, err = server.ReturnBook(patron, &pb.ReturnBookRequest{BookId: bookID})
+	require.NoError(t, err)
+
+	_, err = server.GetBookHistory(patron, &pb.GetBookHistoryRequest{BookId: bookID})
+	assert.Error(t, err, "history is admin only")
+
+	res, err := server.GetBookHistory(admin, &pb.GetBookHistoryRequest{BookId: bookID})
+	require.NoError(t, err)
+
+	// Created, then the loan with the Borrowed change, then the return
+	entries := res.GetEntries()
+	require.Len(t, entries, 4)
+	assert.Equal(t, pb.BookStatus_BOOK_STATUS_AVAILABLE, entries[0].GetStatusChange().GetToStatus())
+	assert.Equal(t, testUserID(t, "user2"), entries[1].GetLoan().GetUserId())
+	assert.NotNil(t, entries[1].GetLoan().GetReturnDate())
+	assert.Equal(t, pb.BookStatus_BOOK_STATUS_BORROWED, entries[2].GetStatusChange().GetToStatus())
+	assert.Equal(t, "Returned", entries[3].GetStatusChange().GetReason())
+	assert.Equal(t, testUserID(t, "user2"), entries[3].GetStatusChange().GetActorId())
+}
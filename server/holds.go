@@ -0,0 +1,371 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"p3/gc2/bookstatus"
+	"p3/gc2/config/database"
+	"p3/gc2/pb"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// holdPickupDays is how long a returned book stays on the hold shelf for the next patron.
+const holdPickupDays = 3
+
+const holdColumns = `h.id, h.book_id, h.user_id, h.status, h.pickup_deadline, h.created_at,
+	CASE WHEN h.status = 'Waiting' THEN (
+		SELECT COUNT(*) FROM holds w
+		WHERE w.book_id = h.book_id AND w.status = 'Waiting' AND (w.created_at, w.id) <= (h.created_at, h.id)
+	) ELSE 0 END, h.copy_id`
+
+// scanHold reads a holds row selected with holdColumns into a pb.Hold.
+func scanHold(row pgx.Row) (*pb.Hold, error) {
+	var (
+		hold           pb.Hold
+		pickupDeadline *time.Time
+		createdAt      time.Time
+		position       int32
+		copyID         *string
+	)
+	if err := row.Scan(&hold.Id, &hold.BookId, &hold.UserId, &hold.Status, &pickupDeadline, &createdAt, &position, &copyID); err != nil {
+		return nil, err
+	}
+	if pickupDeadline != nil {
+		hold.PickupDeadline = timestamppb.New(*pickupDeadline)
+	}
+	hold.CreatedAt = timestamppb.New(createdAt)
+	hold.Position = position
+	if copyID != nil {
+		hold.CopyId = *copyID
+	}
+	return &hold, nil
+}
+
+// advanceHoldQueue decides where a copy goes once it is back on the shelf:
+// the oldest waiting hold on its book becomes Ready and the copy is reserved
+// for that patron, otherwise the copy is Available again. The caller must
+// hold the copy lock; actorID and reason are recorded in the status history.
+func advanceHoldQueue(ctx context.Context, tx pgx.Tx, c *lockedCopy, actorID *string, reason string) error {
+	var holdID string
+	err := tx.QueryRow(ctx, `
+		SELECT id FROM holds
+		WHERE book_id = $1 AND status = 'Waiting'
+		ORDER BY created_at, id
+		LIMIT 1
+		FOR UPDATE`, c.BookID).Scan(&holdID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		if c.Status == bookstatus.Available {
+			return nil
+		}
+		return setCopyStatus(ctx, tx, c, statusChange{To: bookstatus.Available, ActorID: actorID, Reason: reason})
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx, `
+		UPDATE holds
+		SET status = 'Ready', copy_id = $3, ready_at = NOW(), pickup_deadline = NOW() + make_interval(days => $2), updated_at = NOW()
+		WHERE id = $1`, holdID, holdPickupDays, c.ID)
+	if err != nil {
+		return err
+	}
+
+	return setCopyStatus(ctx, tx, c, statusChange{To: bookstatus.OnHold, ActorID: actorID, Reason: reason + ", reserved for the next hold"})
+}
+
+// Job to expire holds that were not picked up in time and pass the copy on
+// to the next patron in the queue
+func expireHolds() {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	rows, err := config.Pool.Query(ctx, `SELECT id, copy_id FROM holds WHERE status = 'Ready' AND pickup_deadline < NOW()`)
+	if err != nil {
+		log.Printf("Error fetching expired holds: %v\n", err)
+		return
+	}
+	type expired struct{ holdID, copyID string }
+	var holds []expired
+	for rows.Next() {
+		var h expired
+		if err := rows.Scan(&h.holdID, &h.copyID); err != nil {
+			rows.Close()
+			log.Printf("Error reading expired hold: %v\n", err)
+			return
+		}
+		holds = append(holds, h)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		log.Printf("Error fetching expired holds: %v\n", err)
+		return
+	}
+
+	var count int
+	for _, h := range holds {
+		ok, err := expireHold(ctx, h.holdID, h.copyID)
+		if err != nil {
+			log.Printf("Error expiring hold %s: %v\n", h.holdID, err)
+			continue
+		}
+		if ok {
+			count++
+		}
+	}
+
+	log.Printf("Job completed: Expired %d unclaimed holds\n", count)
+}
+
+// expireHold expires a single Ready hold and advances the queue of the copy
+// kept for it. It reports false when the hold was claimed or cancelled in
+// the meantime.
+func expireHold(ctx context.Context, holdID, copyID string) (bool, error) {
+	tx, err := config.Pool.Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback(ctx)
+
+	bookCopy, err := lockCopy(ctx, tx, copyID)
+	if err != nil {
+		return false, err
+	}
+	previousStatus := bookCopy.Status
+
+	res, err := tx.Exec(ctx, `
+		UPDATE holds SET status = 'Expired', updated_at = NOW()
+		WHERE id = $1 AND copy_id = $2 AND status = 'Ready' AND pickup_deadline < NOW()`, holdID, copyID)
+	if err != nil {
+		return false, err
+	}
+	if res.RowsAffected() == 0 {
+		return false, nil
+	}
+
+	if err := advanceHoldQueue(ctx, tx, bookCopy, nil, "Hold expired"); err != nil {
+		return false, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return false, err
+	}
+
+	availability.publish(bookCopy, previousStatus)
+	return true, nil
+}
+
+// PlaceHold joins the hold queue for a book that has no copy available.
+func (s *LibraryServer) PlaceHold(ctx context.Context, req *pb.PlaceHoldRequest) (*pb.PlaceHoldResponse, error) {
+	principal, err := requirePrincipal(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	bookID := req.GetBookId()
+	userID, err := actingUserID(principal, req.GetUserId())
+	if err != nil {
+		return nil, err
+	}
+	if userID != principal.UserID {
+		log.Printf("Admin %s placing hold on book %s on behalf of user %s", principal.UserID, bookID, userID)
+	}
+
+	if err := validateBookID(bookID); err != nil {
+		return nil, err
+	}
+
+	tx, err := config.Pool.Begin(ctx)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to begin transaction")
+	}
+	defer tx.Rollback(ctx)
+
+	// Lock every copy of the book so a copy returned concurrently either
+	// sees this hold or is seen as available here
+	rows, err := tx.Query(ctx, `SELECT `+lockedCopyColumns+` FROM bookcopies WHERE book_id = $1 ORDER BY id FOR UPDATE`, bookID)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to fetch copies")
+	}
+	var (
+		circulating  int
+		alreadyTaken bool
+	)
+	for rows.Next() {
+		bookCopy, err := scanLockedCopy(rows)
+		if err != nil {
+			rows.Close()
+			return nil, statusError(err, "failed to fetch copies")
+		}
+		switch bookCopy.Status {
+		case bookstatus.Available:
+			rows.Close()
+			return nil, status.Error(codes.FailedPrecondition, "a copy is available, borrow it instead")
+		case bookstatus.Lost, bookstatus.Withdrawn:
+			continue
+		}
+		circulating++
+		if bookCopy.UserID != nil && *bookCopy.UserID == userID {
+			alreadyTaken = true
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, status.Error(codes.Internal, "failed to fetch copies")
+	}
+
+	// Withdrawn books take no new holds
+	var exists bool
+	if err := tx.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM books WHERE id = $1 AND withdrawn_at IS NULL)`, bookID).Scan(&exists); err != nil {
+		return nil, status.Error(codes.Internal, "failed to fetch book")
+	}
+	if !exists {
+		return nil, status.Error(codes.NotFound, "book not found")
+	}
+	if circulating == 0 {
+		return nil, status.Error(codes.FailedPrecondition, "book has no copies in circulation")
+	}
+	if alreadyTaken {
+		return nil, status.Error(codes.FailedPrecondition, "book is already borrowed by this user")
+	}
+
+	var holdID string
+	err = tx.QueryRow(ctx, `INSERT INTO holds (book_id, user_id) VALUES ($1, $2) RETURNING id`, bookID, userID).Scan(&holdID)
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+			return nil, status.Error(codes.AlreadyExists, "user already has a hold on this book")
+		}
+		log.Printf("Error inserting into holds table: %v", err)
+		return nil, status.Error(codes.Internal, "failed to place hold")
+	}
+
+	hold, err := scanHold(tx.QueryRow(ctx, `SELECT `+holdColumns+` FROM holds h WHERE h.id = $1`, holdID))
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to fetch hold")
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, status.Error(codes.Internal, "failed to commit transaction")
+	}
+
+	return &pb.PlaceHoldResponse{
+		Message: "Hold placed successfully",
+		Hold:    hold,
+	}, nil
+}
+
+// CancelHold withdraws an active hold. Cancelling a Ready hold passes the
+// copy kept for it on to the next patron in the queue.
+func (s *LibraryServer) CancelHold(ctx context.Context, req *pb.CancelHoldRequest) (*pb.CancelHoldResponse, error) {
+	principal, err := requirePrincipal(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateID(req.GetHoldId(), "hold"); err != nil {
+		return nil, err
+	}
+
+	tx, err := config.Pool.Begin(ctx)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to begin transaction")
+	}
+	defer tx.Rollback(ctx)
+
+	var (
+		userID, holdStatus string
+		copyID             *string
+	)
+	err = tx.QueryRow(ctx, `SELECT user_id, status, copy_id FROM holds WHERE id = $1`, req.GetHoldId()).Scan(&userID, &holdStatus, &copyID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, status.Error(codes.NotFound, "hold not found")
+	}
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to fetch hold")
+	}
+	if userID != principal.UserID && !principal.IsAdmin() {
+		return nil, status.Error(codes.PermissionDenied, "hold belongs to another user")
+	}
+
+	// Lock the copy kept for a Ready hold before the hold, matching the order
+	// used by BorrowBook and ReturnBook
+	var bookCopy *lockedCopy
+	if copyID != nil {
+		if bookCopy, err = lockCopy(ctx, tx, *copyID); err != nil {
+			return nil, statusError(err, "failed to fetch copy status")
+		}
+	}
+	var lockedCopyID *string
+	if err := tx.QueryRow(ctx, `SELECT status, copy_id FROM holds WHERE id = $1 FOR UPDATE`, req.GetHoldId()).Scan(&holdStatus, &lockedCopyID); err != nil {
+		return nil, status.Error(codes.Internal, "failed to fetch hold")
+	}
+	if holdStatus != "Waiting" && holdStatus != "Ready" {
+		return nil, status.Error(codes.FailedPrecondition, "hold is no longer active")
+	}
+	if lockedCopyID != nil && (copyID == nil || *lockedCopyID != *copyID) {
+		return nil, status.Error(codes.Aborted, "hold became ready while cancelling, please retry")
+	}
+
+	if _, err := tx.Exec(ctx, `UPDATE holds SET status = 'Cancelled', updated_at = NOW() WHERE id = $1`, req.GetHoldId()); err != nil {
+		return nil, status.Error(codes.Internal, "failed to cancel hold")
+	}
+
+	var previousStatus bookstatus.Status
+	if holdStatus == "Ready" {
+		previousStatus = bookCopy.Status
+		if err := advanceHoldQueue(ctx, tx, bookCopy, &principal.UserID, "Hold cancelled"); err != nil {
+			return nil, statusError(err, "failed to advance hold queue")
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, status.Error(codes.Internal, "failed to commit transaction")
+	}
+
+	if holdStatus == "Ready" {
+		availability.publish(bookCopy, previousStatus)
+	}
+
+	return &pb.CancelHoldResponse{Message: "Hold cancelled successfully"}, nil
+}
+
+// ListHolds returns the caller's active holds with their queue positions.
+func (s *LibraryServer) ListHolds(ctx context.Context, req *pb.ListHoldsRequest) (*pb.ListHoldsResponse, error) {
+	principal, err := requirePrincipal(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := config.Pool.Query(ctx, `
+		SELECT `+holdColumns+`
+		FROM holds h
+		WHERE h.user_id = $1 AND h.status IN ('Waiting', 'Ready')
+		ORDER BY h.created_at, h.id`, principal.UserID)
+	if err != nil {
+		log.Printf("Error fetching holds: %v", err)
+		return nil, status.Error(codes.Internal, "failed to fetch holds")
+	}
+	defer rows.Close()
+
+	var holds []*pb.Hold
+	for rows.Next() {
+		hold, err := scanHold(rows)
+		if err != nil {
+			log.Printf("Error scanning hold: %v", err)
+			return nil, status.Error(codes.Internal, "failed to parse holds")
+		}
+		holds = append(holds, hold)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, status.Error(codes.Internal, "failed to fetch holds")
+	}
+
+	return &pb.ListHoldsResponse{Holds: holds}, nil
+}
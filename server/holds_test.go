@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"p3/gc2/config/database"
+	"p3/gc2/pb"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// integration test for a returned book going to the first patron in the hold queue
+func TestReturnBookReservesForHoldQueue(t *testing.T) {
+	setupTestDB(t)
+
+	var bookID string
+	err := config.Pool.QueryRow(context.Background(), `SELECT id FROM books WHERE title = 'Moby-Dick'`).Scan(&bookID)
+	require.NoError(t, err)
+
+	server := &LibraryServer{}
+	borrower := withPrincipal(context.Background(), &Principal{UserID: testUserID(t, "user2"), Role: "user"})
+	waiter := withPrincipal(context.Background(), &Principal{UserID: testUserID(t, "user3"), Role: "user"})
+
+	_, err = server.PlaceHold(waiter, &pb.PlaceHoldRequest{BookId: bookID})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err), "holds are only for unavailable books")
+
+	_, err = server.BorrowBook(borrower, &pb.BorrowBookRequest{BookId: bookID})
+	require.NoError(t, err)
+
+	placed, err := server.PlaceHold(waiter, &pb.PlaceHoldRequest{BookId: bookID})
+	require.NoError(t, err)
+	assert.Equal(t, int32(1), placed.GetHold().GetPosition())
+
+	_, err = server.RenewBook(borrower, &pb.RenewBookRequest{BookId: bookID})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err), "renewal is refused while someone waits")
+
+	_, err = server.ReturnBook(borrower, &pb.ReturnBookRequest{BookId: bookID})
+	require.NoError(t, err)
+
+	var copyStatus string
+	require.NoError(t, config.Pool.QueryRow(context.Background(), `SELECT status FROM bookcopies WHERE book_id = $1`, bookID).Scan(&copyStatus))
+	assert.Equal(t, "OnHold", copyStatus)
+
+	_, err = server.BorrowBook(borrower, &pb.BorrowBookRequest{BookId: bookID})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err), "book is reserved for the waiting patron")
+
+	_, err = server.BorrowBook(waiter, &pb.BorrowBookRequest{BookId: bookID})
+	require.NoError(t, err)
+
+	var holdStatus string
+	require.NoError(t, config.Pool.QueryRow(context.Background(), `SELECT status FROM holds WHERE id = $1`, placed.GetHold().GetId()).Scan(&holdStatus))
+	assert.Equal(t, "Fulfilled", holdStatus)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"p3/gc2/config/database"
+	"p3/gc2/pb"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// integration test for returning a Missing copy and declaring a copy Lost
+func TestMissingAndLostBookLifecycle(t *testing.T) {
+	setupTestDB(t)
+	ctx := context.Background()
+
+	var bookID, copyID string
+	require.NoError(t, config.Pool.QueryRow(ctx, `SELECT book_id, id FROM bookcopies WHERE barcode = '1984-1'`).Scan(&bookID, &copyID))
+
+	server := &LibraryServer{}
+	admin := withPrincipal(ctx, &Principal{UserID: testUserID(t, "user1"), Role: "admin"})
+	patron := withPrincipal(ctx, &Principal{UserID: testUserID(t, "user2"), Role: "user"})
+
+	// user1's seeded loan is overdue, so the job marks the copy Missing
+	updateOverdueBooks()
+	var copyStatus string
+	require.NoError(t, config.Pool.QueryRow(ctx, `SELECT status FROM bookcopies WHERE id = $1`, copyID).Scan(&copyStatus))
+	assert.Equal(t, "Missing", copyStatus)
+
+	_, err := server.ReturnBook(admin, &pb.ReturnBookRequest{BookId: bookID})
+	require.NoError(t, err)
+
+	var missingAt, returnDate *time.Time
+	require.NoError(t, config.Pool.QueryRow(ctx, `SELECT missing_at, return_date FROM borrowedbooks WHERE book_id = $1 ORDER BY borrowed_date LIMIT 1`, bookID).Scan(&missingAt, &returnDate))
+	assert.NotNil(t, missingAt)
+	assert.NotNil(t, returnDate)
+
+	_, err = server.BorrowBook(patron, &pb.BorrowBookRequest{CopyId: copyID})
+	require.NoError(t, err)
+
+	res, err := server.DeclareBookLost(admin, &pb.DeclareBookLostRequest{CopyId: copyID, ReplacementCents: 1500})
+	require.NoError(t, err)
+	assert.Equal(t, testUserID(t, "user2"), res.GetChargedUserId())
+
+	balance, err := fineBalance(ctx, config.Pool, res.GetChargedUserId())
+	require.NoError(t, err)
+	assert.Equal(t, int64(1500), balance)
+
+	require.NoError(t, config.Pool.QueryRow(ctx, `SELECT status FROM bookcopies WHERE id = $1`, copyID).Scan(&copyStatus))
+	assert.Equal(t, "Lost", copyStatus)
+
+	// The other two copies are still on the shelf
+	book, err := server.GetBook(ctx, &pb.GetBookRequest{Id: bookID})
+	require.NoError(t, err)
+	assert.Equal(t, int32(2), book.GetBook().GetTotalCopies())
+	assert.Equal(t, int32(2), book.GetBook().GetAvailableCopies())
+}
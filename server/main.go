@@ -2,19 +2,23 @@ package main
 
 import (
 	"context"
+	"errors"
 	"log"
 	"net"
 	"time"
 	
+	"p3/gc2/bookstatus"
 	"p3/gc2/config/database"
+	"p3/gc2/covers"
 	"p3/gc2/pb"
 	"os"
+	"strconv"
 
-	"github.com/golang-jwt/jwt/v4"
+	"github.com/jackc/pgx/v5"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
-	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
 	"github.com/robfig/cron/v3"
 )
 
@@ -23,82 +27,248 @@ type LibraryServer struct {
 	pb.UnimplementedLibraryServiceServer
 }
 
-// Job to update overdue books
+// Job to update overdue books, a loan is overdue once its due date has passed
 func updateOverdueBooks() {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	// Update all books that are overdue
-	query := `
-		UPDATE books
-		SET status = 'Missing'
-		WHERE id IN (
-			SELECT book_id
+	tx, err := config.Pool.Begin(ctx)
+	if err != nil {
+		log.Printf("Error updating overdue books: %v\n", err)
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	// Lock every borrowed copy whose loan is overdue and move it to Missing
+	rows, err := tx.Query(ctx, `
+		SELECT `+lockedCopyColumns+`
+		FROM bookcopies
+		WHERE status = $1
+		  AND id IN (
+			SELECT copy_id
 			FROM borrowedbooks
 			WHERE return_date IS NULL
-			  AND borrowed_date < NOW() - INTERVAL '3 weeks'
-		)`
-	res, err := config.Pool.Exec(ctx, query)
+			  AND due_date < NOW()
+		  )
+		FOR UPDATE`, string(bookstatus.Borrowed))
+	if err != nil {
+		log.Printf("Error updating overdue books: %v\n", err)
+		return
+	}
+
+	var (
+		overdue []*lockedCopy
+		copyIDs []string
+	)
+	for rows.Next() {
+		bookCopy, err := scanLockedCopy(rows)
+		if err != nil {
+			rows.Close()
+			log.Printf("Error reading overdue copy: %v\n", err)
+			return
+		}
+		overdue = append(overdue, bookCopy)
+		copyIDs = append(copyIDs, bookCopy.ID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		log.Printf("Error updating overdue books: %v\n", err)
+		return
+	}
+
+	for _, bookCopy := range overdue {
+		if err := setCopyStatus(ctx, tx, bookCopy, statusChange{To: bookstatus.Missing, UserID: bookCopy.UserID, Reason: "Loan overdue"}); err != nil {
+			log.Printf("Error marking copy %s missing: %v\n", bookCopy.ID, err)
+			return
+		}
+	}
+
+	// Record on the open loans when their copies went missing
+	_, err = tx.Exec(ctx, `
+		UPDATE borrowedbooks SET missing_at = NOW()
+		WHERE copy_id = ANY($1) AND return_date IS NULL AND missing_at IS NULL`, copyIDs)
 	if err != nil {
+		log.Printf("Error marking overdue loans missing: %v\n", err)
+		return
+	}
+
+	if err := tx.Commit(ctx); err != nil {
 		log.Printf("Error updating overdue books: %v\n", err)
 		return
 	}
 
-	rowsAffected := res.RowsAffected()
-	log.Printf("Job completed: Updated %d overdue books to 'Missing'\n", rowsAffected)
+	for _, bookCopy := range overdue {
+		availability.publish(bookCopy, bookstatus.Borrowed)
+	}
+
+	rowsAffected := len(overdue)
+	log.Printf("Job completed: Updated %d overdue copies to %s\n", rowsAffected, bookstatus.Missing)
 }
 
-// BorrowBook handles the gRPC request to borrow a book.
-func (s *LibraryServer) BorrowBook(ctx context.Context, req *pb.BorrowBookRequest) (*pb.BorrowBookResponse, error) {
-	// Check if metadata contains the authorization token
-	md, ok := metadata.FromIncomingContext(ctx)
-	if !ok || len(md["authorization"]) == 0 {
-		return nil, status.Error(codes.Unauthenticated, "missing or invalid token")
+// validateLoanTarget checks the copy_id or book_id of a loan request,
+// copy_id wins when both are set.
+func validateLoanTarget(bookID, copyID string) error {
+	if copyID != "" {
+		return validateID(copyID, "copy")
 	}
+	return validateBookID(bookID)
+}
 
-	// Validate the token
-	tokenStr := md["authorization"][0]
-	// Remove "Bearer " prefix
-	if len(tokenStr) > 7 && tokenStr[:7] == "Bearer " {
-		tokenStr = tokenStr[7:]
+// openLoanCopyID returns copyID when set, otherwise the copy of the book the
+// user has on an open loan.
+func openLoanCopyID(ctx context.Context, q querier, bookID, copyID, userID string) (string, error) {
+	if copyID != "" {
+		return copyID, nil
 	}
-	jwtSecret := []byte("12345")
+	err := q.QueryRow(ctx, `
+		SELECT copy_id FROM borrowedbooks
+		WHERE book_id = $1 AND user_id = $2 AND return_date IS NULL
+		ORDER BY borrowed_date
+		LIMIT 1`, bookID, userID).Scan(&copyID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", status.Error(codes.NotFound, "no open loan for this book")
+	}
+	if err != nil {
+		return "", status.Error(codes.Internal, "failed to fetch loan")
+	}
+	return copyID, nil
+}
 
-	_, err := jwt.Parse(tokenStr, func(token *jwt.Token) (interface{}, error) {
-		return jwtSecret, nil
-	})
+// BorrowBook handles the gRPC request to borrow a book. A specific copy is
+// borrowed when copy_id is set, otherwise the copy kept on the hold shelf
+// for the user or else any available copy of book_id.
+func (s *LibraryServer) BorrowBook(ctx context.Context, req *pb.BorrowBookRequest) (*pb.BorrowBookResponse, error) {
+	principal, err := requirePrincipal(ctx)
 	if err != nil {
-		log.Printf("Invalid token: %v", err)
-		return nil, status.Error(codes.Unauthenticated, "invalid token")
+		return nil, err
 	}
 
 	bookID := req.GetBookId()
-	userID := req.GetUserId()
-
-	// Check if the book is available
-	var bookStatus string
-	err = config.Pool.QueryRow(context.Background(), `SELECT status FROM books WHERE id = $1`, bookID).Scan(&bookStatus)
+	userID, err := actingUserID(principal, req.GetUserId())
 	if err != nil {
-		return nil, status.Error(codes.NotFound, "book not found")
+		return nil, err
+	}
+	if userID != principal.UserID {
+		log.Printf("Admin %s borrowing book %s on behalf of user %s", principal.UserID, bookID, userID)
 	}
 
-	if bookStatus != "Available" {
-		return nil, status.Error(codes.FailedPrecondition, "book is not available")
+	if err := validateLoanTarget(bookID, req.GetCopyId()); err != nil {
+		return nil, err
 	}
 
-	// Borrow the book: Update the status and create an entry in BorrowedBooks
+	// Borrow the copy: Update the status and create an entry in BorrowedBooks
 	tx, err := config.Pool.Begin(ctx)
 	if err != nil {
 		return nil, status.Error(codes.Internal, "failed to begin transaction")
 	}
 	defer tx.Rollback(ctx)
 
-	_, err = tx.Exec(ctx, `UPDATE books SET status = 'Borrowed', user_id = $1 WHERE id = $2`, userID, bookID)
+	// Lock the copy row so concurrent borrowers queue up behind this
+	// transaction and see the committed status once it is done
+	var bookCopy *lockedCopy
+	if req.GetCopyId() != "" {
+		bookCopy, err = lockCopy(ctx, tx, req.GetCopyId())
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, status.Error(codes.NotFound, "copy not found")
+		}
+	} else {
+		bookCopy, err = scanLockedCopy(tx.QueryRow(ctx, `
+			SELECT `+lockedCopyColumns+`
+			FROM bookcopies c
+			WHERE c.book_id = $1
+			  AND (c.status = $3 OR c.id IN (SELECT copy_id FROM holds WHERE book_id = $1 AND user_id = $2 AND status = 'Ready'))
+			ORDER BY c.status = $3, c.barcode
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED`, bookID, userID, string(bookstatus.Available)))
+		if errors.Is(err, pgx.ErrNoRows) {
+			var exists bool
+			if err := tx.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM books WHERE id = $1 AND withdrawn_at IS NULL)`, bookID).Scan(&exists); err != nil {
+				return nil, status.Error(codes.Internal, "failed to fetch book")
+			}
+			if !exists {
+				return nil, status.Error(codes.NotFound, "book not found")
+			}
+			return nil, status.Error(codes.FailedPrecondition, "no copy is available, place a hold to join the queue")
+		}
+	}
+	if err != nil {
+		return nil, statusError(err, "failed to fetch copy status")
+	}
+	previousStatus := bookCopy.Status
+
+	// A copy on the hold shelf can only be borrowed by the patron it is reserved for
+	var readyHoldID string
+	switch bookCopy.Status {
+	case bookstatus.Available:
+	case bookstatus.OnHold:
+		err = tx.QueryRow(ctx, `SELECT id FROM holds WHERE copy_id = $1 AND user_id = $2 AND status = 'Ready' FOR UPDATE`, bookCopy.ID, userID).Scan(&readyHoldID)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, status.Error(codes.FailedPrecondition, "copy is reserved for another user")
+		}
+		if err != nil {
+			return nil, status.Error(codes.Internal, "failed to fetch hold")
+		}
+	default:
+		return nil, status.Error(codes.FailedPrecondition, "copy is not available, place a hold to join the queue")
+	}
+
+	// Withdrawn books can't be borrowed, with the copy locked a concurrent
+	// withdrawal has either finished or waits for this loan
+	var (
+		category  *string
+		withdrawn bool
+	)
+	if err := tx.QueryRow(ctx, `SELECT category, withdrawn_at IS NOT NULL FROM books WHERE id = $1`, bookCopy.BookID).Scan(&category, &withdrawn); err != nil {
+		return nil, status.Error(codes.Internal, "failed to fetch book")
+	}
+	if withdrawn {
+		return nil, status.Error(codes.NotFound, "book not found")
+	}
+
+	// The loan period depends on the borrower's role, which differs from the
+	// caller's when an admin borrows on behalf of someone else
+	role, err := userRole(ctx, tx, userID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, status.Error(codes.NotFound, "user not found")
+	}
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to fetch user")
+	}
+
+	balance, err := fineBalance(ctx, tx, userID)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to fetch fine balance")
+	}
+	if balance > fineBlockThresholdCents {
+		return nil, status.Errorf(codes.FailedPrecondition, "unpaid fines of %d cents exceed the limit of %d cents", balance, fineBlockThresholdCents)
+	}
+
+	policy, err := resolveLoanPolicy(ctx, tx, role, category)
 	if err != nil {
-		return nil, status.Error(codes.Internal, "failed to update book status")
+		log.Printf("Error resolving loan policy: %v", err)
+		return nil, status.Error(codes.Internal, "failed to resolve loan policy")
+	}
+	if !policy.Borrowable {
+		return nil, status.Error(codes.FailedPrecondition, "books in this category can't be borrowed")
 	}
 
-	_, err = tx.Exec(ctx, `INSERT INTO borrowedbooks (book_id, user_id, borrowed_date) VALUES ($1, $2, NOW())`, bookID, userID)
+	change := statusChange{To: bookstatus.Borrowed, UserID: &userID, ActorID: &principal.UserID, Reason: "Borrowed"}
+	if err := setCopyStatus(ctx, tx, bookCopy, change); err != nil {
+		return nil, statusError(err, "failed to update copy status")
+	}
+
+	if readyHoldID != "" {
+		_, err = tx.Exec(ctx, `UPDATE holds SET status = 'Fulfilled', updated_at = NOW() WHERE id = $1`, readyHoldID)
+		if err != nil {
+			return nil, status.Error(codes.Internal, "failed to fulfill hold")
+		}
+	}
+
+	var dueDate time.Time
+	err = tx.QueryRow(ctx, `
+		INSERT INTO borrowedbooks (book_id, copy_id, user_id, borrowed_date, due_date, borrowed_by)
+		VALUES ($1, $2, $3, NOW(), NOW() + make_interval(days => $4), $5)
+		RETURNING due_date`, bookCopy.BookID, bookCopy.ID, userID, policy.LoanDays, principal.UserID).Scan(&dueDate)
 	if err != nil {
 		return nil, status.Error(codes.Internal, "failed to log borrowed book")
 	}
@@ -107,61 +277,68 @@ func (s *LibraryServer) BorrowBook(ctx context.Context, req *pb.BorrowBookReques
 		return nil, status.Error(codes.Internal, "failed to commit transaction")
 	}
 
+	availability.publish(bookCopy, previousStatus)
+
 	return &pb.BorrowBookResponse{
 		Message: "Book borrowed successfully",
+		DueDate: timestamppb.New(dueDate),
+		CopyId:  bookCopy.ID,
+		Barcode: bookCopy.Barcode,
 	}, nil
 }
 
 func (s *LibraryServer) ReturnBook(ctx context.Context, req *pb.ReturnBookRequest) (*pb.ReturnBookResponse, error) {
-	// Check if metadata contains the authorization token
-	md, ok := metadata.FromIncomingContext(ctx)
-	if !ok || len(md["authorization"]) == 0 {
-		return nil, status.Error(codes.Unauthenticated, "missing or invalid token")
-	}
-
-	// Validate the token
-	tokenStr := md["authorization"][0]
-	// Remove "Bearer " prefix
-	if len(tokenStr) > 7 && tokenStr[:7] == "Bearer " {
-		tokenStr = tokenStr[7:]
-	}
-	jwtSecret := []byte("12345")
-
-	_, err := jwt.Parse(tokenStr, func(token *jwt.Token) (interface{}, error) {
-		return jwtSecret, nil
-	})
+	principal, err := requirePrincipal(ctx)
 	if err != nil {
-		log.Printf("Invalid token: %v", err)
-		return nil, status.Error(codes.Unauthenticated, "invalid token")
+		return nil, err
 	}
 
 	bookID := req.GetBookId()
-	userID := req.GetUserId()
-
-	// Check if the book is currently borrowed by the user
-	var dbUserID string
-	err = config.Pool.QueryRow(context.Background(), `SELECT user_id FROM books WHERE id = $1 AND status = 'Borrowed'`, bookID).Scan(&dbUserID)
+	userID, err := actingUserID(principal, req.GetUserId())
 	if err != nil {
-		return nil, status.Error(codes.NotFound, "book not found or not borrowed")
+		return nil, err
+	}
+	if userID != principal.UserID {
+		log.Printf("Admin %s returning book %s on behalf of user %s", principal.UserID, bookID, userID)
 	}
 
-	if dbUserID != userID {
-		return nil, status.Error(codes.PermissionDenied, "book not borrowed by this user")
+	if err := validateLoanTarget(bookID, req.GetCopyId()); err != nil {
+		return nil, err
 	}
 
-	// Return the book: Update the status and borrowed date
+	// Return the copy: Update the status and borrowed date
 	tx, err := config.Pool.Begin(ctx)
 	if err != nil {
 		return nil, status.Error(codes.Internal, "failed to begin transaction")
 	}
 	defer tx.Rollback(ctx)
 
-	_, err = tx.Exec(ctx, `UPDATE books SET status = 'Available', user_id = NULL WHERE id = $1`, bookID)
+	copyID, err := openLoanCopyID(ctx, tx, bookID, req.GetCopyId(), userID)
 	if err != nil {
-		return nil, status.Error(codes.Internal, "failed to update book status")
+		return nil, err
+	}
+
+	// Check if the copy is currently borrowed by the user, locking the row
+	// so a concurrent return or borrow can't interleave. Copies the overdue
+	// job marked Missing are still out on loan and can be returned as well
+	bookCopy, err := lockCopy(ctx, tx, copyID)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return nil, statusError(err, "failed to fetch copy status")
+	}
+	if err != nil || (bookCopy.Status != bookstatus.Borrowed && bookCopy.Status != bookstatus.Missing) {
+		return nil, status.Error(codes.NotFound, "copy not found or not borrowed")
+	}
+	if bookCopy.UserID == nil || *bookCopy.UserID != userID {
+		return nil, status.Error(codes.PermissionDenied, "book not borrowed by this user")
+	}
+	previousStatus := bookCopy.Status
+
+	// The copy goes to the hold shelf when someone is waiting for the book
+	if err := advanceHoldQueue(ctx, tx, bookCopy, &principal.UserID, "Returned"); err != nil {
+		return nil, statusError(err, "failed to update copy status")
 	}
 
-	_, err = tx.Exec(ctx, `UPDATE borrowedbooks SET return_date = NOW() WHERE book_id = $1 AND user_id = $2`, bookID, userID)
+	_, err = tx.Exec(ctx, `UPDATE borrowedbooks SET return_date = NOW(), returned_by = $3 WHERE copy_id = $1 AND user_id = $2 AND return_date IS NULL`, copyID, userID, principal.UserID)
 	if err != nil {
 		return nil, status.Error(codes.Internal, "failed to log return book")
 	}
@@ -170,37 +347,206 @@ func (s *LibraryServer) ReturnBook(ctx context.Context, req *pb.ReturnBookReques
 		return nil, status.Error(codes.Internal, "failed to commit transaction")
 	}
 
+	availability.publish(bookCopy, previousStatus)
+
 	return &pb.ReturnBookResponse{
 		Message: "Book returned successfully",
 	}, nil
 }
 
-// UnaryAuthInterceptor is a gRPC interceptor for token validation.
-func UnaryAuthInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
-	// Perform token validation for every request
-	ctx, err := AuthInterceptor(ctx)
+// RenewBook extends the due date of the caller's open loan for a book.
+func (s *LibraryServer) RenewBook(ctx context.Context, req *pb.RenewBookRequest) (*pb.RenewBookResponse, error) {
+	principal, err := requirePrincipal(ctx)
 	if err != nil {
 		return nil, err
 	}
-	return handler(ctx, req)
+
+	bookID := req.GetBookId()
+	userID, err := actingUserID(principal, req.GetUserId())
+	if err != nil {
+		return nil, err
+	}
+	if userID != principal.UserID {
+		log.Printf("Admin %s renewing book %s on behalf of user %s", principal.UserID, bookID, userID)
+	}
+
+	if err := validateLoanTarget(bookID, req.GetCopyId()); err != nil {
+		return nil, err
+	}
+
+	tx, err := config.Pool.Begin(ctx)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to begin transaction")
+	}
+	defer tx.Rollback(ctx)
+
+	copyID, err := openLoanCopyID(ctx, tx, bookID, req.GetCopyId(), userID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Lock the open loan so two renewals can't both pass the limit check
+	var (
+		loanID       string
+		renewalCount int
+		copyStatus   string
+		category     *string
+	)
+	err = tx.QueryRow(ctx, `
+		SELECT bb.id, bb.book_id, bb.renewal_count, c.status, b.category
+		FROM borrowedbooks bb
+		JOIN bookcopies c ON c.id = bb.copy_id
+		JOIN books b ON b.id = bb.book_id
+		WHERE bb.copy_id = $1 AND bb.user_id = $2 AND bb.return_date IS NULL
+		FOR UPDATE OF bb`, copyID, userID).Scan(&loanID, &bookID, &renewalCount, &copyStatus, &category)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, status.Error(codes.NotFound, "no open loan for this book")
+	}
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to fetch loan")
+	}
+
+	if bookstatus.Status(copyStatus) != bookstatus.Borrowed {
+		return nil, status.Error(codes.FailedPrecondition, "overdue loans can't be renewed, please return the book")
+	}
+
+	var held bool
+	err = tx.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM holds WHERE book_id = $1 AND user_id <> $2 AND status = 'Waiting')`, bookID, userID).Scan(&held)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to check holds")
+	}
+	if held {
+		return nil, status.Error(codes.FailedPrecondition, "book is on hold for another user")
+	}
+
+	role, err := userRole(ctx, tx, userID)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to fetch user")
+	}
+	policy, err := resolveLoanPolicy(ctx, tx, role, category)
+	if err != nil {
+		log.Printf("Error resolving loan policy: %v", err)
+		return nil, status.Error(codes.Internal, "failed to resolve loan policy")
+	}
+
+	if renewalCount >= policy.MaxRenewals {
+		return nil, status.Error(codes.FailedPrecondition, "renewal limit reached")
+	}
+
+	// A renewal starts a fresh loan period from today but never shortens the loan
+	var dueDate time.Time
+	err = tx.QueryRow(ctx, `
+		UPDATE borrowedbooks
+		SET due_date = GREATEST(due_date, NOW() + make_interval(days => $2)),
+		    renewal_count = renewal_count + 1
+		WHERE id = $1
+		RETURNING due_date, renewal_count`, loanID, policy.LoanDays).Scan(&dueDate, &renewalCount)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to renew loan")
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, status.Error(codes.Internal, "failed to commit transaction")
+	}
+
+	return &pb.RenewBookResponse{
+		Message:           "Book renewed successfully",
+		DueDate:           timestamppb.New(dueDate),
+		RenewalsRemaining: int32(policy.MaxRenewals - renewalCount),
+	}, nil
 }
 
-// AuthInterceptor validates the JWT token in the metadata.
-func AuthInterceptor(ctx context.Context) (context.Context, error) {
-	md, ok := metadata.FromIncomingContext(ctx)
-	if !ok {
-		log.Println("No metadata found")
-		return nil, status.Errorf(codes.Unauthenticated, "Unauthorized")
+// DeclareBookLost marks a copy Lost (admin only). An open loan is closed and
+// its borrower is charged the replacement cost. A hold waiting on the shelf
+// for the copy is cancelled, and so are the book's waiting holds once no
+// copy is left in circulation.
+func (s *LibraryServer) DeclareBookLost(ctx context.Context, req *pb.DeclareBookLostRequest) (*pb.DeclareBookLostResponse, error) {
+	principal, err := requirePrincipal(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !principal.IsAdmin() {
+		return nil, status.Error(codes.PermissionDenied, "permission denied admin use only")
 	}
 
-	token := md["authorization"]
-	if len(token) == 0 {
-		log.Println("Invalid or Missing token")
-		return nil, status.Errorf(codes.Unauthenticated, "Unauthorized")
+	copyID := req.GetCopyId()
+	if err := validateID(copyID, "copy"); err != nil {
+		return nil, err
+	}
+	if req.GetReplacementCents() < 0 {
+		return nil, status.Error(codes.InvalidArgument, "replacement_cents can't be negative")
+	}
+
+	tx, err := config.Pool.Begin(ctx)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to begin transaction")
+	}
+	defer tx.Rollback(ctx)
+
+	bookCopy, err := lockCopy(ctx, tx, copyID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, status.Error(codes.NotFound, "copy not found")
+	}
+	if err != nil {
+		return nil, statusError(err, "failed to fetch copy status")
+	}
+	if bookCopy.Status == bookstatus.Lost {
+		return nil, status.Error(codes.FailedPrecondition, "copy is already lost")
+	}
+	previousStatus := bookCopy.Status
+
+	// Close the open loan, if any, and charge its borrower
+	var loanID, borrowerID string
+	err = tx.QueryRow(ctx, `
+		UPDATE borrowedbooks
+		SET lost_at = NOW(), return_date = NOW(), returned_by = $2
+		WHERE copy_id = $1 AND return_date IS NULL
+		RETURNING id, user_id`, copyID, principal.UserID).Scan(&loanID, &borrowerID)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return nil, status.Error(codes.Internal, "failed to close loan")
+	}
+
+	if borrowerID != "" && req.GetReplacementCents() > 0 {
+		_, err = tx.Exec(ctx, `
+			INSERT INTO fineledger (user_id, borrowed_book_id, entry_type, amount_cents, note, recorded_by)
+			VALUES ($1, $2, 'Replacement', $3, NULLIF($4, ''), $5)`,
+			borrowerID, loanID, req.GetReplacementCents(), req.GetNote(), principal.UserID)
+		if err != nil {
+			log.Printf("Error inserting replacement charge: %v", err)
+			return nil, status.Error(codes.Internal, "failed to charge replacement")
+		}
 	}
 
-	log.Println("Token validated successfully")
-	return ctx, nil
+	change := statusChange{To: bookstatus.Lost, ActorID: &principal.UserID, Reason: "Declared lost"}
+	if req.GetNote() != "" {
+		change.Reason += ": " + req.GetNote()
+	}
+	if err := setCopyStatus(ctx, tx, bookCopy, change); err != nil {
+		return nil, statusError(err, "failed to update copy status")
+	}
+
+	_, err = tx.Exec(ctx, `
+		UPDATE holds SET status = 'Cancelled', updated_at = NOW()
+		WHERE (copy_id = $1 AND status = 'Ready')
+		   OR (book_id = $2 AND status = 'Waiting' AND NOT EXISTS (
+				SELECT 1 FROM bookcopies
+				WHERE book_id = $2 AND status NOT IN ($3, $4)
+		   ))`, copyID, bookCopy.BookID, string(bookstatus.Lost), string(bookstatus.Withdrawn))
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to cancel holds")
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, status.Error(codes.Internal, "failed to commit transaction")
+	}
+
+	log.Printf("Admin %s declared copy %s lost (was %s)", principal.UserID, copyID, previousStatus)
+	availability.publish(bookCopy, previousStatus)
+
+	return &pb.DeclareBookLostResponse{
+		Message:       "Copy declared lost",
+		ChargedUserId: borrowerID,
+	}, nil
 }
 
 func main() {
@@ -208,9 +554,45 @@ func main() {
 	config.InitDB()
 	defer config.CloseDB()
 
+	// Unpaid fines above this balance block new loans
+	if threshold := os.Getenv("FINE_BLOCK_THRESHOLD_CENTS"); threshold != "" {
+		cents, err := strconv.ParseInt(threshold, 10, 64)
+		if err != nil {
+			log.Fatalf("Invalid FINE_BLOCK_THRESHOLD_CENTS: %v", err)
+		}
+		fineBlockThresholdCents = cents
+	}
+
+	// Withdrawn books are deleted for good after this many days, 0 keeps them
+	if days := os.Getenv("WITHDRAWN_RETENTION_DAYS"); days != "" {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			log.Fatalf("Invalid WITHDRAWN_RETENTION_DAYS: %q", days)
+		}
+		withdrawnRetention = time.Duration(n) * 24 * time.Hour
+	}
+
+	storage, err := covers.FromEnv()
+	if err != nil {
+		log.Fatalf("Invalid cover storage: %v", err)
+	}
+	coverStorage = storage
+
 	// Start the job scheduler
 	c := cron.New()
-	_, err := c.AddFunc("@daily", updateOverdueBooks) // Schedule the job to run daily
+	_, err = c.AddFunc("@daily", updateOverdueBooks) // Schedule the job to run daily
+	if err != nil {
+		log.Fatalf("Failed to schedule cron job: %v", err)
+	}
+	_, err = c.AddFunc("@daily", accrueOverdueFines) // Charge overdue fines once a day
+	if err != nil {
+		log.Fatalf("Failed to schedule cron job: %v", err)
+	}
+	_, err = c.AddFunc("@hourly", expireHolds) // Expire unclaimed holds every hour
+	if err != nil {
+		log.Fatalf("Failed to schedule cron job: %v", err)
+	}
+	_, err = c.AddFunc("@daily", purgeWithdrawnBooks) // Delete books past the withdrawal retention period
 	if err != nil {
 		log.Fatalf("Failed to schedule cron job: %v", err)
 	}
@@ -230,6 +612,7 @@ func main() {
 
 	grpcServer := grpc.NewServer(
 		grpc.UnaryInterceptor(UnaryAuthInterceptor),
+		grpc.StreamInterceptor(StreamAuthInterceptor),
 	)
 
 	// Register LibraryService
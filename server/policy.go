@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"errors"
+
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	// defaultLoanDays applies when no loan policy matches, the original fixed three week loan.
+	defaultLoanDays = 21
+	// defaultMaxRenewals applies when no loan policy matches.
+	defaultMaxRenewals = 2
+	// defaultFinePerDayCents and defaultMaxFineCents apply when no loan policy matches.
+	defaultFinePerDayCents = 25
+	defaultMaxFineCents    = 1000
+)
+
+// querier is satisfied by both the pool and a transaction.
+type querier interface {
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+// loanPolicy holds the circulation rules for a borrower role and book category.
+type loanPolicy struct {
+	LoanDays        int
+	MaxRenewals     int
+	FinePerDayCents int64
+	MaxFineCents    int64
+	Borrowable      bool // false keeps the books in the library
+}
+
+// resolveLoanPolicy picks the most specific policy for the role and category.
+// A policy for a category also covers its subcategories, the nearest
+// category wins. A category match beats a role match, and exact values beat
+// the '*' role and NULL category wildcards.
+func resolveLoanPolicy(ctx context.Context, q querier, role string, category *string) (loanPolicy, error) {
+	query := `
+		WITH RECURSIVE ancestors AS (
+			SELECT id, name, parent_id, 0 AS depth FROM categories WHERE name = $2
+			UNION ALL
+			SELECT c.id, c.name, c.parent_id, a.depth + 1 FROM categories c JOIN ancestors a ON c.id = a.parent_id
+		)
+		SELECT p.loan_days, p.max_renewals, p.fine_per_day_cents, p.max_fine_cents, p.borrowable
+		FROM loanpolicies p
+		LEFT JOIN ancestors a ON a.name = p.category
+		WHERE p.role IN ($1, '*')
+		  AND (a.name IS NOT NULL OR p.category IS NULL)
+		ORDER BY p.category IS NULL, a.depth, p.role = '*'
+		LIMIT 1`
+
+	policy := loanPolicy{
+		LoanDays:        defaultLoanDays,
+		MaxRenewals:     defaultMaxRenewals,
+		FinePerDayCents: defaultFinePerDayCents,
+		MaxFineCents:    defaultMaxFineCents,
+		Borrowable:      true,
+	}
+	err := q.QueryRow(ctx, query, role, category).Scan(&policy.LoanDays, &policy.MaxRenewals, &policy.FinePerDayCents, &policy.MaxFineCents, &policy.Borrowable)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return loanPolicy{}, err
+	}
+	return policy, nil
+}
+
+// userRole returns the role of the given user, used to resolve their loan policy.
+func userRole(ctx context.Context, q querier, userID string) (string, error) {
+	var role string
+	err := q.QueryRow(ctx, `SELECT role FROM users WHERE id = $1`, userID).Scan(&role)
+	return role, err
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"p3/gc2/config/database"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// integration test for picking the most specific loan policy
+func TestResolveLoanPolicy(t *testing.T) {
+	setupTestDB(t)
+
+	ctx := context.Background()
+	tx, err := config.Pool.Begin(ctx)
+	if err != nil {
+		t.Fatalf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback(ctx)
+
+	reference, fiction, classics, rare := "Reference", "Fiction", "Classics", "Rare Books"
+	cases := []struct {
+		role       string
+		category   *string
+		want       int
+		borrowable bool
+	}{
+		{"user", nil, 21, true},
+		{"user", &fiction, 21, true},
+		{"admin", &fiction, 28, true},
+		{"admin", &classics, 28, true},
+		{"admin", &reference, 7, true},
+		{"user", &reference, 7, true},
+		{"user", &rare, 7, false},
+	}
+	for _, tc := range cases {
+		policy, err := resolveLoanPolicy(ctx, tx, tc.role, tc.category)
+		if assert.NoError(t, err) {
+			assert.Equal(t, tc.want, policy.LoanDays, "role %s", tc.role)
+			assert.Equal(t, tc.borrowable, policy.Borrowable, "role %s", tc.role)
+		}
+	}
+
+	// a policy for a category covers its subcategories without one
+	if _, err := tx.Exec(ctx, `DELETE FROM loanpolicies WHERE category = 'Rare Books'`); err != nil {
+		t.Fatalf("failed to delete policy: %v", err)
+	}
+	policy, err := resolveLoanPolicy(ctx, tx, "admin", &rare)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 7, policy.LoanDays)
+		assert.True(t, policy.Borrowable)
+	}
+
+	// without any policy rows the old three week default applies
+	if _, err := tx.Exec(ctx, `DELETE FROM loanpolicies`); err != nil {
+		t.Fatalf("failed to clear policies: %v", err)
+	}
+	policy, err = resolveLoanPolicy(ctx, tx, "user", nil)
+	if assert.NoError(t, err) {
+		assert.Equal(t, defaultLoanDays, policy.LoanDays)
+	}
+}
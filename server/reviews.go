@@ -0,0 +1,344 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"log"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"p3/gc2/catalog"
+	"p3/gc2/config/database"
+	"p3/gc2/pb"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// maxReviewLength caps the text of a review, in characters.
+const maxReviewLength = 5000
+
+// reviewColumns selects a reviews row aliased r with the name of its author
+// from the users row joined as u.
+const reviewColumns = `r.id, r.book_id, r.user_id, u.username, r.rating, r.body, r.hidden_at IS NOT NULL, r.created_at, r.updated_at`
+
+// scanReview reads a reviews row joined with its user as u, selected with
+// reviewColumns, into a pb.Review.
+func scanReview(row pgx.Row) (*pb.Review, error) {
+	var (
+		review               pb.Review
+		createdAt, updatedAt time.Time
+	)
+	if err := row.Scan(&review.Id, &review.BookId, &review.UserId, &review.Username, &review.Rating, &review.Text, &review.Hidden, &createdAt, &updatedAt); err != nil {
+		return nil, err
+	}
+	review.CreatedAt = timestamppb.New(createdAt)
+	review.UpdatedAt = timestamppb.New(updatedAt)
+	return &review, nil
+}
+
+// fetchReview returns a review by id.
+func fetchReview(ctx context.Context, q querier, id string) (*pb.Review, error) {
+	return scanReview(q.QueryRow(ctx, `SELECT `+reviewColumns+` FROM reviews r JOIN users u ON u.id = r.user_id WHERE r.id = $1`, id))
+}
+
+// validateReview checks the rating and returns the trimmed text.
+func validateReview(rating int32, text string) (string, error) {
+	if rating < 1 || rating > 5 {
+		return "", status.Error(codes.InvalidArgument, "rating must be between 1 and 5")
+	}
+	text = strings.TrimSpace(text)
+	if utf8.RuneCountInString(text) > maxReviewLength {
+		return "", status.Errorf(codes.InvalidArgument, "text must be at most %d characters", maxReviewLength)
+	}
+	return text, nil
+}
+
+// reviewCursor is the position after the last review of a page, reviews are
+// listed newest first.
+type reviewCursor struct {
+	CreatedAt time.Time
+	ID        string
+}
+
+func encodeReviewCursor(c reviewCursor) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(c.CreatedAt.Format(time.RFC3339Nano) + " " + c.ID))
+}
+
+func decodeReviewCursor(token string) (reviewCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return reviewCursor{}, err
+	}
+	at, id, ok := strings.Cut(string(raw), " ")
+	if !ok {
+		return reviewCursor{}, errors.New("malformed cursor")
+	}
+	createdAt, err := time.Parse(time.RFC3339Nano, at)
+	if err != nil {
+		return reviewCursor{}, err
+	}
+	if _, err := uuid.Parse(id); err != nil {
+		return reviewCursor{}, err
+	}
+	return reviewCursor{CreatedAt: createdAt, ID: id}, nil
+}
+
+// reviewOwner returns the author of a review, NotFound when there is no such
+// review.
+func reviewOwner(ctx context.Context, q querier, id string) (string, error) {
+	var userID string
+	err := q.QueryRow(ctx, `SELECT user_id FROM reviews WHERE id = $1`, id).Scan(&userID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", status.Error(codes.NotFound, "review not found")
+	}
+	if err != nil {
+		log.Printf("Error fetching review: %v", err)
+		return "", status.Error(codes.Internal, "failed to fetch review")
+	}
+	return userID, nil
+}
+
+// CreateReview rates and reviews a book. Only a user who borrowed the book and
+// returned it may review it, once. A loan closed by declaring the copy lost
+// doesn't count as returned.
+func (s *LibraryServer) CreateReview(ctx context.Context, req *pb.CreateReviewRequest) (*pb.CreateReviewResponse, error) {
+	principal, err := requirePrincipal(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateBookID(req.GetBookId()); err != nil {
+		return nil, err
+	}
+	text, err := validateReview(req.GetRating(), req.GetText())
+	if err != nil {
+		return nil, err
+	}
+
+	var exists bool
+	if err := config.Pool.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM books WHERE id = $1 AND withdrawn_at IS NULL)`, req.GetBookId()).Scan(&exists); err != nil {
+		return nil, status.Error(codes.Internal, "failed to fetch book")
+	}
+	if !exists {
+		return nil, status.Error(codes.NotFound, "book not found")
+	}
+
+	var reviewID string
+	err = config.Pool.QueryRow(ctx, `
+		INSERT INTO reviews (book_id, user_id, rating, body)
+		SELECT $1::UUID, $2::UUID, $3::SMALLINT, $4
+		WHERE EXISTS (SELECT 1 FROM borrowedbooks WHERE book_id = $1 AND user_id = $2 AND return_date IS NOT NULL AND lost_at IS NULL)
+		RETURNING id`, req.GetBookId(), principal.UserID, req.GetRating(), text).Scan(&reviewID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, status.Error(codes.FailedPrecondition, "only users who borrowed and returned this book can review it")
+	}
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+		return nil, status.Error(codes.AlreadyExists, "user already reviewed this book, update the review instead")
+	}
+	if err != nil {
+		log.Printf("Error inserting into reviews table: %v", err)
+		return nil, status.Error(codes.Internal, "failed to create review")
+	}
+
+	review, err := fetchReview(ctx, config.Pool, reviewID)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to fetch review")
+	}
+	return &pb.CreateReviewResponse{
+		Message: "Review created successfully",
+		Review:  review,
+	}, nil
+}
+
+// ListReviews returns a page of the reviews of a book, newest first, with its
+// rating. Hidden reviews are only listed for admins who ask for them.
+func (s *LibraryServer) ListReviews(ctx context.Context, req *pb.ListReviewsRequest) (*pb.ListReviewsResponse, error) {
+	if req.GetIncludeHidden() {
+		if err := requireAdmin(ctx); err != nil {
+			return nil, err
+		}
+	}
+	if err := validateBookID(req.GetBookId()); err != nil {
+		return nil, err
+	}
+	limit := int(req.GetPageSize())
+	if limit == 0 {
+		limit = catalog.DefaultPageSize
+	}
+	if limit < 0 || limit > catalog.MaxPageSize {
+		return nil, status.Errorf(codes.InvalidArgument, "page_size must be between 1 and %d", catalog.MaxPageSize)
+	}
+	// One extra row tells whether there is a next page
+	args := []any{req.GetBookId(), req.GetIncludeHidden(), limit + 1}
+	var after string
+	if token := req.GetPageToken(); token != "" {
+		c, err := decodeReviewCursor(token)
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, "page_token is invalid")
+		}
+		after = ` AND (r.created_at, r.id) < ($4, $5)`
+		args = append(args, c.CreatedAt, c.ID)
+	}
+
+	res := &pb.ListReviewsResponse{Reviews: []*pb.Review{}}
+	err := config.Pool.QueryRow(ctx, `
+		SELECT ROUND(COALESCE(AVG(r.rating), 0), 2)::FLOAT8, COUNT(r.id)::INT
+		FROM books b LEFT JOIN reviews r ON r.book_id = b.id AND r.hidden_at IS NULL
+		WHERE b.id = $1 AND b.withdrawn_at IS NULL
+		GROUP BY b.id`, req.GetBookId()).Scan(&res.AverageRating, &res.ReviewCount)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, status.Error(codes.NotFound, "book not found")
+	}
+	if err != nil {
+		log.Printf("Error fetching rating: %v", err)
+		return nil, status.Error(codes.Internal, "failed to fetch reviews")
+	}
+
+	rows, err := config.Pool.Query(ctx, `
+		SELECT `+reviewColumns+` FROM reviews r JOIN users u ON u.id = r.user_id
+		WHERE r.book_id = $1 AND ($2 OR r.hidden_at IS NULL)`+after+`
+		ORDER BY r.created_at DESC, r.id DESC
+		LIMIT $3`, args...)
+	if err != nil {
+		log.Printf("Error fetching reviews: %v", err)
+		return nil, status.Error(codes.Internal, "failed to fetch reviews")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		review, err := scanReview(rows)
+		if err != nil {
+			log.Printf("Error scanning review: %v", err)
+			return nil, status.Error(codes.Internal, "failed to fetch reviews")
+		}
+		res.Reviews = append(res.Reviews, review)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, status.Error(codes.Internal, "failed to fetch reviews")
+	}
+
+	if len(res.Reviews) > limit {
+		res.Reviews = res.Reviews[:limit]
+		last := res.Reviews[limit-1]
+		res.NextPageToken = encodeReviewCursor(reviewCursor{CreatedAt: last.GetCreatedAt().AsTime(), ID: last.GetId()})
+	}
+	return res, nil
+}
+
+// UpdateReview changes the rating and text of the caller's own review.
+func (s *LibraryServer) UpdateReview(ctx context.Context, req *pb.UpdateReviewRequest) (*pb.UpdateReviewResponse, error) {
+	principal, err := requirePrincipal(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateID(req.GetId(), "review"); err != nil {
+		return nil, err
+	}
+	text, err := validateReview(req.GetRating(), req.GetText())
+	if err != nil {
+		return nil, err
+	}
+
+	// Only the author's own review is updated, a miss is either someone
+	// else's review or one that is gone
+	res, err := config.Pool.Exec(ctx, `UPDATE reviews SET rating = $2, body = $3, updated_at = NOW() WHERE id = $1 AND user_id = $4`,
+		req.GetId(), req.GetRating(), text, principal.UserID)
+	if err != nil {
+		log.Printf("Error updating review: %v", err)
+		return nil, status.Error(codes.Internal, "failed to update review")
+	}
+	if res.RowsAffected() == 0 {
+		if _, err := reviewOwner(ctx, config.Pool, req.GetId()); err != nil {
+			return nil, err
+		}
+		return nil, status.Error(codes.PermissionDenied, "review belongs to another user")
+	}
+	review, err := fetchReview(ctx, config.Pool, req.GetId())
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, status.Error(codes.NotFound, "review not found")
+	}
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to fetch review")
+	}
+	return &pb.UpdateReviewResponse{
+		Message: "Review updated successfully",
+		Review:  review,
+	}, nil
+}
+
+// DeleteReview removes a review, by its author or an admin.
+func (s *LibraryServer) DeleteReview(ctx context.Context, req *pb.DeleteReviewRequest) (*pb.DeleteReviewResponse, error) {
+	principal, err := requirePrincipal(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateID(req.GetId(), "review"); err != nil {
+		return nil, err
+	}
+
+	userID, err := reviewOwner(ctx, config.Pool, req.GetId())
+	if err != nil {
+		return nil, err
+	}
+	if userID != principal.UserID && !principal.IsAdmin() {
+		return nil, status.Error(codes.PermissionDenied, "review belongs to another user")
+	}
+
+	if _, err := config.Pool.Exec(ctx, `DELETE FROM reviews WHERE id = $1`, req.GetId()); err != nil {
+		log.Printf("Error deleting review: %v", err)
+		return nil, status.Error(codes.Internal, "failed to delete review")
+	}
+	if userID != principal.UserID {
+		log.Printf("Admin %s deleted review %s by user %s", principal.UserID, req.GetId(), userID)
+	}
+	return &pb.DeleteReviewResponse{Message: "Review deleted successfully"}, nil
+}
+
+// HideReview hides a review from listings and ratings, or shows it again
+// (admin only).
+func (s *LibraryServer) HideReview(ctx context.Context, req *pb.HideReviewRequest) (*pb.HideReviewResponse, error) {
+	principal, err := requirePrincipal(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !principal.IsAdmin() {
+		return nil, status.Error(codes.PermissionDenied, "permission denied admin use only")
+	}
+	if err := validateID(req.GetId(), "review"); err != nil {
+		return nil, err
+	}
+
+	tag, err := config.Pool.Exec(ctx, `
+		UPDATE reviews
+		SET hidden_at = CASE WHEN $2 THEN NOW() END, hidden_by = CASE WHEN $2 THEN $3::UUID END
+		WHERE id = $1`, req.GetId(), req.GetHidden(), principal.UserID)
+	if err != nil {
+		log.Printf("Error hiding review: %v", err)
+		return nil, status.Error(codes.Internal, "failed to update review")
+	}
+	if tag.RowsAffected() == 0 {
+		return nil, status.Error(codes.NotFound, "review not found")
+	}
+	review, err := fetchReview(ctx, config.Pool, req.GetId())
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to fetch review")
+	}
+
+	message := "Review shown"
+	if req.GetHidden() {
+		message = "Review hidden"
+		log.Printf("Admin %s hid review %s", principal.UserID, req.GetId())
+	} else {
+		log.Printf("Admin %s showed review %s", principal.UserID, req.GetId())
+	}
+	return &pb.HideReviewResponse{
+		Message: message,
+		Review:  review,
+	}, nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"p3/gc2/config/database"
+	"p3/gc2/pb"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// unittest for checking the rating and text of a review
+func TestValidateReview(t *testing.T) {
+	text, err := validateReview(5, "  A classic.  ")
+	require.NoError(t, err)
+	assert.Equal(t, "A classic.", text)
+
+	for _, rating := range []int32{0, 6, -1} {
+		_, err := validateReview(rating, "")
+		assert.Equal(t, codes.InvalidArgument, status.Code(err), rating)
+	}
+	_, err = validateReview(3, strings.Repeat("é", maxReviewLength))
+	assert.NoError(t, err, "the limit counts characters, not bytes")
+	_, err = validateReview(3, strings.Repeat("a", maxReviewLength+1))
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+// unittest for round-tripping the page token of ListReviews
+func TestReviewCursor(t *testing.T) {
+	c := reviewCursor{CreatedAt: time.Date(2025, 1, 5, 15, 0, 0, 123456000, time.UTC), ID: "6f1c7e2a-1d1f-4e57-8d7b-3b8f7c1f2a10"}
+	decoded, err := decodeReviewCursor(encodeReviewCursor(c))
+	require.NoError(t, err)
+	assert.Equal(t, c, decoded)
+
+	for _, token := range []string{"???", "bm9wZQ", encodeReviewCursor(reviewCursor{ID: "42"})} {
+		_, err := decodeReviewCursor(token)
+		assert.Error(t, err, token)
+	}
+}
+
+// integration test for reviewing a returned book and the rating on the book
+func TestReviews(t *testing.T) {
+	setupTestDB(t)
+	ctx := context.Background()
+	server := &LibraryServer{}
+	admin := withPrincipal(ctx, &Principal{UserID: testUserID(t, "user1"), Role: "admin"})
+	user2 := withPrincipal(ctx, &Principal{UserID: testUserID(t, "user2"), Role: "user"})
+	user3 := withPrincipal(ctx, &Principal{UserID: testUserID(t, "user3"), Role: "user"})
+
+	pride, err := server.GetBook(ctx, &pb.GetBookRequest{Isbn: "9780141439518"})
+	require.NoError(t, err)
+	prideID := pride.GetBook().GetId()
+	assert.Zero(t, pride.GetBook().GetReviewCount())
+
+	// user2 returned Pride and Prejudice, user3 never borrowed it and user1
+	// still has 1984 out
+	_, err = server.CreateReview(user3, &pb.CreateReviewRequest{BookId: prideID, Rating: 4})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	nineteen, err := server.GetBook(ctx, &pb.GetBookRequest{Isbn: "9780451524935"})
+	require.NoError(t, err)
+	_, err = server.CreateReview(admin, &pb.CreateReviewRequest{BookId: nineteen.GetBook().GetId(), Rating: 5})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err), "the loan is still open")
+	var copyID string
+	require.NoError(t, config.Pool.QueryRow(ctx, `SELECT copy_id FROM borrowedbooks WHERE book_id = $1 AND return_date IS NULL`, nineteen.GetBook().GetId()).Scan(&copyID))
+	_, err = server.DeclareBookLost(admin, &pb.DeclareBookLostRequest{CopyId: copyID, ReplacementCents: 1500})
+	require.NoError(t, err)
+	_, err = server.CreateReview(admin, &pb.CreateReviewRequest{BookId: nineteen.GetBook().GetId(), Rating: 5})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err), "a loan closed by losing the copy is not a return")
+
+	created, err := server.CreateReview(user2, &pb.CreateReviewRequest{BookId: prideID, Rating: 4, Text: " Witty. "})
+	require.NoError(t, err)
+	review := created.GetReview()
+	assert.Equal(t, "user2", review.GetUsername())
+	assert.Equal(t, "Witty.", review.GetText())
+	_, err = server.CreateReview(user2, &pb.CreateReviewRequest{BookId: prideID, Rating: 5})
+	assert.Equal(t, codes.AlreadyExists, status.Code(err))
+
+	// A second reviewer moves the average
+	_, err = config.Pool.Exec(ctx, `
+		INSERT INTO borrowedbooks (book_id, copy_id, user_id, borrowed_date, due_date, return_date)
+		SELECT book_id, id, $2, NOW() - INTERVAL '10 days', NOW() + INTERVAL '11 days', NOW() FROM bookcopies WHERE book_id = $1 LIMIT 1`,
+		prideID, testUserID(t, "user3"))
+	require.NoError(t, err)
+	_, err = server.CreateReview(user3, &pb.CreateReviewRequest{BookId: prideID, Rating: 1, Text: "Too long"})
+	require.NoError(t, err)
+
+	pride, err = server.GetBook(ctx, &pb.GetBookRequest{Id: prideID})
+	require.NoError(t, err)
+	assert.Equal(t, 2.5, pride.GetBook().GetAverageRating())
+	assert.Equal(t, int32(2), pride.GetBook().GetReviewCount())
+	assert.Equal(t, int32(1), pride.GetBook().GetVersion(), "reviews don't make edits of the book conflict")
+
+	// Only the author edits a review
+	_, err = server.UpdateReview(user3, &pb.UpdateReviewRequest{Id: review.GetId(), Rating: 1})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	updated, err := server.UpdateReview(user2, &pb.UpdateReviewRequest{Id: review.GetId(), Rating: 5, Text: "Witty and wise."})
+	require.NoError(t, err)
+	assert.Equal(t, int32(5), updated.GetReview().GetRating())
+
+	// Paging newest first
+	page, err := server.ListReviews(ctx, &pb.ListReviewsRequest{BookId: prideID, PageSize: 1})
+	require.NoError(t, err)
+	require.Len(t, page.GetReviews(), 1)
+	assert.Equal(t, "user3", page.GetReviews()[0].GetUsername())
+	assert.Equal(t, 3.0, page.GetAverageRating())
+	require.NotEmpty(t, page.GetNextPageToken())
+	page, err = server.ListReviews(ctx, &pb.ListReviewsRequest{BookId: prideID, PageSize: 1, PageToken: page.GetNextPageToken()})
+	require.NoError(t, err)
+	require.Len(t, page.GetReviews(), 1)
+	assert.Equal(t, review.GetId(), page.GetReviews()[0].GetId())
+	assert.Empty(t, page.GetNextPageToken())
+
+	// Hidden reviews drop out of the listing and the rating
+	_, err = server.HideReview(user2, &pb.HideReviewRequest{Id: review.GetId(), Hidden: true})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	hidden, err := server.HideReview(admin, &pb.HideReviewRequest{Id: review.GetId(), Hidden: true})
+	require.NoError(t, err)
+	assert.True(t, hidden.GetReview().GetHidden())
+	_, err = server.UpdateReview(user2, &pb.UpdateReviewRequest{Id: review.GetId(), Rating: 5, Text: "Please show it again"})
+	require.NoError(t, err)
+
+	list, err := server.ListReviews(ctx, &pb.ListReviewsRequest{BookId: prideID})
+	require.NoError(t, err)
+	require.Len(t, list.GetReviews(), 1)
+	assert.Equal(t, 1.0, list.GetAverageRating())
+	assert.Equal(t, int32(1), list.GetReviewCount())
+	_, err = server.ListReviews(user2, &pb.ListReviewsRequest{BookId: prideID, IncludeHidden: true})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	list, err = server.ListReviews(admin, &pb.ListReviewsRequest{BookId: prideID, IncludeHidden: true})
+	require.NoError(t, err)
+	assert.Len(t, list.GetReviews(), 2)
+
+	// Authors and admins delete reviews, nobody else
+	_, err = server.DeleteReview(user2, &pb.DeleteReviewRequest{Id: list.GetReviews()[0].GetId()})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = server.DeleteReview(admin, &pb.DeleteReviewRequest{Id: review.GetId()})
+	require.NoError(t, err)
+	_, err = server.DeleteReview(user2, &pb.DeleteReviewRequest{Id: review.GetId()})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	// A deleted review can be written again
+	_, err = server.CreateReview(user2, &pb.CreateReviewRequest{BookId: prideID, Rating: 3})
+	assert.NoError(t, err)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+
+	"p3/gc2/bookstatus"
+	"p3/gc2/config/database"
+	"p3/gc2/pb"
+
+	"github.com/jackc/pgx/v5"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// lockedCopy is a bookcopies row locked for the rest of a transaction.
+type lockedCopy struct {
+	ID, BookID, Barcode string
+	Status              bookstatus.Status
+	UserID              *string // patron who has the copy out (Borrowed or Missing)
+}
+
+const lockedCopyColumns = `id, book_id, barcode, status, user_id`
+
+// scanLockedCopy reads a bookcopies row selected with lockedCopyColumns.
+func scanLockedCopy(row pgx.Row) (*lockedCopy, error) {
+	var (
+		c          lockedCopy
+		copyStatus string
+	)
+	if err := row.Scan(&c.ID, &c.BookID, &c.Barcode, &copyStatus, &c.UserID); err != nil {
+		return nil, err
+	}
+	status, err := bookstatus.Parse(copyStatus)
+	if err != nil {
+		return nil, err
+	}
+	c.Status = status
+	return &c, nil
+}
+
+// lockCopy locks a copy for the rest of the transaction.
+func lockCopy(ctx context.Context, tx pgx.Tx, copyID string) (*lockedCopy, error) {
+	return scanLockedCopy(tx.QueryRow(ctx, `SELECT `+lockedCopyColumns+` FROM bookcopies WHERE id = $1 FOR UPDATE`, copyID))
+}
+
+// statusChange describes a status transition made by setCopyStatus.
+type statusChange struct {
+	To      bookstatus.Status
+	UserID  *string // patron who has the copy out (Borrowed or Missing), nil otherwise
+	ActorID *string // user making the change, nil for scheduled jobs
+	Reason  string
+}
+
+// setCopyStatus moves a locked copy to a new status and records the
+// transition in bookstatushistory. Every status write goes through here so
+// the transition rules in package bookstatus are enforced in one place. On
+// success the copy reflects its new status.
+func setCopyStatus(ctx context.Context, tx pgx.Tx, c *lockedCopy, change statusChange) error {
+	if err := bookstatus.Transition(c.Status, change.To); err != nil {
+		return err
+	}
+	_, err := tx.Exec(ctx, `UPDATE bookcopies SET status = $1, user_id = $2, updated_at = NOW() WHERE id = $3`, string(change.To), change.UserID, c.ID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx, `
+		INSERT INTO bookstatushistory (book_id, copy_id, from_status, to_status, actor_id, reason)
+		VALUES ($1, $2, $3, $4, $5, NULLIF($6, ''))`, c.BookID, c.ID, string(c.Status), string(change.To), change.ActorID, change.Reason)
+	if err != nil {
+		return err
+	}
+	c.Status = change.To
+	c.UserID = change.UserID
+	return nil
+}
+
+// statusError converts an error from the status model into a gRPC error.
+func statusError(err error, message string) error {
+	var transitionErr *bookstatus.TransitionError
+	if errors.As(err, &transitionErr) {
+		return status.Error(codes.FailedPrecondition, transitionErr.Error())
+	}
+	var unknownErr *bookstatus.UnknownStatusError
+	if errors.As(err, &unknownErr) {
+		return status.Error(codes.InvalidArgument, unknownErr.Error())
+	}
+	log.Printf("%s: %v", message, err)
+	return status.Error(codes.Internal, message)
+}
+
+// UpdateBookStatus changes a copy's status outside of circulation (admin
+// only), e.g. sending it to repair, withdrawing it or reinstating a lost
+// copy. Copies on loan or on the hold shelf must go through the loan and hold
+// RPCs instead.
+func (s *LibraryServer) UpdateBookStatus(ctx context.Context, req *pb.UpdateBookStatusRequest) (*pb.UpdateBookStatusResponse, error) {
+	principal, err := requirePrincipal(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !principal.IsAdmin() {
+		return nil, status.Error(codes.PermissionDenied, "permission denied admin use only")
+	}
+	if err := validateID(req.GetCopyId(), "copy"); err != nil {
+		return nil, err
+	}
+	to, ok := bookstatus.FromProto(req.GetStatus())
+	if !ok {
+		return nil, status.Error(codes.InvalidArgument, "status is required")
+	}
+	if to == bookstatus.Borrowed || to == bookstatus.OnHold {
+		return nil, status.Errorf(codes.InvalidArgument, "copies become %s through BorrowBook and ReturnBook", to)
+	}
+
+	tx, err := config.Pool.Begin(ctx)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to begin transaction")
+	}
+	defer tx.Rollback(ctx)
+
+	bookCopy, err := lockCopy(ctx, tx, req.GetCopyId())
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, status.Error(codes.NotFound, "copy not found")
+	}
+	if err != nil {
+		return nil, statusError(err, "failed to fetch copy status")
+	}
+
+	from := bookCopy.Status
+	switch from {
+	case bookstatus.Borrowed, bookstatus.Missing:
+		return nil, status.Error(codes.FailedPrecondition, "copy is on loan, use ReturnBook or DeclareBookLost")
+	case bookstatus.OnHold:
+		return nil, status.Error(codes.FailedPrecondition, "copy is reserved on the hold shelf, cancel the hold first")
+	}
+
+	change := statusChange{To: to, ActorID: &principal.UserID, Reason: req.GetReason()}
+	if err := setCopyStatus(ctx, tx, bookCopy, change); err != nil {
+		return nil, statusError(err, "failed to update copy status")
+	}
+
+	// A reinstated copy goes to the next patron waiting for the book
+	if to == bookstatus.Available {
+		if err := advanceHoldQueue(ctx, tx, bookCopy, &principal.UserID, req.GetReason()); err != nil {
+			return nil, statusError(err, "failed to advance hold queue")
+		}
+	}
+
+	updated, err := scanCopy(tx.QueryRow(ctx, `SELECT `+copyColumns+` FROM bookcopies WHERE id = $1`, bookCopy.ID))
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to fetch copy")
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, status.Error(codes.Internal, "failed to commit transaction")
+	}
+
+	log.Printf("Copy %s status changed from %s to %s: %s", bookCopy.ID, from, bookCopy.Status, req.GetReason())
+	availability.publish(bookCopy, from)
+
+	return &pb.UpdateBookStatusResponse{
+		Message: "Copy status updated successfully",
+		Copy:    updated,
+	}, nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"p3/gc2/config/database"
+	"p3/gc2/pb"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// integration test for admin status changes and illegal transitions
+func TestUpdateBookStatus(t *testing.T) {
+	setupTestDB(t)
+	ctx := context.Background()
+
+	var availableID, borrowedID string
+	require.NoError(t, config.Pool.QueryRow(ctx, `SELECT id FROM bookcopies WHERE barcode = 'MOBYDICK-1'`).Scan(&availableID))
+	require.NoError(t, config.Pool.QueryRow(ctx, `SELECT id FROM bookcopies WHERE barcode = '1984-1'`).Scan(&borrowedID))
+
+	server := &LibraryServer{}
+	admin := withPrincipal(ctx, &Principal{UserID: testUserID(t, "user1"), Role: "admin"})
+
+	res, err := server.UpdateBookStatus(admin, &pb.UpdateBookStatusRequest{CopyId: availableID, Status: pb.BookStatus_BOOK_STATUS_WITHDRAWN, Reason: "damaged beyond repair"})
+	require.NoError(t, err)
+	assert.Equal(t, pb.BookStatus_BOOK_STATUS_WITHDRAWN, res.GetCopy().GetStatus())
+
+	// Withdrawn copies must be reinstated before they can go anywhere else
+	_, err = server.UpdateBookStatus(admin, &pb.UpdateBookStatusRequest{CopyId: availableID, Status: pb.BookStatus_BOOK_STATUS_IN_REPAIR})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	_, err = server.BorrowBook(admin, &pb.BorrowBookRequest{CopyId: availableID})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	// Copies on loan change status through ReturnBook, not here
+	_, err = server.UpdateBookStatus(admin, &pb.UpdateBookStatusRequest{CopyId: borrowedID, Status: pb.BookStatus_BOOK_STATUS_IN_REPAIR})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	_, err = server.UpdateBookStatus(admin, &pb.UpdateBookStatusRequest{CopyId: availableID, Status: pb.BookStatus_BOOK_STATUS_BORROWED})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	_, err = config.Pool.Exec(ctx, `UPDATE bookcopies SET status = 'Shelved' WHERE id = $1`, availableID)
+	assert.Error(t, err, "the CHECK constraint rejects statuses outside the model")
+}
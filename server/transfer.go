@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"p3/gc2/catalog"
+	"p3/gc2/config/database"
+	"p3/gc2/pb"
+
+	"github.com/jackc/pgx/v5"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// maxImportRows caps how many rows a single import may stream.
+const maxImportRows = 10000
+
+// validateImportRow checks every value of an import row and returns the
+// book it describes, or all of its problems.
+func validateImportRow(row *pb.ImportBookRow) (newBook, []*pb.ImportRowError) {
+	var problems []*pb.ImportRowError
+	invalid := func(field, message string) {
+		problems = append(problems, &pb.ImportRowError{Row: row.GetRow(), Field: field, Message: message})
+	}
+
+	b := newBook{
+		Title:    strings.TrimSpace(row.GetTitle()),
+		Author:   strings.TrimSpace(row.GetAuthor()),
+		Category: strings.TrimSpace(row.GetCategory()),
+		Copies:   1,
+	}
+	if b.Title == "" {
+		invalid("title", "is required")
+	}
+	if b.Author == "" {
+		invalid("author", "is required")
+	}
+	if date := strings.TrimSpace(row.GetPublishedDate()); date == "" {
+		invalid("published_date", "is required")
+	} else if published, err := time.Parse(time.DateOnly, date); err != nil {
+		invalid("published_date", "must be a date in YYYY-MM-DD format")
+	} else {
+		b.PublishedDate = published
+	}
+	if row.GetIsbn() != "" {
+		isbn13, err := normalizeISBN(row.GetIsbn())
+		if err != nil {
+			invalid("isbn", status.Convert(err).Message())
+		}
+		b.ISBN13 = isbn13
+	}
+	if copies := strings.TrimSpace(row.GetCopies()); copies != "" {
+		n, err := strconv.Atoi(copies)
+		if err != nil || n < 1 || n > maxCopiesPerRequest {
+			invalid("copies", fmt.Sprintf("must be a number between 1 and %d", maxCopiesPerRequest))
+		}
+		b.Copies = int32(n)
+	}
+	return b, problems
+}
+
+// importTimeout bounds the transaction that inserts the rows of an import.
+const importTimeout = 2 * time.Minute
+
+// importedRow is a streamed row with the book it describes, or its problems.
+type importedRow struct {
+	row      int32
+	book     newBook
+	problems []*pb.ImportRowError
+}
+
+// ImportBooks adds the streamed rows to the catalog (admin only). The whole
+// stream is read and validated before the transaction starts, so a slow
+// client never holds it open. Every row is inserted under its own savepoint
+// so one bad row doesn't hide the problems of the rows after it. In atomic
+// mode nothing is kept unless every row succeeded, a dry run never keeps
+// anything.
+func (s *LibraryServer) ImportBooks(stream grpc.ClientStreamingServer[pb.ImportBooksRequest, pb.ImportBooksResponse]) error {
+	ctx := stream.Context()
+	principal, err := requirePrincipal(ctx)
+	if err != nil {
+		return err
+	}
+	if !principal.IsAdmin() {
+		return status.Error(codes.PermissionDenied, "permission denied admin use only")
+	}
+
+	var (
+		opts pb.ImportOptions
+		rows []importedRow
+	)
+	for first := true; ; first = false {
+		msg, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		if options := msg.GetOptions(); options != nil {
+			if !first {
+				return status.Error(codes.InvalidArgument, "options must be the first message of the stream")
+			}
+			opts.DryRun, opts.Mode = options.GetDryRun(), options.GetMode()
+			continue
+		}
+		row := msg.GetRow()
+		if row == nil {
+			return status.Error(codes.InvalidArgument, "each message must carry options or a row")
+		}
+
+		if len(rows) >= maxImportRows {
+			return status.Errorf(codes.InvalidArgument, "an import is limited to %d rows", maxImportRows)
+		}
+		if row.GetRow() == 0 {
+			row.Row = int32(len(rows) + 1)
+		}
+		book, problems := validateImportRow(row)
+		rows = append(rows, importedRow{row: row.GetRow(), book: book, problems: problems})
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, importTimeout)
+	defer cancel()
+
+	tx, err := config.Pool.Begin(ctx)
+	if err != nil {
+		return status.Error(codes.Internal, "failed to begin transaction")
+	}
+	defer tx.Rollback(ctx)
+
+	res := pb.ImportBooksResponse{TotalRows: int32(len(rows))}
+	for _, r := range rows {
+		problems := r.problems
+		if len(problems) == 0 {
+			if problem := importRow(ctx, tx, r.book, r.row, principal.UserID); problem != nil {
+				problems = append(problems, problem)
+			}
+		}
+		if len(problems) > 0 {
+			res.FailedRows++
+			res.Errors = append(res.Errors, problems...)
+			continue
+		}
+		res.ImportedRows++
+	}
+
+	switch {
+	case opts.GetDryRun():
+		res.Message = "Dry run completed, nothing was imported"
+	case res.FailedRows > 0 && opts.GetMode() == pb.ImportMode_IMPORT_MODE_ATOMIC:
+		res.Message = "Import rolled back, no books were imported"
+	case res.ImportedRows == 0:
+		res.Message = "No books were imported"
+	default:
+		if err := tx.Commit(ctx); err != nil {
+			return status.Error(codes.Internal, "failed to commit transaction")
+		}
+		res.Committed = true
+		res.Message = "Books imported successfully"
+		log.Printf("Admin %s imported %d books, %d rows failed", principal.UserID, res.ImportedRows, res.FailedRows)
+	}
+	return stream.SendAndClose(&res)
+}
+
+// importRow inserts a validated row under a savepoint and rolls just that
+// row back when the database refuses it.
+func importRow(ctx context.Context, tx pgx.Tx, book newBook, row int32, actorID string) *pb.ImportRowError {
+	savepoint, err := tx.Begin(ctx)
+	if err != nil {
+		return &pb.ImportRowError{Row: row, Message: "failed to import row"}
+	}
+	_, err = insertBook(ctx, savepoint, book, actorID)
+	if err == nil {
+		err = savepoint.Commit(ctx)
+	}
+	if err == nil {
+		return nil
+	}
+	savepoint.Rollback(ctx)
+
+	if existingID, taken := isbnTaken(ctx, tx, err, book.ISBN13); taken {
+		return &pb.ImportRowError{Row: row, Field: "isbn", Message: "already belongs to book " + existingID}
+	}
+	if unknownCategory(err) != nil {
+		return &pb.ImportRowError{Row: row, Field: "category", Message: "does not exist"}
+	}
+	log.Printf("Error importing row %d: %v", row, err)
+	return &pb.ImportRowError{Row: row, Message: "failed to import row"}
+}
+
+// ExportBooks streams the whole catalog, oldest first (admin only). Withdrawn
+// books are left out.
+func (s *LibraryServer) ExportBooks(req *pb.ExportBooksRequest, stream grpc.ServerStreamingServer[pb.Book]) error {
+	ctx := stream.Context()
+	if err := requireAdmin(ctx); err != nil {
+		return err
+	}
+
+	rows, err := config.Pool.Query(ctx, `SELECT `+catalog.BookColumns+` FROM books WHERE withdrawn_at IS NULL ORDER BY created_at, id`)
+	if err != nil {
+		log.Printf("Error exporting books: %v", err)
+		return status.Error(codes.Internal, "failed to export books")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		book, err := scanBook(rows)
+		if err != nil {
+			log.Printf("Error scanning book: %v", err)
+			return status.Error(codes.Internal, "failed to export books")
+		}
+		if err := stream.Send(book); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil && !errors.Is(err, context.Canceled) {
+		log.Printf("Error exporting books: %v", err)
+		return status.Error(codes.Internal, "failed to export books")
+	}
+	return nil
+}
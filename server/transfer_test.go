@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	"p3/gc2/pb"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fakeImportStream feeds ImportBooks its requests and keeps the response
+type fakeImportStream struct {
+	grpc.ServerStream
+	ctx      context.Context
+	requests []*pb.ImportBooksRequest
+	response *pb.ImportBooksResponse
+}
+
+func (f *fakeImportStream) Context() context.Context { return f.ctx }
+
+func (f *fakeImportStream) Recv() (*pb.ImportBooksRequest, error) {
+	if len(f.requests) == 0 {
+		return nil, io.EOF
+	}
+	req := f.requests[0]
+	f.requests = f.requests[1:]
+	return req, nil
+}
+
+func (f *fakeImportStream) SendAndClose(res *pb.ImportBooksResponse) error {
+	f.response = res
+	return nil
+}
+
+func importStream(ctx context.Context, options *pb.ImportOptions, rows ...*pb.ImportBookRow) *fakeImportStream {
+	stream := &fakeImportStream{ctx: ctx}
+	stream.requests = append(stream.requests, &pb.ImportBooksRequest{Payload: &pb.ImportBooksRequest_Options{Options: options}})
+	for _, row := range rows {
+		stream.requests = append(stream.requests, &pb.ImportBooksRequest{Payload: &pb.ImportBooksRequest_Row{Row: row}})
+	}
+	return stream
+}
+
+// unittest for reporting every problem of an import row
+func TestValidateImportRow(t *testing.T) {
+	book, problems := validateImportRow(&pb.ImportBookRow{Row: 2, Title: " Dune ", Author: "Frank Herbert", PublishedDate: "1965-08-01", Isbn: "0-441-17271-7", Copies: "2"})
+	assert.Empty(t, problems)
+	assert.Equal(t, "Dune", book.Title)
+	assert.Equal(t, "9780441172719", book.ISBN13)
+	assert.Equal(t, int32(2), book.Copies)
+
+	_, problems = validateImportRow(&pb.ImportBookRow{Row: 3, Author: "Frank Herbert", PublishedDate: "01/08/1965", Isbn: "12345", Copies: "0"})
+	fields := make([]string, 0, len(problems))
+	for _, problem := range problems {
+		assert.Equal(t, int32(3), problem.GetRow())
+		fields = append(fields, problem.GetField())
+	}
+	assert.Equal(t, []string{"title", "published_date", "isbn", "copies"}, fields)
+}
+
+// integration test for atomic, partial and dry run imports
+func TestImportBooks(t *testing.T) {
+	setupTestDB(t)
+	server := &LibraryServer{}
+	ctx := withPrincipal(context.Background(), &Principal{UserID: testUserID(t, "user1"), Role: "admin"})
+
+	dune := &pb.ImportBookRow{Row: 2, Title: "Dune", Author: "Frank Herbert", PublishedDate: "1965-08-01", Copies: "2"}
+	duplicate := &pb.ImportBookRow{Row: 3, Title: "Nineteen Eighty-Four", Author: "George Orwell", PublishedDate: "1949-06-08", Isbn: "9780451524935"}
+
+	// A failed row rolls back an atomic import
+	stream := importStream(ctx, &pb.ImportOptions{}, dune, duplicate)
+	require.NoError(t, server.ImportBooks(stream))
+	assert.False(t, stream.response.GetCommitted())
+	assert.Equal(t, int32(1), stream.response.GetImportedRows())
+	if assert.Len(t, stream.response.GetErrors(), 1) {
+		assert.Equal(t, int32(3), stream.response.GetErrors()[0].GetRow())
+		assert.Equal(t, "isbn", stream.response.GetErrors()[0].GetField())
+	}
+	res, err := server.SearchBooks(ctx, &pb.SearchBooksRequest{Query: "dune"})
+	require.NoError(t, err)
+	assert.Empty(t, res.GetResults())
+
+	// A dry run keeps nothing even when every row is valid
+	stream = importStream(ctx, &pb.ImportOptions{DryRun: true}, dune)
+	require.NoError(t, server.ImportBooks(stream))
+	assert.False(t, stream.response.GetCommitted())
+	res, _ = server.SearchBooks(ctx, &pb.SearchBooksRequest{Query: "dune"})
+	assert.Empty(t, res.GetResults())
+
+	// A partial import keeps the valid rows
+	stream = importStream(ctx, &pb.ImportOptions{Mode: pb.ImportMode_IMPORT_MODE_PARTIAL}, dune, duplicate)
+	require.NoError(t, server.ImportBooks(stream))
+	assert.True(t, stream.response.GetCommitted())
+	assert.Equal(t, int32(1), stream.response.GetFailedRows())
+	res, _ = server.SearchBooks(ctx, &pb.SearchBooksRequest{Query: "dune"})
+	if assert.Len(t, res.GetResults(), 1) {
+		assert.Equal(t, int32(2), res.GetResults()[0].GetBook().GetTotalCopies())
+	}
+
+	user2 := withPrincipal(context.Background(), &Principal{UserID: testUserID(t, "user2"), Role: "user"})
+	err = server.ImportBooks(importStream(user2, &pb.ImportOptions{}, dune))
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"p3/gc2/catalog"
+	"p3/gc2/config/database"
+	"p3/gc2/covers"
+	"p3/gc2/pb"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// withdrawnRetention is how long a withdrawn book is kept before
+// purgeWithdrawnBooks deletes it for good, zero keeps withdrawn books forever.
+// Set with WITHDRAWN_RETENTION_DAYS.
+var withdrawnRetention = 365 * 24 * time.Hour
+
+// coverStorage holds the book covers uploaded through the REST API, the
+// purge job deletes the covers of the books it purges. Configured like the
+// REST API with COVER_STORAGE, see covers.FromEnv.
+var coverStorage covers.Storage
+
+// RestoreBook puts a withdrawn book back in the catalog (admin only).
+func (s *LibraryServer) RestoreBook(ctx context.Context, req *pb.RestoreBookRequest) (*pb.RestoreBookResponse, error) {
+	principal, err := requirePrincipal(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !principal.IsAdmin() {
+		return nil, status.Error(codes.PermissionDenied, "permission denied admin use only")
+	}
+	if err := validateBookID(req.GetId()); err != nil {
+		return nil, err
+	}
+
+	err = catalog.Restore(ctx, config.Pool, req.GetId())
+	if errors.Is(err, catalog.ErrNotFound) {
+		return nil, status.Error(codes.NotFound, "book not found")
+	}
+	if errors.Is(err, catalog.ErrNotWithdrawn) {
+		return nil, status.Error(codes.FailedPrecondition, "book is not withdrawn")
+	}
+	if catalog.ISBNTaken(err) {
+		return nil, status.Error(codes.AlreadyExists, "another book in the catalog has the isbn of this book")
+	}
+	if err != nil {
+		log.Printf("Error restoring book: %v", err)
+		return nil, status.Error(codes.Internal, "failed to restore book")
+	}
+
+	book, err := scanBook(config.Pool.QueryRow(ctx, `SELECT `+catalog.BookColumns+` FROM books WHERE id = $1`, req.GetId()))
+	if err != nil {
+		log.Printf("Error fetching book: %v", err)
+		return nil, status.Error(codes.Internal, "failed to fetch book")
+	}
+
+	log.Printf("Admin %s restored book %s", principal.UserID, req.GetId())
+	return &pb.RestoreBookResponse{
+		Message: "Book restored successfully",
+		Book:    book,
+	}, nil
+}
+
+// Job to delete the books withdrawn longer than the retention period, with
+// their copies, loans and history
+func purgeWithdrawnBooks() {
+	if withdrawnRetention <= 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	purged, coverKeys, err := catalog.Purge(ctx, config.Pool, time.Now().Add(-withdrawnRetention))
+	if err != nil {
+		log.Printf("Error purging withdrawn books: %v\n", err)
+		return
+	}
+	if coverStorage != nil {
+		for _, key := range coverKeys {
+			if err := covers.DeleteWithThumbnail(ctx, coverStorage, key); err != nil {
+				log.Printf("Error deleting cover %s: %v\n", key, err)
+			}
+		}
+	}
+	log.Printf("Job completed: Deleted %d books withdrawn more than %s ago\n", purged, withdrawnRetention)
+}